@@ -0,0 +1,229 @@
+// Package archive gives uniform access to files stored in archives: zip, 7z, tar (plain or compressed with gzip,
+// bzip2 or xz) and single files compressed with gzip, bzip2 or xz.
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File describes single file stored in archive.
+type File struct {
+	// Name is slash separated path of the file inside archive.
+	Name string
+	// NonUTF8 is set when encoding of the name is unknown and it may need conversion.
+	NonUTF8 bool
+	// Size is uncompressed size of the file or -1 when it is unknown.
+	Size int64
+	// ModTime is modification time when archive keeps it.
+	ModTime time.Time
+	// CRC32 is checksum of the file content or 0 when archive does not keep one.
+	CRC32 uint32
+
+	open func() (io.ReadCloser, error)
+}
+
+// Open returns reader for file content. Some archives could only be read sequentially, so content is only
+// guaranteed to be available until WalkFunc returns and file could be opened only once.
+func (f *File) Open() (io.ReadCloser, error) {
+	return f.open()
+}
+
+// WalkFunc is the type of the function called for each file in archive
+// visited by Walk. The archive argument contains path to archive passed to Walk
+// The file argument describes file in archive which satisfies
+// match condition. If an error is returned, processing stops.
+type WalkFunc func(archive string, file *File) error
+
+// Archive is opened archive of any supported format.
+type Archive interface {
+	// Walk calls walkFn for every file in archive which name starts with pattern in order files are stored.
+	Walk(pattern string, walkFn WalkFunc) error
+	// Close releases resources.
+	Close() error
+}
+
+type format int
+
+const (
+	formatUnknown format = iota
+	formatZip
+	format7z
+	formatTar
+	formatTarGz
+	formatTarBz2
+	formatTarXz
+	formatGz
+	formatBz2
+	formatXz
+)
+
+// extensions maps file name suffixes to archive formats, longer suffixes first.
+var extensions = []struct {
+	ext string
+	f   format
+}{
+	{".tar.gz", formatTarGz},
+	{".tar.bz2", formatTarBz2},
+	{".tar.xz", formatTarXz},
+	{".tgz", formatTarGz},
+	{".tbz2", formatTarBz2},
+	{".tbz", formatTarBz2},
+	{".txz", formatTarXz},
+	{".zip", formatZip},
+	{".7z", format7z},
+	{".tar", formatTar},
+	{".gz", formatGz},
+	{".bz2", formatBz2},
+	{".xz", formatXz},
+}
+
+var (
+	magicZip   = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06"), []byte("PK\x07\x08")}
+	magic7z    = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+	magicGz    = []byte{0x1F, 0x8B}
+	magicBz2   = []byte("BZh")
+	magicXz    = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	magicTar   = []byte("ustar")
+	tarMagicAt = 257
+)
+
+// formatByName detects archive format from file name.
+func formatByName(name string) format {
+	lname := strings.ToLower(name)
+	for _, e := range extensions {
+		if strings.HasSuffix(lname, e.ext) {
+			return e.f
+		}
+	}
+	return formatUnknown
+}
+
+// Supported reports if file name has extension of supported archive.
+func Supported(name string) bool {
+	return formatByName(name) != formatUnknown
+}
+
+// checkMagic verifies that file header matches format.
+func (f format) checkMagic(header []byte) bool {
+	switch f {
+	case formatZip:
+		for _, m := range magicZip {
+			if bytes.HasPrefix(header, m) {
+				return true
+			}
+		}
+	case format7z:
+		return bytes.HasPrefix(header, magic7z)
+	case formatTar:
+		return len(header) >= tarMagicAt+len(magicTar) && bytes.Equal(header[tarMagicAt:tarMagicAt+len(magicTar)], magicTar)
+	case formatTarGz, formatGz:
+		return bytes.HasPrefix(header, magicGz)
+	case formatTarBz2, formatBz2:
+		return bytes.HasPrefix(header, magicBz2)
+	case formatTarXz, formatXz:
+		return bytes.HasPrefix(header, magicXz)
+	}
+	return false
+}
+
+// detect finds format of the archive using its name and checks that content matches.
+func detect(path string) (format, error) {
+
+	f := formatByName(path)
+	if f == formatUnknown {
+		return f, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return formatUnknown, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return formatUnknown, err
+	}
+	if !f.checkMagic(header[:n]) {
+		return formatUnknown, nil
+	}
+	return f, nil
+}
+
+// IsArchive detects if file is supported archive.
+func IsArchive(path string) (bool, error) {
+	f, err := detect(path)
+	return f != formatUnknown, err
+}
+
+// ErrUnknownFormat is returned when archive format is not recognized.
+var ErrUnknownFormat = errors.New("unsupported archive format")
+
+// content is archive data, either file or memory buffer.
+type content interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// openContent opens archive of known format. When closer is not nil it is called when archive is closed.
+func openContent(path string, c content, size int64, modTime time.Time, f format, closer io.Closer) (Archive, error) {
+	switch f {
+	case formatZip:
+		return openZip(path, c, size, closer)
+	case format7z:
+		return open7z(path, c, size, closer)
+	case formatTar, formatTarGz, formatTarBz2, formatTarXz:
+		return &tarArchive{path: path, c: c, f: f, closer: closer}, nil
+	case formatGz, formatBz2, formatXz:
+		return &singleArchive{path: path, c: c, f: f, modTime: modTime, closer: closer}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Open opens archive of any supported format.
+func Open(path string) (Archive, error) {
+
+	f, err := detect(path)
+	if err != nil {
+		return nil, err
+	}
+	if f == formatUnknown {
+		return nil, ErrUnknownFormat
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a, err := openContent(path, file, fi.Size(), fi.ModTime(), f, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Walk walks the all files in the archive which satisfy match condition,
+// calling walkFn for each item.
+func Walk(archive, pattern string, walkFn WalkFunc) error {
+	return WalkNested(archive, pattern, Nested{}, walkFn)
+}
+
+// singleName returns name of the compressed file: archive name without compression extension.
+func singleName(path string) string {
+	name := filepath.Base(path)
+	return name[:len(name)-len(filepath.Ext(name))]
+}
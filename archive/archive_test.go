@@ -0,0 +1,314 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFiles = []struct {
+	name, content string
+}{
+	{"books/readme.txt", "not a book\n"},
+	{"books/one.fb2", "<p>one</p>"},
+	{"books/sub/two.fb2", "<p>two</p>"},
+}
+
+// createArchives writes archives of formats which could be produced with standard library.
+func createArchives(t *testing.T) string {
+
+	t.Helper()
+	dir := t.TempDir()
+
+	zf, err := os.Create(filepath.Join(dir, "books.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, f := range testFiles {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, f.content)
+	}
+	zw.Close()
+	zf.Close()
+
+	writeTar := func(w io.Writer) {
+		tw := tar.NewWriter(w)
+		for _, f := range testFiles {
+			hdr := &tar.Header{Name: "./" + f.name, Mode: 0644, Size: int64(len(f.content)), ModTime: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(tw, f.content)
+		}
+		tw.Close()
+	}
+	for _, name := range []string{"books.tar", "books.tgz"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".tgz") {
+			gw := gzip.NewWriter(f)
+			writeTar(gw)
+			gw.Close()
+		} else {
+			writeTar(f)
+		}
+		f.Close()
+	}
+
+	f, err := os.Create(filepath.Join(dir, "one.fb2.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	io.WriteString(gw, "<p>one</p>")
+	gw.Close()
+	f.Close()
+
+	return dir
+}
+
+func walkAll(t *testing.T, path, pattern string) map[string]string {
+	t.Helper()
+	res := make(map[string]string)
+	err := Walk(path, pattern, func(archive string, file *File) error {
+		if archive != path {
+			t.Fatalf("Unexpected archive path %s", archive)
+		}
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		res[file.Name] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to walk %s: %v", path, err)
+	}
+	return res
+}
+
+func TestWalk(t *testing.T) {
+
+	dir := createArchives(t)
+
+	for _, name := range []string{"books.zip", "books.tar", "books.tgz", "testdata/books.tar.bz2", "testdata/books.tar.xz"} {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			path := name
+			if !strings.HasPrefix(name, "testdata") {
+				path = filepath.Join(dir, name)
+			}
+			if ok, err := IsArchive(path); err != nil || !ok {
+				t.Fatalf("Not recognized as archive: %v", err)
+			}
+			res := walkAll(t, path, "")
+			if len(res) != 3 || !strings.Contains(res["books/one.fb2"], "one") || !strings.Contains(res["books/sub/two.fb2"], "two") || res["books/readme.txt"] != "not a book\n" {
+				t.Fatalf("Unexpected content: %v", res)
+			}
+			// path inside of archive
+			res = walkAll(t, path, "books/sub/")
+			if len(res) != 1 || !strings.Contains(res["books/sub/two.fb2"], "two") {
+				t.Fatalf("Unexpected content: %v", res)
+			}
+		})
+	}
+
+	for _, name := range []string{"one.fb2.gz", "testdata/one.fb2.bz2", "testdata/one.fb2.xz"} {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			path := name
+			if !strings.HasPrefix(name, "testdata") {
+				path = filepath.Join(dir, name)
+			}
+			res := walkAll(t, path, "")
+			if len(res) != 1 || !strings.Contains(res["one.fb2"], "<p>one</p>") {
+				t.Fatalf("Unexpected content: %v", res)
+			}
+			if res := walkAll(t, path, "two"); len(res) != 0 {
+				t.Fatalf("Unexpected content: %v", res)
+			}
+		})
+	}
+
+	t.Run("books.7z", func(t *testing.T) {
+		res := walkAll(t, "testdata/books.7z", "books/")
+		names := make([]string, 0, len(res))
+		for name := range res {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, []string{"books/empty.fb2", "books/first.fb2", "books/second.fb2"}) || !strings.Contains(res["books/second.fb2"], "Вторая") {
+			t.Fatalf("Unexpected content: %v", names)
+		}
+	})
+}
+
+func TestIsArchive(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"fake.zip":    "text pretending to be archive",
+		"fake.tar.xz": "text pretending to be archive",
+		"book.fb2":    "<?xml version=\"1.0\"?>",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := IsArchive(path); err != nil || ok {
+			t.Fatalf("%s: unexpectedly recognized as archive (%v)", name, err)
+		}
+	}
+	if _, err := IsArchive(filepath.Join(dir, "missing.7z")); err == nil {
+		t.Fatal("Expected error for missing file")
+	}
+	if !Supported("Books.TAR.GZ") || Supported("book.fb2") {
+		t.Fatal("Unexpected archive name detection")
+	}
+}
+
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWalkNested(t *testing.T) {
+
+	txz, err := os.ReadFile("testdata/books.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep := zipBytes(t, map[string][]byte{"deep.fb2": []byte("<p>deep</p>")})
+	var deepGz bytes.Buffer
+	gw := gzip.NewWriter(&deepGz)
+	gw.Write(deep)
+	gw.Close()
+
+	inner := zipBytes(t, map[string][]byte{
+		"sub/inner.fb2": []byte("<p>inner</p>"),
+		"deep.zip":      deep,
+	})
+	outer := filepath.Join(t.TempDir(), "outer.zip")
+	if err := os.WriteFile(outer, zipBytes(t, map[string][]byte{
+		"top.fb2":          []byte("<p>top</p>"),
+		"dir/inner.zip":    inner,
+		"books.tar.xz":     txz,
+		"deep.zip.gz":      deepGz.Bytes(),
+		"bad.zip":          []byte("text pretending to be archive"),
+		"broken.zip":       []byte("PK\x03\x04 archive which is cut short"),
+		"notes/readme.txt": []byte("text"),
+	}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(pattern string, nested Nested) []string {
+		var res []string
+		err := WalkNested(outer, pattern, nested, func(archive string, file *File) error {
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			if _, err := io.ReadAll(r); err != nil {
+				return err
+			}
+			res = append(res, filepath.ToSlash(strings.TrimPrefix(archive, outer))+":"+file.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%q: unable to walk: %v", pattern, err)
+		}
+		slices.Sort(res)
+		return res
+	}
+
+	var failed []string
+	nested := Nested{Depth: 2, Failed: func(archive string, err error) {
+		failed = append(failed, filepath.ToSlash(strings.TrimPrefix(archive, outer)))
+	}}
+
+	for _, tc := range []struct {
+		pattern  string
+		nested   Nested
+		expected []string
+	}{
+		{"", Nested{}, []string{":bad.zip", ":books.tar.xz", ":broken.zip", ":deep.zip.gz", ":dir/inner.zip", ":notes/readme.txt", ":top.fb2"}},
+		// file which is not an archive is regular one whatever its name is
+		{"", Nested{Depth: 1, Failed: nested.Failed}, []string{
+			"/books.tar.xz:books/one.fb2", "/books.tar.xz:books/readme.txt", "/books.tar.xz:books/sub/two.fb2",
+			"/deep.zip.gz:deep.zip", "/dir/inner.zip:deep.zip", "/dir/inner.zip:sub/inner.fb2",
+			":bad.zip", ":notes/readme.txt", ":top.fb2"}},
+		// compressed archive takes two levels
+		{"", nested, []string{
+			"/books.tar.xz:books/one.fb2", "/books.tar.xz:books/readme.txt", "/books.tar.xz:books/sub/two.fb2",
+			"/deep.zip.gz/deep.zip:deep.fb2", "/dir/inner.zip/deep.zip:deep.fb2", "/dir/inner.zip:sub/inner.fb2",
+			":bad.zip", ":notes/readme.txt", ":top.fb2"}},
+		{"dir/inner.zip/sub/", nested, []string{"/dir/inner.zip:sub/inner.fb2"}},
+		{"dir/inner.zip/deep.zip/deep.fb2", nested, []string{"/dir/inner.zip/deep.zip:deep.fb2"}},
+		{"dir/", Nested{Depth: 1}, []string{"/dir/inner.zip:deep.zip", "/dir/inner.zip:sub/inner.fb2"}},
+		{"books.tar.xz/books/sub", nested, []string{"/books.tar.xz:books/sub/two.fb2"}},
+		{"bad.zip", nested, []string{":bad.zip"}},
+		{"bad.zip/dir/", nested, nil},
+	} {
+		failed = failed[:0]
+		if res := walk(tc.pattern, tc.nested); !slices.Equal(res, tc.expected) {
+			t.Fatalf("%q, depth %d: unexpected files %q", tc.pattern, tc.nested.Depth, res)
+		}
+	}
+
+	// broken and large nested archives are reported and skipped, size is checked before content
+	failed = failed[:0]
+	walk("", nested)
+	if !slices.Equal(failed, []string{"/broken.zip"}) {
+		t.Fatalf("Unexpected failures: %q", failed)
+	}
+	failed = failed[:0]
+	nested.MaxSize = 1
+	walk("", nested)
+	slices.Sort(failed)
+	if !slices.Equal(failed, []string{"/bad.zip", "/books.tar.xz", "/broken.zip", "/deep.zip.gz", "/dir/inner.zip"}) {
+		t.Fatalf("Unexpected failures: %q", failed)
+	}
+
+	// errors from walk function stop walking and are never reported as nested archive failures
+	failed = failed[:0]
+	nested.MaxSize = 0
+	stop := errors.New("stop")
+	err = WalkNested(outer, "dir/", nested, func(archive string, file *File) error { return stop })
+	if !errors.Is(err, stop) || len(failed) != 0 {
+		t.Fatalf("Unexpected result: %v, %q", err, failed)
+	}
+	if err = WalkNested(outer, "", Nested{Depth: 1}, func(string, *File) error { return nil }); err == nil {
+		t.Fatal("Expected error for broken nested archive without Failed")
+	}
+}
@@ -0,0 +1,293 @@
+package lzma
+
+import "fmt"
+
+const (
+	numStates          = 12
+	numPosBitsMax      = 4
+	numLenToPosStates  = 4
+	numAlignBits       = 4
+	startPosModelIndex = 4
+	endPosModelIndex   = 14
+	numFullDistances   = 1 << (endPosModelIndex >> 1)
+	matchMinLen        = 2
+)
+
+// Properties are LZMA literal context, literal position and position bits.
+type Properties struct {
+	LC, LP, PB uint32
+}
+
+// decodeProperties unpacks properties byte.
+func decodeProperties(b byte) (Properties, error) {
+	d := uint32(b)
+	if d >= 9*5*5 {
+		return Properties{}, fmt.Errorf("lzma: invalid properties %#x", b)
+	}
+	p := Properties{LC: d % 9, LP: (d / 9) % 5, PB: d / 45}
+	return p, nil
+}
+
+// window is sliding dictionary decoded data is written to. Buffer grows up to dictionary size as data are decoded, so
+// size stored in stream header does not make reader allocate more memory than output takes.
+type window struct {
+	buf   []byte
+	size  int
+	pos   int
+	full  bool
+	total int64
+	// bytes decoded but not yet consumed by the reader
+	out []byte
+}
+
+func newWindow(size uint32) *window {
+	return &window{buf: make([]byte, 0, 1<<12), size: int(max(size, 1<<12))}
+}
+
+func (w *window) reset() {
+	w.pos, w.full, w.total = 0, false, 0
+}
+
+func (w *window) put(b byte) {
+	if w.pos < len(w.buf) {
+		w.buf[w.pos] = b
+	} else {
+		w.buf = append(w.buf, b)
+	}
+	if w.pos++; w.pos == w.size {
+		w.pos, w.full = 0, true
+	}
+	w.total++
+	w.out = append(w.out, b)
+}
+
+// get returns byte dist positions back, dist 1 is the last written byte.
+func (w *window) get(dist uint32) byte {
+	i := w.pos - int(dist)
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+func (w *window) valid(dist uint32) bool {
+	return dist > 0 && (w.full && int(dist) <= len(w.buf) || int(dist) <= w.pos)
+}
+
+func (w *window) empty() bool {
+	return !w.full && w.pos == 0
+}
+
+type lenDecoder struct {
+	choice  prob
+	choice2 prob
+	low     [1 << numPosBitsMax][1 << 3]prob
+	mid     [1 << numPosBitsMax][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (ld *lenDecoder) init() {
+	ld.choice, ld.choice2 = probInit, probInit
+	initProbs(ld.high[:])
+	for i := range ld.low {
+		initProbs(ld.low[i][:])
+		initProbs(ld.mid[i][:])
+	}
+}
+
+func (ld *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&ld.choice) == 0 {
+		return rc.bitTree(ld.low[posState][:], 3)
+	}
+	if rc.bit(&ld.choice2) == 0 {
+		return 8 + rc.bitTree(ld.mid[posState][:], 3)
+	}
+	return 16 + rc.bitTree(ld.high[:], 8)
+}
+
+// decoder keeps LZMA state, which could be carried over between LZMA2 chunks.
+type decoder struct {
+	props Properties
+	rc    rangeDecoder
+	win   *window
+
+	literal    []prob
+	posSlot    [numLenToPosStates][1 << 6]prob
+	posDecoder [1 + numFullDistances - endPosModelIndex]prob
+	align      [1 << numAlignBits]prob
+	isMatch    [numStates << numPosBitsMax]prob
+	isRep      [numStates]prob
+	isRepG0    [numStates]prob
+	isRepG1    [numStates]prob
+	isRepG2    [numStates]prob
+	isRep0Long [numStates << numPosBitsMax]prob
+	lenDec     lenDecoder
+	repLenDec  lenDecoder
+
+	state uint32
+	reps  [4]uint32
+}
+
+func newDecoder(props Properties, dictSize uint32) *decoder {
+	d := &decoder{win: newWindow(dictSize)}
+	d.setProperties(props)
+	d.resetState()
+	return d
+}
+
+func (d *decoder) setProperties(props Properties) {
+	d.props = props
+	if n := 0x300 << (props.LC + props.LP); len(d.literal) != n {
+		d.literal = make([]prob, n)
+	}
+}
+
+func (d *decoder) resetState() {
+	initProbs(d.literal)
+	for i := range d.posSlot {
+		initProbs(d.posSlot[i][:])
+	}
+	initProbs(d.posDecoder[:])
+	initProbs(d.align[:])
+	initProbs(d.isMatch[:])
+	initProbs(d.isRep[:])
+	initProbs(d.isRepG0[:])
+	initProbs(d.isRepG1[:])
+	initProbs(d.isRepG2[:])
+	initProbs(d.isRep0Long[:])
+	d.lenDec.init()
+	d.repLenDec.init()
+	d.state = 0
+	d.reps = [4]uint32{}
+}
+
+func (d *decoder) decodeLiteral() {
+	var prev uint32
+	if !d.win.empty() {
+		prev = uint32(d.win.get(1))
+	}
+	litState := (uint32(d.win.total)&(1<<d.props.LP-1))<<d.props.LC + prev>>(8-d.props.LC)
+	probs := d.literal[0x300*litState:]
+
+	sym := uint32(1)
+	if d.state >= 7 {
+		match := uint32(d.win.get(d.reps[0] + 1))
+		for sym < 0x100 {
+			matchBit := (match >> 7) & 1
+			match <<= 1
+			b := d.rc.bit(&probs[(1+matchBit)<<8+sym])
+			sym = sym<<1 | b
+			if matchBit != b {
+				break
+			}
+		}
+	}
+	for sym < 0x100 {
+		sym = sym<<1 | d.rc.bit(&probs[sym])
+	}
+	d.win.put(byte(sym))
+
+	switch {
+	case d.state < 4:
+		d.state = 0
+	case d.state < 10:
+		d.state -= 3
+	default:
+		d.state -= 6
+	}
+}
+
+func (d *decoder) decodeDistance(length uint32) uint32 {
+	lenState := min(length, numLenToPosStates-1)
+	posSlot := d.rc.bitTree(d.posSlot[lenState][:], 6)
+	if posSlot < startPosModelIndex {
+		return posSlot
+	}
+	numDirectBits := posSlot>>1 - 1
+	dist := (2 | posSlot&1) << numDirectBits
+	if posSlot < endPosModelIndex {
+		return dist + d.rc.bitTreeReverse(d.posDecoder[dist-posSlot:], numDirectBits)
+	}
+	dist += d.rc.directBits(numDirectBits-numAlignBits) << numAlignBits
+	return dist + d.rc.bitTreeReverse(d.align[:], numAlignBits)
+}
+
+// errEndMarker signals end of stream marker.
+var errEndMarker = fmt.Errorf("lzma: end marker")
+
+// decodeSymbol decodes single literal or match, limit is maximum number of bytes which could be produced.
+func (d *decoder) decodeSymbol(limit int64) error {
+
+	posState := uint32(d.win.total) & (1<<d.props.PB - 1)
+
+	if d.rc.bit(&d.isMatch[d.state<<numPosBitsMax+posState]) == 0 {
+		d.decodeLiteral()
+		return d.rc.err
+	}
+
+	var length uint32
+	if d.rc.bit(&d.isRep[d.state]) != 0 {
+		if d.win.empty() {
+			return ErrCorrupted
+		}
+		if d.rc.bit(&d.isRepG0[d.state]) == 0 {
+			if d.rc.bit(&d.isRep0Long[d.state<<numPosBitsMax+posState]) == 0 {
+				if d.state < 7 {
+					d.state = 9
+				} else {
+					d.state = 11
+				}
+				d.win.put(d.win.get(d.reps[0] + 1))
+				return d.rc.err
+			}
+		} else {
+			var dist uint32
+			if d.rc.bit(&d.isRepG1[d.state]) == 0 {
+				dist = d.reps[1]
+			} else {
+				if d.rc.bit(&d.isRepG2[d.state]) == 0 {
+					dist = d.reps[2]
+				} else {
+					dist = d.reps[3]
+					d.reps[3] = d.reps[2]
+				}
+				d.reps[2] = d.reps[1]
+			}
+			d.reps[1] = d.reps[0]
+			d.reps[0] = dist
+		}
+		length = d.repLenDec.decode(&d.rc, posState)
+		if d.state < 7 {
+			d.state = 8
+		} else {
+			d.state = 11
+		}
+	} else {
+		d.reps[3], d.reps[2], d.reps[1] = d.reps[2], d.reps[1], d.reps[0]
+		length = d.lenDec.decode(&d.rc, posState)
+		if d.state < 7 {
+			d.state = 7
+		} else {
+			d.state = 10
+		}
+		d.reps[0] = d.decodeDistance(length)
+		if d.reps[0] == 0xFFFFFFFF {
+			if d.rc.err != nil {
+				return d.rc.err
+			}
+			return errEndMarker
+		}
+	}
+	if d.rc.err != nil {
+		return d.rc.err
+	}
+
+	n := int64(length + matchMinLen)
+	if n > limit || !d.win.valid(d.reps[0]+1) {
+		return ErrCorrupted
+	}
+	for ; n > 0; n-- {
+		d.win.put(d.win.get(d.reps[0] + 1))
+	}
+	return nil
+}
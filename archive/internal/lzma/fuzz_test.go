@@ -0,0 +1,66 @@
+package lzma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+)
+
+// maxFuzzOutput limits amount of data read from decoders, highly compressed input could expand to a lot.
+const maxFuzzOutput = 1 << 22
+
+func FuzzReader(f *testing.F) {
+
+	// .lzma files: properties, dictionary size and uncompressed size followed by stream; start of the test file is
+	// enough, long inputs make fuzzing slow
+	data, err := os.ReadFile("testdata/text.lzma")
+	if err != nil {
+		f.Fatal(err)
+	}
+	data = data[:13+256]
+	f.Add(data)
+	known := bytes.Clone(data)
+	binary.LittleEndian.PutUint64(known[5:13], 1000)
+	f.Add(known)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 13 {
+			return
+		}
+		size := int64(binary.LittleEndian.Uint64(data[5:13]))
+		r, err := NewReader(bytes.NewReader(data[13:]), data[:5], size)
+		if err != nil {
+			return
+		}
+		got, err := io.ReadAll(io.LimitReader(r, maxFuzzOutput))
+		if err != nil || len(got) == maxFuzzOutput {
+			return
+		}
+		if size >= 0 && int64(len(got)) != size {
+			t.Fatalf("stream decoded without errors, but size is %d instead of %d", len(got), size)
+		}
+	})
+}
+
+func FuzzReader2(f *testing.F) {
+
+	data, err := os.ReadFile("testdata/text.lzma2")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(byte(8), data)
+	// single uncompressed chunk
+	f.Add(byte(0), []byte{0x01, 0x00, 0x03, 't', 'e', 'x', 't', 0x00})
+	f.Add(byte(40), []byte{})
+
+	f.Fuzz(func(t *testing.T, dictProp byte, data []byte) {
+		r, err := NewReader2(bytes.NewReader(data), dictProp)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(r, maxFuzzOutput))
+	})
+}
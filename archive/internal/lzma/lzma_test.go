@@ -0,0 +1,99 @@
+package lzma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sampleText reproduces content of compressed test files.
+func sampleText(n int) []byte {
+	words := []string{"книга", "глава", "fiction", "book", "текст", "море", "the", "and", "секция", "описание", "автор", "title", "<p>", "</p>", "\n"}
+	var b strings.Builder
+	for x := uint64(1); b.Len() < n; {
+		x = (x*1103515245 + 12345) % (1 << 31)
+		b.WriteString(words[(x>>16)%uint64(len(words))])
+		b.WriteByte(' ')
+	}
+	return []byte(b.String())
+}
+
+func TestReader(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/text.lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sampleText(200000)
+
+	// .lzma header: properties, dictionary size and uncompressed size (unknown here)
+	if size := int64(binary.LittleEndian.Uint64(data[5:13])); size != -1 {
+		t.Fatalf("Unexpected test file, size is known: %d", size)
+	}
+
+	for _, tc := range []struct {
+		name string
+		size int64
+	}{
+		{"end marker", -1},
+		{"known size", int64(len(expected))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(data[13:]), data[:5], tc.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Unable to decompress: %v", err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Fatalf("Unexpected result, got %d bytes, expected %d", len(got), len(expected))
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		r, err := NewReader(bytes.NewReader(data[13:len(data)/2]), data[:5], -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Fatal("Expected error for truncated stream")
+		}
+	})
+}
+
+func TestReader2(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/text.lzma2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// raw LZMA2 stream with 64 KiB dictionary
+	r, err := NewReader2(bytes.NewReader(data), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unable to decompress: %v", err)
+	}
+	if expected := sampleText(2000); !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result, got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestDictSize2(t *testing.T) {
+	for prop, size := range map[byte]uint32{0: 4 << 10, 1: 6 << 10, 18: 2 << 20, 19: 3 << 20, 40: 0xFFFFFFFF} {
+		if got, err := DictSize2(prop); err != nil || got != size {
+			t.Fatalf("Property %d: expected %d, got %d (%v)", prop, size, got, err)
+		}
+	}
+	if _, err := DictSize2(41); err == nil {
+		t.Fatal("Expected error for invalid property")
+	}
+}
@@ -0,0 +1,123 @@
+package lzma
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrCorrupted is returned when compressed data does not make sense.
+var ErrCorrupted = errors.New("lzma: corrupted data")
+
+const (
+	numBitModelTotalBits = 11
+	bitModelTotal        = 1 << numBitModelTotalBits
+	numMoveBits          = 5
+	topValue             = 1 << 24
+	probInit             = bitModelTotal / 2
+)
+
+type prob uint16
+
+func initProbs(p []prob) {
+	for i := range p {
+		p[i] = probInit
+	}
+}
+
+// rangeDecoder is arithmetic decoder all LZMA symbols are read with.
+type rangeDecoder struct {
+	br   io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rc *rangeDecoder) init(br io.ByteReader) error {
+	rc.br, rc.rng, rc.code, rc.err = br, 0xFFFFFFFF, 0, nil
+	b, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		return ErrCorrupted
+	}
+	for i := 0; i < 4; i++ {
+		if b, err = br.ReadByte(); err != nil {
+			return err
+		}
+		rc.code = rc.code<<8 | uint32(b)
+	}
+	if rc.code == rc.rng {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < topValue {
+		b, err := rc.br.ReadByte()
+		if err != nil && rc.err == nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rc.err = err
+		}
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+// finishedOK reports if stream ended properly: code is zero after last symbol.
+func (rc *rangeDecoder) finishedOK() bool {
+	return rc.code == 0
+}
+
+func (rc *rangeDecoder) bit(p *prob) uint32 {
+	bound := (rc.rng >> numBitModelTotalBits) * uint32(*p)
+	var b uint32
+	if rc.code < bound {
+		*p += (bitModelTotal - *p) >> numMoveBits
+		rc.rng = bound
+	} else {
+		*p -= *p >> numMoveBits
+		rc.code -= bound
+		rc.rng -= bound
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) directBits(n uint32) uint32 {
+	var res uint32
+	for ; n > 0; n-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		if rc.code == rc.rng {
+			rc.err = ErrCorrupted
+		}
+		rc.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+func (rc *rangeDecoder) bitTree(probs []prob, numBits uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < numBits; i++ {
+		m = m<<1 + rc.bit(&probs[m])
+	}
+	return m - 1<<numBits
+}
+
+func (rc *rangeDecoder) bitTreeReverse(probs []prob, numBits uint32) uint32 {
+	m, sym := uint32(1), uint32(0)
+	for i := uint32(0); i < numBits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 + b
+		sym |= b << i
+	}
+	return sym
+}
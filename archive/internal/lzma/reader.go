@@ -0,0 +1,83 @@
+// Package lzma implements decompression of raw LZMA and LZMA2 streams as they are stored in xz and 7z archives.
+package lzma
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxSymbol is the largest output of a single symbol.
+const maxSymbol = 273
+
+// Reader decompresses LZMA stream.
+type Reader struct {
+	d    *decoder
+	size int64 // expected uncompressed size or -1
+	eos  bool
+	err  error
+}
+
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// NewReader returns reader for LZMA stream with 5 bytes of properties as used by 7z: properties byte followed by
+// little endian dictionary size. When size is negative stream has to be terminated by end marker.
+func NewReader(r io.Reader, props []byte, size int64) (*Reader, error) {
+	if len(props) != 5 {
+		return nil, fmt.Errorf("lzma: invalid properties length %d", len(props))
+	}
+	p, err := decodeProperties(props[0])
+	if err != nil {
+		return nil, err
+	}
+	dictSize := binary.LittleEndian.Uint32(props[1:])
+	if size >= 0 && int64(dictSize) > size {
+		// there is no need to keep more than the whole output
+		dictSize = uint32(size)
+	}
+	lr := &Reader{d: newDecoder(p, dictSize), size: size}
+	if err := lr.d.rc.init(byteReader(r)); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+// Read implements io.Reader.
+func (lr *Reader) Read(p []byte) (int, error) {
+	w := lr.d.win
+	for len(w.out) < len(p) && !lr.eos && lr.err == nil {
+		if lr.size >= 0 && w.total >= lr.size {
+			lr.eos = true
+			break
+		}
+		limit := int64(maxSymbol)
+		if lr.size >= 0 {
+			limit = lr.size - w.total
+		}
+		switch err := lr.d.decodeSymbol(limit); {
+		case errors.Is(err, errEndMarker):
+			if lr.size >= 0 && w.total != lr.size {
+				lr.err = io.ErrUnexpectedEOF
+			}
+			lr.eos = true
+		case err != nil:
+			lr.err = err
+		}
+	}
+	n := copy(p, w.out)
+	w.out = w.out[:copy(w.out, w.out[n:])]
+	if n > 0 {
+		return n, nil
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return 0, io.EOF
+}
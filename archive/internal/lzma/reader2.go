@@ -0,0 +1,181 @@
+package lzma
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DictSize2 returns dictionary size encoded in LZMA2 properties byte.
+func DictSize2(b byte) (uint32, error) {
+	switch {
+	case b > 40:
+		return 0, fmt.Errorf("lzma2: invalid dictionary size property %#x", b)
+	case b == 40:
+		return 0xFFFFFFFF, nil
+	}
+	return (2 | uint32(b)&1) << (b/2 + 11), nil
+}
+
+// Reader2 decompresses LZMA2 stream: sequence of compressed and uncompressed chunks ending with zero control byte.
+type Reader2 struct {
+	r   io.Reader
+	br  io.ByteReader
+	d   *decoder
+	eos bool
+	err error
+
+	// state of the current chunk
+	unpacked     int64
+	uncompressed bool
+	needDict     bool
+	needProps    bool
+	packed       []byte
+}
+
+// NewReader2 returns reader for LZMA2 stream with dictionary size property as stored in xz and 7z headers.
+func NewReader2(r io.Reader, dictProp byte) (*Reader2, error) {
+	size, err := DictSize2(dictProp)
+	if err != nil {
+		return nil, err
+	}
+	// streams produced by real encoders never need dictionary larger than data, limit allocation for small inputs
+	size = min(size, 1<<28)
+	br := byteReader(r)
+	return &Reader2{
+		r:         br.(io.Reader),
+		br:        br,
+		d:         &decoder{win: newWindow(size)},
+		needDict:  true,
+		needProps: true,
+	}, nil
+}
+
+// nextChunk reads chunk header.
+func (lr *Reader2) nextChunk() error {
+
+	control, err := lr.br.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if control == 0 {
+		lr.eos = true
+		return nil
+	}
+
+	var hdr [5]byte
+	if control < 0x80 {
+		// uncompressed chunk, 1 resets dictionary
+		if control > 2 {
+			return fmt.Errorf("lzma2: invalid control byte %#x", control)
+		}
+		if _, err := io.ReadFull(lr.r, hdr[:2]); err != nil {
+			return unexpected(err)
+		}
+		if control == 1 {
+			lr.d.win.reset()
+			lr.needDict = false
+		} else if lr.needDict {
+			return ErrCorrupted
+		}
+		lr.unpacked = int64(hdr[0])<<8 | int64(hdr[1]) + 1
+		lr.uncompressed = true
+		return nil
+	}
+
+	n := 4
+	if control >= 0xC0 {
+		n = 5
+	}
+	if _, err := io.ReadFull(lr.r, hdr[:n]); err != nil {
+		return unexpected(err)
+	}
+	lr.unpacked = int64(control&0x1F)<<16 | int64(hdr[0])<<8 | int64(hdr[1]) + 1
+	packed := int(hdr[2])<<8 | int(hdr[3]) + 1
+	lr.uncompressed = false
+
+	switch reset := (control >> 5) & 3; {
+	case reset == 3:
+		lr.d.win.reset()
+		lr.needDict = false
+		fallthrough
+	case reset == 2:
+		p, err := decodeProperties(hdr[4])
+		if err != nil {
+			return err
+		}
+		if p.LC+p.LP > 4 {
+			return fmt.Errorf("lzma2: invalid properties %#x", hdr[4])
+		}
+		lr.d.setProperties(p)
+		lr.needProps = false
+		fallthrough
+	case reset == 1:
+		if lr.needProps {
+			return ErrCorrupted
+		}
+		lr.d.resetState()
+	default:
+		if lr.needProps {
+			return ErrCorrupted
+		}
+	}
+	if lr.needDict {
+		return ErrCorrupted
+	}
+
+	if cap(lr.packed) < packed {
+		lr.packed = make([]byte, packed)
+	}
+	lr.packed = lr.packed[:packed]
+	if _, err := io.ReadFull(lr.r, lr.packed); err != nil {
+		return unexpected(err)
+	}
+	return lr.d.rc.init(bytes.NewReader(lr.packed))
+}
+
+// Read implements io.Reader.
+func (lr *Reader2) Read(p []byte) (int, error) {
+	w := lr.d.win
+	for len(w.out) < len(p) && !lr.eos && lr.err == nil {
+		if lr.unpacked == 0 {
+			lr.err = lr.nextChunk()
+			continue
+		}
+		if lr.uncompressed {
+			b, err := lr.br.ReadByte()
+			if err != nil {
+				lr.err = unexpected(err)
+				continue
+			}
+			w.put(b)
+			lr.unpacked--
+			continue
+		}
+		before := w.total
+		if err := lr.d.decodeSymbol(lr.unpacked); err != nil {
+			if err == errEndMarker {
+				err = ErrCorrupted
+			}
+			lr.err = err
+			continue
+		}
+		lr.unpacked -= w.total - before
+	}
+	n := copy(p, w.out)
+	w.out = w.out[:copy(w.out, w.out[n:])]
+	if n > 0 {
+		return n, nil
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return 0, io.EOF
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
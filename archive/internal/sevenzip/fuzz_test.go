@@ -0,0 +1,39 @@
+package sevenzip
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// maxFuzzOutput limits amount of data read for every file, highly compressed input could expand to a lot.
+const maxFuzzOutput = 1 << 22
+
+func FuzzReader(f *testing.F) {
+
+	files, err := filepath.Glob("testdata/*.7z")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fname := range files {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		zr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		zr.Walk(all, func(f *File, r io.Reader) error {
+			_, err := io.Copy(io.Discard, io.LimitReader(r, maxFuzzOutput))
+			return err
+		})
+	})
+}
@@ -0,0 +1,685 @@
+package sevenzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf16"
+)
+
+// Property ids of 7z headers.
+const (
+	idEnd                   = 0x00
+	idHeader                = 0x01
+	idArchiveProperties     = 0x02
+	idAdditionalStreamsInfo = 0x03
+	idMainStreamsInfo       = 0x04
+	idFilesInfo             = 0x05
+	idPackInfo              = 0x06
+	idUnpackInfo            = 0x07
+	idSubStreamsInfo        = 0x08
+	idSize                  = 0x09
+	idCRC                   = 0x0A
+	idFolder                = 0x0B
+	idCodersUnpackSize      = 0x0C
+	idNumUnpackStream       = 0x0D
+	idEmptyStream           = 0x0E
+	idEmptyFile             = 0x0F
+	idName                  = 0x11
+	idMTime                 = 0x14
+	idWinAttributes         = 0x15
+	idEncodedHeader         = 0x17
+	idDummy                 = 0x19
+)
+
+// ErrFormat is returned when archive headers could not be parsed.
+var ErrFormat = errors.New("7z: invalid format")
+
+// sanity limit for counts read from headers, protects from allocating huge slices for broken archives
+const maxCount = 1 << 24
+
+type coder struct {
+	id         []byte
+	numIn      int
+	numOut     int
+	properties []byte
+}
+
+type bindPair struct {
+	in, out int
+}
+
+type folder struct {
+	coders        []coder
+	bindPairs     []bindPair
+	packedStreams []int    // folder in stream indexes which are read from pack streams
+	unpackSizes   []uint64 // for every out stream of every coder
+	crc           uint32
+	hasCRC        bool
+	// position of the first pack stream used by this folder
+	firstPackStream int
+}
+
+func (f *folder) numOutStreams() int {
+	n := 0
+	for _, c := range f.coders {
+		n += c.numOut
+	}
+	return n
+}
+
+func (f *folder) numInStreams() int {
+	n := 0
+	for _, c := range f.coders {
+		n += c.numIn
+	}
+	return n
+}
+
+// mainOutStream returns index of out stream which is not bound to any coder input - folder result.
+func (f *folder) mainOutStream() (int, error) {
+outer:
+	for i := 0; i < f.numOutStreams(); i++ {
+		for _, bp := range f.bindPairs {
+			if bp.out == i {
+				continue outer
+			}
+		}
+		return i, nil
+	}
+	return 0, ErrFormat
+}
+
+func (f *folder) unpackSize() uint64 {
+	if i, err := f.mainOutStream(); err == nil {
+		return f.unpackSizes[i]
+	}
+	return 0
+}
+
+type streamsInfo struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []*folder
+	// sub streams
+	numUnpackStreams []int
+	sizes            []uint64
+	digests          []uint32
+	hasDigests       []bool
+}
+
+type fileInfo struct {
+	name        string
+	hasStream   bool
+	isDir       bool
+	modTime     time.Time
+	attrib      uint32
+	hasAttrib   bool
+	emptyFile   bool
+	emptyStream bool
+}
+
+// headerReader parses header structures.
+type headerReader struct {
+	*bytes.Reader
+}
+
+func (hr headerReader) byte() (byte, error) {
+	b, err := hr.ReadByte()
+	if err != nil {
+		return 0, ErrFormat
+	}
+	return b, nil
+}
+
+func (hr headerReader) number() (uint64, error) {
+	first, err := hr.byte()
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	mask := byte(0x80)
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			high := uint64(first & (mask - 1))
+			return value | high<<(8*i), nil
+		}
+		b, err := hr.byte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b) << (8 * i)
+		mask >>= 1
+	}
+	return value, nil
+}
+
+func (hr headerReader) count() (int, error) {
+	n, err := hr.number()
+	if err != nil {
+		return 0, err
+	}
+	if n > maxCount {
+		return 0, ErrFormat
+	}
+	return int(n), nil
+}
+
+func (hr headerReader) uint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(hr, b[:]); err != nil {
+		return 0, ErrFormat
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+func (hr headerReader) uint64() (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(hr, b[:]); err != nil {
+		return 0, ErrFormat
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+func (hr headerReader) expect(id byte) error {
+	b, err := hr.byte()
+	if err != nil {
+		return err
+	}
+	if b != id {
+		return fmt.Errorf("%w: expected property %#x, got %#x", ErrFormat, id, b)
+	}
+	return nil
+}
+
+func (hr headerReader) bits(n int) ([]bool, error) {
+	v := make([]bool, n)
+	var b byte
+	for i := 0; i < n; i++ {
+		if i%8 == 0 {
+			var err error
+			if b, err = hr.byte(); err != nil {
+				return nil, err
+			}
+		}
+		v[i] = b&(0x80>>(i%8)) != 0
+	}
+	return v, nil
+}
+
+// optionalBits reads "all are defined" byte followed by bit vector when not all are.
+func (hr headerReader) optionalBits(n int) ([]bool, error) {
+	all, err := hr.byte()
+	if err != nil {
+		return nil, err
+	}
+	if all == 0 {
+		return hr.bits(n)
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = true
+	}
+	return v, nil
+}
+
+func (hr headerReader) digests(n int) ([]uint32, []bool, error) {
+	defined, err := hr.optionalBits(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	crcs := make([]uint32, n)
+	for i := range crcs {
+		if defined[i] {
+			if crcs[i], err = hr.uint32(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return crcs, defined, nil
+}
+
+func (hr headerReader) packInfo(si *streamsInfo) error {
+	var err error
+	if si.packPos, err = hr.number(); err != nil {
+		return err
+	}
+	n, err := hr.count()
+	if err != nil {
+		return err
+	}
+	si.packSizes = make([]uint64, n)
+	for {
+		id, err := hr.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return nil
+		case idSize:
+			for i := range si.packSizes {
+				if si.packSizes[i], err = hr.number(); err != nil {
+					return err
+				}
+			}
+		case idCRC:
+			if _, _, err := hr.digests(n); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unexpected property %#x in pack info", ErrFormat, id)
+		}
+	}
+}
+
+func (hr headerReader) folder() (*folder, error) {
+	n, err := hr.count()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n > 64 {
+		return nil, ErrFormat
+	}
+	f := &folder{coders: make([]coder, n)}
+	for i := range f.coders {
+		flags, err := hr.byte()
+		if err != nil {
+			return nil, err
+		}
+		if flags&0x80 != 0 {
+			return nil, fmt.Errorf("%w: alternative coder methods are not supported", ErrFormat)
+		}
+		c := &f.coders[i]
+		c.id = make([]byte, flags&0x0F)
+		if _, err := io.ReadFull(hr, c.id); err != nil {
+			return nil, ErrFormat
+		}
+		c.numIn, c.numOut = 1, 1
+		if flags&0x10 != 0 {
+			if c.numIn, err = hr.count(); err != nil {
+				return nil, err
+			}
+			if c.numOut, err = hr.count(); err != nil {
+				return nil, err
+			}
+			if c.numIn > 64 || c.numOut > 64 {
+				return nil, ErrFormat
+			}
+		}
+		if flags&0x20 != 0 {
+			size, err := hr.count()
+			if err != nil {
+				return nil, err
+			}
+			c.properties = make([]byte, size)
+			if _, err := io.ReadFull(hr, c.properties); err != nil {
+				return nil, ErrFormat
+			}
+		}
+	}
+	numOut, numIn := f.numOutStreams(), f.numInStreams()
+	if numOut == 0 || numIn < numOut-1 {
+		return nil, ErrFormat
+	}
+	f.bindPairs = make([]bindPair, numOut-1)
+	for i := range f.bindPairs {
+		if f.bindPairs[i].in, err = hr.count(); err != nil {
+			return nil, err
+		}
+		if f.bindPairs[i].out, err = hr.count(); err != nil {
+			return nil, err
+		}
+	}
+	numPacked := numIn - len(f.bindPairs)
+	if numPacked == 1 {
+	outer:
+		for i := 0; i < numIn; i++ {
+			for _, bp := range f.bindPairs {
+				if bp.in == i {
+					continue outer
+				}
+			}
+			f.packedStreams = append(f.packedStreams, i)
+			break
+		}
+		if len(f.packedStreams) != 1 {
+			return nil, ErrFormat
+		}
+	} else {
+		f.packedStreams = make([]int, numPacked)
+		for i := range f.packedStreams {
+			if f.packedStreams[i], err = hr.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+func (hr headerReader) unpackInfo(si *streamsInfo) error {
+	if err := hr.expect(idFolder); err != nil {
+		return err
+	}
+	n, err := hr.count()
+	if err != nil {
+		return err
+	}
+	if external, err := hr.byte(); err != nil {
+		return err
+	} else if external != 0 {
+		return fmt.Errorf("%w: external folders are not supported", ErrFormat)
+	}
+	si.folders = make([]*folder, n)
+	packStream := 0
+	for i := range si.folders {
+		if si.folders[i], err = hr.folder(); err != nil {
+			return err
+		}
+		si.folders[i].firstPackStream = packStream
+		packStream += len(si.folders[i].packedStreams)
+	}
+	if err := hr.expect(idCodersUnpackSize); err != nil {
+		return err
+	}
+	for _, f := range si.folders {
+		f.unpackSizes = make([]uint64, f.numOutStreams())
+		for i := range f.unpackSizes {
+			if f.unpackSizes[i], err = hr.number(); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		id, err := hr.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return nil
+		case idCRC:
+			crcs, defined, err := hr.digests(n)
+			if err != nil {
+				return err
+			}
+			for i, f := range si.folders {
+				f.crc, f.hasCRC = crcs[i], defined[i]
+			}
+		default:
+			return fmt.Errorf("%w: unexpected property %#x in unpack info", ErrFormat, id)
+		}
+	}
+}
+
+func (hr headerReader) subStreamsInfo(si *streamsInfo) error {
+
+	si.numUnpackStreams = make([]int, len(si.folders))
+	for i := range si.numUnpackStreams {
+		si.numUnpackStreams[i] = 1
+	}
+
+	id, err := hr.byte()
+	if err != nil {
+		return err
+	}
+	if id == idNumUnpackStream {
+		for i := range si.numUnpackStreams {
+			if si.numUnpackStreams[i], err = hr.count(); err != nil {
+				return err
+			}
+		}
+		if id, err = hr.byte(); err != nil {
+			return err
+		}
+	}
+
+	// sizes of all but last stream in folder are stored, the last one is what is left
+	si.sizes = si.sizes[:0]
+	for i, f := range si.folders {
+		if si.numUnpackStreams[i] == 0 {
+			continue
+		}
+		var sum uint64
+		if id == idSize {
+			for j := 1; j < si.numUnpackStreams[i]; j++ {
+				size, err := hr.number()
+				if err != nil {
+					return err
+				}
+				si.sizes = append(si.sizes, size)
+				sum += size
+			}
+		}
+		total := f.unpackSize()
+		if sum > total {
+			return ErrFormat
+		}
+		si.sizes = append(si.sizes, total-sum)
+	}
+	if id == idSize {
+		if id, err = hr.byte(); err != nil {
+			return err
+		}
+	}
+
+	// streams with unknown digests: all but those in folders with single stream and known folder CRC
+	unknown := 0
+	for i, f := range si.folders {
+		if n := si.numUnpackStreams[i]; n != 1 || !f.hasCRC {
+			unknown += n
+		}
+	}
+	si.digests = make([]uint32, 0, len(si.sizes))
+	si.hasDigests = make([]bool, 0, len(si.sizes))
+
+	for ; id != idEnd; id, err = hr.byte() {
+		if err != nil {
+			return err
+		}
+		if id != idCRC {
+			return fmt.Errorf("%w: unexpected property %#x in substreams info", ErrFormat, id)
+		}
+		crcs, defined, err := hr.digests(unknown)
+		if err != nil {
+			return err
+		}
+		k := 0
+		for i, f := range si.folders {
+			n := si.numUnpackStreams[i]
+			if n == 1 && f.hasCRC {
+				si.digests = append(si.digests, f.crc)
+				si.hasDigests = append(si.hasDigests, true)
+				continue
+			}
+			for j := 0; j < n; j++ {
+				si.digests = append(si.digests, crcs[k])
+				si.hasDigests = append(si.hasDigests, defined[k])
+				k++
+			}
+		}
+	}
+	if len(si.digests) == 0 {
+		// no digests were stored, take what folders have
+		for i, f := range si.folders {
+			for j := 0; j < si.numUnpackStreams[i]; j++ {
+				si.digests = append(si.digests, f.crc)
+				si.hasDigests = append(si.hasDigests, si.numUnpackStreams[i] == 1 && f.hasCRC)
+			}
+		}
+	}
+	return nil
+}
+
+func (hr headerReader) streamsInfo() (*streamsInfo, error) {
+	si := &streamsInfo{}
+	for {
+		id, err := hr.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case idEnd:
+			if si.numUnpackStreams == nil {
+				// no substreams info - every folder is a single stream
+				if err := (headerReader{bytes.NewReader([]byte{idEnd})}).subStreamsInfo(si); err != nil {
+					return nil, err
+				}
+			}
+			return si, nil
+		case idPackInfo:
+			err = hr.packInfo(si)
+		case idUnpackInfo:
+			err = hr.unpackInfo(si)
+		case idSubStreamsInfo:
+			err = hr.subStreamsInfo(si)
+		default:
+			err = fmt.Errorf("%w: unexpected property %#x in streams info", ErrFormat, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// filetime converts Windows FILETIME to time.
+func filetime(v uint64) time.Time {
+	const epochDiff = 116444736000000000 // 100ns intervals between 1601 and 1970
+	if v < epochDiff {
+		return time.Time{}
+	}
+	v -= epochDiff
+	return time.Unix(int64(v/10000000), int64(v%10000000)*100).UTC()
+}
+
+func (hr headerReader) filesInfo() ([]*fileInfo, error) {
+
+	n, err := hr.count()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*fileInfo, n)
+	for i := range files {
+		files[i] = &fileInfo{hasStream: true}
+	}
+
+	var emptyStreams []int
+	for {
+		id, err := hr.byte()
+		if err != nil {
+			return nil, err
+		}
+		if id == idEnd {
+			break
+		}
+		size, err := hr.number()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(hr.Len()) {
+			return nil, ErrFormat
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(hr, data); err != nil {
+			return nil, ErrFormat
+		}
+		pr := headerReader{bytes.NewReader(data)}
+
+		switch id {
+		case idEmptyStream:
+			v, err := pr.bits(n)
+			if err != nil {
+				return nil, err
+			}
+			emptyStreams = emptyStreams[:0]
+			for i, empty := range v {
+				files[i].hasStream = !empty
+				files[i].emptyStream = empty
+				if empty {
+					emptyStreams = append(emptyStreams, i)
+				}
+			}
+		case idEmptyFile:
+			v, err := pr.bits(len(emptyStreams))
+			if err != nil {
+				return nil, err
+			}
+			for i, empty := range v {
+				files[emptyStreams[i]].emptyFile = empty
+			}
+		case idName:
+			if external, err := pr.byte(); err != nil {
+				return nil, err
+			} else if external != 0 {
+				return nil, fmt.Errorf("%w: external names are not supported", ErrFormat)
+			}
+			for _, f := range files {
+				var u []uint16
+				for {
+					lo, err := pr.byte()
+					if err != nil {
+						return nil, err
+					}
+					hi, err := pr.byte()
+					if err != nil {
+						return nil, err
+					}
+					c := uint16(hi)<<8 | uint16(lo)
+					if c == 0 {
+						break
+					}
+					u = append(u, c)
+				}
+				f.name = string(utf16.Decode(u))
+			}
+		case idMTime:
+			defined, err := pr.optionalBits(n)
+			if err != nil {
+				return nil, err
+			}
+			if external, err := pr.byte(); err != nil {
+				return nil, err
+			} else if external != 0 {
+				return nil, fmt.Errorf("%w: external times are not supported", ErrFormat)
+			}
+			for i, f := range files {
+				if defined[i] {
+					v, err := pr.uint64()
+					if err != nil {
+						return nil, err
+					}
+					f.modTime = filetime(v)
+				}
+			}
+		case idWinAttributes:
+			defined, err := pr.optionalBits(n)
+			if err != nil {
+				return nil, err
+			}
+			if external, err := pr.byte(); err != nil {
+				return nil, err
+			} else if external != 0 {
+				return nil, fmt.Errorf("%w: external attributes are not supported", ErrFormat)
+			}
+			for i, f := range files {
+				if defined[i] {
+					if f.attrib, err = pr.uint32(); err != nil {
+						return nil, err
+					}
+					f.hasAttrib = true
+				}
+			}
+		default:
+			// times, comments, start positions, anti items and padding do not matter to us
+		}
+	}
+
+	const attrDirectory = 0x10
+	for _, f := range files {
+		f.isDir = f.emptyStream && !f.emptyFile || f.hasAttrib && f.attrib&attrDirectory != 0
+	}
+	return files, nil
+}
@@ -0,0 +1,437 @@
+// Package sevenzip implements sequential reading of 7z archives. Supported methods are copy, LZMA, LZMA2, deflate,
+// bzip2 and delta filter, encrypted archives and branch converters (BCJ, BCJ2 and the like) are not supported.
+package sevenzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"fb2converter/archive/internal/lzma"
+)
+
+const signatureHeaderSize = 32
+
+var signature = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+
+// ErrChecksum is returned when data do not match stored CRC.
+var ErrChecksum = errors.New("7z: checksum mismatch")
+
+// ErrUnsupportedFilter is returned for folders using branch converters 7z applies to executables.
+var ErrUnsupportedFilter = errors.New("7z: unsupported filter")
+
+// File describes file stored in archive.
+type File struct {
+	Name    string
+	Size    uint64
+	ModTime time.Time
+	CRC32   uint32
+	HasCRC  bool
+	IsDir   bool
+
+	folder int    // -1 for files without data
+	offset uint64 // position of file data in unpacked folder
+}
+
+// Reader gives access to 7z archive content.
+type Reader struct {
+	r       io.ReaderAt
+	Files   []*File
+	streams *streamsInfo
+}
+
+// NewReader reads archive headers.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+
+	var sh [signatureHeaderSize]byte
+	if _, err := r.ReadAt(sh[:], 0); err != nil {
+		return nil, ErrFormat
+	}
+	if !bytes.Equal(sh[:6], signature) {
+		return nil, ErrFormat
+	}
+	if crc32.ChecksumIEEE(sh[12:]) != binary.LittleEndian.Uint32(sh[8:12]) {
+		return nil, fmt.Errorf("%w in start header", ErrChecksum)
+	}
+	offset := binary.LittleEndian.Uint64(sh[12:20])
+	hsize := binary.LittleEndian.Uint64(sh[20:28])
+	hcrc := binary.LittleEndian.Uint32(sh[28:32])
+
+	zr := &Reader{r: r}
+	if hsize == 0 {
+		// empty archive
+		return zr, nil
+	}
+	if offset > uint64(size) || hsize > uint64(size)-offset || signatureHeaderSize+offset+hsize > uint64(size) {
+		return nil, fmt.Errorf("%w: header is out of file bounds", ErrFormat)
+	}
+	header := make([]byte, hsize)
+	if _, err := r.ReadAt(header, int64(signatureHeaderSize+offset)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(header) != hcrc {
+		return nil, fmt.Errorf("%w in header", ErrChecksum)
+	}
+
+	for {
+		hr := headerReader{bytes.NewReader(header)}
+		id, err := hr.byte()
+		if err != nil {
+			return nil, err
+		}
+		if id == idHeader {
+			if err := zr.readHeader(hr); err != nil {
+				return nil, err
+			}
+			return zr, nil
+		}
+		if id != idEncodedHeader {
+			return nil, fmt.Errorf("%w: unexpected header type %#x", ErrFormat, id)
+		}
+		// header itself is packed
+		si, err := hr.streamsInfo()
+		if err != nil {
+			return nil, err
+		}
+		if len(si.folders) == 0 {
+			return nil, ErrFormat
+		}
+		fr, err := zr.folderReader(si, 0)
+		if err != nil {
+			return nil, err
+		}
+		if header, err = io.ReadAll(fr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (zr *Reader) readHeader(hr headerReader) error {
+
+	var files []*fileInfo
+	for {
+		id, err := hr.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case idEnd:
+			return zr.assignStreams(files)
+		case idArchiveProperties:
+			for {
+				t, err := hr.byte()
+				if err != nil {
+					return err
+				}
+				if t == idEnd {
+					break
+				}
+				size, err := hr.number()
+				if err != nil {
+					return err
+				}
+				if _, err := hr.Seek(int64(size), io.SeekCurrent); err != nil {
+					return ErrFormat
+				}
+			}
+		case idAdditionalStreamsInfo:
+			if _, err := hr.streamsInfo(); err != nil {
+				return err
+			}
+		case idMainStreamsInfo:
+			if zr.streams, err = hr.streamsInfo(); err != nil {
+				return err
+			}
+		case idFilesInfo:
+			if files, err = hr.filesInfo(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unexpected property %#x in header", ErrFormat, id)
+		}
+	}
+}
+
+// assignStreams matches files with unpacked streams.
+func (zr *Reader) assignStreams(files []*fileInfo) error {
+
+	si := zr.streams
+	if si == nil {
+		si = &streamsInfo{}
+		zr.streams = si
+	}
+	var offset uint64
+	folder, inFolder, stream := 0, 0, 0
+	for _, fi := range files {
+		f := &File{Name: fi.name, ModTime: fi.modTime, IsDir: fi.isDir, folder: -1}
+		zr.Files = append(zr.Files, f)
+		if !fi.hasStream {
+			continue
+		}
+		for folder < len(si.folders) && inFolder >= si.numUnpackStreams[folder] {
+			folder, inFolder, offset = folder+1, 0, 0
+		}
+		if folder >= len(si.folders) || stream >= len(si.sizes) {
+			return fmt.Errorf("%w: not enough streams for files", ErrFormat)
+		}
+		f.folder = folder
+		f.Size, f.offset = si.sizes[stream], offset
+		offset += f.Size
+		f.CRC32, f.HasCRC = si.digests[stream], si.hasDigests[stream]
+		inFolder++
+		stream++
+	}
+	return nil
+}
+
+// packStream returns reader for pack stream with specified index.
+func (zr *Reader) packStream(si *streamsInfo, index int) (io.Reader, error) {
+	if index >= len(si.packSizes) {
+		return nil, ErrFormat
+	}
+	offset := signatureHeaderSize + si.packPos
+	for _, size := range si.packSizes[:index] {
+		offset += size
+	}
+	return bufio.NewReader(io.NewSectionReader(zr.r, int64(offset), int64(si.packSizes[index]))), nil
+}
+
+// folderReader returns reader for unpacked folder content.
+func (zr *Reader) folderReader(si *streamsInfo, index int) (io.Reader, error) {
+
+	f := si.folders[index]
+	main, err := f.mainOutStream()
+	if err != nil {
+		return nil, err
+	}
+	r, err := zr.outStream(si, f, main, 0)
+	if err != nil {
+		return nil, err
+	}
+	size := f.unpackSizes[main]
+	if f.hasCRC {
+		return &checkedReader{r: io.LimitReader(r, int64(size)), size: size, crc: f.crc, hash: crc32.NewIEEE()}, nil
+	}
+	return &checkedReader{r: io.LimitReader(r, int64(size)), size: size}, nil
+}
+
+// outStream builds decoder chain producing folder out stream.
+func (zr *Reader) outStream(si *streamsInfo, f *folder, out, depth int) (io.Reader, error) {
+
+	if depth > len(f.coders) {
+		return nil, ErrFormat
+	}
+
+	// find coder owning out stream and its first in stream
+	ci, in, o := -1, 0, 0
+	for i, c := range f.coders {
+		if out < o+c.numOut {
+			ci = i
+			break
+		}
+		o += c.numOut
+		in += c.numIn
+	}
+	if ci < 0 {
+		return nil, ErrFormat
+	}
+	c := f.coders[ci]
+	if name, ok := branchFilters[string(c.id)]; ok {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedFilter, name)
+	}
+	if c.numIn != 1 || c.numOut != 1 {
+		return nil, fmt.Errorf("7z: unsupported complex coder %x", c.id)
+	}
+
+	var input io.Reader
+	for _, bp := range f.bindPairs {
+		if bp.in == in {
+			r, err := zr.outStream(si, f, bp.out, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			input = r
+			break
+		}
+	}
+	if input == nil {
+		for i, ps := range f.packedStreams {
+			if ps == in {
+				r, err := zr.packStream(si, f.firstPackStream+i)
+				if err != nil {
+					return nil, err
+				}
+				input = r
+				break
+			}
+		}
+	}
+	if input == nil {
+		return nil, ErrFormat
+	}
+	return newDecoder(c, input, f.unpackSizes[out])
+}
+
+// Method ids.
+var (
+	methodCopy    = []byte{0x00}
+	methodDelta   = []byte{0x03}
+	methodLZMA2   = []byte{0x21}
+	methodLZMA    = []byte{0x03, 0x01, 0x01}
+	methodDeflate = []byte{0x04, 0x01, 0x08}
+	methodBZip2   = []byte{0x04, 0x02, 0x02}
+	methodAES     = []byte{0x06, 0xF1, 0x07, 0x01}
+)
+
+// branchFilters are names of branch converters by method id.
+var branchFilters = map[string]string{
+	"\x03\x03\x01\x03": "BCJ",
+	"\x03\x03\x01\x1B": "BCJ2",
+	"\x03\x03\x02\x05": "PPC",
+	"\x03\x03\x04\x01": "IA64",
+	"\x03\x03\x05\x01": "ARM",
+	"\x03\x03\x07\x01": "ARMT",
+	"\x03\x03\x08\x05": "SPARC",
+	"\x0A":             "ARM64",
+	"\x0B":             "RISCV",
+}
+
+func newDecoder(c coder, r io.Reader, size uint64) (io.Reader, error) {
+	switch {
+	case bytes.Equal(c.id, methodCopy):
+		return r, nil
+	case bytes.Equal(c.id, methodLZMA):
+		return lzma.NewReader(r, c.properties, int64(size))
+	case bytes.Equal(c.id, methodLZMA2):
+		if len(c.properties) != 1 {
+			return nil, ErrFormat
+		}
+		// smaller dictionary is enough when all data fit in it
+		prop := c.properties[0]
+		for prop > 0 {
+			if smaller, err := lzma.DictSize2(prop - 1); err != nil || uint64(smaller) < size {
+				break
+			}
+			prop--
+		}
+		return lzma.NewReader2(r, prop)
+	case bytes.Equal(c.id, methodDeflate):
+		return flate.NewReader(r), nil
+	case bytes.Equal(c.id, methodBZip2):
+		return bzip2.NewReader(r), nil
+	case bytes.Equal(c.id, methodDelta):
+		dist := 1
+		if len(c.properties) == 1 {
+			dist = int(c.properties[0]) + 1
+		}
+		return &deltaReader{r: r, hist: make([]byte, dist)}, nil
+	case bytes.Equal(c.id, methodAES):
+		return nil, errors.New("7z: encrypted archives are not supported")
+	}
+	return nil, fmt.Errorf("7z: unsupported compression method %x", c.id)
+}
+
+// deltaReader reverses delta filter.
+type deltaReader struct {
+	r    io.Reader
+	hist []byte
+	pos  int
+}
+
+func (dr *deltaReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	for i := 0; i < n; i++ {
+		j := dr.pos % len(dr.hist)
+		p[i] += dr.hist[j]
+		dr.hist[j] = p[i]
+		dr.pos++
+	}
+	return n, err
+}
+
+// checkedReader verifies size and optionally CRC of the stream.
+type checkedReader struct {
+	r    io.Reader
+	size uint64
+	read uint64
+	crc  uint32
+	hash hash.Hash32
+}
+
+func (cr *checkedReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read += uint64(n)
+	if cr.hash != nil {
+		cr.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		if cr.read != cr.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		if cr.hash != nil && cr.hash.Sum32() != cr.crc {
+			return n, ErrChecksum
+		}
+	}
+	return n, err
+}
+
+// Walk calls fn for every file accepted by match in order of storage. Content reader is only valid until fn returns.
+// Folders without accepted files are never decompressed. When fn returns error walking stops and the error is
+// returned.
+func (zr *Reader) Walk(match func(f *File) bool, fn func(f *File, r io.Reader) error) error {
+
+	var (
+		folder = -1
+		fr     io.Reader
+		pos    uint64 // position in unpacked folder
+	)
+	for _, f := range zr.Files {
+		if !match(f) {
+			continue
+		}
+		if f.folder < 0 {
+			if err := fn(f, bytes.NewReader(nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.folder != folder {
+			var err error
+			if fr, err = zr.folderReader(zr.streams, f.folder); err != nil {
+				return err
+			}
+			folder, pos = f.folder, 0
+		}
+		// solid archives keep several files in single folder, skip files we are not interested in
+		if _, err := io.CopyN(io.Discard, fr, int64(f.offset-pos)); err != nil {
+			return unexpected(err)
+		}
+		cr := &checkedReader{r: io.LimitReader(fr, int64(f.Size)), size: f.Size}
+		if f.HasCRC {
+			cr.crc, cr.hash = f.CRC32, crc32.NewIEEE()
+		}
+		if err := fn(f, cr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, cr); err != nil {
+			return err
+		}
+		pos = f.offset + f.Size
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package sevenzip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func openArchive(t *testing.T, data []byte) *Reader {
+	t.Helper()
+	zr, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Unable to open archive: %v", err)
+	}
+	return zr
+}
+
+func readAll(zr *Reader, match func(f *File) bool) (map[string]string, error) {
+	res := make(map[string]string)
+	err := zr.Walk(match, func(f *File, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		res[f.Name] = string(data)
+		return nil
+	})
+	return res, err
+}
+
+func all(*File) bool { return true }
+
+func TestReader(t *testing.T) {
+
+	for _, tc := range []struct {
+		file     string
+		expected map[string]string // file name and last paragraph
+	}{
+		// LZMA2, solid, with directory, empty file and packed header
+		{"solid.7z", map[string]string{
+			"books/first.fb2":  "<p>Абзац 299 книги Первая.</p>",
+			"books/second.fb2": "<p>Абзац 199 книги Вторая.</p>",
+			"books/empty.fb2":  "",
+		}},
+		// LZMA, deflate and copy - one folder per file
+		{"nonsolid.7z", map[string]string{
+			"один.fb2":    "<p>Абзац 99 книги Один.</p>",
+			"dir/два.fb2": "<p>Абзац 49 книги Два.</p>",
+			"три.fb2":     "<p>Абзац 19 книги Три.</p>",
+		}},
+		// written by libarchive (bsdtar), LZMA2, solid, with directories and empty file
+		{"libarchive.7z", map[string]string{
+			"library/четыре.fb2":       "<p>Абзац 399 книги Четыре.</p>",
+			"library/authors/пять.fb2": "<p>Абзац 149 книги Пять.</p>",
+			"library/empty.fb2":        "",
+		}},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/" + tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr := openArchive(t, data)
+
+			files := 0
+			for _, f := range zr.Files {
+				if f.IsDir {
+					continue
+				}
+				files++
+				if f.ModTime.Year() != 2022 {
+					t.Fatalf("%s: unexpected modification time %v", f.Name, f.ModTime)
+				}
+			}
+			if files != len(tc.expected) {
+				t.Fatalf("Expected %d files, got %d", len(tc.expected), files)
+			}
+
+			res, err := readAll(zr, func(f *File) bool { return !f.IsDir })
+			if err != nil {
+				t.Fatalf("Unable to read archive: %v", err)
+			}
+			for name, last := range tc.expected {
+				content, ok := res[name]
+				if !ok {
+					t.Fatalf("%s was not found", name)
+				}
+				if len(last) == 0 && len(content) == 0 {
+					continue
+				}
+				if !strings.Contains(content, last) || !strings.HasSuffix(content, "</FictionBook>\n") {
+					t.Fatalf("%s: unexpected content\n%s", name, content)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderSelected(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/solid.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// second file in solid folder requires skipping the first one
+	res, err := readAll(openArchive(t, data), func(f *File) bool { return f.Name == "books/second.fb2" })
+	if err != nil {
+		t.Fatalf("Unable to read archive: %v", err)
+	}
+	if len(res) != 1 || !strings.Contains(res["books/second.fb2"], "книги Вторая") {
+		t.Fatalf("Unexpected result: %v", res)
+	}
+}
+
+func TestReaderCorrupted(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/nonsolid.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		broken := bytes.Clone(data)
+		// the last file is stored, damage its text
+		i := bytes.LastIndex(broken, []byte("Абзац 19"))
+		broken[i+len("Абзац ")] = '7'
+		_, err := readAll(openArchive(t, broken), all)
+		if !errors.Is(err, ErrChecksum) {
+			t.Fatalf("Expected checksum error, got %v", err)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		broken := bytes.Clone(data)
+		broken[len(broken)-10] ^= 0xFF
+		if _, err := NewReader(bytes.NewReader(broken), int64(len(broken))); err == nil {
+			t.Fatal("Expected error for damaged header")
+		}
+	})
+
+	t.Run("not 7z", func(t *testing.T) {
+		if _, err := NewReader(strings.NewReader("not an archive at all, really not"), 33); !errors.Is(err, ErrFormat) {
+			t.Fatalf("Expected format error, got %v", err)
+		}
+	})
+}
+
+func TestReaderUnsupportedFilter(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/branch.7z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr := openArchive(t, data)
+	for name, filter := range map[string]string{"bcj.fb2": "BCJ", "bcj2.fb2": "BCJ2"} {
+		_, err := readAll(zr, func(f *File) bool { return f.Name == name })
+		if !errors.Is(err, ErrUnsupportedFilter) || !strings.HasSuffix(err.Error(), " "+filter) {
+			t.Errorf("%s: expected unsupported filter error for %s, got %v", name, filter, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+#!/usr/bin/env python3
+# Generates 7z archives for tests. Archives are assembled by hand, so every header structure reader supports is used.
+
+import lzma
+import struct
+import zlib
+
+
+def num(v):
+    if v < 0x80:
+        return bytes([v])
+    if v < 0x4000:
+        return bytes([0x80 | (v >> 8), v & 0xFF])
+    if v < 0x200000:
+        return bytes([0xC0 | (v >> 16), v & 0xFF, (v >> 8) & 0xFF])
+    return bytes([0xE0 | (v >> 24), v & 0xFF, (v >> 8) & 0xFF, (v >> 16) & 0xFF])
+
+
+def crc(b):
+    return struct.pack("<I", zlib.crc32(b) & 0xFFFFFFFF)
+
+
+def lzma1(data):
+    raw = lzma.compress(data, format=lzma.FORMAT_RAW, filters=[{"id": lzma.FILTER_LZMA1, "dict_size": 1 << 16, "lc": 3, "lp": 0, "pb": 2}])
+    return raw, bytes([(2 * 5 + 0) * 9 + 3]) + struct.pack("<I", 1 << 16)
+
+
+def lzma2(data):
+    raw = lzma.compress(data, format=lzma.FORMAT_RAW, filters=[{"id": lzma.FILTER_LZMA2, "dict_size": 1 << 20}])
+    return raw, bytes([16])
+
+
+def deflate(data):
+    c = zlib.compressobj(9, zlib.DEFLATED, -15)
+    return c.compress(data) + c.flush(), b""
+
+
+def coder(method, props):
+    flags = len(method)
+    out = b""
+    if props:
+        flags |= 0x20
+    out += bytes([flags]) + method
+    if props:
+        out += num(len(props)) + props
+    return out
+
+
+def complex_coder(method, num_in, num_out):
+    return bytes([0x10 | len(method)]) + method + num(num_in) + num(num_out)
+
+
+def names(files):
+    b = b"\x00"
+    for n in files:
+        b += n.encode("utf-16-le") + b"\x00\x00"
+    return b
+
+
+def prop(pid, data):
+    return bytes([pid]) + num(len(data)) + data
+
+
+def bits(v):
+    out = bytearray((len(v) + 7) // 8)
+    for i, x in enumerate(v):
+        if x:
+            out[i // 8] |= 0x80 >> (i % 8)
+    return bytes(out)
+
+
+FILETIME = 133000000000000000  # 2022-06-16
+
+
+def files_info(files, empty_stream, empty_file, attrs):
+    b = bytes([0x05]) + num(len(files))
+    if any(empty_stream):
+        b += prop(0x0E, bits(empty_stream))
+        b += prop(0x0F, bits(empty_file))
+    b += prop(0x11, names(files))
+    b += prop(0x14, b"\x01\x00" + b"".join(struct.pack("<Q", FILETIME + i * 10000000) for i in range(len(files))))
+    b += prop(0x15, b"\x01\x00" + b"".join(struct.pack("<I", a) for a in attrs))
+    return b + b"\x00"
+
+
+def archive(packed, header):
+    start = struct.pack("<QQ", len(packed), len(header)) + crc(header)
+    return b"7z\xbc\xaf\x27\x1c\x00\x04" + crc(start) + start + packed + header
+
+
+def encode_header(packed, header):
+    raw, props = lzma1(header)
+    enc = bytes([0x17])
+    enc += bytes([0x06]) + num(len(packed)) + num(1) + bytes([0x09]) + num(len(raw)) + b"\x00"
+    enc += bytes([0x07, 0x0B]) + num(1) + b"\x00" + num(1) + coder(b"\x03\x01\x01", props)
+    enc += bytes([0x0C]) + num(len(header)) + bytes([0x0A, 0x01]) + crc(header) + b"\x00"
+    enc += b"\x00"
+    return packed + raw, enc
+
+
+def book(title, n):
+    body = "".join("<p>Абзац %d книги %s.</p>\n" % (i, title) for i in range(n))
+    return ('<?xml version="1.0" encoding="utf-8"?>\n<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">\n'
+            '<description><title-info><book-title>%s</book-title><lang>ru</lang></title-info></description>\n'
+            '<body><section>\n%s</section></body>\n</FictionBook>\n' % (title, body)).encode()
+
+
+def solid():
+    a, b = book("Первая", 300), book("Вторая", 200)
+    raw, props = lzma2(a + b)
+    h = bytes([0x01, 0x04])
+    h += bytes([0x06]) + num(0) + num(1) + bytes([0x09]) + num(len(raw)) + b"\x00"
+    h += bytes([0x07, 0x0B]) + num(1) + b"\x00" + num(1) + coder(b"\x21", props)
+    h += bytes([0x0C]) + num(len(a) + len(b)) + b"\x00"
+    h += bytes([0x08, 0x0D]) + num(2) + bytes([0x09]) + num(len(a)) + bytes([0x0A, 0x01]) + crc(a) + crc(b) + b"\x00"
+    h += b"\x00"
+    h += files_info(["books", "books/first.fb2", "books/second.fb2", "books/empty.fb2"],
+                    [True, False, False, True], [False, True], [0x10, 0x20, 0x20, 0x20])
+    h += b"\x00"
+    packed, enc = encode_header(raw, h)
+    return archive(packed, enc)
+
+
+def nonsolid():
+    datas = [book("Один", 100), book("Два", 50), book("Три", 20)]
+    methods = [(b"\x03\x01\x01", lzma1), (b"\x04\x01\x08", deflate), (b"\x00", lambda d: (d, b""))]
+    packed, sizes, folders = b"", [], b""
+    for data, (mid, fn) in zip(datas, methods):
+        raw, props = fn(data)
+        packed += raw
+        sizes.append(len(raw))
+        folders += num(1) + coder(mid, props)
+    h = bytes([0x01, 0x04])
+    h += bytes([0x06]) + num(0) + num(len(sizes)) + bytes([0x09]) + b"".join(num(s) for s in sizes) + b"\x00"
+    h += bytes([0x07, 0x0B]) + num(len(datas)) + b"\x00" + folders
+    h += bytes([0x0C]) + b"".join(num(len(d)) for d in datas)
+    h += bytes([0x0A, 0x01]) + b"".join(crc(d) for d in datas) + b"\x00"
+    h += b"\x00"
+    h += files_info(["один.fb2", "dir/два.fb2", "три.fb2"], [False, False, False], [], [0x20, 0x20, 0x20])
+    h += b"\x00"
+    return archive(packed, h)
+
+
+def branch():
+    # coders are laid out the way 7-Zip writes them: BCJ after LZMA2, BCJ2 reading three LZMA2 streams and range coder
+    a, b = book("Исполняемая", 20), book("Ветвление", 20)
+    raw = lzma.compress(a, format=lzma.FORMAT_RAW, filters=[{"id": lzma.FILTER_X86}, {"id": lzma.FILTER_LZMA2, "dict_size": 1 << 16}])
+    # text has no call or jump opcodes, so BCJ2 main stream is the text itself
+    main, empty = lzma2(b)[0], lzma2(b"")[0]
+    streams = [raw, main, b"\x00" * 5, empty, empty]
+    h = bytes([0x01, 0x04])
+    h += bytes([0x06]) + num(0) + num(len(streams)) + bytes([0x09]) + b"".join(num(len(s)) for s in streams) + b"\x00"
+    h += bytes([0x07, 0x0B]) + num(2) + b"\x00"
+    h += num(2) + coder(b"\x21", bytes([16])) + coder(b"\x03\x03\x01\x03", b"") + num(1) + num(0)
+    h += num(4) + coder(b"\x21", bytes([16])) * 3 + complex_coder(b"\x03\x03\x01\x1B", 4, 1)
+    h += num(5) + num(0) + num(4) + num(1) + num(3) + num(2)
+    h += num(2) + num(6) + num(1) + num(0)
+    h += bytes([0x0C]) + num(len(a)) + num(len(a)) + num(0) + num(0) + num(len(b)) + num(len(b))
+    h += bytes([0x0A, 0x01]) + crc(a) + crc(b) + b"\x00"
+    h += bytes([0x08, 0x00])
+    h += b"\x00"
+    h += files_info(["bcj.fb2", "bcj2.fb2"], [False, False], [], [0x20, 0x20])
+    h += b"\x00"
+    packed, enc = encode_header(b"".join(streams), h)
+    return archive(packed, enc)
+
+
+open("solid.7z", "wb").write(solid())
+open("nonsolid.7z", "wb").write(nonsolid())
+open("branch.7z", "wb").write(branch())
@@ -0,0 +1,31 @@
+#!/bin/sh
+# Generates 7z archive with libarchive (bsdtar). Unlike make7z.py output, headers come from independent writer.
+
+set -e
+export LC_ALL=C.UTF-8
+
+out="$(pwd)/libarchive.7z"
+dir="$(mktemp -d)"
+trap 'rm -rf "$dir"' EXIT
+
+book() {
+    printf '<?xml version="1.0" encoding="utf-8"?>\n<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">\n'
+    printf '<description><title-info><book-title>%s</book-title><lang>ru</lang></title-info></description>\n' "$1"
+    printf '<body><section>\n'
+    i=0
+    while [ $i -lt "$2" ]; do
+        printf '<p>Абзац %d книги %s.</p>\n' $i "$1"
+        i=$((i + 1))
+    done
+    printf '</section></body>\n</FictionBook>\n'
+}
+
+mkdir -p "$dir/library/authors"
+book "Четыре" 400 > "$dir/library/четыре.fb2"
+book "Пять" 150 > "$dir/library/authors/пять.fb2"
+: > "$dir/library/empty.fb2"
+find "$dir/library" -exec touch -d "2022-03-04 05:06:07" {} +
+
+rm -f "$out"
+cd "$dir"
+bsdtar --format 7zip --options 7zip:compression=lzma2 -cf "$out" library
@@ -0,0 +1,36 @@
+package xz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// maxFuzzOutput limits amount of data read from decoder, highly compressed input could expand to a lot.
+const maxFuzzOutput = 1 << 22
+
+func FuzzReader(f *testing.F) {
+
+	files, err := filepath.Glob("testdata/*.xz")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fname := range files {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(r, maxFuzzOutput))
+	})
+}
@@ -0,0 +1,393 @@
+// Package xz implements decompression of xz files. Only LZMA2 filter is supported, which is what xz produces for
+// anything but executables: branch converters (BCJ) and delta filter are reported with ErrUnsupportedFilter.
+package xz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"fb2converter/archive/internal/lzma"
+)
+
+var (
+	headerMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	footerMagic = []byte{'Y', 'Z'}
+
+	// ErrFormat is returned when input is not valid xz stream.
+	ErrFormat = errors.New("xz: invalid format")
+	// ErrChecksum is returned when decompressed data do not match stored check.
+	ErrChecksum = errors.New("xz: checksum mismatch")
+	// ErrUnsupportedFilter is returned for blocks using filters other than LZMA2.
+	ErrUnsupportedFilter = errors.New("xz: unsupported filter")
+)
+
+const (
+	checkNone   = 0x00
+	checkCRC32  = 0x01
+	checkCRC64  = 0x04
+	checkSHA256 = 0x0A
+
+	filterLZMA2 = 0x21
+)
+
+// filterNames are names of known filters reader does not support.
+var filterNames = map[uint64]string{
+	0x03: "delta",
+	0x04: "BCJ x86",
+	0x05: "BCJ PowerPC",
+	0x06: "BCJ IA-64",
+	0x07: "BCJ ARM",
+	0x08: "BCJ ARM-Thumb",
+	0x09: "BCJ SPARC",
+	0x0A: "BCJ ARM64",
+	0x0B: "BCJ RISC-V",
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// countingReader keeps track of position in compressed input for padding calculations.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// Reader decompresses xz file, which may consist of several concatenated streams.
+type Reader struct {
+	r     *countingReader
+	check byte
+	hash  hash.Hash
+	// current block
+	block      io.Reader
+	blockStart int64
+	blockSize  int64 // uncompressed size of the current block from header, -1 if unknown
+	blockOut   int64
+	// index records collected from blocks to verify stream index
+	records [][2]uint64
+	err     error
+}
+
+// NewReader creates reader for xz data.
+func NewReader(r io.Reader) (*Reader, error) {
+	xr := &Reader{r: &countingReader{r: bufio.NewReader(r)}}
+	if err := xr.streamHeader(); err != nil {
+		return nil, err
+	}
+	return xr, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readVLI reads variable length integer.
+func readVLI(br io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		v |= uint64(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrFormat
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrFormat
+}
+
+func (xr *Reader) streamHeader() error {
+	var hdr [12]byte
+	if _, err := io.ReadFull(xr.r, hdr[:]); err != nil {
+		return unexpected(err)
+	}
+	if !bytes.Equal(hdr[:6], headerMagic) {
+		return ErrFormat
+	}
+	if crc32.ChecksumIEEE(hdr[6:8]) != binary.LittleEndian.Uint32(hdr[8:]) {
+		return fmt.Errorf("%w in stream header", ErrChecksum)
+	}
+	if hdr[6] != 0 || hdr[7] > 0x0F {
+		return fmt.Errorf("xz: unsupported stream flags %#x", hdr[6:8])
+	}
+	xr.check = hdr[7]
+	switch xr.check {
+	case checkNone:
+		xr.hash = nil
+	case checkCRC32:
+		xr.hash = crc32.NewIEEE()
+	case checkCRC64:
+		xr.hash = crc64.New(crc64Table)
+	case checkSHA256:
+		xr.hash = sha256.New()
+	default:
+		return fmt.Errorf("xz: unsupported check type %#x", xr.check)
+	}
+	xr.records = xr.records[:0]
+	return nil
+}
+
+// nextBlock reads block header or, when there are no more blocks, stream index and footer. It returns io.EOF at
+// the end of the last stream.
+func (xr *Reader) nextBlock() error {
+
+	start := xr.r.n
+	size, err := xr.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if size == 0 {
+		if err := xr.streamEnd(); err != nil {
+			return err
+		}
+		return xr.nextStream()
+	}
+
+	hdr := make([]byte, (int(size)+1)*4)
+	hdr[0] = size
+	if _, err := io.ReadFull(xr.r, hdr[1:]); err != nil {
+		return unexpected(err)
+	}
+	n := len(hdr) - 4
+	if crc32.ChecksumIEEE(hdr[:n]) != binary.LittleEndian.Uint32(hdr[n:]) {
+		return fmt.Errorf("%w in block header", ErrChecksum)
+	}
+	flags := hdr[1]
+	if flags&0x3C != 0 {
+		return fmt.Errorf("xz: unsupported block flags %#x", flags)
+	}
+	br := bytes.NewReader(hdr[2:n])
+	if flags&0x40 != 0 {
+		if _, err := readVLI(br); err != nil {
+			return err
+		}
+	}
+	xr.blockSize = -1
+	if flags&0x80 != 0 {
+		v, err := readVLI(br)
+		if err != nil {
+			return err
+		}
+		xr.blockSize = int64(v)
+	}
+	var dictProp byte
+	for i := 0; i <= int(flags&0x03); i++ {
+		id, err := readVLI(br)
+		if err != nil {
+			return err
+		}
+		psize, err := readVLI(br)
+		if err != nil {
+			return err
+		}
+		props := make([]byte, psize)
+		if _, err := io.ReadFull(br, props); err != nil {
+			return ErrFormat
+		}
+		if name, ok := filterNames[id]; ok {
+			return fmt.Errorf("%w %s", ErrUnsupportedFilter, name)
+		}
+		if id != filterLZMA2 || i != int(flags&0x03) || len(props) != 1 {
+			return fmt.Errorf("%w %#x", ErrUnsupportedFilter, id)
+		}
+		dictProp = props[0]
+	}
+	for br.Len() > 0 {
+		if b, _ := br.ReadByte(); b != 0 {
+			return ErrFormat
+		}
+	}
+
+	if xr.block, err = lzma.NewReader2(xr.r, dictProp); err != nil {
+		return err
+	}
+	xr.blockStart, xr.blockOut = start, 0
+	if xr.hash != nil {
+		xr.hash.Reset()
+	}
+	return nil
+}
+
+// endBlock verifies block padding and check.
+func (xr *Reader) endBlock() error {
+
+	if xr.blockSize >= 0 && xr.blockSize != xr.blockOut {
+		return ErrFormat
+	}
+	unpadded := xr.r.n - xr.blockStart
+	for xr.r.n%4 != 0 {
+		if b, err := xr.r.ReadByte(); err != nil {
+			return unexpected(err)
+		} else if b != 0 {
+			return ErrFormat
+		}
+	}
+	if xr.hash != nil {
+		sum := make([]byte, xr.hash.Size())
+		if _, err := io.ReadFull(xr.r, sum); err != nil {
+			return unexpected(err)
+		}
+		unpadded += int64(len(sum))
+		expected := xr.hash.Sum(nil)
+		if xr.check != checkSHA256 {
+			// CRCs are stored little endian
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+		if !bytes.Equal(sum, expected) {
+			return ErrChecksum
+		}
+	}
+	xr.records = append(xr.records, [2]uint64{uint64(unpadded), uint64(xr.blockOut)})
+	xr.block = nil
+	return nil
+}
+
+// streamEnd reads index (indicator is already consumed) and stream footer.
+func (xr *Reader) streamEnd() error {
+
+	start := xr.r.n - 1
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	r := io.TeeReader(xr.r, crc)
+	// index is read byte by byte, so nothing past it gets into checksum
+	one := func() (byte, error) {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, unexpected(err)
+		}
+		return b[0], nil
+	}
+	count, err := readVLI(byteFunc(one))
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(xr.records)) {
+		return fmt.Errorf("xz: index does not match blocks")
+	}
+	for i := uint64(0); i < count; i++ {
+		for j := 0; j < 2; j++ {
+			v, err := readVLI(byteFunc(one))
+			if err != nil {
+				return err
+			}
+			if v != xr.records[i][j] {
+				return fmt.Errorf("xz: index does not match blocks")
+			}
+		}
+	}
+	for (xr.r.n-start)%4 != 0 {
+		if b, err := one(); err != nil {
+			return err
+		} else if b != 0 {
+			return ErrFormat
+		}
+	}
+	indexSize := xr.r.n - start
+	var sum [4]byte
+	if _, err := io.ReadFull(xr.r, sum[:]); err != nil {
+		return unexpected(err)
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(sum[:]) {
+		return fmt.Errorf("%w in index", ErrChecksum)
+	}
+	indexSize += 4
+
+	var footer [12]byte
+	if _, err := io.ReadFull(xr.r, footer[:]); err != nil {
+		return unexpected(err)
+	}
+	if !bytes.Equal(footer[10:], footerMagic) {
+		return ErrFormat
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+		return fmt.Errorf("%w in stream footer", ErrChecksum)
+	}
+	if (int64(binary.LittleEndian.Uint32(footer[4:8]))+1)*4 != indexSize || footer[8] != 0 || footer[9] != xr.check {
+		return ErrFormat
+	}
+	return nil
+}
+
+// nextStream skips stream padding and reads header of the next concatenated stream, if any.
+func (xr *Reader) nextStream() error {
+	for {
+		b, err := xr.r.r.Peek(1)
+		if err == io.EOF || len(b) == 0 {
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] != 0 {
+			break
+		}
+		xr.r.ReadByte()
+	}
+	if xr.r.n%4 != 0 {
+		return ErrFormat
+	}
+	if err := xr.streamHeader(); err != nil {
+		return err
+	}
+	return xr.nextBlock()
+}
+
+type byteFunc func() (byte, error)
+
+func (f byteFunc) ReadByte() (byte, error) {
+	return f()
+}
+
+// Read implements io.Reader.
+func (xr *Reader) Read(p []byte) (int, error) {
+	for xr.err == nil {
+		if xr.block == nil {
+			xr.err = xr.nextBlock()
+			continue
+		}
+		n, err := xr.block.Read(p)
+		if n > 0 {
+			xr.blockOut += int64(n)
+			if xr.hash != nil {
+				xr.hash.Write(p[:n])
+			}
+			return n, nil
+		}
+		switch {
+		case err == io.EOF:
+			xr.err = xr.endBlock()
+		case err != nil:
+			xr.err = err
+		}
+	}
+	return 0, xr.err
+}
@@ -0,0 +1,108 @@
+package xz
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sampleText reproduces content of compressed test files.
+func sampleText(n int) []byte {
+	words := []string{"книга", "глава", "fiction", "book", "текст", "море", "the", "and", "секция", "описание", "автор", "title", "<p>", "</p>", "\n"}
+	var b strings.Builder
+	for x := uint64(1); b.Len() < n; {
+		x = (x*1103515245 + 12345) % (1 << 31)
+		b.WriteString(words[(x>>16)%uint64(len(words))])
+		b.WriteByte(' ')
+	}
+	return []byte(b.String())
+}
+
+func TestReader(t *testing.T) {
+
+	small := sampleText(20000)
+
+	for _, tc := range []struct {
+		file     string
+		expected []byte
+	}{
+		{"text.xz", sampleText(200000)},
+		{"blocks-crc32.xz", small},
+		{"sha256.xz", small},
+		{"none.xz", small},
+		{"concat.xz", append(append([]byte{}, small...), small...)},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open("testdata/" + tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Unable to decompress: %v", err)
+			}
+			if !bytes.Equal(got, tc.expected) {
+				t.Fatalf("Unexpected result, got %d bytes, expected %d", len(got), len(tc.expected))
+			}
+		})
+	}
+}
+
+func TestReaderCorrupted(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/blocks-crc32.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		r, err := NewReader(bytes.NewReader(data[:len(data)-20]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Fatal("Expected error for truncated file")
+		}
+	})
+
+	t.Run("not xz", func(t *testing.T) {
+		if _, err := NewReader(strings.NewReader("plain text is not compressed")); err == nil {
+			t.Fatal("Expected error for wrong format")
+		}
+	})
+}
+
+func TestReaderUnsupportedFilter(t *testing.T) {
+
+	for _, tc := range []struct {
+		file   string
+		filter string
+	}{
+		{"bcj-x86.xz", "BCJ x86"},
+		{"bcj-arm.xz", "BCJ ARM"},
+		{"delta.xz", "delta"},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open("testdata/" + tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := NewReader(f)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if !errors.Is(err, ErrUnsupportedFilter) || !strings.HasSuffix(err.Error(), tc.filter) {
+				t.Fatalf("Expected unsupported filter error for %s, got %v", tc.filter, err)
+			}
+		})
+	}
+}
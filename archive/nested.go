@@ -0,0 +1,200 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inMemorySize is the largest nested archive kept in memory, bigger ones are unpacked to temporary files.
+const inMemorySize = 16 * 1024 * 1024
+
+// Nested controls processing of archives stored inside archives.
+type Nested struct {
+	// Depth is number of levels of nested archives to open, 0 means archives inside archives are treated as
+	// regular files.
+	Depth int
+	// MaxSize is the largest nested archive which will be unpacked, 0 means no limit.
+	MaxSize int64
+	// Failed is called when nested archive could not be read, walking continues after it returns. When Failed is nil
+	// walking stops and error is returned. File which only has name of archive is reported to WalkFunc as regular one.
+	Failed func(archive string, err error)
+}
+
+// stopError carries error returned by WalkFunc through nested walks, so it is never reported as nested archive
+// failure.
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string {
+	return e.err.Error()
+}
+
+// WalkNested is Walk which also looks inside archives stored in archive. Files from nested archives are reported with
+// archive path made of the outer archive path and nested archive name, for example "outer.zip/inner.zip". Pattern
+// could go through nested archives: "inner.zip/dir/" selects files under "dir" in "inner.zip".
+func WalkNested(archive, pattern string, nested Nested, walkFn WalkFunc) error {
+
+	a, err := Open(archive)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	err = walkNested(a, pattern, nested, nested.Depth, func(archive string, file *File) error {
+		if err := walkFn(archive, file); err != nil {
+			return &stopError{err: err}
+		}
+		return nil
+	})
+	var stop *stopError
+	if errors.As(err, &stop) {
+		return stop.err
+	}
+	return err
+}
+
+// nestedPattern checks if file name is selected by pattern and if it is returns pattern to be used inside of it
+// when file is an archive.
+func nestedPattern(name, pattern string) (string, bool) {
+	if strings.HasPrefix(name, pattern) {
+		return "", true
+	}
+	if strings.HasPrefix(pattern, name+"/") {
+		return pattern[len(name)+1:], true
+	}
+	return "", false
+}
+
+func walkNested(a Archive, pattern string, nested Nested, depth int, walkFn WalkFunc) error {
+
+	if depth <= 0 {
+		return a.Walk(pattern, walkFn)
+	}
+
+	// pattern may point inside of nested archive, so everything has to be looked at
+	return a.Walk("", func(archive string, file *File) error {
+
+		inner, ok := nestedPattern(file.Name, pattern)
+		if !ok {
+			return nil
+		}
+		f := formatByName(file.Name)
+		if f == formatUnknown {
+			if !strings.HasPrefix(file.Name, pattern) {
+				return nil
+			}
+			return walkFn(archive, file)
+		}
+
+		path := filepath.Join(archive, filepath.FromSlash(file.Name))
+		na, err := openNested(path, file, f, nested.MaxSize)
+		if errors.Is(err, ErrUnknownFormat) {
+			// only name looks like archive
+			if !strings.HasPrefix(file.Name, pattern) {
+				return nil
+			}
+			return walkFn(archive, file)
+		}
+		if err == nil {
+			err = walkNested(na, inner, nested, depth-1, walkFn)
+			na.Close()
+		}
+		var stop *stopError
+		if err == nil || errors.As(err, &stop) || nested.Failed == nil {
+			return err
+		}
+		nested.Failed(path, err)
+		return nil
+	})
+}
+
+// tempContent is unpacked nested archive, which is removed when archive is closed.
+type tempContent struct {
+	*os.File
+}
+
+func (t tempContent) Close() error {
+	err := t.File.Close()
+	if rerr := os.Remove(t.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// closeContent releases archive content if archive owns it.
+func closeContent(closer io.Closer) error {
+	if closer == nil {
+		return nil
+	}
+	return closer.Close()
+}
+
+// openNested unpacks archive stored in another archive and opens it. Small archives are kept in memory.
+func openNested(path string, file *File, f format, maxSize int64) (Archive, error) {
+
+	if maxSize > 0 && file.Size > maxSize {
+		return nil, fmt.Errorf("nested archive is too large (%d bytes)", file.Size)
+	}
+	limit := maxSize
+	if limit <= 0 {
+		limit = 1<<63 - 2
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var (
+		c      content
+		size   int64
+		closer io.Closer
+	)
+	if file.Size >= 0 && file.Size <= inMemorySize {
+		data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		c, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		tmp, err := os.CreateTemp("", "fb2c-nested-*")
+		if err != nil {
+			return nil, err
+		}
+		t := tempContent{tmp}
+		if size, err = io.Copy(tmp, io.LimitReader(rc, limit+1)); err != nil {
+			t.Close()
+			return nil, err
+		}
+		c, closer = tmp, t
+	}
+	if size > limit {
+		closeContent(closer)
+		return nil, fmt.Errorf("nested archive is larger than %d bytes", limit)
+	}
+
+	header := make([]byte, 512)
+	n, err := c.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		closeContent(closer)
+		return nil, err
+	}
+	if !f.checkMagic(header[:n]) {
+		closeContent(closer)
+		return nil, ErrUnknownFormat
+	}
+
+	a, err := openContent(path, c, size, file.ModTime, f, closer)
+	if err != nil {
+		closeContent(closer)
+		return nil, err
+	}
+	return a, nil
+}
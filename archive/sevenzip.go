@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"io"
+	"strings"
+
+	"fb2converter/archive/internal/sevenzip"
+)
+
+type sevenZipArchive struct {
+	path   string
+	r      *sevenzip.Reader
+	closer io.Closer
+}
+
+func open7z(path string, c content, size int64, closer io.Closer) (Archive, error) {
+	r, err := sevenzip.NewReader(c, size)
+	if err != nil {
+		return nil, err
+	}
+	return &sevenZipArchive{path: path, r: r, closer: closer}, nil
+}
+
+// Walk reads archive sequentially, file content is available only until walkFn returns.
+func (a *sevenZipArchive) Walk(pattern string, walkFn WalkFunc) error {
+	return a.r.Walk(
+		func(f *sevenzip.File) bool {
+			return !f.IsDir && strings.HasPrefix(f.Name, pattern)
+		},
+		func(f *sevenzip.File, r io.Reader) error {
+			file := &File{
+				Name:    f.Name,
+				Size:    int64(f.Size),
+				ModTime: f.ModTime,
+				open:    func() (io.ReadCloser, error) { return io.NopCloser(r), nil },
+			}
+			if f.HasCRC {
+				file.CRC32 = f.CRC32
+			}
+			return walkFn(a.path, file)
+		})
+}
+
+func (a *sevenZipArchive) Close() error {
+	return closeContent(a.closer)
+}
@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"fb2converter/archive/internal/xz"
+)
+
+// decompress returns reader for content of compressed stream.
+func decompress(r io.Reader, f format) (io.Reader, error) {
+	switch f {
+	case formatTarGz, formatGz:
+		return gzip.NewReader(r)
+	case formatTarBz2, formatBz2:
+		return bzip2.NewReader(r), nil
+	case formatTarXz, formatXz:
+		return xz.NewReader(r)
+	}
+	return r, nil
+}
+
+type tarArchive struct {
+	path   string
+	c      content
+	f      format
+	closer io.Closer
+}
+
+// Walk reads tar sequentially, file content is available only until walkFn returns.
+func (a *tarArchive) Walk(pattern string, walkFn WalkFunc) error {
+
+	if _, err := a.c.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := decompress(bufio.NewReader(a.c), a.f)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", a.path, err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", a.path, err)
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !hdr.FileInfo().Mode().IsRegular() || !strings.HasPrefix(name, pattern) {
+			continue
+		}
+		opened := false
+		file := &File{
+			Name:    name,
+			NonUTF8: !utf8.ValidString(name),
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			open: func() (io.ReadCloser, error) {
+				if opened {
+					return nil, errors.New("file in tar archive could be read only once")
+				}
+				opened = true
+				return io.NopCloser(tr), nil
+			},
+		}
+		if err := walkFn(a.path, file); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *tarArchive) Close() error {
+	return closeContent(a.closer)
+}
+
+// singleArchive is a single compressed file, name of which is archive name without compression extension.
+type singleArchive struct {
+	path    string
+	c       content
+	f       format
+	modTime time.Time
+	closer  io.Closer
+}
+
+func (a *singleArchive) Walk(pattern string, walkFn WalkFunc) error {
+
+	name := singleName(a.path)
+	if !strings.HasPrefix(name, pattern) {
+		return nil
+	}
+	file := &File{
+		Name:    name,
+		Size:    -1,
+		ModTime: a.modTime,
+		open: func() (io.ReadCloser, error) {
+			if _, err := a.c.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			r, err := decompress(bufio.NewReader(a.c), a.f)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(r), nil
+		},
+	}
+	return walkFn(a.path, file)
+}
+
+func (a *singleArchive) Close() error {
+	return closeContent(a.closer)
+}
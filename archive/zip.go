@@ -0,0 +1,44 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"strings"
+)
+
+type zipArchive struct {
+	path   string
+	r      *zip.Reader
+	closer io.Closer
+}
+
+func openZip(path string, c content, size int64, closer io.Closer) (Archive, error) {
+	r, err := zip.NewReader(c, size)
+	if err != nil {
+		return nil, err
+	}
+	return &zipArchive{path: path, r: r, closer: closer}, nil
+}
+
+func (a *zipArchive) Walk(pattern string, walkFn WalkFunc) error {
+	for _, f := range a.r.File {
+		if !f.FileInfo().IsDir() && strings.HasPrefix(f.FileHeader.Name, pattern) {
+			file := &File{
+				Name:    f.FileHeader.Name,
+				NonUTF8: f.FileHeader.NonUTF8,
+				Size:    int64(f.UncompressedSize64),
+				ModTime: f.Modified,
+				CRC32:   f.CRC32,
+				open:    func() (io.ReadCloser, error) { return f.Open() },
+			}
+			if err := walkFn(a.path, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *zipArchive) Close() error {
+	return closeContent(a.closer)
+}
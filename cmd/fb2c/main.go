@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/pkg/profile"
 	cli "github.com/urfave/cli/v2"
@@ -207,11 +208,19 @@ func main() {
 			Before: wrap.beforeCommandRun,
 			After:  wrap.afterCommandRun,
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, kepub, azw3, mobi)"},
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, txt, md, html, fb2 - reads EPUB, KEPUB and KF8 Kindle books)"},
 				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "when producing output do not keep input directory structure"},
 				&cli.BoolFlag{Name: "sendtokindle", Aliases: []string{"stk"}, Usage: "send converted file to kindle via e-mail (epub only)"},
 				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "continue even if destination exits, overwrite files"},
+				&cli.BoolFlag{Name: "incremental", Aliases: []string{"inc"}, Usage: "skip books converted earlier if neither book nor configuration changed since"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "number of books to convert concurrently, 0 - one per CPU"},
+				&cli.StringFlag{Name: "summary", Usage: "write result of every book to `FILE` (CSV when FILE has .csv extension, JSON lines otherwise) and print totals"},
+				&cli.StringFlag{Name: "engine", Usage: "`ENGINE` to produce azw3 and mobi (supported engines: auto, kindlegen, native, calibre, command), overrides configuration"},
 				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.StringFlag{Name: "force-cp", Usage: "Force `ENCODING` for fb2 files without BOM instead of detecting it (see IANA.org for character set names), overrides configuration"},
+				&cli.BoolFlag{Name: "reproducible", Usage: "produce byte identical results for the same input and configuration, overrides configuration"},
+				&cli.BoolFlag{Name: "low-memory", Usage: "keep images on disk and write out content as soon as it is ready, for huge books on machines with little memory, overrides configuration"},
+				&cli.StringFlag{Name: "query", Aliases: []string{"q"}, Usage: "select books from INPX collection index with `QUERY` (\"field=value;...\", fields: author, title, series, genre, lang, libid)"},
 			},
 			ArgsUsage: "SOURCE [DESTINATION]",
 			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
@@ -220,12 +229,157 @@ func main() {
         path to a directory: "[path_to_directory]directory" - recursively process all files under directory (symbolic links are not followed)
         path to archive with path inside archive to a particular fb2 file: "[path_to_archive]archive.zip[path_in_archive]/file.fb2"
         path to archive with path inside archive: "[path_to_archive]archive.zip[path_in_archive]" - recursively process all fb2 files under archive path
+        path to INPX collection index: "[path_to_index]collection.inpx" - process books selected by query from archives next to index
 
-    When working on archive recursively only fb2 files will be considered, processing of archives inside archives is not supported.
+    Supported archives are zip, 7z, tar (plain or compressed with gzip, bzip2 or xz) and single fb2 files compressed
+    with gzip, bzip2 or xz ("file.fb2.gz" is treated as archive containing "file.fb2").
+    Terms of the query for the same field are alternatives, book has to match every field mentioned. Text fields are
+    matched by substring, genre by code or its prefix ("sf" selects all sf_* genres). Without query all books in the
+    index are processed. Authors, title, series, genres and language from the index are used as meta information overwrites.
+    When working on archive recursively only fb2 files will be considered. Archives inside archives are processed up to the depth
+    set in configuration (document.nested_archives), path could go through them: "[path_to_archive]outer.zip/inner.zip/file.fb2".
+    When output type is fb2 source is EPUB, KEPUB, AZW3 or MOBI (KF8 only) file or directory with such files, archives are not supported.
 
 DESTINATION:
     always a path, output file name(s) and extension will be derived from other parameters
     if absent - current working directory
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "watch",
+			Usage:  "Watches directory and converts FB2 file(s) dropped there",
+			Action: commands.Watch,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, txt, md, html)"},
+				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "continue even if destination exits, overwrite files"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "number of dropped files to convert concurrently"},
+				&cli.StringFlag{Name: "engine", Usage: "`ENGINE` to produce azw3 and mobi (supported engines: auto, kindlegen, native, calibre, command), overrides configuration"},
+				&cli.StringFlag{Name: "force-cp", Usage: "Force `ENCODING` for fb2 files without BOM instead of detecting it (see IANA.org for character set names), overrides configuration"},
+				&cli.BoolFlag{Name: "reproducible", Usage: "produce byte identical results for the same input and configuration, overrides configuration"},
+				&cli.BoolFlag{Name: "low-memory", Usage: "keep images on disk and write out content as soon as it is ready, for huge books on machines with little memory, overrides configuration"},
+				&cli.StringFlag{Name: "done", Usage: "move successfully converted files to `DIRECTORY`"},
+				&cli.StringFlag{Name: "failed", Usage: "move files which could not be converted to `DIRECTORY`"},
+				&cli.DurationFlag{Name: "settle", Value: 5 * time.Second, Usage: "time dropped file should stay unchanged before conversion starts"},
+			},
+			ArgsUsage: "SOURCE DESTINATION",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to a directory to watch recursively, fb2 files and zip archives already there are processed at start
+
+DESTINATION:
+    always a path, output file name(s) and extension will be derived from other parameters
+
+Runs until interrupted (SIGINT, SIGTERM), conversions in progress are completed before exiting.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "serve",
+			Usage:  "Runs HTTP server converting uploaded FB2 file(s)",
+			Action: commands.Serve,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: ":8080", Usage: "`ADDRESS` to listen on"},
+				&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Value: 1, DefaultText: "1", Usage: "number of books to convert concurrently"},
+				&cli.IntFlag{Name: "queue", Value: 32, DefaultText: "32", Usage: "number of books waiting for conversion, when queue is full requests are rejected"},
+				&cli.Int64Flag{Name: "max-size", Value: 50, DefaultText: "50", Usage: "maximum size of uploaded book in `MB`"},
+				&cli.DurationFlag{Name: "timeout", Value: 5 * time.Minute, Usage: "maximum time single conversion could take"},
+				&cli.DurationFlag{Name: "keep", Value: time.Hour, Usage: "time finished job waits for download before being removed"},
+			},
+			CustomHelpTemplate: fmt.Sprintf(`%s
+API:
+    POST /jobs               multipart form: "book" - fb2 file or zip archive with it, "to" - output type (default epub, md is not supported),
+                             "config" - optional JSON with "document" section overriding configuration values, settings naming
+                             files or programs on the server and image sizes could not be changed, name formats only when
+                             server configuration uses version 1 formats
+                             responds with 503 when too many books are waiting for conversion
+    GET  /jobs/{id}          job status and book information when done
+    GET  /jobs/{id}/result   converted book, job is removed after download
+
+Runs until interrupted (SIGINT, SIGTERM).
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "lint",
+			Usage:  "Checks FB2 file(s) against FictionBook schema rules",
+			Action: commands.Lint,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "strict", Usage: "treat warnings as errors"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to fb2 file, directory or zip archive with fb2 files
+
+Every problem found is written to STDOUT as single JSON object per line with "file", "path" (XPath of offending element),
+"severity" (error or warning) and "message". Exits with non-zero code if any errors were found.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "meta",
+			Usage:  "Reports metadata of FB2 file(s) without conversion",
+			Action: commands.Meta,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "format", Value: "json", Usage: "output `FORMAT` (supported formats: json, csv)"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.StringFlag{Name: "force-cp", Usage: "Force `ENCODING` for fb2 files without BOM instead of detecting it (see IANA.org for character set names), overrides configuration"},
+			},
+			ArgsUsage: "SOURCE",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to fb2 file, directory or zip archive with fb2 files
+
+Only book descriptions are read, so large collections could be scanned quickly. Results are written to STDOUT - single JSON
+object per line or CSV with header. Book source is full path, for books in archives path inside archive is appended.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "catalog",
+			Usage:  "Generates static OPDS catalog for converted FB2 file(s)",
+			Action: commands.Catalog,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` books were converted to (supported types: epub, epub3, kepub, azw3, mobi, txt, html)"},
+				&cli.BoolFlag{Name: "nodirs", Aliases: []string{"nd"}, Usage: "books were converted without keeping input directory structure"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.StringFlag{Name: "force-cp", Usage: "Force `ENCODING` for fb2 files without BOM instead of detecting it (see IANA.org for character set names), overrides configuration"},
+				&cli.StringFlag{Name: "title", Value: "Library", Usage: "catalog `TITLE`"},
+			},
+			ArgsUsage: "SOURCE DESTINATION",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to fb2 files directory or zip archive with fb2 files, which was used for conversion
+
+DESTINATION:
+    path to the converted books, same configuration and parameters should be used as during conversion
+
+Catalog is written to "opds" directory under DESTINATION (start with opds/index.xml), links to books and covers are relative,
+so DESTINATION could be published by any web server as is.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "unpack",
+			Usage:  "Extracts EPUB and metadata from Kindle book (KF8 only)",
+			Action: commands.Unpack,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "overwrite", Aliases: []string{"ow"}, Usage: "overwrite existing files"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    path to azw3 book or combo mobi book with KF8 part, DRM protected books are not supported
+DESTINATION:
+    always a path, output files will be named after the book
+    if absent - current working directory
+
+Produces EPUB with restored documents, stylesheets, images, fonts and table of contents and JSON file with EXTH records.
 `, cli.CommandHelpTemplate),
 		},
 		{
@@ -0,0 +1,180 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// cacheName is name of the file in destination directory where conversion cache is kept.
+const cacheName = ".fb2c-cache.json"
+
+// cacheSaveInterval is how often cache is saved while books are converted, so interrupted run does not lose everything.
+const cacheSaveInterval = 30 * time.Second
+
+// fingerprint identifies particular state of the source book. Books in archives are identified by CRC32, regular files
+// by modification time.
+type fingerprint struct {
+	source  string
+	size    int64
+	modTime time.Time
+	crc32   uint32
+}
+
+type cacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime,omitzero"`
+	CRC32   uint32    `json:"crc32,omitempty"`
+	Config  string    `json:"config"`
+	Output  string    `json:"output"`
+}
+
+// bookCache remembers books converted earlier, so unchanged books could be skipped. Cached result is valid as long as
+// source book, configuration and output format are the same and produced file still exists.
+type bookCache struct {
+	mu       sync.Mutex
+	fname    string
+	format   processor.OutputFmt
+	digest   string
+	entries  map[string]*cacheEntry
+	changed  bool
+	saved    time.Time
+	interval time.Duration
+}
+
+func newBookCache(dst string, format processor.OutputFmt, env *state.LocalEnv) (*bookCache, error) {
+
+	data, err := env.Cfg.GetActualBytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get actual configuration: %w", err)
+	}
+	sum := sha256.Sum256(data)
+
+	c := &bookCache{
+		fname:    filepath.Join(dst, cacheName),
+		format:   format,
+		digest:   hex.EncodeToString(sum[:]),
+		entries:  make(map[string]*cacheEntry),
+		saved:    time.Now(),
+		interval: cacheSaveInterval,
+	}
+
+	data, err = os.ReadFile(c.fname)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return c, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read conversion cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		env.Log.Warn("Conversion cache is corrupted, starting anew", zap.String("file", c.fname), zap.Error(err))
+		c.entries = make(map[string]*cacheEntry)
+	}
+	return c, nil
+}
+
+func (c *bookCache) key(fp *fingerprint) string {
+	return c.format.String() + ":" + filepath.ToSlash(fp.source)
+}
+
+// fresh checks if book was already converted with the same configuration and result is still in place.
+func (c *bookCache) fresh(fp *fingerprint) bool {
+
+	if c == nil || fp == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[c.key(fp)]
+	c.mu.Unlock()
+
+	if !ok || e.Size != fp.size || !e.ModTime.Equal(fp.modTime) || e.CRC32 != fp.crc32 || e.Config != c.digest {
+		return false
+	}
+	_, err := os.Stat(e.Output)
+	return err == nil
+}
+
+// owns checks if book was converted before into the same output file, so its result could be replaced.
+func (c *bookCache) owns(fp *fingerprint, output string) bool {
+
+	if c == nil || fp == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[c.key(fp)]
+	return ok && filepath.Clean(e.Output) == filepath.Clean(output)
+}
+
+// store remembers conversion result, cache is saved from time to time.
+func (c *bookCache) store(fp *fingerprint, output string) error {
+
+	if c == nil || fp == nil || len(output) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.entries[c.key(fp)] = &cacheEntry{
+		Size:    fp.size,
+		ModTime: fp.modTime,
+		CRC32:   fp.crc32,
+		Config:  c.digest,
+		Output:  output,
+	}
+	c.changed = true
+	due := time.Since(c.saved) >= c.interval
+	c.mu.Unlock()
+
+	if due {
+		return c.save()
+	}
+	return nil
+}
+
+// save writes cache to destination directory if anything was converted.
+func (c *bookCache) save() error {
+
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.changed {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to prepare conversion cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.fname), 0700); err != nil {
+		return fmt.Errorf("unable to create conversion cache directory: %w", err)
+	}
+	// replace atomically, so interrupted run would not destroy previous state
+	tmp := c.fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write conversion cache: %w", err)
+	}
+	if err := os.Rename(tmp, c.fname); err != nil {
+		return fmt.Errorf("unable to write conversion cache: %w", err)
+	}
+	c.changed, c.saved = false, time.Now()
+	return nil
+}
@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestBookCache(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	dst := t.TempDir()
+	out := filepath.Join(dst, "book.epub")
+	if err := os.WriteFile(out, []byte("epub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := &fingerprint{source: "/books/book.fb2", size: 10, modTime: time.Date(2020, 1, 2, 3, 4, 5, 6, time.Local)}
+	inZip := &fingerprint{source: "/books/books.zip/book.fb2", size: 10, crc32: 0xdeadbeef}
+
+	c, err := newBookCache(dst, processor.OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.fresh(file) || c.owns(file, out) {
+		t.Fatal("Empty cache knows the book")
+	}
+	if err := c.store(file, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store(inZip, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = newBookCache(dst, processor.OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.fresh(file) || !c.fresh(inZip) {
+		t.Fatal("Unchanged books should be skipped")
+	}
+	if c.fresh(&fingerprint{source: file.source, size: file.size, modTime: file.modTime.Add(time.Second)}) {
+		t.Fatal("Modified book should be converted")
+	}
+	if c.fresh(&fingerprint{source: inZip.source, size: inZip.size, crc32: 1}) {
+		t.Fatal("Modified book in archive should be converted")
+	}
+	if !c.owns(&fingerprint{source: file.source}, out) {
+		t.Fatal("Modified book should be allowed to replace its result")
+	}
+	if c.owns(&fingerprint{source: file.source}, filepath.Join(dst, "other.epub")) {
+		t.Fatal("Book should not be allowed to replace file it did not produce")
+	}
+
+	// other format
+	other, err := newBookCache(dst, processor.OAzw3, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.fresh(file) || other.owns(file, out) {
+		t.Fatal("Cache should depend on output format")
+	}
+
+	// other configuration
+	env.Cfg.Doc.ChapterPerFile = !env.Cfg.Doc.ChapterPerFile
+	changed, err := newBookCache(dst, processor.OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.fresh(file) {
+		t.Fatal("Cache should depend on configuration")
+	}
+
+	// result removed
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+	if c.fresh(file) {
+		t.Fatal("Book without result should be converted")
+	}
+}
+
+func TestBookCacheSavedPeriodically(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	dst := t.TempDir()
+	c, err := newBookCache(dst, processor.OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fingerprint{source: "/books/book.fb2", size: 10}
+
+	if err := c.store(fp, filepath.Join(dst, "book.epub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, cacheName)); err == nil {
+		t.Fatal("Cache should not be saved after every book")
+	}
+
+	c.interval = 0
+	if err := c.store(fp, filepath.Join(dst, "book.epub")); err != nil {
+		t.Fatal(err)
+	}
+	// run is interrupted, wait is never called
+	if _, err := os.Stat(filepath.Join(dst, cacheName)); err != nil {
+		t.Fatalf("Cache should be saved while books are converted: %v", err)
+	}
+}
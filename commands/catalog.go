@@ -0,0 +1,450 @@
+package commands
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gosimple/slug"
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"fb2converter/etree"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Catalog is "catalog" command body. It produces static OPDS catalog for converted library.
+func Catalog(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "catalog: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no destination has been specified"), errCode)
+	}
+	if dst, err = filepath.Abs(dst); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line, too many destinations", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	format := processor.ParseFmtString(ctx.String("to"))
+	if format == processor.UnsupportedOutputFmt || format == processor.OFb2 || format == processor.OMd {
+		env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
+		format = processor.OEpub
+	}
+
+	var cpage encoding.Encoding
+	if cp := ctx.String("force-cp"); len(cp) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.SourceCharset = cp
+	}
+	if page := ctx.String("force-zip-cp"); len(page) > 0 {
+		if cpage, err = ianaindex.IANA.Encoding(page); err != nil {
+			env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
+			cpage = nil
+		}
+	}
+
+	// books are not converted, there is no need to look for kindlegen
+	env.Cfg.Doc.Kindlegen.Engine = processor.EngineNative.String()
+
+	env.Log.Info("Cataloging starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
+	defer func(start time.Time) {
+		env.Log.Info("Cataloging completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	c := newCatalog(ctx.String("title"), dst, format, ctx.Bool("nodirs"), env)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sinput source was not found: %w", errPrefix, err), errCode)
+	}
+	if fi.IsDir() {
+		err = processDir(src, cpage, c, env)
+	} else if ok, aerr := isArchiveFile(src); aerr != nil {
+		err = aerr
+	} else if ok {
+		err = processArchive(src, "", "", cpage, c, env)
+	} else {
+		err = errors.New("source must be directory or archive")
+	}
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+	}
+
+	if err := c.write(); err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	return nil
+}
+
+// Catalog layout and OPDS specifics.
+const (
+	catalogDir    = "opds"
+	catalogCovers = "covers"
+
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+
+	thumbWidth  = 200
+	thumbHeight = 300
+)
+
+// catalogBook is converted book as catalog sees it. Paths are relative to destination directory.
+type catalogBook struct {
+	id         string
+	title      string
+	lang       string
+	date       string
+	annotation string
+	authors    []string
+	genres     []string
+	series     string
+	seqNum     int
+	file       string
+	cover      string
+	thumbnail  string
+	updated    time.Time
+}
+
+// catalog collects books found in source and generates static OPDS 1.2 feeds for them.
+type catalog struct {
+	title   string
+	dst     string
+	format  processor.OutputFmt
+	nodirs  bool
+	env     *state.LocalEnv
+	books   []*catalogBook
+	updated time.Time
+}
+
+func newCatalog(title, dst string, format processor.OutputFmt, nodirs bool, env *state.LocalEnv) *catalog {
+	if len(title) == 0 {
+		title = "Library"
+	}
+	return &catalog{
+		title:   title,
+		dst:     dst,
+		format:  format,
+		nodirs:  nodirs,
+		env:     env,
+		updated: time.Now(),
+	}
+}
+
+// reject implements bookSink, books which could not be read are not cataloged.
+func (c *catalog) reject(string, error) {}
+
+// convert implements bookSink, it reads book description and finds result of its conversion.
+func (c *catalog) convert(r io.Reader, enc processor.SrcEncoding, src string, _ *fingerprint, fail func(err error)) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.env.Log.Debug("Parsing ended with panic", zap.String("from", src), zap.ByteString("stack", debug.Stack()))
+			fail(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	p, err := processor.NewFB2(processor.SelectReader(r, enc), enc == processor.EncUnknown, src, c.dst, c.nodirs, false, false, c.format, c.env)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer p.Clean()
+
+	cover, err := p.Describe()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	fname := p.OutputName()
+	fi, err := os.Stat(fname)
+	if err != nil {
+		c.env.Log.Warn("Book was not converted, skipping", zap.String("from", src), zap.String("to", fname))
+		return
+	}
+	rel, err := filepath.Rel(c.dst, fname)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	b := &catalogBook{
+		id:         "urn:uuid:" + p.Book.ID.String(),
+		title:      p.Book.Title,
+		lang:       p.Book.Lang.String(),
+		date:       p.Book.Date,
+		annotation: p.Book.Annotation,
+		genres:     p.Book.Genres,
+		series:     p.Book.SeqName,
+		seqNum:     p.Book.SeqNum,
+		file:       filepath.ToSlash(rel),
+		updated:    fi.ModTime(),
+	}
+	for _, a := range p.Book.Authors {
+		b.authors = append(b.authors, a.String())
+	}
+	if len(cover) > 0 {
+		if err := c.storeCover(b, p.Book.ID.String(), cover); err != nil {
+			c.env.Log.Warn("Unable to store cover image", zap.String("from", src), zap.Error(err))
+		}
+	}
+	c.books = append(c.books, b)
+	c.env.Log.Debug("Book cataloged", zap.String("from", src), zap.String("to", fname))
+}
+
+// storeCover saves cover image and its thumbnail as JPEGs.
+func (c *catalog) storeCover(b *catalogBook, id string, data []byte) error {
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(c.dst, catalogDir, catalogCovers)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	cover := path.Join(catalogDir, catalogCovers, id+".jpg")
+	if err := imaging.Save(img, filepath.Join(c.dst, cover), imaging.JPEGQuality(75)); err != nil {
+		return err
+	}
+	thumbnail := path.Join(catalogDir, catalogCovers, id+"-thumb.jpg")
+	if err := imaging.Save(imaging.Fit(img, thumbWidth, thumbHeight, imaging.Lanczos), filepath.Join(c.dst, thumbnail), imaging.JPEGQuality(75)); err != nil {
+		return err
+	}
+	b.cover, b.thumbnail = cover, thumbnail
+	return nil
+}
+
+// catalogGroup is set of books sharing author, series or genre.
+type catalogGroup struct {
+	name  string
+	file  string
+	books []*catalogBook
+}
+
+// group arranges books by keys, groups are sorted by name and get unique file names under dir.
+func group(books []*catalogBook, dir string, keys func(b *catalogBook) []string) []*catalogGroup {
+
+	index := make(map[string]*catalogGroup)
+	for _, b := range books {
+		for _, k := range keys(b) {
+			if len(k) == 0 {
+				continue
+			}
+			g, ok := index[k]
+			if !ok {
+				g = &catalogGroup{name: k}
+				index[k] = g
+			}
+			g.books = append(g.books, b)
+		}
+	}
+
+	groups := make([]*catalogGroup, 0, len(index))
+	for _, g := range index {
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b *catalogGroup) int { return strings.Compare(a.name, b.name) })
+
+	used := make(map[string]bool)
+	for _, g := range groups {
+		name := slug.Make(g.name)
+		if len(name) == 0 {
+			name = "unnamed"
+		}
+		for i, base := 1, name; used[name]; i++ {
+			name = base + "-" + strconv.Itoa(i)
+		}
+		used[name] = true
+		g.file = path.Join(dir, name+".xml")
+	}
+	return groups
+}
+
+// write replaces catalog in destination directory.
+func (c *catalog) write() error {
+
+	slices.SortStableFunc(c.books, func(a, b *catalogBook) int { return strings.Compare(a.title, b.title) })
+
+	authors := group(c.books, "authors", func(b *catalogBook) []string { return b.authors })
+	series := group(c.books, "series", func(b *catalogBook) []string { return []string{b.series} })
+	genres := group(c.books, "genres", func(b *catalogBook) []string { return b.genres })
+	for _, g := range series {
+		slices.SortStableFunc(g.books, func(a, b *catalogBook) int { return cmp.Compare(a.seqNum, b.seqNum) })
+	}
+
+	// covers were already stored, everything else is regenerated
+	for _, dir := range []string{"authors", "series", "genres"} {
+		if err := os.RemoveAll(filepath.Join(c.dst, catalogDir, dir)); err != nil {
+			return fmt.Errorf("unable to remove old catalog: %w", err)
+		}
+	}
+
+	feed, root := c.newFeed("index.xml", c.title, opdsNavigation)
+	c.navEntry(root, "index.xml", "authors.xml", "By author", fmt.Sprintf("%d authors", len(authors)), opdsNavigation)
+	c.navEntry(root, "index.xml", "series.xml", "By series", fmt.Sprintf("%d series", len(series)), opdsNavigation)
+	c.navEntry(root, "index.xml", "genres.xml", "By genre", fmt.Sprintf("%d genres", len(genres)), opdsNavigation)
+	c.navEntry(root, "index.xml", "books.xml", "All books", fmt.Sprintf("%d books", len(c.books)), opdsAcquisition)
+	if err := c.writeFeed("index.xml", feed); err != nil {
+		return err
+	}
+
+	feed, root = c.newFeed("books.xml", "All books", opdsAcquisition)
+	for _, b := range c.books {
+		c.bookEntry(root, "books.xml", b)
+	}
+	if err := c.writeFeed("books.xml", feed); err != nil {
+		return err
+	}
+
+	for _, nav := range []struct {
+		file, title string
+		groups      []*catalogGroup
+	}{
+		{"authors.xml", "By author", authors},
+		{"series.xml", "By series", series},
+		{"genres.xml", "By genre", genres},
+	} {
+		feed, root = c.newFeed(nav.file, nav.title, opdsNavigation)
+		for _, g := range nav.groups {
+			c.navEntry(root, nav.file, g.file, g.name, fmt.Sprintf("%d books", len(g.books)), opdsAcquisition)
+
+			gfeed, groot := c.newFeed(g.file, g.name, opdsAcquisition)
+			groot.AddNext("link", etree.NewAttr("rel", "up"), etree.NewAttr("href", c.href(g.file, path.Join(catalogDir, nav.file))), etree.NewAttr("type", opdsNavigation))
+			for _, b := range g.books {
+				c.bookEntry(groot, g.file, b)
+			}
+			if err := c.writeFeed(g.file, gfeed); err != nil {
+				return err
+			}
+		}
+		if err := c.writeFeed(nav.file, feed); err != nil {
+			return err
+		}
+	}
+
+	c.env.Log.Info("Catalog written",
+		zap.String("index", filepath.Join(c.dst, catalogDir, "index.xml")),
+		zap.Int("books", len(c.books)),
+		zap.Int("authors", len(authors)),
+		zap.Int("series", len(series)),
+		zap.Int("genres", len(genres)))
+	return nil
+}
+
+// href returns link from feed (relative to catalog directory) to target (relative to destination directory).
+func (c *catalog) href(feed, target string) string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.Join(catalogDir, feed)), filepath.FromSlash(target))
+	if err != nil {
+		rel = target
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).String()
+}
+
+func (c *catalog) newFeed(file, title, kind string) (*etree.Document, *etree.Element) {
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+
+	root := doc.Element.AddNext("feed",
+		etree.NewAttr("xmlns", "http://www.w3.org/2005/Atom"),
+		etree.NewAttr("xmlns:dc", "http://purl.org/dc/terms/"),
+		etree.NewAttr("xmlns:opds", "http://opds-spec.org/2010/catalog"),
+	)
+	root.AddNext("id").SetText("urn:fb2c:" + strings.TrimSuffix(file, ".xml"))
+	root.AddNext("title").SetText(title)
+	root.AddNext("updated").SetText(c.updated.UTC().Format(time.RFC3339))
+	root.AddNext("author").AddNext("name").SetText("fb2converter")
+	root.AddNext("link", etree.NewAttr("rel", "self"), etree.NewAttr("href", c.href(file, path.Join(catalogDir, file))), etree.NewAttr("type", kind))
+	root.AddNext("link", etree.NewAttr("rel", "start"), etree.NewAttr("href", c.href(file, path.Join(catalogDir, "index.xml"))), etree.NewAttr("type", opdsNavigation))
+	return doc, root
+}
+
+func (c *catalog) navEntry(root *etree.Element, feed, target, title, content, kind string) {
+	entry := root.AddNext("entry")
+	entry.AddNext("title").SetText(title)
+	entry.AddNext("id").SetText("urn:fb2c:" + strings.TrimSuffix(target, ".xml"))
+	entry.AddNext("updated").SetText(c.updated.UTC().Format(time.RFC3339))
+	entry.AddNext("content", etree.NewAttr("type", "text")).SetText(content)
+	entry.AddNext("link", etree.NewAttr("rel", "subsection"), etree.NewAttr("href", c.href(feed, path.Join(catalogDir, target))), etree.NewAttr("type", kind))
+}
+
+func (c *catalog) bookEntry(root *etree.Element, feed string, b *catalogBook) {
+
+	entry := root.AddNext("entry")
+	entry.AddNext("title").SetText(b.title)
+	entry.AddNext("id").SetText(b.id)
+	entry.AddNext("updated").SetText(b.updated.UTC().Format(time.RFC3339))
+	for _, a := range b.authors {
+		entry.AddNext("author").AddNext("name").SetText(a)
+	}
+	entry.AddNext("dc:language").SetText(b.lang)
+	if len(b.date) > 0 {
+		entry.AddNext("dc:issued").SetText(b.date)
+	}
+	for _, g := range b.genres {
+		entry.AddNext("category", etree.NewAttr("term", g), etree.NewAttr("label", g))
+	}
+	if len(b.annotation) > 0 {
+		entry.AddNext("summary", etree.NewAttr("type", "text")).SetText(b.annotation)
+	}
+	if len(b.series) > 0 {
+		series := b.series
+		if b.seqNum > 0 {
+			series += " #" + strconv.Itoa(b.seqNum)
+		}
+		entry.AddNext("content", etree.NewAttr("type", "text")).SetText(series)
+	}
+	if len(b.cover) > 0 {
+		entry.AddNext("link", etree.NewAttr("rel", "http://opds-spec.org/image"), etree.NewAttr("href", c.href(feed, b.cover)), etree.NewAttr("type", "image/jpeg"))
+		entry.AddNext("link", etree.NewAttr("rel", "http://opds-spec.org/image/thumbnail"), etree.NewAttr("href", c.href(feed, b.thumbnail)), etree.NewAttr("type", "image/jpeg"))
+	}
+	entry.AddNext("link", etree.NewAttr("rel", "http://opds-spec.org/acquisition"), etree.NewAttr("href", c.href(feed, b.file)), etree.NewAttr("type", contentType(c.format)))
+}
+
+func (c *catalog) writeFeed(file string, doc *etree.Document) error {
+	fname := filepath.Join(c.dst, catalogDir, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return fmt.Errorf("unable to create catalog directory: %w", err)
+	}
+	doc.Indent(2)
+	if err := doc.WriteToFile(fname); err != nil {
+		return fmt.Errorf("unable to write catalog feed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestCatalog(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "sample.fb2"), []byte(serveBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// book which was never converted
+	if err := os.WriteFile(filepath.Join(src, "other.fb2"), []byte(strings.Replace(serveBook, "Sample Book", "Other Book", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// conversion result
+	if err := os.MkdirAll(filepath.Join(dst, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "sub", "sample.epub"), []byte("epub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCatalog("Test", dst, processor.OEpub, false, env)
+	if err := processDir(src, nil, c, env); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.books) != 1 {
+		t.Fatalf("Unexpected number of books cataloged: %d", len(c.books))
+	}
+	if err := c.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"index.xml", "books.xml", "authors.xml", "series.xml", "genres.xml", "genres/sf.xml"} {
+		if _, err := os.Stat(filepath.Join(dst, catalogDir, name)); err != nil {
+			t.Fatalf("Feed was not written: %v", err)
+		}
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(filepath.Join(dst, catalogDir, "authors", "john-sample.xml")); err != nil {
+		t.Fatal(err)
+	}
+	entries := doc.FindElements("./feed/entry")
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected number of entries: %d", len(entries))
+	}
+	if title := entries[0].SelectElement("title").Text(); title != "Sample Book" {
+		t.Fatalf("Unexpected title: %s", title)
+	}
+	link := entries[0].FindElement("./link[@rel='http://opds-spec.org/acquisition']")
+	if link == nil || link.SelectAttrValue("href", "") != "../../sub/sample.epub" || link.SelectAttrValue("type", "") != "application/epub+zip" {
+		t.Fatal("Unexpected acquisition link")
+	}
+}
+
+func TestCatalogBookWithoutID(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := t.TempDir(), t.TempDir()
+	book := strings.Replace(serveBook, "<document-info><id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id></document-info>", "", 1)
+	if err := os.WriteFile(filepath.Join(src, "sample.fb2"), []byte(book), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, lowMemory := range []bool{false, false, true} {
+		cfg.Doc.LowMemory = lowMemory
+		env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+		// catalog entry has the same id as converted book
+		books := newBookPool(1, processor.OEpub, true, false, true, dst, nil, nil, env)
+		if err := processDir(src, nil, books, env); err != nil {
+			t.Fatal(err)
+		}
+		books.wait()
+		ids = append(ids, epubIdentifier(t, filepath.Join(dst, "sample.epub")))
+
+		c := newCatalog("Test", dst, processor.OEpub, false, env)
+		if err := processDir(src, nil, c, env); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.books) != 1 {
+			t.Fatalf("Unexpected number of books cataloged: %d", len(c.books))
+		}
+		ids = append(ids, c.books[0].id)
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("Book id changes between runs or differs from catalog: %q", ids)
+		}
+	}
+}
+
+// epubIdentifier returns book identifier from EPUB package.
+func epubIdentifier(t *testing.T, fname string) string {
+
+	t.Helper()
+
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	rc, err := zr.Open("OEBPS/content.opf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(rc); err != nil {
+		t.Fatal(err)
+	}
+	e := doc.FindElement("//dc:identifier[@id='BookId']")
+	if e == nil {
+		t.Fatal("Book has no identifier")
+	}
+	return e.Text()
+}
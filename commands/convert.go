@@ -2,13 +2,14 @@
 package commands
 
 import (
-	"archive/zip"
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strings"
 	"time"
@@ -20,6 +21,7 @@ import (
 
 	"fb2converter/archive"
 	"fb2converter/config"
+	"fb2converter/inpx"
 	"fb2converter/processor"
 	"fb2converter/state"
 )
@@ -27,43 +29,59 @@ import (
 // processBook processes single FB2 file. "src" is part of the source path (always including file name) relative to the original
 // path. When actual file was specified it will be just base file name without a path. When looking inside archive or directory
 // it will be relative path inside archive or directory (including base file name).
-func processBook(r io.Reader, enc srcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) error {
+// When "claim" is not nil it is called with output file name before anything is written, it reports if existing file
+// could be replaced even without "overwrite". Panic during conversion is reported as error wrapping errPanic.
+func processBook(r io.Reader, enc processor.SrcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv, claim func(fname string) (bool, error)) (res bookResult, err error) {
 
-	var fname, id string
+	env, warnings := countWarnings(env)
 
 	env.Log.Info("Conversion starting", zap.String("from", src))
 	defer func(start time.Time) {
+		res.elapsed = time.Since(start)
 		if r := recover(); r != nil {
-			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.ByteString("stack", debug.Stack()))
+			env.Log.Error("Conversion ended with panic", zap.Any("panic", r), zap.Duration("elapsed", res.elapsed), zap.String("to", res.fname), zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("%w: %v", errPanic, r)
 		} else {
-			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.String("ref_id", id))
+			env.Log.Info("Conversion completed", zap.Duration("elapsed", res.elapsed), zap.String("to", res.fname), zap.String("ref_id", res.id))
 		}
+		res.warnings = int(warnings.count.Load())
 	}(time.Now())
 
-	p, err := processor.NewFB2(selectReader(r, enc), enc == encUnknown, src, dst, nodirs, stk, overwrite, format, env)
+	p, err := processor.NewFB2(processor.SelectReader(r, enc), enc == processor.EncUnknown, src, dst, nodirs, stk, overwrite, format, env)
 	if err != nil {
-		return err
+		return res, err
 	}
-	id = p.Book.ID.String() // store for reference in the log
+	res.id = p.Book.ID.String() // store for reference in the log
 
 	if err = p.Process(); err != nil {
-		return err
+		return res, err
 	}
-	if fname, err = p.Save(); err != nil {
-		return err
+	if claim != nil {
+		replace, err := claim(p.OutputName())
+		if err != nil {
+			return res, err
+		}
+		if replace {
+			p.AllowOverwrite()
+		}
 	}
+	fname, err := p.Save()
+	if err != nil {
+		return res, err
+	}
+	res.fname = fname
 
 	// store convertion result
-	env.Rpt.Store(fmt.Sprintf("fb2c-%s/%s", id, filepath.Base(fname)), fname)
+	env.Rpt.Store(fmt.Sprintf("fb2c-%s/%s", res.id, filepath.Base(res.fname)), res.fname)
 
-	if err = p.SendToKindle(fname); err != nil {
-		return err
+	if err = p.SendToKindle(res.fname); err != nil {
+		return res, err
 	}
-	return p.Clean()
+	return res, p.Clean()
 }
 
 // processDir walks directory tree finding fb2 files and processes them.
-func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+func processDir(dir string, cpage encoding.Encoding, books bookSink, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -76,12 +94,12 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 		if err != nil {
 			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
 		} else if info.Mode().IsRegular() {
-			var enc srcEncoding
+			var enc processor.SrcEncoding
 			if ok, err := isArchiveFile(path); err != nil {
 				// checking format - but cannot open target file
 				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
 			} else if ok {
-				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), cpage, books, env); err != nil {
 					env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
 				}
 			} else if ok, enc, err = isBookFile(path); err != nil {
@@ -91,14 +109,13 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 				// encoding will be handled properly by processBook
 				if file, err := os.Open(path); err != nil {
 					env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+					books.reject(path, err)
 				} else {
 					defer file.Close()
-					if err := processBook(file, enc,
-						strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), dst,
-						nodirs, stk, overwrite, format, env); err != nil {
-
+					fp := &fingerprint{source: path, size: info.Size(), modTime: info.ModTime()}
+					books.convert(file, enc, strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), fp, func(err error) {
 						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
-					}
+					})
 				}
 			} else {
 				env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
@@ -110,7 +127,13 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 }
 
 // processArchive walks all files inside archive, finds fb2 files under "pathIn" and processes them.
-func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+func processArchive(path, pathIn, pathOut string, cpage encoding.Encoding, books bookSink, env *state.LocalEnv) error {
+	return processArchiveSelected(path, pathIn, pathOut, cpage, nil, books, env)
+}
+
+// processArchiveSelected is processArchive which only looks at files accepted by "selected" (when it is not nil),
+// other files are never unpacked.
+func processArchiveSelected(path, pathIn, pathOut string, cpage encoding.Encoding, selected func(name string) bool, books bookSink, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -119,47 +142,81 @@ func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, no
 		}
 	}()
 
-	err = archive.Walk(path, pathIn, func(archive string, f *zip.File) error {
-		if ok, enc, err := isBookInArchive(f); err != nil {
+	nested := archive.Nested{
+		Depth:   env.Cfg.Doc.NestedArchives.Depth,
+		MaxSize: int64(env.Cfg.Doc.NestedArchives.MaxSize) * 1024 * 1024,
+		Failed: func(arc string, err error) {
+			env.Log.Error("Unable to process nested archive", zap.String("archive", arc), zap.Error(err))
+			books.reject(arc, err)
+		},
+	}
+	err = archive.WalkNested(path, pathIn, nested, func(arc string, f *archive.File) error {
+		if !strings.EqualFold(filepath.Ext(f.Name), ".fb2") {
+			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", arc), zap.String("file", f.Name))
+			return nil
+		}
+		if selected != nil && !selected(f.Name) {
+			return nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			env.Log.Error("Unable to process file in archive",
+				zap.String("archive", arc),
+				zap.String("file", f.Name),
+				zap.Error(err))
+			books.reject(filepath.Join(arc, f.Name), err)
+			return nil
+		}
+		defer rc.Close()
+
+		r := bufio.NewReader(rc)
+		if ok, enc, err := isBookInArchive(f.Name, r); err != nil {
 			env.Log.Warn("Skipping file in archive",
-				zap.String("archive", archive),
-				zap.String("path", f.FileHeader.Name),
+				zap.String("archive", arc),
+				zap.String("path", f.Name),
 				zap.Error(err))
+			books.reject(filepath.Join(arc, f.Name), err)
 		} else if ok {
 			count++
 			// encoding will be handled properly by processBook
-			if r, err := f.Open(); err != nil {
-				env.Log.Error("Unable to process file in archive",
-					zap.String("archive", archive),
-					zap.String("file", f.FileHeader.Name),
-					zap.Error(err))
-			} else {
-				defer r.Close()
-				apath := f.FileHeader.Name
-				if cpage != nil && f.FileHeader.NonUTF8 {
-					// forcing zip file name encoding
-					if n, err := cpage.NewDecoder().String(apath); err == nil {
-						apath = n
-					} else {
-						n, _ = ianaindex.IANA.Name(cpage)
-						env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
-					}
-				}
-				if err := processBook(r, enc, filepath.Join(pathOut, apath), dst, nodirs, stk, overwrite, format, env); err != nil {
-					env.Log.Error("Unable to process file in archive",
-						zap.String("archive", archive),
-						zap.String("file", f.FileHeader.Name),
-						zap.Error(err))
+			apath := f.Name
+			if cpage != nil && f.NonUTF8 {
+				// forcing archive file name encoding
+				if n, err := cpage.NewDecoder().String(apath); err == nil {
+					apath = n
+				} else {
+					n, _ = ianaindex.IANA.Name(cpage)
+					env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
 				}
 			}
+			fp := &fingerprint{source: filepath.Join(arc, f.Name), size: f.Size, crc32: f.CRC32}
+			if f.CRC32 == 0 {
+				// without checksum content changes could only be noticed by time
+				fp.modTime = f.ModTime
+			}
+			// books from nested archives keep location of nested archive inside outer one
+			dir := pathOut
+			if arc != path {
+				dir = filepath.Join(pathOut, filepath.Dir(strings.TrimPrefix(strings.TrimPrefix(arc, path), string(filepath.Separator))))
+			}
+			books.convert(r, enc, filepath.Join(dir, apath), fp, func(err error) {
+				env.Log.Error("Unable to process file in archive",
+					zap.String("archive", arc),
+					zap.String("file", f.Name),
+					zap.Error(err))
+			})
 		} else {
-			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.FileHeader.Name))
+			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", arc), zap.String("file", f.Name))
+			books.reject(filepath.Join(arc, f.Name), errNotBook)
 		}
 		return nil
 	})
 	return err
 }
 
+// errNotBook is reported for archive members named as FB2 which content is something else.
+var errNotBook = errors.New("not recognized as FB2 book")
+
 // Convert is "convert" command body.
 func Convert(ctx *cli.Context) (err error) {
 
@@ -197,13 +254,13 @@ func Convert(ctx *cli.Context) (err error) {
 	switch env.Mhl {
 	case config.MhlMobi:
 		format = processor.ParseFmtString(env.Cfg.Fb2Mobi.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OEpub || format == processor.OKepub {
+		if format != processor.OMobi && format != processor.OAzw3 {
 			env.Log.Warn("Unknown output format in MHL mode requested, switching to mobi", zap.String("format", env.Cfg.Fb2Mobi.OutputFormat))
 			format = processor.OMobi
 		}
 	case config.MhlEpub:
 		format = processor.ParseFmtString(env.Cfg.Fb2Epub.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OMobi || format == processor.OAzw3 {
+		if format != processor.OEpub && format != processor.OKepub && format != processor.OEpub3 {
 			env.Log.Warn("Unknown output format in MHL mode requested, switching to epub", zap.String("format", env.Cfg.Fb2Epub.OutputFormat))
 			format = processor.OEpub
 		}
@@ -247,11 +304,80 @@ func Convert(ctx *cli.Context) (err error) {
 		env.Cfg.Doc.Cover.Convert = true
 	}
 
+	if cp := ctx.String("force-cp"); len(cp) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.SourceCharset = cp
+	}
+	if ctx.Bool("reproducible") {
+		// command line overrides configuration
+		env.Cfg.Doc.Reproducible = true
+	}
+	if ctx.Bool("low-memory") {
+		// command line overrides configuration
+		env.Cfg.Doc.LowMemory = true
+	}
+	if engine := ctx.String("engine"); len(engine) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.Kindlegen.Engine = engine
+	}
+
+	query, err := inpx.ParseQuery(ctx.String("query"))
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sbad query: %w", errPrefix, err), errCode)
+	}
+	if len(query) > 0 && !isIndexFile(src) {
+		env.Log.Warn("Query could only be used with INPX collection index, ignoring", zap.String("query", ctx.String("query")))
+	}
+
+	jobs := ctx.Int("jobs")
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	var summary *runSummary
+	if fname := ctx.String("summary"); len(fname) > 0 {
+		if summary, err = newRunSummary(fname, format, env); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+	}
+
 	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
 	defer func(start time.Time) {
 		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
+		if summary == nil {
+			return
+		}
+		if err := summary.close(); err != nil {
+			env.Log.Error("Unable to write summary", zap.Error(err))
+		}
+		fmt.Fprintf(ctx.App.Writer, "Total %s\n", summary.total())
 	}(time.Now())
 
+	if format == processor.OFb2 {
+		// reverse conversion reads EPUB books
+		if err := reverseSource(src, dst, nodirs, overwrite, summary, env); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+		return nil
+	}
+
+	var cache *bookCache
+	if ctx.Bool("incremental") {
+		if cache, err = newBookCache(dst, format, env); err != nil {
+			return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+		}
+	}
+
+	books := newBookPool(jobs, format, nodirs, stk, overwrite, dst, cache, summary, env)
+	defer books.wait()
+
+	if isIndexFile(src) {
+		if err := processIndex(src, query, cpage, books, env); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to process collection index: %w", errPrefix, err), errCode)
+		}
+		return nil
+	}
+
 	var head, tail string
 	for head = src; len(head) != 0; head, tail = filepath.Split(head) {
 
@@ -268,7 +394,7 @@ func Convert(ctx *cli.Context) (err error) {
 				// directory cannot have tail - it would be simple file
 				return cli.Exit(fmt.Errorf("%sinput source was not found (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
 			}
-			if err := processDir(head, format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+			if err := processDir(head, cpage, books, env); err != nil {
 				return cli.Exit(fmt.Errorf("%sunable to process directory", errPrefix), errCode)
 			}
 			break
@@ -284,14 +410,14 @@ func Convert(ctx *cli.Context) (err error) {
 
 			if ok {
 				// we need to look inside to see if path makes sense
-				tail = strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator))
-				if err := processArchive(head, tail, "", format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				tail = filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator)))
+				if err := processArchive(head, tail, "", cpage, books, env); err != nil {
 					return cli.Exit(fmt.Errorf("%sunable to process archive: %w", errPrefix, err), errCode)
 				}
 				break
 			}
 
-			var enc srcEncoding
+			var enc processor.SrcEncoding
 			ok, enc, err = isBookFile(head)
 			if err != nil {
 				// checking format - but cannot open target file
@@ -306,9 +432,10 @@ func Convert(ctx *cli.Context) (err error) {
 					env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
 				} else {
 					defer file.Close()
-					if err := processBook(file, enc, filepath.Base(head), dst, nodirs, stk, overwrite, format, env); err != nil {
+					fp := &fingerprint{source: head, size: fi.Size(), modTime: fi.ModTime()}
+					books.convert(file, enc, filepath.Base(head), fp, func(err error) {
 						env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
-					}
+					})
 				}
 				break
 			}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+
+	"fb2converter/config"
+	"fb2converter/inpx"
+	"fb2converter/state"
+)
+
+// isIndexFile detects if file is INPX collection index.
+func isIndexFile(fname string) bool {
+	return strings.EqualFold(filepath.Ext(fname), ".inpx")
+}
+
+// indexMeta converts index record to meta information overwrite. Values already set in "meta" (generic overwrite from
+// configuration) take precedence.
+func indexMeta(b *inpx.Book, meta config.MetaInfo) config.MetaInfo {
+	if len(meta.Title) == 0 {
+		meta.Title = b.Title
+	}
+	if len(meta.Lang) == 0 {
+		meta.Lang = b.Lang
+	}
+	if len(meta.Genres) == 0 {
+		meta.Genres = b.Genres
+	}
+	if len(meta.SeqName) == 0 {
+		meta.SeqName, meta.SeqNum = b.Series, b.SeqNum
+	}
+	if len(meta.Authors) == 0 {
+		for _, a := range b.Authors {
+			meta.Authors = append(meta.Authors, &config.AuthorName{First: a.First, Middle: a.Middle, Last: a.Last})
+		}
+	}
+	return meta
+}
+
+// indexSourceDir returns directory books from index archive are attributed to, as it is done for archives found in
+// directories.
+func indexSourceDir(archive string) string {
+	return filepath.Dir(filepath.FromSlash(archive))
+}
+
+// processIndex selects books from INPX collection index using query and processes them. Archives with books are
+// expected to be in the same directory as index, only archives with selected books are opened. Index information
+// is used as meta information overwrites unless configuration already has overwrites for the book, generic overwrite
+// from configuration is merged with index information.
+func processIndex(path string, query inpx.Query, cpage encoding.Encoding, books bookSink, env *state.LocalEnv) error {
+
+	c, err := inpx.Open(path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		archives []string
+		count    int
+	)
+	selected := make(map[string]map[string]bool)
+	indexed := make(map[string]bool)
+	for _, b := range c.Books {
+		if !query.Match(b) {
+			continue
+		}
+		names, ok := selected[b.Archive]
+		if !ok {
+			names = make(map[string]bool)
+			selected[b.Archive] = names
+			archives = append(archives, b.Archive)
+		}
+		names[b.Name()] = true
+		count++
+
+		if env.Cfg.Overwrites == nil {
+			env.Cfg.Overwrites = make(map[string]config.MetaInfo)
+		}
+		// the same way book source is seen when overwrite is looked up
+		key := filepath.ToSlash(filepath.Join(indexSourceDir(b.Archive), b.Name()))
+		switch _, exists := env.Cfg.Overwrites[key]; {
+		case indexed[key]:
+			env.Log.Warn("Book is listed in collection index more than once, using first record", zap.String("book", key))
+		case !exists:
+			env.Cfg.Overwrites[key] = indexMeta(b, env.Cfg.Overwrites["*"])
+			indexed[key] = true
+		}
+	}
+
+	env.Log.Info("Collection index loaded",
+		zap.String("name", c.Name),
+		zap.Int("books", len(c.Books)),
+		zap.Int("selected", count),
+	)
+	if count == 0 {
+		env.Log.Warn("No books in collection index match query", zap.String("index", path))
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	for _, name := range archives {
+		arc := filepath.Join(dir, filepath.FromSlash(name))
+		if _, err := os.Stat(arc); err != nil {
+			env.Log.Error("Unable to process archive from collection index", zap.String("archive", arc), zap.Error(err))
+			continue
+		}
+		names := selected[name]
+		if err := processArchiveSelected(arc, "", indexSourceDir(name), cpage, func(name string) bool { return names[name] }, books, env); err != nil {
+			env.Log.Error("Unable to process archive", zap.String("file", arc), zap.Error(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/inpx"
+	"fb2converter/state"
+)
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessIndex(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// generic overwrite is merged with index information
+	cfg.Overwrites = map[string]config.MetaInfo{"*": {Publisher: "Index House"}}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	src := t.TempDir()
+	writeZip(t, filepath.Join(src, "lib-000001.zip"), map[string]string{
+		"10.fb2": serveBook,
+		"11.fb2": serveBook,
+	})
+	if err := os.Mkdir(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(src, "sub", "lib-000003.zip"), map[string]string{
+		"13.fb2": serveBook,
+	})
+	rec := func(fields ...string) string { return strings.Join(fields, "\x04") + "\r\n" }
+	writeZip(t, filepath.Join(src, "lib.inpx"), map[string]string{
+		"collection.info": "Test library\r\n",
+		"structure.info":  "AUTHOR;GENRE;TITLE;SERIES;SERNO;FILE;SIZE;LIBID;DEL;EXT;DATE;LANG;LIBRATE;KEYWORDS;FOLDER;",
+		"lib-000001.inp": rec("Толстой,Лев,Николаевич:", "prose_classic:", "Война и мир", "Эпопеи", "2", "10", "100", "10", "0", "fb2", "2009-01-01", "ru") +
+			rec("Sample,John,:", "sf:", "Sample Book", "", "", "11", "100", "11", "0", "fb2", "2009-01-01", "en") +
+			rec("Missing,Archive,:", "sf:", "Lost", "", "", "12", "100", "12", "0", "fb2", "2009-01-01", "ru", "", "", "lib-000002.zip") +
+			rec("Пушкин,Александр,Сергеевич:", "poetry:", "Евгений Онегин", "", "", "13", "100", "13", "0", "fb2", "2009-01-01", "ru", "", "", "sub/lib-000003.zip"),
+	})
+
+	query, err := inpx.ParseQuery("lang=ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := &bookMeta{env: env, json: json.NewEncoder(&out)}
+	if err := processIndex(filepath.Join(src, "lib.inpx"), query, nil, m, env); err != nil {
+		t.Fatal(err)
+	}
+	if m.books != 2 || m.failed != 0 {
+		t.Fatalf("Unexpected results: books %d, failed %d", m.books, m.failed)
+	}
+
+	dec := json.NewDecoder(&out)
+	var r metaRecord
+	if err := dec.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Source != filepath.Join(src, "lib-000001.zip", "10.fb2") || r.Title != "Война и мир" || len(r.Authors) != 1 || r.Authors[0] != "Лев Николаевич Толстой" ||
+		r.Series != "Эпопеи" || r.SeriesNumber != 2 || r.Lang != "ru" || len(r.Genres) != 1 || r.Genres[0] != "prose_classic" || r.Publisher != "Index House" {
+		t.Fatalf("Unexpected record: %+v", r)
+	}
+	if err := dec.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Source != filepath.Join(src, "sub", "lib-000003.zip", "13.fb2") || r.Title != "Евгений Онегин" || r.Publisher != "Index House" {
+		t.Fatalf("Unexpected record from archive in subdirectory: %+v", r)
+	}
+	if _, ok := cfg.Overwrites["sub/13.fb2"]; !ok {
+		t.Fatalf("Unexpected overwrites: %v", slices.Collect(maps.Keys(cfg.Overwrites)))
+	}
+}
@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Lint is "lint" command body. It checks books against FictionBook schema rules and reports problems as JSON lines.
+func Lint(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "lint: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	var cpage encoding.Encoding
+	if page := ctx.String("force-zip-cp"); len(page) > 0 {
+		if cpage, err = ianaindex.IANA.Encoding(page); err != nil {
+			env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
+			cpage = nil
+		}
+	}
+
+	out := json.NewEncoder(ctx.App.Writer)
+	out.SetEscapeHTML(false)
+	l := &bookLinter{out: out, env: env}
+
+	env.Log.Info("Linting starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Linting completed", zap.Duration("elapsed", time.Since(start)), zap.Int("books", l.books), zap.Int("errors", l.errors), zap.Int("warnings", l.warnings))
+	}(time.Now())
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sinput source was not found: %w", errPrefix, err), errCode)
+	}
+	if fi.IsDir() {
+		err = processDir(src, cpage, l, env)
+	} else if ok, aerr := isArchiveFile(src); aerr != nil {
+		err = aerr
+	} else if ok {
+		err = processArchive(src, "", "", cpage, l, env)
+	} else {
+		err = lintFile(src, l, env)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+	}
+
+	if l.errors > 0 || (ctx.Bool("strict") && l.warnings > 0) {
+		return cli.Exit(fmt.Errorf("%sfound %d error(s) and %d warning(s)", errPrefix, l.errors, l.warnings), errCode)
+	}
+	return nil
+}
+
+func lintFile(path string, l *bookLinter, env *state.LocalEnv) error {
+
+	ok, enc, err := isBookFile(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not recognized as book or archive")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	l.convert(file, enc, filepath.Base(path), &fingerprint{source: path}, func(err error) {
+		env.Log.Error("Unable to lint file", zap.String("file", path), zap.Error(err))
+	})
+	return nil
+}
+
+// lintRecord is single line of lint output.
+type lintRecord struct {
+	File string `json:"file"`
+	processor.Finding
+}
+
+// bookLinter checks books found in directories and archives.
+type bookLinter struct {
+	out      *json.Encoder
+	env      *state.LocalEnv
+	books    int
+	errors   int
+	warnings int
+}
+
+// reject implements bookSink.
+func (l *bookLinter) reject(source string, err error) {
+	l.books++
+	l.errors++
+	if err := l.out.Encode(&lintRecord{File: source, Finding: processor.Finding{Path: "/", Severity: processor.SeverityError, Message: err.Error()}}); err != nil {
+		l.env.Log.Error("Unable to write lint results", zap.Error(err))
+	}
+}
+
+// convert implements bookSink.
+func (l *bookLinter) convert(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, fail func(err error)) {
+
+	l.books++
+	if fp != nil {
+		src = fp.source
+	}
+
+	findings, err := processor.Lint(processor.SelectReader(r, enc), enc == processor.EncUnknown)
+	if err != nil {
+		l.errors++
+		fail(err)
+		return
+	}
+	for _, f := range findings {
+		switch f.Severity {
+		case processor.SeverityError:
+			l.errors++
+		case processor.SeverityWarning:
+			l.warnings++
+		}
+		if err := l.out.Encode(&lintRecord{File: src, Finding: f}); err != nil {
+			l.env.Log.Error("Unable to write lint results", zap.Error(err))
+		}
+	}
+}
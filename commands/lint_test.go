@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/state"
+)
+
+func TestBookLinter(t *testing.T) {
+
+	env := &state.LocalEnv{Log: zap.NewNop()}
+
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "good.fb2"), []byte(serveBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := strings.Replace(serveBook, "<genre>sf</genre>", "", 1)
+	if err := os.WriteFile(filepath.Join(src, "bad.fb2"), []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	l := &bookLinter{out: json.NewEncoder(&out), env: env}
+	if err := processDir(src, nil, l, env); err != nil {
+		t.Fatal(err)
+	}
+	if l.books != 2 || l.errors != 1 {
+		t.Fatalf("Unexpected results: books %d, errors %d, warnings %d", l.books, l.errors, l.warnings)
+	}
+
+	var rec lintRecord
+	if err := json.NewDecoder(&out).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.File != filepath.Join(src, "bad.fb2") || rec.Path != "/FictionBook/description[1]/title-info[1]" || rec.Message != "title-info has no genre" {
+		t.Fatalf("Unexpected record: %+v", rec)
+	}
+}
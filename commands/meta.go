@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Meta is "meta" command body. It reports metadata of the books without converting them.
+func Meta(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "meta: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+	if ctx.Args().Len() > 1 {
+		env.Log.Warn("Mailformed command line", zap.Strings("ignoring", ctx.Args().Slice()[1:]))
+	}
+
+	var cpage encoding.Encoding
+	if cp := ctx.String("force-cp"); len(cp) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.SourceCharset = cp
+	}
+	if page := ctx.String("force-zip-cp"); len(page) > 0 {
+		if cpage, err = ianaindex.IANA.Encoding(page); err != nil {
+			env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
+			cpage = nil
+		}
+	}
+
+	m := &bookMeta{env: env}
+	switch f := ctx.String("format"); f {
+	case "json":
+		m.json = json.NewEncoder(ctx.App.Writer)
+		m.json.SetEscapeHTML(false)
+	case "csv":
+		m.csv = csv.NewWriter(ctx.App.Writer)
+		if err := m.csv.Write(metaHeader); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to write results: %w", errPrefix, err), errCode)
+		}
+	default:
+		return cli.Exit(fmt.Errorf("%sunsupported output format %s", errPrefix, f), errCode)
+	}
+
+	env.Log.Info("Scanning starting", zap.String("source", src))
+	defer func(start time.Time) {
+		env.Log.Info("Scanning completed", zap.Duration("elapsed", time.Since(start)), zap.Int("books", m.books), zap.Int("failed", m.failed))
+	}(time.Now())
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sinput source was not found: %w", errPrefix, err), errCode)
+	}
+	if fi.IsDir() {
+		err = processDir(src, cpage, m, env)
+	} else if ok, aerr := isArchiveFile(src); aerr != nil {
+		err = aerr
+	} else if ok {
+		err = processArchive(src, "", "", cpage, m, env)
+	} else {
+		err = metaFile(src, m, env)
+	}
+	if m.csv != nil {
+		m.csv.Flush()
+		if ferr := m.csv.Error(); err == nil && ferr != nil {
+			err = ferr
+		}
+	}
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+	}
+	if m.failed > 0 {
+		return cli.Exit(fmt.Errorf("%sunable to read %d book(s)", errPrefix, m.failed), errCode)
+	}
+	return nil
+}
+
+func metaFile(path string, m *bookMeta, env *state.LocalEnv) error {
+
+	ok, enc, err := isBookFile(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not recognized as book or archive")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	m.convert(file, enc, filepath.Base(path), &fingerprint{source: path}, func(err error) {
+		env.Log.Error("Unable to read book metadata", zap.String("file", path), zap.Error(err))
+	})
+	return nil
+}
+
+// metaRecord is book metadata as reported by "meta" command.
+type metaRecord struct {
+	Source       string   `json:"source"`
+	ID           string   `json:"id,omitempty"`
+	Title        string   `json:"title"`
+	Authors      []string `json:"authors,omitempty"`
+	Series       string   `json:"series,omitempty"`
+	SeriesNumber int      `json:"series_number,omitempty"`
+	Lang         string   `json:"language"`
+	Genres       []string `json:"genres,omitempty"`
+	Date         string   `json:"date,omitempty"`
+	Annotation   string   `json:"annotation,omitempty"`
+	ISBN         string   `json:"isbn,omitempty"`
+	Publisher    string   `json:"publisher,omitempty"`
+	Year         string   `json:"year,omitempty"`
+	Cover        bool     `json:"cover"`
+}
+
+var metaHeader = []string{"source", "id", "title", "authors", "series", "series_number", "language", "genres", "date", "annotation", "isbn", "publisher", "year", "cover"}
+
+func (r *metaRecord) csv() []string {
+	var num string
+	if r.SeriesNumber > 0 {
+		num = strconv.Itoa(r.SeriesNumber)
+	}
+	return []string{
+		r.Source, r.ID, r.Title, strings.Join(r.Authors, "; "), r.Series, num, r.Lang, strings.Join(r.Genres, "; "),
+		r.Date, r.Annotation, r.ISBN, r.Publisher, r.Year, strconv.FormatBool(r.Cover),
+	}
+}
+
+// bookMeta reads descriptions of the books found in directories and archives.
+type bookMeta struct {
+	env    *state.LocalEnv
+	json   *json.Encoder
+	csv    *csv.Writer
+	books  int
+	failed int
+}
+
+// reject implements bookSink.
+func (m *bookMeta) reject(string, error) {
+	m.failed++
+}
+
+// convert implements bookSink.
+func (m *bookMeta) convert(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, fail func(err error)) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.env.Log.Debug("Parsing ended with panic", zap.String("from", src), zap.ByteString("stack", debug.Stack()))
+			m.failed++
+			fail(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	book, err := processor.ReadDescription(processor.SelectReader(r, enc), enc == processor.EncUnknown, src, m.env)
+	if err != nil {
+		m.failed++
+		fail(err)
+		return
+	}
+	m.books++
+
+	rec := &metaRecord{
+		Source:       src,
+		Title:        book.Title,
+		Series:       book.SeqName,
+		SeriesNumber: book.SeqNum,
+		Lang:         book.Lang.String(),
+		Genres:       book.Genres,
+		Date:         book.Date,
+		Annotation:   book.Annotation,
+		ISBN:         book.ISBN,
+		Publisher:    book.Publisher,
+		Year:         book.PublishYear,
+		Cover:        len(book.Cover) > 0,
+	}
+	if fp != nil {
+		rec.Source = fp.source
+	}
+	if book.ID != uuid.Nil {
+		rec.ID = book.ID.String()
+	}
+	for _, a := range book.Authors {
+		rec.Authors = append(rec.Authors, a.String())
+	}
+
+	if m.json != nil {
+		err = m.json.Encode(rec)
+	} else {
+		err = m.csv.Write(rec.csv())
+	}
+	if err != nil {
+		m.env.Log.Error("Unable to write results", zap.Error(err))
+	}
+}
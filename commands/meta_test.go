@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+func TestBookMeta(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	book := strings.Replace(serveBook, "</title-info>",
+		`</title-info><publish-info><publisher>Sample House</publisher><year>2002</year><isbn>978-3-16-148410-0</isbn></publish-info>`, 1)
+
+	src := t.TempDir()
+	arc := filepath.Join(src, "books.zip")
+	f, err := os.Create(arc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("inner/book.fb2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(book)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var out bytes.Buffer
+	m := &bookMeta{env: env, json: json.NewEncoder(&out)}
+	if err := processArchive(arc, "", "", nil, m, env); err != nil {
+		t.Fatal(err)
+	}
+	if m.books != 1 || m.failed != 0 {
+		t.Fatalf("Unexpected results: books %d, failed %d", m.books, m.failed)
+	}
+
+	var rec metaRecord
+	if err := json.NewDecoder(&out).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Source != filepath.Join(arc, "inner/book.fb2") || rec.ID != "5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11" || rec.Title != "Sample Book" ||
+		len(rec.Authors) != 1 || rec.Authors[0] != "John Sample" || rec.Lang != "en" ||
+		rec.ISBN != "978-3-16-148410-0" || rec.Publisher != "Sample House" || rec.Year != "2002" || rec.Cover {
+		t.Fatalf("Unexpected record: %+v", rec)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "book.fb2"), []byte(serveBook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	m = &bookMeta{env: env, csv: csv.NewWriter(&out)}
+	if err := metaFile(filepath.Join(src, "book.fb2"), m, env); err != nil {
+		t.Fatal(err)
+	}
+	m.csv.Flush()
+
+	row, err := csv.NewReader(&out).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != len(metaHeader) || row[0] != filepath.Join(src, "book.fb2") || row[2] != "Sample Book" || row[7] != "sf" || row[13] != "false" {
+		t.Fatalf("Unexpected row: %q", row)
+	}
+}
+
+func TestBookMetaNested(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	src := t.TempDir()
+	writeZip(t, filepath.Join(src, "inner.zip"), map[string]string{"book.fb2": serveBook})
+	inner, err := os.ReadFile(filepath.Join(src, "inner.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arc := filepath.Join(src, "outer.zip")
+	writeZip(t, arc, map[string]string{"sub/inner.zip": string(inner), "other.fb2": serveBook})
+
+	var out bytes.Buffer
+	m := &bookMeta{env: env, json: json.NewEncoder(&out)}
+	if err := processArchive(arc, "sub/inner.zip/book.fb2", "", nil, m, env); err != nil {
+		t.Fatal(err)
+	}
+	if m.books != 1 || m.failed != 0 {
+		t.Fatalf("Unexpected results: books %d, failed %d", m.books, m.failed)
+	}
+	var rec metaRecord
+	if err := json.NewDecoder(&out).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Source != filepath.Join(arc, "sub", "inner.zip", "book.fb2") || rec.Title != "Sample Book" {
+		t.Fatalf("Unexpected record: %+v", rec)
+	}
+
+	// nested archives are regular files when disabled
+	env.Cfg.Doc.NestedArchives.Depth = 0
+	m = &bookMeta{env: env, json: json.NewEncoder(&out)}
+	if err := processArchive(arc, "", "", nil, m, env); err != nil {
+		t.Fatal(err)
+	}
+	if m.books != 1 {
+		t.Fatalf("Unexpected results: books %d", m.books)
+	}
+}
@@ -0,0 +1,324 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// bookSink receives books found in directories and archives.
+type bookSink interface {
+	convert(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, fail func(err error))
+	// reject accounts for book (or nested archive) which could not be read, "source" is its full path.
+	reject(source string, err error)
+}
+
+// bookJob is single book waiting for conversion.
+type bookJob struct {
+	seq   int // order in which book was found
+	data  []byte
+	spool string // low memory mode - book is kept in temporary file instead
+	enc   processor.SrcEncoding
+	src   string
+	fp    *fingerprint
+	fail  func(err error)
+}
+
+// bookPool converts books found in directories and archives. With single job books are converted immediately, in the
+// order they were found. Otherwise books are read in memory (or in temporary files in low memory mode) and handed to
+// the bounded number of workers.
+type bookPool struct {
+	format    processor.OutputFmt
+	nodirs    bool
+	stk       bool
+	overwrite bool
+	dst       string
+	env       *state.LocalEnv
+	cache     *bookCache
+	summary   *runSummary
+	failed    atomic.Int64 // number of books which could not be converted
+	// concurrent mode only
+	jobs  chan *bookJob
+	wg    sync.WaitGroup
+	names *outputNames
+	seq   int
+}
+
+func newBookPool(workers int, format processor.OutputFmt, nodirs, stk, overwrite bool, dst string, cache *bookCache, summary *runSummary, env *state.LocalEnv) *bookPool {
+
+	bp := &bookPool{
+		format:    format,
+		nodirs:    nodirs,
+		stk:       stk,
+		overwrite: overwrite,
+		dst:       dst,
+		env:       env,
+		cache:     cache,
+		summary:   summary,
+	}
+	if workers <= 1 {
+		return bp
+	}
+
+	env.Log.Debug("Converting books concurrently", zap.Int("jobs", workers))
+
+	bp.jobs = make(chan *bookJob)
+	bp.names = newOutputNames()
+	for range workers {
+		bp.wg.Add(1)
+		go bp.worker()
+	}
+	return bp
+}
+
+// convert processes single book, "fail" is called when conversion could not be completed. When "fp" is not nil and
+// book with the same fingerprint was converted before, conversion is skipped.
+func (bp *bookPool) convert(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, fail func(err error)) {
+
+	report := fail
+	fail = func(err error) {
+		bp.failed.Add(1)
+		report(err)
+	}
+
+	if bp.cache.fresh(fp) {
+		bp.env.Log.Debug("Skipping unchanged book", zap.String("source", fp.source))
+		bp.summary.skipped(fp.source)
+		return
+	}
+
+	if bp.jobs == nil {
+		if err := bp.process(r, enc, src, fp, nil); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	// source may not be available after we return (archives), so keep the whole book
+	job := &bookJob{enc: enc, src: src, fp: fp, fail: fail}
+	var err error
+	if bp.env.Cfg.Doc.LowMemory {
+		job.spool, err = spoolBook(r)
+	} else {
+		job.data, err = io.ReadAll(r)
+	}
+	if err != nil {
+		err = fmt.Errorf("unable to read book: %w", err)
+		bp.summary.record(bookSource(src, fp), bookResult{}, err)
+		fail(err)
+		return
+	}
+	job.seq = bp.seq
+	bp.seq++
+	bp.jobs <- job
+}
+
+// spoolBook stores book in temporary file and returns its name.
+func spoolBook(r io.Reader) (string, error) {
+
+	f, err := os.CreateTemp("", "fb2c-book-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// reject implements bookSink.
+func (bp *bookPool) reject(source string, err error) {
+	bp.failed.Add(1)
+	bp.summary.record(source, bookResult{}, err)
+}
+
+// wait blocks until all submitted books are converted.
+func (bp *bookPool) wait() {
+	if bp.jobs != nil {
+		close(bp.jobs)
+		bp.wg.Wait()
+	}
+	if err := bp.cache.save(); err != nil {
+		bp.env.Log.Error("Unable to save conversion cache", zap.Error(err))
+	}
+}
+
+// process converts book remembering result in cache and reporting it in summary.
+func (bp *bookPool) process(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, claim func(fname string) (bool, error)) error {
+	res, fname, err := bp.transform(r, enc, src, fp, claim)
+	bp.complete(src, fp, res, fname, err)
+	return err
+}
+
+// transform converts book, "claim" (may be nil) is called with output name before book is saved and tells whether
+// existing file may be replaced. Books converted before are allowed to replace their own results.
+func (bp *bookPool) transform(r io.Reader, enc processor.SrcEncoding, src string, fp *fingerprint, claim func(fname string) (bool, error)) (bookResult, string, error) {
+
+	var fname string
+	res, err := processBook(r, enc, src, bp.dst, bp.nodirs, bp.stk, bp.overwrite, bp.format, bp.env, func(name string) (bool, error) {
+		fname = name
+		replace := false
+		if claim != nil {
+			var err error
+			if replace, err = claim(name); err != nil {
+				return false, err
+			}
+		}
+		return replace || bp.cache.owns(fp, name), nil
+	})
+	return res, fname, err
+}
+
+// complete remembers successful conversion in cache and reports result in summary.
+func (bp *bookPool) complete(src string, fp *fingerprint, res bookResult, fname string, err error) {
+	if err == nil {
+		if err := bp.cache.store(fp, fname); err != nil {
+			bp.env.Log.Warn("Unable to save conversion cache", zap.Error(err))
+		}
+	}
+	bp.summary.record(bookSource(src, fp), res, err)
+}
+
+// bookSource returns full path of the book when it is known.
+func bookSource(src string, fp *fingerprint) string {
+	if fp != nil {
+		return fp.source
+	}
+	return src
+}
+
+func (bp *bookPool) worker() {
+
+	defer bp.wg.Done()
+
+	for job := range bp.jobs {
+		res, fname, err := bp.run(job)
+		// book found later may still lose its output name to this one, so result is settled in order books were found
+		bp.names.finish(job.seq, err == nil, func(lost error) {
+			if lost != nil {
+				res.fname, err = "", lost
+			}
+			bp.complete(job.src, job.fp, res, fname, err)
+			if err != nil {
+				job.fail(err)
+			}
+		})
+	}
+}
+
+// run converts book taken by worker.
+func (bp *bookPool) run(job *bookJob) (bookResult, string, error) {
+
+	claim := func(fname string) (bool, error) {
+		return bp.names.claim(job.seq, fname, job.src)
+	}
+	if len(job.spool) == 0 {
+		return bp.transform(bytes.NewReader(job.data), job.enc, job.src, job.fp, claim)
+	}
+
+	defer os.Remove(job.spool)
+	f, err := os.Open(job.spool)
+	if err != nil {
+		return bookResult{}, "", fmt.Errorf("unable to read book: %w", err)
+	}
+	defer f.Close()
+	return bp.transform(f, job.enc, job.src, job.fp, claim)
+}
+
+// outputNames resolves output name collisions in the order books were found rather than in the order workers finish:
+// book with the lowest sequence number wins, others fail. Workers are not held by slower books - book found later may
+// save its output first and lose it when earlier book claims the same name, so results are settled in sequence order.
+type outputNames struct {
+	mu      sync.Mutex
+	idle    *sync.Cond // signalled when book is done with its output name
+	names   map[string]*nameClaim
+	holding map[int]string      // output names of books still being saved
+	lost    map[int]error       // books which lost their output names to books found earlier
+	settle  map[int]func(error) // finished books waiting for books found earlier
+	next    int                 // lowest sequence number of book not finished yet
+}
+
+// nameClaim is the book currently owning output name.
+type nameClaim struct {
+	seq   int
+	src   string
+	busy  bool // book is being saved
+	saved bool // output file was produced by the book
+}
+
+func newOutputNames() *outputNames {
+	o := &outputNames{
+		names:   make(map[string]*nameClaim),
+		holding: make(map[int]string),
+		lost:    make(map[int]error),
+		settle:  make(map[int]func(error)),
+	}
+	o.idle = sync.NewCond(&o.mu)
+	return o
+}
+
+// claim registers output name for the book with sequence number "seq" and tells whether book may replace existing
+// output file, which happens when it takes the name from the book found later. Only books claiming the same name wait
+// for each other while one of them is being saved.
+func (o *outputNames) claim(seq int, fname, src string) (bool, error) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := filepath.Clean(fname)
+	for c := o.names[key]; c != nil && c.busy; c = o.names[key] {
+		o.idle.Wait()
+	}
+
+	replace := false
+	if c := o.names[key]; c != nil {
+		if c.seq < seq {
+			return false, fmt.Errorf("output name collision, %s is already produced from %s", fname, c.src)
+		}
+		o.lost[c.seq] = fmt.Errorf("output name collision, %s is already produced from %s", fname, src)
+		replace = c.saved
+	}
+	o.names[key] = &nameClaim{seq: seq, src: src, busy: true}
+	o.holding[seq] = key
+	return replace, nil
+}
+
+// finish releases output name of the book, "saved" tells whether output was produced. "settle" is called with error
+// when book lost its name, as soon as all books found earlier are finished. It may run on other worker and must not
+// use outputNames.
+func (o *outputNames) finish(seq int, saved bool, settle func(lost error)) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.holding[seq]; ok {
+		delete(o.holding, seq)
+		if c := o.names[key]; c.seq == seq {
+			c.busy, c.saved = false, saved
+		}
+		o.idle.Broadcast()
+	}
+	o.settle[seq] = settle
+
+	// results are settled under lock to keep them in order
+	for fn, ok := o.settle[o.next]; ok; fn, ok = o.settle[o.next] {
+		fn(o.lost[o.next])
+		delete(o.settle, o.next)
+		delete(o.lost, o.next)
+		o.next++
+	}
+}
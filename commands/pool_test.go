@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestOutputNamesOrder(t *testing.T) {
+
+	o := newOutputNames()
+	results := make(map[int]error)
+	var order []int
+	settle := func(seq int) func(error) {
+		return func(lost error) {
+			results[seq] = lost
+			order = append(order, seq)
+		}
+	}
+
+	// book found later finishes first
+	if _, err := o.claim(1, "book.epub", "second.fb2"); err != nil {
+		t.Fatalf("Unexpected collision: %v", err)
+	}
+	o.finish(1, true, settle(1))
+	if len(order) != 0 {
+		t.Fatal("Result was settled before book found earlier was finished")
+	}
+
+	// book without output
+	o.finish(2, false, settle(2))
+
+	// earlier book takes the name replacing output of the later one
+	replace, err := o.claim(0, "./book.epub", "first.fb2")
+	if err != nil {
+		t.Fatalf("Book found first should win, got %v", err)
+	}
+	if !replace {
+		t.Fatal("Book found first should replace output of the later one")
+	}
+	o.finish(0, true, settle(0))
+
+	if _, err := o.claim(3, "book.epub", "fourth.fb2"); err == nil {
+		t.Fatal("Collision was not detected")
+	}
+	o.finish(3, false, settle(3))
+
+	if !slices.Equal(order, []int{0, 1, 2, 3}) {
+		t.Fatalf("Results settled out of order: %v", order)
+	}
+	if results[0] != nil || results[2] != nil {
+		t.Fatalf("Unexpected failures: %v", results)
+	}
+	if results[1] == nil || !strings.Contains(results[1].Error(), "first.fb2") {
+		t.Fatalf("Book found later should lose, got %v", results[1])
+	}
+}
+
+func TestBookPoolCollision(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	for range 3 {
+		dst := t.TempDir()
+		books := newBookPool(4, processor.OEpub, true, false, false, dst, nil, nil, env)
+
+		// every book produces the same output name, the first one is the largest
+		var mu sync.Mutex
+		var failed []string
+		for i, size := range []int{200, 1, 1, 1} {
+			book := strings.Replace(serveBook, "<section>", strings.Repeat("<section><p>Text.</p></section>", size)+"<section>", 1)
+			src := fmt.Sprintf("dir%d/book.fb2", i)
+			books.convert(strings.NewReader(book), processor.EncUTF8, src, nil, func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, src)
+			})
+		}
+		books.wait()
+
+		if !slices.Equal(failed, []string{"dir1/book.fb2", "dir2/book.fb2", "dir3/book.fb2"}) {
+			t.Fatalf("Only books found later should fail, failed %v", failed)
+		}
+		entries, err := os.ReadDir(dst)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Expected single output, got %v (%v)", entries, err)
+		}
+	}
+}
+
+func TestBookPoolLowMemory(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.LowMemory = true
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	// books are spooled to temporary directory
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	dst := t.TempDir()
+	books := newBookPool(2, processor.OEpub, true, false, false, dst, nil, nil, env)
+	for _, title := range []string{"First", "Second", "Third"} {
+		book := strings.Replace(serveBook, "Sample Book", title, 1)
+		books.convert(strings.NewReader(book), processor.EncUTF8, strings.ToLower(title)+".fb2", nil, func(err error) {
+			t.Errorf("Unable to convert %s: %v", title, err)
+		})
+	}
+	books.wait()
+
+	for _, name := range []string{"first.epub", "second.epub", "third.epub"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("Book was not converted: %v", err)
+		}
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Fatalf("Temporary files left: %v", left)
+	}
+}
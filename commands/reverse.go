@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/h2non/filetype"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// reverseSource converts EPUB (or Kindle) book or all such books in directory tree to FB2.
+func reverseSource(src, dst string, nodirs, overwrite bool, summary *runSummary, env *state.LocalEnv) error {
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("input source was not found: %w", err)
+	}
+
+	if !fi.IsDir() {
+		ok, err := isReversibleFile(src)
+		if err != nil {
+			return fmt.Errorf("unable to check file type: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("input was not recognized as EPUB or Kindle book (%s)", src)
+		}
+		reverseFile(src, filepath.Base(src), dst, nodirs, overwrite, summary, env)
+		return nil
+	}
+
+	count := 0
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+		} else if info.Mode().IsRegular() {
+			if ok, err := isReversibleFile(path); err != nil {
+				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+			} else if ok {
+				count++
+				rel := strings.TrimPrefix(strings.TrimPrefix(path, src), string(filepath.Separator))
+				reverseFile(path, rel, dst, nodirs, overwrite, summary, env)
+			} else {
+				env.Log.Debug("Skipping file, not recognized as EPUB or Kindle book", zap.String("file", path))
+			}
+		}
+		return nil
+	})
+	if err == nil && count == 0 {
+		env.Log.Debug("Nothing to process", zap.String("dir", src))
+	}
+	return err
+}
+
+// reverseFile converts single book reporting result in summary.
+func reverseFile(path, rel, dst string, nodirs, overwrite bool, summary *runSummary, env *state.LocalEnv) {
+
+	local, warnings := countWarnings(env)
+
+	start := time.Now()
+	fname, err := reverseBook(path, rel, dst, nodirs, overwrite, local)
+	if err != nil {
+		env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+	}
+	summary.record(path, bookResult{fname: fname, elapsed: time.Since(start), warnings: int(warnings.count.Load())}, err)
+}
+
+// reverseBook converts single EPUB (or Kindle) book to FB2 returning name of the resulting file. Kindle books are
+// unpacked to EPUB first. "rel" is path of the book relative to the source directory.
+func reverseBook(path, rel, dst string, nodirs, overwrite bool, env *state.LocalEnv) (string, error) {
+
+	var fname string
+
+	env.Log.Info("Conversion starting", zap.String("from", rel))
+	defer func(start time.Time) {
+		env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname))
+	}(time.Now())
+
+	var r io.ReaderAt
+	var size int64
+	if isKindleName(path) {
+		data, err := processor.ReadKF8(path, env.Log)
+		if err != nil {
+			return "", err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		fi, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
+		r, size = file, fi.Size()
+	}
+	doc, err := processor.EPUBToFB2(r, size, env)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(rel)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = strings.TrimSuffix(name, "."+processor.OKepub.String())
+	fname = filepath.Join(dst, name+"."+processor.OFb2.String())
+	if !nodirs {
+		fname = filepath.Join(dst, filepath.Dir(rel), name+"."+processor.OFb2.String())
+	}
+
+	if _, err := os.Stat(fname); err == nil {
+		if !overwrite {
+			return "", fmt.Errorf("output file already exists: %s", fname)
+		}
+		env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return "", fmt.Errorf("unable to create output directory: %w", err)
+	}
+	if err := doc.WriteToFile(fname); err != nil {
+		return "", err
+	}
+	return fname, nil
+}
+
+// isKindleName checks if file name has one of Kindle book extensions.
+func isKindleName(fname string) bool {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".azw3", ".azw", ".mobi":
+		return true
+	}
+	return false
+}
+
+// isReversibleFile detects if file is epub (or kepub) or Kindle book. Container structure is checked when book is read,
+// Kindle books without KF8 part will be rejected at that time.
+func isReversibleFile(fname string) (bool, error) {
+
+	kindle := isKindleName(fname)
+	if !kindle && !strings.EqualFold(filepath.Ext(fname), ".epub") {
+		return false, nil
+	}
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 262)
+	if count, err := file.Read(header); err != nil {
+		return false, err
+	} else if count < 262 {
+		return false, nil
+	}
+	if kindle {
+		return bytes.Equal(header[60:68], []byte("BOOKMOBI")), nil
+	}
+	return filetype.Is(header, "zip"), nil
+}
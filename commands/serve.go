@@ -0,0 +1,674 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/convert"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Serve is "serve" command body. It runs HTTP server converting uploaded books.
+func Serve(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "serve: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() > 0 {
+		env.Log.Warn("Mailformed command line", zap.Strings("ignoring", ctx.Args().Slice()))
+	}
+
+	js, err := newJobServer(ctx.Int("jobs"), ctx.Int("queue"), ctx.Int64("max-size")<<20, ctx.Duration("timeout"), ctx.Duration("keep"), env)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+	}
+	defer js.close()
+
+	sctx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              ctx.String("listen"),
+		Handler:           js,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	env.Log.Info("Serving started", zap.String("listen", srv.Addr))
+	defer func(start time.Time) {
+		env.Log.Info("Serving completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return cli.Exit(fmt.Errorf("%sunable to serve: %w", errPrefix, err), errCode)
+	case <-sctx.Done():
+	}
+
+	env.Log.Info("Stopping, waiting for requests in progress")
+	shctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shctx); err != nil {
+		env.Log.Warn("Unable to shutdown gracefully", zap.Error(err))
+	}
+	return nil
+}
+
+// Job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// serveJob is single conversion requested over HTTP.
+type serveJob struct {
+	ID      string          `json:"id"`
+	Status  string          `json:"status"`
+	Format  string          `json:"format"`
+	Error   string          `json:"error,omitempty"`
+	Book    *convert.Result `json:"book,omitempty"`
+	fname   string          // conversion result
+	updated time.Time
+}
+
+// jobServer keeps conversion jobs and serves HTTP API:
+//
+//	POST /jobs                - multipart form: "book" - fb2 file or zip with fb2 file, "to" - output format,
+//	                            "config" - optional JSON with "document" section overrides
+//	GET  /jobs/{id}           - job status
+//	GET  /jobs/{id}/result    - converted book, job is removed after download
+//
+// Number of jobs waiting for conversion is limited, when queue is full requests are rejected with 503.
+type jobServer struct {
+	mu       sync.Mutex
+	jobs     map[string]*serveJob
+	queued   int
+	maxQueue int
+	dir      string
+	slots    chan struct{}
+	maxSize  int64
+	timeout  time.Duration
+	keep     time.Duration
+	env      *state.LocalEnv
+	mux      *http.ServeMux
+	// stops running conversions and expiration
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newJobServer(workers, maxQueue int, maxSize int64, timeout, keep time.Duration, env *state.LocalEnv) (*jobServer, error) {
+
+	dir, err := os.MkdirTemp("", "fb2c-serve-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	if maxQueue <= 0 {
+		maxQueue = 1
+	}
+
+	js := &jobServer{
+		jobs:     make(map[string]*serveJob),
+		maxQueue: maxQueue,
+		dir:      dir,
+		slots:    make(chan struct{}, workers),
+		maxSize:  maxSize,
+		timeout:  timeout,
+		keep:     keep,
+		env:      env,
+		mux:      http.NewServeMux(),
+	}
+	js.ctx, js.cancel = context.WithCancel(context.Background())
+
+	js.mux.HandleFunc("POST /jobs", js.submit)
+	js.mux.HandleFunc("GET /jobs/{id}", js.status)
+	js.mux.HandleFunc("GET /jobs/{id}/result", js.result)
+
+	if keep > 0 {
+		js.wg.Add(1)
+		go js.expire()
+	}
+	return js, nil
+}
+
+func (js *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	js.mux.ServeHTTP(w, r)
+}
+
+// close stops all conversions and removes everything which was not downloaded.
+func (js *jobServer) close() {
+	js.cancel()
+	js.wg.Wait()
+	if err := os.RemoveAll(js.dir); err != nil {
+		js.env.Log.Warn("Unable to cleanup", zap.String("dir", js.dir), zap.Error(err))
+	}
+}
+
+func (js *jobServer) submit(w http.ResponseWriter, r *http.Request) {
+
+	// reserve place in queue before upload is read
+	if !js.enqueue() {
+		w.Header().Set("Retry-After", "60")
+		httpError(w, http.StatusServiceUnavailable, errors.New("too many jobs waiting, try again later"))
+		return
+	}
+	accepted := false
+	defer func() {
+		if !accepted {
+			js.dequeue()
+		}
+	}()
+
+	if js.maxSize > 0 {
+		// leave some room for the rest of the form
+		r.Body = http.MaxBytesReader(w, r.Body, js.maxSize+1<<20)
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("unable to parse request: %w", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	format := processor.OEpub
+	if to := r.FormValue("to"); len(to) > 0 {
+		if format = processor.ParseFmtString(to); format == processor.UnsupportedOutputFmt || format == processor.OFb2 || format == processor.OMd {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("unsupported output format %s", to))
+			return
+		}
+	}
+
+	cfg, err := jobConfig(js.env.Cfg, []byte(r.FormValue("config")))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	file, header, err := r.FormFile("book")
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("no book in request: %w", err))
+		return
+	}
+	defer file.Close()
+
+	name, data, err := js.readBook(file, filepath.Base(header.Filename))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, fmt.Errorf("unable to generate job id: %w", err))
+		return
+	}
+	job := &serveJob{ID: u.String(), Status: jobQueued, Format: format.String(), updated: time.Now()}
+
+	js.mu.Lock()
+	js.jobs[job.ID] = job
+	js.mu.Unlock()
+
+	accepted = true
+	js.wg.Add(1)
+	go js.run(job, name, data, format, cfg)
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// readBook reads uploaded book, from zip archive first fb2 file is taken.
+func (js *jobServer) readBook(r io.Reader, name string) (string, []byte, error) {
+
+	limit := js.maxSize
+	if limit <= 0 {
+		limit = 1<<63 - 2
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read book: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return "", nil, errors.New("book is too large")
+	}
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) && !bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		return name, data, nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read archive: %w", err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(filepath.Ext(f.Name), ".fb2") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to read archive: %w", err)
+		}
+		defer rc.Close()
+		if data, err = io.ReadAll(io.LimitReader(rc, limit+1)); err != nil {
+			return "", nil, fmt.Errorf("unable to read archive: %w", err)
+		}
+		if int64(len(data)) > limit {
+			return "", nil, errors.New("book is too large")
+		}
+		return filepath.Base(f.Name), data, nil
+	}
+	return "", nil, errors.New("no fb2 file in archive")
+}
+
+func (js *jobServer) run(job *serveJob, name string, data []byte, format processor.OutputFmt, cfg *config.Config) {
+
+	defer js.wg.Done()
+
+	// slot is given back either when conversion ends or when it runs out of time
+	release := sync.OnceFunc(func() { <-js.slots })
+	select {
+	case js.slots <- struct{}{}:
+		js.dequeue()
+		defer release()
+	case <-js.ctx.Done():
+		js.dequeue()
+		js.finish(job, "", nil, js.ctx.Err())
+		return
+	}
+	js.update(job, jobRunning)
+
+	ctx := js.ctx
+	if js.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, js.timeout)
+		defer cancel()
+	}
+
+	out, err := os.CreateTemp(js.dir, "result-")
+	if err != nil {
+		js.finish(job, "", nil, fmt.Errorf("unable to create result file: %w", err))
+		return
+	}
+	var res *convert.Result
+	converted := make(chan error, 1)
+	go func() {
+		var err error
+		res, err = convert.Convert(ctx, bytes.NewReader(data), out, convert.Options{
+			Format: format,
+			Config: cfg,
+			Log:    js.env.Log.With(zap.String("job", job.ID)),
+			Name:   name,
+		})
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("unable to write result file: %w", cerr)
+		}
+		converted <- err
+	}()
+
+	select {
+	case err = <-converted:
+	case <-ctx.Done():
+		// conversion may not stop at once (external programs keep running until they notice), job fails on time and
+		// lets others run, result is thrown away whenever conversion ends
+		js.finish(job, "", nil, js.limitError(ctx.Err()))
+		release()
+		<-converted
+		os.Remove(out.Name())
+		return
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		js.finish(job, "", nil, js.limitError(err))
+		return
+	}
+	js.finish(job, out.Name(), res, nil)
+}
+
+// limitError explains conversion which ran out of time.
+func (js *jobServer) limitError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("conversion did not finish in %v", js.timeout)
+	}
+	return err
+}
+
+// enqueue reserves place for a job waiting for conversion.
+func (js *jobServer) enqueue() bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.queued >= js.maxQueue {
+		return false
+	}
+	js.queued++
+	return true
+}
+
+func (js *jobServer) dequeue() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.queued--
+}
+
+func (js *jobServer) update(job *serveJob, status string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	job.Status, job.updated = status, time.Now()
+}
+
+func (js *jobServer) finish(job *serveJob, fname string, res *convert.Result, err error) {
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job.updated = time.Now()
+	if err != nil {
+		js.env.Log.Error("Unable to convert book", zap.String("job", job.ID), zap.Error(err))
+		job.Status, job.Error = jobFailed, err.Error()
+		return
+	}
+	job.Status, job.fname, job.Book = jobDone, fname, res
+}
+
+// lookup returns copy of the job state, so it could be used without locking.
+func (js *jobServer) lookup(id string) (serveJob, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if job, ok := js.jobs[id]; ok {
+		return *job, true
+	}
+	return serveJob{}, false
+}
+
+func (js *jobServer) status(w http.ResponseWriter, r *http.Request) {
+	job, ok := js.lookup(r.PathValue("id"))
+	if !ok {
+		httpError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	}
+	writeJSON(w, http.StatusOK, &job)
+}
+
+func (js *jobServer) result(w http.ResponseWriter, r *http.Request) {
+
+	job, ok := js.lookup(r.PathValue("id"))
+	switch {
+	case !ok:
+		httpError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	case job.Status == jobFailed:
+		httpError(w, http.StatusUnprocessableEntity, errors.New(job.Error))
+		return
+	case job.Status != jobDone:
+		httpError(w, http.StatusConflict, fmt.Errorf("job is %s", job.Status))
+		return
+	}
+
+	f, err := os.Open(job.fname)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, fmt.Errorf("unable to open result: %w", err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", contentType(job.Book.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.Book.FileName))
+	if _, err := io.Copy(w, f); err != nil {
+		js.env.Log.Warn("Unable to send result", zap.String("job", job.ID), zap.Error(err))
+		return
+	}
+	js.remove(job.ID)
+}
+
+func (js *jobServer) remove(id string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if job, ok := js.jobs[id]; ok {
+		if len(job.fname) > 0 {
+			os.Remove(job.fname)
+		}
+		delete(js.jobs, id)
+	}
+}
+
+// expire removes finished jobs which were not downloaded in time.
+func (js *jobServer) expire() {
+
+	defer js.wg.Done()
+
+	ticker := time.NewTicker(min(js.keep, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-js.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var ids []string
+			js.mu.Lock()
+			for id, job := range js.jobs {
+				if (job.Status == jobDone || job.Status == jobFailed) && now.Sub(job.updated) > js.keep {
+					ids = append(ids, id)
+				}
+			}
+			js.mu.Unlock()
+			for _, id := range ids {
+				js.env.Log.Debug("Removing expired job", zap.String("job", id))
+				js.remove(id)
+			}
+		}
+	}
+}
+
+// jobFields lists configuration settings clients are allowed to change. Nested sections list their own settings, nil
+// means that setting is accepted as a whole.
+type jobFields map[string]jobFields
+
+// jobDocFields are "document" settings which are safe to change for a single job. Settings naming files or programs
+// on the server are not here, neither are sizes of generated images, which could make server allocate unbounded
+// memory.
+var jobDocFields = jobFields{
+	"transliterate_meta":        nil,
+	"open_from_cover":           nil,
+	"chapter_per_file":          nil,
+	"chapter_level":             nil,
+	"series_number_positions":   nil,
+	"series_first_word_length":  nil,
+	"remove_png_transparency":   nil,
+	"optimize_images":           nil,
+	"jpeq_quality_level":        nil,
+	"characters_per_page":       nil,
+	"pages_per_file":            nil,
+	"chapter_subtitle_dividers": nil,
+	"insert_soft_hyphen":        nil,
+	"ignore_nonbreakable_space": nil,
+	"use_broken_images":         nil,
+	"file_name_transliterate":   nil,
+	"fix_zip_format":            nil,
+	"no_page_map":               nil,
+	"dropcaps":                  {"create": nil, "ignore_symbols": nil},
+	"notes":                     {"body_names": nil, "mode": nil, "renumber": nil},
+	"annotation":                {"create": nil, "add_to_toc": nil, "title": nil},
+	"text":                      {"line_width": nil},
+	"toc": {
+		"type":                           nil,
+		"page_title":                     nil,
+		"page_placement":                 nil,
+		"page_maxlevel":                  nil,
+		"include_chapters_without_title": nil,
+		"book_title_from_meta":           nil,
+	},
+	"cover":          {"always_convert": nil, "default": nil, "resize": nil, "stamp_placement": nil},
+	"vignettes":      {"create": nil},
+	"transform":      nil,
+	"source_charset": nil,
+	"reproducible":   nil,
+	"low_memory":     nil,
+	"kindlegen": {
+		"compression_level":     nil,
+		"no_mobi_optimization":  nil,
+		"remove_personal_label": nil,
+		"generate_apnx":         nil,
+		"force_asin_on_azw3":    nil,
+	},
+}
+
+// jobFormatFields are "document" settings used to format names. Since version 2 they are templates, which could read
+// server environment, so they are only accepted when server uses keyword formats of version 1.
+var jobFormatFields = jobFields{
+	"title_format":            nil,
+	"author_format":           nil,
+	"author_format_meta":      nil,
+	"author_format_file_name": nil,
+	"file_name_format":        nil,
+	"notes":                   {"link_format": nil},
+}
+
+// allowedDocFields returns "document" settings clients could change with given server configuration.
+func allowedDocFields(base *config.Config) jobFields {
+
+	allowed := maps.Clone(jobDocFields)
+	if base.Doc.Version > 1 {
+		return allowed
+	}
+	for name, sub := range jobFormatFields {
+		if prev, ok := allowed[name]; ok && sub != nil {
+			merged := maps.Clone(prev)
+			maps.Copy(merged, sub)
+			sub = merged
+		}
+		allowed[name] = sub
+	}
+	return allowed
+}
+
+// sanitize checks that only allowed settings are present in JSON object and returns them. Names have to match exactly,
+// so case insensitive matching of JSON decoder could not be used to sneak anything in.
+func (allowed jobFields) sanitize(data json.RawMessage, prefix string) (map[string]any, error) {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("unable to parse document configuration: %w", err)
+	}
+
+	res := make(map[string]any, len(fields))
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		sub, ok := allowed[name]
+		if !ok {
+			return nil, fmt.Errorf("setting %s%s could not be changed", prefix, name)
+		}
+		if sub == nil {
+			res[name] = fields[name]
+			continue
+		}
+		nested, err := sub.sanitize(fields[name], prefix+name+".")
+		if err != nil {
+			return nil, err
+		}
+		res[name] = nested
+	}
+	return res, nil
+}
+
+// jobConfig prepares configuration for a single job. Only "document" section could be overwritten and only settings
+// listed in jobDocFields are accepted.
+func jobConfig(base *config.Config, overrides []byte) (*config.Config, error) {
+
+	if len(bytes.TrimSpace(overrides)) == 0 {
+		return base, nil
+	}
+
+	var o struct {
+		Doc json.RawMessage `json:"document"`
+	}
+	if err := json.Unmarshal(overrides, &o); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration: %w", err)
+	}
+
+	// deep copy, so nothing is shared with the base configuration
+	data, err := json.Marshal(&base.Doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to copy configuration: %w", err)
+	}
+	var doc config.Doc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to copy configuration: %w", err)
+	}
+	if len(o.Doc) > 0 {
+		fields, err := allowedDocFields(base).sanitize(o.Doc, "")
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(fields); err != nil {
+			return nil, fmt.Errorf("unable to parse document configuration: %w", err)
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse document configuration: %w", err)
+		}
+	}
+
+	// settings running programs on the server always come from server configuration, whatever allowlist says
+	doc.Kindlegen.Path = base.Doc.Kindlegen.Path
+	doc.Kindlegen.Engine = base.Doc.Kindlegen.Engine
+	doc.Kindlegen.Calibre = base.Doc.Kindlegen.Calibre
+	doc.Kindlegen.Command = base.Doc.Kindlegen.Command
+
+	cfg := *base
+	cfg.Doc = doc
+	return &cfg, nil
+}
+
+func contentType(format processor.OutputFmt) string {
+	switch format {
+	case processor.OMobi:
+		return "application/x-mobipocket-ebook"
+	case processor.OAzw3:
+		return "application/vnd.amazon.ebook"
+	case processor.OTxt:
+		return "text/plain; charset=utf-8"
+	case processor.OHtml:
+		return "text/html; charset=utf-8"
+	}
+	return "application/epub+zip"
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
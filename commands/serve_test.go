@@ -0,0 +1,356 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+const serveBook = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>John</first-name><last-name>Sample</last-name></author>
+   <book-title>Sample Book</book-title>
+   <lang>en</lang>
+  </title-info>
+  <document-info><id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id></document-info>
+ </description>
+ <body>
+  <section><title><p>Chapter 1</p></title><p>Some text.</p></section>
+ </body>
+</FictionBook>
+`
+
+func submitJob(t *testing.T, url string, fields map[string]string, name string, book []byte) *http.Response {
+
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("book", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(book); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(url+"/jobs", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func waitJob(t *testing.T, url, id string) serveJob {
+
+	t.Helper()
+
+	for range 100 {
+		resp, err := http.Get(url + "/jobs/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var job serveJob
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == jobDone || job.Status == jobFailed {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return serveJob{}
+}
+
+func TestJobServer(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newJobServer(2, 8, 1<<20, time.Minute, time.Hour, &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.close()
+
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	// book in archive with configuration override
+	var arc bytes.Buffer
+	zw := zip.NewWriter(&arc)
+	fw, err := zw.Create("dir/sample.fb2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(serveBook)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := submitJob(t, srv.URL, map[string]string{"to": "epub3", "config": `{"document": {"file_name_format": "#title"}}`}, "books.zip", arc.Bytes())
+	var job serveJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/jobs/"+job.ID {
+		t.Fatalf("Unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	job = waitJob(t, srv.URL, job.ID)
+	if job.Status != jobDone || job.Book == nil || job.Book.Title != "Sample Book" || job.Format != "epub3" {
+		t.Fatalf("Unexpected job state: %+v", job)
+	}
+
+	resp, err = http.Get(srv.URL + "/jobs/" + job.ID + "/result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := out.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != `attachment; filename="Sample Book.epub"` {
+		t.Fatalf("Unexpected result response: %d %s", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+	if _, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len())); err != nil {
+		t.Fatalf("Result is not an epub: %v", err)
+	}
+
+	// downloaded job is gone
+	resp, err = http.Get(srv.URL + "/jobs/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Downloaded job still present: %d", resp.StatusCode)
+	}
+
+	// bad requests
+	resp = submitJob(t, srv.URL, map[string]string{"to": "pdf"}, "sample.fb2", []byte(serveBook))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unsupported format accepted: %d", resp.StatusCode)
+	}
+	resp = submitJob(t, srv.URL, nil, "sample.fb2", bytes.Repeat([]byte(" "), 2<<20))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Large book accepted: %d", resp.StatusCode)
+	}
+
+	// archive without book
+	var empty bytes.Buffer
+	if err := zip.NewWriter(&empty).Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp = submitJob(t, srv.URL, nil, "empty.zip", empty.Bytes())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Archive without book accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestJobConfig(t *testing.T) {
+
+	base, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Doc.Stylesheet = "/server/style.css"
+
+	cfg, err := jobConfig(base, []byte(`{"document": {"chapter_per_file": false, "notes": {"mode": "float"}, "kindlegen": {"compression_level": 2}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Doc.ChapterPerFile || !base.Doc.ChapterPerFile {
+		t.Fatal("Override was not applied to job configuration only")
+	}
+	if cfg.Doc.Notes.Mode != "float" || cfg.Doc.Kindlegen.CompressionLevel != 2 {
+		t.Fatalf("Nested overrides were not applied: %+v", cfg.Doc.Notes)
+	}
+	if cfg.Doc.Stylesheet != "/server/style.css" || len(cfg.Doc.Notes.BodyNames) != len(base.Doc.Notes.BodyNames) {
+		t.Fatal("Settings which were not overridden changed")
+	}
+
+	for _, override := range []string{
+		`{"document": {"style": "/etc/passwd"}}`,
+		`{"document": {"Style": "/etc/passwd"}}`,
+		`{"document": {"cover": {"image_path": "/etc/passwd"}}}`,
+		`{"document": {"cover": {"width": 100000, "height": 100000}}}`,
+		`{"document": {"vignettes": {"images": {"default": {"chapter_end": "/etc/passwd"}}}}}`,
+		`{"document": {"kindlegen": {"path": "/bin/sh"}}}`,
+		`{"document": {"unknown": 1}}`,
+		`{"document": `,
+	} {
+		if _, err := jobConfig(base, []byte(override)); err == nil {
+			t.Errorf("Configuration accepted: %s", override)
+		}
+	}
+
+	// name formats are templates since version 2
+	format := []byte(`{"document": {"title_format": "{{ env \"HOME\" }}", "notes": {"link_format": "x"}}}`)
+	if _, err := jobConfig(base, format); err != nil {
+		t.Fatalf("Keyword formats should be accepted: %v", err)
+	}
+	base.Doc.Version = 2
+	if _, err := jobConfig(base, format); err == nil {
+		t.Fatal("Templates accepted")
+	}
+}
+
+func TestJobServerQueue(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newJobServer(1, 2, 1<<20, time.Minute, time.Hour, &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.close()
+
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	// both places taken by books waiting for conversion
+	js.enqueue()
+	js.enqueue()
+	resp := submitJob(t, srv.URL, nil, "sample.fb2", []byte(serveBook))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Book accepted with full queue: %d", resp.StatusCode)
+	}
+
+	// rejected requests do not take place in queue
+	js.dequeue()
+	resp = submitJob(t, srv.URL, map[string]string{"to": "pdf"}, "sample.fb2", []byte(serveBook))
+	resp.Body.Close()
+	resp = submitJob(t, srv.URL, nil, "sample.fb2", []byte(serveBook))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Book rejected with free place in queue: %d", resp.StatusCode)
+	}
+}
+
+func TestJobServerEngine(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.Kindlegen.Engine = "native"
+	js, err := newJobServer(1, 8, 1<<20, time.Minute, time.Hour, &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.close()
+
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	for _, override := range []string{
+		`{"document": {"kindlegen": {"engine": "command", "command": {"path": "/bin/sh", "args": ["-c", "touch /tmp/pwned"]}}}}`,
+		`{"document": {"kindlegen": {"engine": "calibre", "calibre": {"path": "/bin/sh"}}}}`,
+		`{"document": {"Kindlegen": {"Engine": "command"}}}`,
+	} {
+		resp := submitJob(t, srv.URL, map[string]string{"to": "azw3", "config": override}, "sample.fb2", []byte(serveBook))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Engine override accepted: %d %s", resp.StatusCode, override)
+		}
+	}
+
+	// even if allowlist lets engine settings through, server configuration wins
+	saved := jobDocFields["kindlegen"]
+	jobDocFields["kindlegen"] = nil
+	defer func() { jobDocFields["kindlegen"] = saved }()
+
+	job, err := jobConfig(cfg, []byte(`{"document": {"kindlegen": {"engine": "command", "path": "/bin/sh", "command": {"path": "/bin/sh"}, "calibre": {"path": "/bin/sh"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := job.Doc.Kindlegen; k.Engine != "native" || k.Path != cfg.Doc.Kindlegen.Path || k.Command.Path != cfg.Doc.Kindlegen.Command.Path || k.Calibre.Path != cfg.Doc.Kindlegen.Calibre.Path {
+		t.Fatalf("Server programs were changed: %+v", k)
+	}
+}
+
+func TestJobServerTimeout(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses shell script")
+	}
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kindle content builder which is stuck, its child keeps output open after shell is killed
+	cfg.Doc.Kindlegen.Engine = "command"
+	cfg.Doc.Kindlegen.Command = config.KindleTool{Path: "/bin/sh", Args: []string{"-c", "sleep 2; true"}}
+	js, err := newJobServer(1, 8, 1<<20, 200*time.Millisecond, time.Hour, &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.close()
+
+	srv := httptest.NewServer(js)
+	defer srv.Close()
+
+	submit := func(format string) string {
+		resp := submitJob(t, srv.URL, map[string]string{"to": format}, "sample.fb2", []byte(serveBook))
+		defer resp.Body.Close()
+		var job serveJob
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		return job.ID
+	}
+
+	start := time.Now()
+	slow := submit("azw3")
+	// single slot, second job waits for the first one
+	fast := submit("epub")
+
+	if job := waitJob(t, srv.URL, slow); job.Status != jobFailed || !strings.Contains(job.Error, "did not finish") {
+		t.Fatalf("Slow job was not stopped: %+v", job)
+	}
+	if job := waitJob(t, srv.URL, fast); job.Status != jobDone {
+		t.Fatalf("Job after slow one failed: %+v", job)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("Slow job held its slot for %v", elapsed)
+	}
+}
@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Conversion statuses reported in run summary.
+const (
+	statusOK      = "ok"      // converted cleanly
+	statusWarning = "warning" // converted, but something was logged as warning
+	statusError   = "error"   // conversion failed
+	statusPanic   = "panic"   // conversion ended with panic
+	statusSkipped = "skipped" // unchanged book, converted earlier
+)
+
+var summaryStatuses = []string{statusOK, statusWarning, statusError, statusPanic, statusSkipped}
+
+// errPanic marks conversions which ended with panic.
+var errPanic = errors.New("panic")
+
+// bookResult is outcome of single book conversion.
+type bookResult struct {
+	fname    string
+	id       string
+	elapsed  time.Duration
+	warnings int
+}
+
+// warnCounter is logger core counting warnings, it sees messages regardless of configured log level.
+type warnCounter struct {
+	count atomic.Int64
+}
+
+func (c *warnCounter) Enabled(lvl zapcore.Level) bool      { return lvl == zapcore.WarnLevel }
+func (c *warnCounter) With(_ []zapcore.Field) zapcore.Core { return c }
+func (c *warnCounter) Sync() error                         { return nil }
+
+func (c *warnCounter) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *warnCounter) Write(_ zapcore.Entry, _ []zapcore.Field) error {
+	c.count.Add(1)
+	return nil
+}
+
+// countWarnings returns copy of environment which logger counts warnings.
+func countWarnings(env *state.LocalEnv) (*state.LocalEnv, *warnCounter) {
+
+	c := &warnCounter{}
+	local := *env
+	local.Log = env.Log.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, c)
+	}))
+	return &local, c
+}
+
+// summaryRecord is single book entry of the run summary.
+type summaryRecord struct {
+	Source   string `json:"source"`
+	Output   string `json:"output,omitempty"`
+	Format   string `json:"format"`
+	ID       string `json:"id,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Warnings int    `json:"warnings"`
+	Elapsed  int64  `json:"elapsed_ms"`
+}
+
+var summaryHeader = []string{"source", "output", "format", "id", "status", "error", "warnings", "elapsed_ms"}
+
+func (r *summaryRecord) csv() []string {
+	return []string{
+		r.Source, r.Output, r.Format, r.ID, r.Status, r.Error, strconv.Itoa(r.Warnings), strconv.FormatInt(r.Elapsed, 10),
+	}
+}
+
+// runSummary writes report of every book processed by "convert" command. Summary with ".csv" extension is written as
+// CSV, anything else as JSON lines. Records are written as soon as books are processed, so summary of interrupted run is
+// still useful.
+type runSummary struct {
+	mu     sync.Mutex
+	file   *os.File
+	format processor.OutputFmt
+	json   *json.Encoder
+	csv    *csv.Writer
+	totals map[string]int
+	env    *state.LocalEnv
+}
+
+func newRunSummary(fname string, format processor.OutputFmt, env *state.LocalEnv) (*runSummary, error) {
+
+	file, err := os.Create(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create summary: %w", err)
+	}
+
+	s := &runSummary{
+		file:   file,
+		format: format,
+		totals: make(map[string]int),
+		env:    env,
+	}
+	if strings.EqualFold(filepath.Ext(fname), ".csv") {
+		s.csv = csv.NewWriter(file)
+		if err := s.csv.Write(summaryHeader); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to write summary: %w", err)
+		}
+	} else {
+		s.json = json.NewEncoder(file)
+		s.json.SetEscapeHTML(false)
+	}
+	return s, nil
+}
+
+// record reports conversion of the book. "source" is full path of the book, including path inside archive.
+func (s *runSummary) record(source string, res bookResult, err error) {
+
+	if s == nil {
+		return
+	}
+
+	rec := &summaryRecord{
+		Source:   source,
+		Output:   res.fname,
+		Format:   s.format.String(),
+		ID:       res.id,
+		Status:   bookStatus(res, err),
+		Warnings: res.warnings,
+		Elapsed:  res.elapsed.Milliseconds(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.write(rec)
+}
+
+func bookStatus(res bookResult, err error) string {
+	switch {
+	case errors.Is(err, errPanic):
+		return statusPanic
+	case err != nil:
+		return statusError
+	case res.warnings > 0:
+		return statusWarning
+	}
+	return statusOK
+}
+
+// skipped reports book which was not converted because it did not change since previous run.
+func (s *runSummary) skipped(source string) {
+
+	if s == nil {
+		return
+	}
+	s.write(&summaryRecord{Source: source, Format: s.format.String(), Status: statusSkipped})
+}
+
+func (s *runSummary) write(rec *summaryRecord) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totals[rec.Status]++
+
+	var err error
+	if s.json != nil {
+		err = s.json.Encode(rec)
+	} else {
+		if err = s.csv.Write(rec.csv()); err == nil {
+			s.csv.Flush()
+			err = s.csv.Error()
+		}
+	}
+	if err != nil {
+		s.env.Log.Error("Unable to write summary", zap.Error(err))
+	}
+}
+
+// total returns line with number of books for every status.
+func (s *runSummary) total() string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var books int
+	parts := make([]string, 0, len(summaryStatuses))
+	for _, status := range summaryStatuses {
+		books += s.totals[status]
+		parts = append(parts, fmt.Sprintf("%s: %d", status, s.totals[status]))
+	}
+	return fmt.Sprintf("books: %d, %s", books, strings.Join(parts, ", "))
+}
+
+func (s *runSummary) close() error {
+
+	if s == nil {
+		return nil
+	}
+	return s.file.Close()
+}
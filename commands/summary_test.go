@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+func TestCountWarnings(t *testing.T) {
+
+	// warnings are counted even when they are not logged
+	env := &state.LocalEnv{Log: zap.NewNop().WithOptions(zap.IncreaseLevel(zapcore.ErrorLevel))}
+	local, warnings := countWarnings(env)
+
+	local.Log.Info("info")
+	local.Log.Warn("warning")
+	local.Log.Named("child").With(zap.String("key", "value")).Warn("warning")
+	local.Log.Error("error")
+
+	if n := warnings.count.Load(); n != 2 {
+		t.Fatalf("Expected 2 warnings, got %d", n)
+	}
+	if env.Log == local.Log {
+		t.Fatal("Original environment should not be changed")
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	book, err := os.ReadFile(filepath.Join("..", "processor", "testdata", "corpus", "structure.fb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fname := range []string{"summary.jsonl", "summary.csv"} {
+		t.Run(fname, func(t *testing.T) {
+
+			dst := t.TempDir()
+			summary, err := newRunSummary(filepath.Join(dst, fname), processor.OEpub, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache, err := newBookCache(dst, processor.OEpub, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			good := &fingerprint{source: "/books/books.zip/good.fb2", size: int64(len(book)), crc32: 1}
+			// the same output name, book could not be stored
+			duplicate := &fingerprint{source: "/books/other.zip/good.fb2", size: int64(len(book)), crc32: 2}
+			fail := func(error) {}
+
+			books := newBookPool(1, processor.OEpub, true, false, false, dst, cache, summary, env)
+			books.convert(strings.NewReader(string(book)), processor.EncUTF8, "good.fb2", good, fail)
+			books.convert(strings.NewReader(string(book)), processor.EncUTF8, "good.fb2", duplicate, fail)
+			books.convert(strings.NewReader(string(book)), processor.EncUTF8, "good.fb2", good, fail)
+			books.wait()
+			if err := summary.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dst, fname))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []summaryRecord
+			if filepath.Ext(fname) == ".csv" {
+				rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(summaryHeader, ",") {
+					t.Fatalf("Unexpected header: %q", rows)
+				}
+				for _, row := range rows[1:] {
+					var rec summaryRecord
+					rec.Source, rec.Output, rec.Format, rec.ID, rec.Status, rec.Error = row[0], row[1], row[2], row[3], row[4], row[5]
+					fmt.Sscan(row[6], &rec.Warnings)
+					records = append(records, rec)
+				}
+			} else {
+				dec := json.NewDecoder(strings.NewReader(string(data)))
+				for dec.More() {
+					var rec summaryRecord
+					if err := dec.Decode(&rec); err != nil {
+						t.Fatal(err)
+					}
+					records = append(records, rec)
+				}
+			}
+
+			if len(records) != 3 {
+				t.Fatalf("Expected 3 records, got %d: %+v", len(records), records)
+			}
+			if r := records[0]; r.Source != good.source || r.Output != filepath.Join(dst, "good.epub") || r.Format != "epub" || len(r.ID) == 0 || (r.Status != statusOK && r.Status != statusWarning) || len(r.Error) != 0 {
+				t.Errorf("Unexpected record of converted book: %+v", r)
+			}
+			if r := records[1]; r.Source != duplicate.source || r.Status != statusError || len(r.Error) == 0 || len(r.Output) != 0 {
+				t.Errorf("Unexpected record of failed book: %+v", r)
+			}
+			if r := records[2]; r.Source != good.source || r.Status != statusSkipped {
+				t.Errorf("Unexpected record of unchanged book: %+v", r)
+			}
+			if total := summary.total(); !strings.HasPrefix(total, "books: 3, ") || !strings.Contains(total, "error: 1") || !strings.Contains(total, "skipped: 1") {
+				t.Errorf("Unexpected totals: %s", total)
+			}
+		})
+	}
+}
+
+func TestBookStatus(t *testing.T) {
+
+	for _, c := range []struct {
+		res  bookResult
+		err  error
+		want string
+	}{
+		{bookResult{}, nil, statusOK},
+		{bookResult{warnings: 2}, nil, statusWarning},
+		{bookResult{warnings: 2}, errors.New("bad book"), statusError},
+		{bookResult{}, fmt.Errorf("%w: %v", errPanic, "index out of range"), statusPanic},
+	} {
+		if got := bookStatus(c.res, c.err); got != c.want {
+			t.Errorf("%+v, %v: expected status %s, got %s", c.res, c.err, c.want, got)
+		}
+	}
+}
+
+func TestRunSummaryArchive(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+
+	src, dst := t.TempDir(), t.TempDir()
+	arc := filepath.Join(src, "books.zip")
+	f, err := os.Create(arc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, m := range []struct {
+		name string
+		data string
+		raw  bool
+	}{
+		{"good.fb2", serveBook, false},
+		{"text.fb2", strings.Repeat("not a book ", 10), false},
+		{"nested.zip", "PK\x03\x04 archive which is cut short", false},
+		// only name looks like archive, skipped
+		{"misnamed.zip", "not an archive", false},
+		// deflated data which cannot be inflated
+		{"corrupt.fb2", "\xff\xff\xff\xff\xff\xff\xff\xff", true},
+	} {
+		var w io.Writer
+		if m.raw {
+			w, err = zw.CreateRaw(&zip.FileHeader{Name: m.name, Method: zip.Deflate, CompressedSize64: uint64(len(m.data)), UncompressedSize64: 1024, CRC32: 1})
+		} else {
+			w, err = zw.Create(m.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	summary, err := newRunSummary(filepath.Join(dst, "summary.jsonl"), processor.OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := newBookPool(1, processor.OEpub, true, false, false, dst, nil, summary, env)
+	if err := processArchive(arc, "", "", nil, books, env); err != nil {
+		t.Fatal(err)
+	}
+	books.wait()
+	if err := summary.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst, "summary.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]string)
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	for dec.More() {
+		var rec summaryRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Status == statusError && len(rec.Error) == 0 {
+			t.Errorf("Error is not reported: %+v", rec)
+		}
+		status[strings.TrimPrefix(rec.Source, arc+string(filepath.Separator))] = rec.Status
+	}
+	for name, want := range map[string]string{"good.fb2": statusOK, "text.fb2": statusError, "nested.zip": statusError, "corrupt.fb2": statusError} {
+		if status[name] != want && !(want == statusOK && status[name] == statusWarning) {
+			t.Errorf("%s: expected status %s, got %q", name, want, status[name])
+		}
+	}
+	if st, ok := status["misnamed.zip"]; ok {
+		t.Errorf("misnamed.zip: unexpected status %s", st)
+	}
+	if n := books.failed.Load(); n != 3 {
+		t.Errorf("Expected 3 failed books, got %d", n)
+	}
+}
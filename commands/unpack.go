@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Unpack extracts KF8 content of Kindle book as EPUB along with its EXTH metadata.
+func Unpack(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "unpack: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input book has been specified"), errCode)
+	}
+	if src, err = filepath.Abs(src); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed: %w", errPrefix, err), errCode)
+	}
+	if info, err := os.Stat(src); err != nil {
+		return cli.Exit(fmt.Errorf("%sinput book was not found: %w", errPrefix, err), errCode)
+	} else if !info.Mode().IsRegular() {
+		return cli.Exit(fmt.Errorf("%sinput book must be a file", errPrefix), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory: %w", errPrefix, err), errCode)
+		}
+	} else if dst, err = filepath.Abs(dst); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed: %w", errPrefix, err), errCode)
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to create destination directory: %w", errPrefix, err), errCode)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	epub := filepath.Join(dst, name+".epub")
+	meta := filepath.Join(dst, name+".exth.json")
+	for _, fname := range []string{epub, meta} {
+		if _, err := os.Stat(fname); err == nil {
+			if !ctx.Bool("overwrite") {
+				return cli.Exit(fmt.Errorf("%soutput file already exists: %s", errPrefix, fname), errCode)
+			}
+			env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		}
+	}
+
+	env.Log.Info("Unpacking starting", zap.String("from", src))
+	defer func(start time.Time) {
+		env.Log.Info("Unpacking completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", epub))
+	}(time.Now())
+
+	if err := processor.UnpackKF8(src, epub, meta, env.Log); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to unpack book: %w", errPrefix, err), errCode)
+	}
+	return nil
+}
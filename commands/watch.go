@@ -0,0 +1,397 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/archive"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Watch is "watch" command body. It converts books dropped into source directory until terminated.
+func Watch(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "watch: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() > 2 {
+		env.Log.Warn("Mailformed command line", zap.Strings("ignoring", ctx.Args().Slice()[2:]))
+	}
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no directory to watch has been specified"), errCode)
+	}
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing source path failed", errPrefix), errCode)
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return cli.Exit(fmt.Errorf("%ssource must be an existing directory (%s)", errPrefix, src), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no destination has been specified"), errCode)
+	}
+	if dst, err = filepath.Abs(dst); err != nil {
+		return cli.Exit(fmt.Errorf("%snormalizing destination path failed", errPrefix), errCode)
+	}
+
+	var done, failed string
+	if done = ctx.String("done"); len(done) > 0 {
+		if done, err = filepath.Abs(done); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing done path failed", errPrefix), errCode)
+		}
+	}
+	if failed = ctx.String("failed"); len(failed) > 0 {
+		if failed, err = filepath.Abs(failed); err != nil {
+			return cli.Exit(fmt.Errorf("%snormalizing failed path failed", errPrefix), errCode)
+		}
+	}
+
+	format := processor.ParseFmtString(ctx.String("to"))
+	if format == processor.UnsupportedOutputFmt || format == processor.OFb2 {
+		env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
+		format = processor.OEpub
+	}
+	if cp := ctx.String("force-cp"); len(cp) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.SourceCharset = cp
+	}
+	if ctx.Bool("reproducible") {
+		// command line overrides configuration
+		env.Cfg.Doc.Reproducible = true
+	}
+	if ctx.Bool("low-memory") {
+		// command line overrides configuration
+		env.Cfg.Doc.LowMemory = true
+	}
+	if engine := ctx.String("engine"); len(engine) > 0 {
+		// command line overrides configuration
+		env.Cfg.Doc.Kindlegen.Engine = engine
+	}
+
+	jobs := ctx.Int("jobs")
+	if jobs <= 0 {
+		jobs = 1
+	}
+	settle := ctx.Duration("settle")
+	if settle <= 0 {
+		settle = time.Second
+	}
+
+	sctx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w, err := newDropWatcher(src, settle, env, done, failed)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to watch source: %w", errPrefix, err), errCode)
+	}
+	defer w.close()
+
+	env.Log.Info("Watching started", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
+	defer func(start time.Time) {
+		env.Log.Info("Watching completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				books := newBookPool(1, format, ctx.Bool("nodirs"), false, ctx.Bool("ow"), dst, nil, nil, env)
+				ok := convertDropped(src, path, books, env)
+				switch {
+				case ok && len(done) > 0:
+					moveDropped(src, path, done, env)
+				case !ok && len(failed) > 0:
+					moveDropped(src, path, failed, env)
+				}
+			}
+		}()
+	}
+
+	w.run(sctx, files)
+	close(files)
+
+	env.Log.Info("Stopping, waiting for conversions in progress")
+	wg.Wait()
+	return nil
+}
+
+// convertDropped processes book or archive found in watched directory, returns false if anything failed.
+func convertDropped(root, path string, books *bookPool, env *state.LocalEnv) bool {
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(path, root), string(filepath.Separator))
+
+	if ok, err := isArchiveFile(path); err != nil {
+		env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		return false
+	} else if ok {
+		if err := processArchive(path, "", filepath.Dir(rel), nil, books, env); err != nil {
+			env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+			return false
+		}
+		return books.failed.Load() == 0
+	}
+
+	ok, enc, err := isBookFile(path)
+	if err != nil {
+		env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		return false
+	}
+	if !ok {
+		env.Log.Error("Unable to process file, not recognized as book or archive", zap.String("file", path))
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		return false
+	}
+	defer file.Close()
+
+	books.convert(file, enc, rel, nil, func(err error) {
+		env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+	})
+	return books.failed.Load() == 0
+}
+
+// moveDropped moves processed file out of watched directory keeping its relative path.
+func moveDropped(root, path, dir string, env *state.LocalEnv) {
+
+	to := filepath.Join(dir, strings.TrimPrefix(strings.TrimPrefix(path, root), string(filepath.Separator)))
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		env.Log.Error("Unable to move processed file", zap.String("file", path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	if err := os.Rename(path, to); err == nil {
+		return
+	}
+	// could be on different devices
+	if err := copyAndRemove(path, to); err != nil {
+		env.Log.Error("Unable to move processed file", zap.String("file", path), zap.String("to", to), zap.Error(err))
+	}
+}
+
+func copyAndRemove(from, to string) error {
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(from)
+}
+
+// dropState is last observed state of the file waiting to become stable.
+type dropState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// dropWatcher monitors directory tree and reports books and archives which were not changed for settle period.
+type dropWatcher struct {
+	root    string
+	skip    []string
+	settle  time.Duration
+	fw      *fsnotify.Watcher
+	pending map[string]*dropState
+	env     *state.LocalEnv
+}
+
+func newDropWatcher(root string, settle time.Duration, env *state.LocalEnv, skip ...string) (*dropWatcher, error) {
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &dropWatcher{
+		root:    root,
+		settle:  settle,
+		fw:      fw,
+		pending: make(map[string]*dropState),
+		env:     env,
+	}
+	for _, s := range skip {
+		if len(s) > 0 {
+			w.skip = append(w.skip, s)
+		}
+	}
+	// files already present are treated as just dropped
+	if err := w.add(root); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *dropWatcher) close() {
+	w.fw.Close()
+}
+
+// skipped checks if path belongs to the directories where processed files are moved.
+func (w *dropWatcher) skipped(path string) bool {
+	for _, s := range w.skip {
+		if path == s || strings.HasPrefix(path, s+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// add starts watching directory tree and remembers books found there.
+func (w *dropWatcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			w.env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		case w.skipped(path):
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		case d.IsDir():
+			if err := w.fw.Add(path); err != nil {
+				return fmt.Errorf("unable to watch %s: %w", path, err)
+			}
+		default:
+			w.touch(path)
+		}
+		return nil
+	})
+}
+
+// touch remembers file if it looks like something we could convert.
+func (w *dropWatcher) touch(path string) {
+
+	if !strings.EqualFold(filepath.Ext(path), ".fb2") && !archive.Supported(path) {
+		return
+	}
+	if _, ok := w.pending[path]; !ok {
+		w.pending[path] = &dropState{size: -1}
+	}
+	w.pending[path].since = time.Now()
+}
+
+// run reports stable files to out until ctx is canceled.
+func (w *dropWatcher) run(ctx context.Context, out chan<- string) {
+
+	// tiny settle periods are valid, but ticker needs positive interval
+	ticker := time.NewTicker(max(min(w.settle/2, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+
+	var ready []string
+	for {
+		// only try to send when there is something to send
+		var (
+			next  string
+			sendc chan<- string
+		)
+		if len(ready) > 0 {
+			next, sendc = ready[0], out
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case sendc <- next:
+			ready = ready[1:]
+		case event, ok := <-w.fw.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.fw.Errors:
+			if !ok {
+				return
+			}
+			w.env.Log.Warn("Watcher problem", zap.Error(err))
+		case <-ticker.C:
+			ready = append(ready, w.stable()...)
+		}
+	}
+}
+
+func (w *dropWatcher) handle(event fsnotify.Event) {
+
+	if w.skipped(event.Name) {
+		return
+	}
+	switch {
+	case event.Has(fsnotify.Create):
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+			// new directories may already have something in them
+			if err := w.add(event.Name); err != nil {
+				w.env.Log.Warn("Unable to watch directory", zap.String("dir", event.Name), zap.Error(err))
+			}
+			return
+		}
+		w.touch(event.Name)
+	case event.Has(fsnotify.Write):
+		w.touch(event.Name)
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		delete(w.pending, event.Name)
+	}
+}
+
+// stable returns files which did not change for settle period and forgets about them.
+func (w *dropWatcher) stable() (res []string) {
+
+	now := time.Now()
+	for path, st := range w.pending {
+		fi, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if fi.Size() != st.size || !fi.ModTime().Equal(st.modTime) {
+			st.size, st.modTime, st.since = fi.Size(), fi.ModTime(), now
+			continue
+		}
+		if now.Sub(st.since) >= w.settle {
+			delete(w.pending, path)
+			res = append(res, path)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
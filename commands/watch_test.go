@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/state"
+)
+
+func TestDropWatcherStable(t *testing.T) {
+
+	root := t.TempDir()
+	done := filepath.Join(root, "done")
+	for _, name := range []string{"a.fb2", "b.zip", "c.txt", "done/d.fb2"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := newDropWatcher(root, 50*time.Millisecond, &state.LocalEnv{Log: zap.NewNop()}, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	// first look only records file state
+	if res := w.stable(); len(res) != 0 {
+		t.Fatalf("Files reported before settling: %v", res)
+	}
+
+	// file keeps changing
+	time.Sleep(60 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(root, "b.zip"), []byte("more data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res := w.stable(); !slices.Equal(res, []string{filepath.Join(root, "a.fb2")}) {
+		t.Fatalf("Unexpected stable files: %v", res)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if res := w.stable(); !slices.Equal(res, []string{filepath.Join(root, "b.zip")}) {
+		t.Fatalf("Unexpected stable files: %v", res)
+	}
+	if len(w.pending) != 0 {
+		t.Fatalf("Files left pending: %v", w.pending)
+	}
+}
+
+func TestDropWatcherTinySettle(t *testing.T) {
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.fb2"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newDropWatcher(root, time.Nanosecond, &state.LocalEnv{Log: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out := make(chan string)
+	go w.run(ctx, out)
+	select {
+	case name := <-out:
+		if name != filepath.Join(root, "a.fb2") {
+			t.Fatalf("Unexpected stable file: %s", name)
+		}
+	case <-ctx.Done():
+		t.Fatal("Stable file was not reported")
+	}
+}
@@ -53,6 +53,12 @@ type Fb2Epub struct {
 	SendToKindle bool   `json:"send_to_kindle"`
 }
 
+// KindleTool describes external program used to produce kindle content.
+type KindleTool struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+}
+
 // SMTPConfig keeps STK configuration.
 type SMTPConfig struct {
 	DeleteOnSuccess bool   `json:"delete_sent_book"`
@@ -87,16 +93,26 @@ func (a *AuthorName) String() string {
 
 // MetaInfo keeps book meta-info overwrites from configuration.
 type MetaInfo struct {
-	ID         string        `json:"id"`
-	ASIN       string        `json:"asin"`
-	Title      string        `json:"title"`
-	Lang       string        `json:"language"`
-	Genres     []string      `json:"genres"`
-	Authors    []*AuthorName `json:"authors"`
-	SeqName    string        `json:"sequence"`
-	SeqNum     int           `json:"sequence_number"`
-	Date       string        `json:"date"`
-	CoverImage string        `json:"cover_image"`
+	ID          string        `json:"id"`
+	ASIN        string        `json:"asin"`
+	Title       string        `json:"title"`
+	Lang        string        `json:"language"`
+	Genres      []string      `json:"genres"`
+	Authors     []*AuthorName `json:"authors"`
+	SeqName     string        `json:"sequence"`
+	SeqNum      int           `json:"sequence_number"`
+	Date        string        `json:"date"`
+	CoverImage  string        `json:"cover_image"`
+	Translators []*AuthorName `json:"translators"`
+	// publish-info
+	Publisher   string `json:"publisher"`
+	PublishCity string `json:"city"`
+	PublishYear string `json:"year"`
+	ISBN        string `json:"isbn"`
+	// src-title-info
+	SrcTitle   string        `json:"src_title"`
+	SrcLang    string        `json:"src_language"`
+	SrcAuthors []*AuthorName `json:"src_authors"`
 }
 
 type confMetaOverwrite struct {
@@ -162,6 +178,9 @@ type Doc struct {
 		AddToToc bool   `json:"add_to_toc"`
 		Title    string `json:"title"`
 	} `json:"annotation"`
+	Text struct {
+		Width int `json:"line_width"`
+	} `json:"text"`
 	TOC struct {
 		Type              string `json:"type"`
 		Title             string `json:"page_title"`
@@ -186,15 +205,25 @@ type Doc struct {
 	} `json:"vignettes"`
 	//
 	Transformations map[string]map[string]string `json:"transform"`
+	SourceCharset   string                       `json:"source_charset"`
+	Reproducible    bool                         `json:"reproducible"`
+	LowMemory       bool                         `json:"low_memory"`
+	NestedArchives  struct {
+		Depth   int `json:"depth"`
+		MaxSize int `json:"max_size_mb"`
+	} `json:"nested_archives"`
 	//
 	Kindlegen struct {
-		Path             string `json:"path"`
-		CompressionLevel int    `json:"compression_level"`
-		Verbose          bool   `json:"verbose"`
-		NoOptimization   bool   `json:"no_mobi_optimization"`
-		RemovePersonal   bool   `json:"remove_personal_label"`
-		PageMap          string `json:"generate_apnx"`
-		ForceASIN        bool   `json:"force_asin_on_azw3"`
+		Path             string     `json:"path"`
+		CompressionLevel int        `json:"compression_level"`
+		Verbose          bool       `json:"verbose"`
+		NoOptimization   bool       `json:"no_mobi_optimization"`
+		RemovePersonal   bool       `json:"remove_personal_label"`
+		PageMap          string     `json:"generate_apnx"`
+		ForceASIN        bool       `json:"force_asin_on_azw3"`
+		Engine           string     `json:"engine"`
+		Calibre          KindleTool `json:"calibre"`
+		Command          KindleTool `json:"command"`
 	} `json:"kindlegen"`
 }
 
@@ -252,10 +281,15 @@ var defaultConfig = []byte(`{
         }
       }
     },
+    "nested_archives": {
+      "depth": 2,
+      "max_size_mb": 512
+    },
     "kindlegen": {
       "compression_level": 1,
       "remove_personal_label": true,
-      "generate_apnx": "none"
+      "generate_apnx": "none",
+      "engine": "auto"
     },
     "cover": {
       "height": 1680,
@@ -269,6 +303,9 @@ var defaultConfig = []byte(`{
     "annotation": {
       "title": "Annotation"
     },
+    "text": {
+      "line_width": 72
+    },
     "toc": {
       "type": "normal",
       "page_title": "Content",
@@ -425,6 +462,10 @@ func BuildConfig(fnames ...string) (*Config, error) {
 
 // GetBytes returns configuration the way it was read from various sources, before unmarshaling.
 func (conf *Config) GetBytes() ([]byte, error) {
+	if conf.cfg == nil {
+		// built directly, not loaded
+		return conf.GetActualBytes()
+	}
 	// do some pretty-printing
 	var out bytes.Buffer
 	err := json.Indent(&out, conf.cfg.Bytes(), "", "  ")
@@ -0,0 +1,249 @@
+// Package convert allows programs to embed the converter and process books in-process.
+package convert
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Options controls single conversion.
+type Options struct {
+	// Format of the result, epub by default. Neither fb2 nor md (which produces several files) are supported.
+	Format processor.OutputFmt
+	// Config to use, could be built directly or started from config.BuildConfig() defaults. Nil means defaults.
+	// Configuration is never modified, so it could be shared between concurrent conversions.
+	Config *config.Config
+	// Log receives all conversion messages, nil means no logging.
+	Log *zap.Logger
+	// Name of the source book, used to calculate output name and to look up meta information overwrites.
+	Name string
+}
+
+// Result describes converted book.
+type Result struct {
+	ID           string              `json:"id"`
+	ASIN         string              `json:"asin,omitempty"`
+	Title        string              `json:"title"`
+	Lang         string              `json:"language"`
+	Authors      []string            `json:"authors,omitempty"`
+	Genres       []string            `json:"genres,omitempty"`
+	Series       string              `json:"series,omitempty"`
+	SeriesNumber int                 `json:"series_number,omitempty"`
+	Annotation   string              `json:"annotation,omitempty"`
+	Date         string              `json:"date,omitempty"`
+	Format       processor.OutputFmt `json:"-"`
+	// FileName is output file name converter would use, without directory.
+	FileName string `json:"file_name"`
+	// Warnings reported during conversion.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Convert reads FB2 book from r and writes converted book to w. Nothing is written to w unless conversion succeeds.
+// Context is checked while source is read and for every section, image and output file, when it is canceled conversion
+// stops and context error is returned.
+func Convert(ctx context.Context, r io.Reader, w io.Writer, opts Options) (*Result, error) {
+
+	if opts.Format < 0 || opts.Format >= processor.UnsupportedOutputFmt || opts.Format == processor.OFb2 || opts.Format == processor.OMd {
+		return nil, fmt.Errorf("unsupported output format %s", opts.Format)
+	}
+	if len(opts.Name) == 0 {
+		opts.Name = "book.fb2"
+	}
+	if opts.Config == nil {
+		cfg, err := config.BuildConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to build default configuration: %w", err)
+		}
+		opts.Config = cfg
+	}
+	if opts.Log == nil {
+		opts.Log = zap.NewNop()
+	}
+
+	collector := &warningsCore{warnings: &warnings{}}
+	env := &state.LocalEnv{
+		Cfg: opts.Config,
+		Log: opts.Log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+			return zapcore.NewTee(c, collector)
+		})),
+	}
+
+	dst, err := os.MkdirTemp("", "fb2c-out-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+
+	c := convert(ctx, r, dst, opts, env)
+	defer c.clean(dst)
+	if c.err != nil {
+		return nil, c.err
+	}
+	if err := copyFile(w, c.fname); err != nil {
+		return nil, err
+	}
+	res := newResult(c.p.Book, opts.Format, filepath.Base(c.fname))
+	res.Warnings = collector.list()
+	return res, nil
+}
+
+type conversion struct {
+	p     *processor.Processor
+	fname string
+	err   error
+}
+
+func convert(ctx context.Context, r io.Reader, dst string, opts Options, env *state.LocalEnv) (c *conversion) {
+
+	c = &conversion{}
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("conversion ended with panic: %v", r)
+		}
+	}()
+
+	br := bufio.NewReader(contextReader{ctx: ctx, r: r})
+	// BOM detection needs first 4 bytes, shorter sources will fail parsing anyway
+	buf, _ := br.Peek(4)
+	enc := processor.EncUnknown
+	if len(buf) == 4 {
+		enc = processor.DetectUTF(buf)
+	}
+
+	defer func() {
+		// whatever step noticed cancellation, report it as is
+		if c.err != nil && ctx.Err() != nil {
+			c.err = ctx.Err()
+		}
+	}()
+
+	if c.p, c.err = processor.NewFB2(processor.SelectReader(br, enc), enc == processor.EncUnknown, opts.Name, dst, true, false, true, opts.Format, env); c.err != nil {
+		return
+	}
+	c.p.SetContext(ctx)
+	if c.err = c.p.Process(); c.err != nil {
+		return
+	}
+	c.fname, c.err = c.p.Save()
+	return
+}
+
+// contextReader stops reading source when context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
+
+func (c *conversion) clean(dst string) {
+	if c.p != nil {
+		c.p.Clean()
+	}
+	os.RemoveAll(dst)
+}
+
+func copyFile(w io.Writer, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("unable to open conversion result: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("unable to write conversion result: %w", err)
+	}
+	return nil
+}
+
+func newResult(b *processor.Book, format processor.OutputFmt, fname string) *Result {
+	res := &Result{
+		ID:           b.ID.String(),
+		ASIN:         b.ASIN,
+		Title:        b.Title,
+		Lang:         b.Lang.String(),
+		Genres:       b.Genres,
+		Series:       b.SeqName,
+		SeriesNumber: b.SeqNum,
+		Annotation:   b.Annotation,
+		Date:         b.Date,
+		Format:       format,
+		FileName:     fname,
+	}
+	for _, a := range b.Authors {
+		res.Authors = append(res.Authors, a.String())
+	}
+	return res
+}
+
+// warningsCore collects warnings logged during conversion.
+type warningsCore struct {
+	*warnings
+	fields []zapcore.Field
+}
+
+type warnings struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *warningsCore) Enabled(l zapcore.Level) bool {
+	return l == zapcore.WarnLevel
+}
+
+func (c *warningsCore) With(fields []zapcore.Field) zapcore.Core {
+	return &warningsCore{warnings: c.warnings, fields: append(slices.Clip(c.fields), fields...)}
+}
+
+func (c *warningsCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *warningsCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	msg := e.Message
+	if len(enc.Fields) > 0 {
+		msg += fmt.Sprintf(" %v", enc.Fields)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func (c *warningsCore) Sync() error {
+	return nil
+}
+
+func (c *warningsCore) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.msgs)
+}
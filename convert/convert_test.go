@@ -0,0 +1,227 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+)
+
+const book = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>John</first-name><last-name>Sample</last-name></author>
+   <book-title>Sample Book</book-title>
+   <coverpage><image l:href="#missing.jpg"/></coverpage>
+   <lang>en</lang>
+   <sequence name="Samples" number="3"/>
+  </title-info>
+  <document-info><id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id></document-info>
+ </description>
+ <body>
+  <section><title><p>Chapter 1</p></title><p>Some text.</p></section>
+ </body>
+</FictionBook>
+`
+
+func TestConvert(t *testing.T) {
+
+	var out bytes.Buffer
+	res, err := Convert(context.Background(), strings.NewReader(book), &out, Options{Format: processor.OEpub3, Name: "dir/sample.fb2"})
+	if err != nil {
+		t.Fatalf("Unable to convert: %v", err)
+	}
+
+	if res.Title != "Sample Book" || res.Series != "Samples" || res.SeriesNumber != 3 || res.Lang != "en" {
+		t.Fatalf("Unexpected metadata: %+v", res)
+	}
+	if len(res.Authors) != 1 || res.Authors[0] != "John Sample" {
+		t.Fatalf("Unexpected authors: %v", res.Authors)
+	}
+	if res.ID != "5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11" {
+		t.Fatalf("Unexpected id: %s", res.ID)
+	}
+	if res.FileName != "sample.epub" {
+		t.Fatalf("Unexpected file name: %s", res.FileName)
+	}
+	if len(res.Warnings) == 0 {
+		t.Fatal("Missing cover was not reported")
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("Result is not an epub: %v", err)
+	}
+	if len(z.File) == 0 || z.File[0].Name != "mimetype" {
+		t.Fatal("Result does not start with mimetype")
+	}
+}
+
+func TestConvertConfig(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.FileNameFormat = "#title"
+
+	var out bytes.Buffer
+	res, err := Convert(context.Background(), strings.NewReader(book), &out, Options{Format: processor.OKepub, Config: cfg})
+	if err != nil {
+		t.Fatalf("Unable to convert: %v", err)
+	}
+	if res.FileName != "Sample Book.kepub.epub" {
+		t.Fatalf("Unexpected file name: %s", res.FileName)
+	}
+}
+
+func TestConvertCanceled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var out bytes.Buffer
+	if _, err := Convert(ctx, strings.NewReader(book), &out, Options{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatal("Canceled conversion produced output")
+	}
+}
+
+func TestConvertCanceledMidway(t *testing.T) {
+
+	var sections strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&sections, "<section><title><p>Chapter %d</p></title><p>Some text of chapter %d.</p></section>\n", i, i)
+	}
+	large := strings.Replace(book, "<section><title><p>Chapter 1</p></title><p>Some text.</p></section>", sections.String(), 1)
+
+	for _, tc := range []struct {
+		step   string // conversion is canceled when this step starts
+		format processor.OutputFmt
+	}{
+		{"Parsing images - done", processor.OEpub},
+		{"Saving content - starting", processor.OEpub},
+		{"Saving content - starting", processor.OAzw3},
+	} {
+		t.Run(tc.step+" "+tc.format.String(), func(t *testing.T) {
+
+			cfg, err := config.BuildConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Doc.Kindlegen.Engine = processor.EngineNative.String()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var (
+				canceled time.Time
+				after    []string
+			)
+			log := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.AddSync(io.Discard), zap.DebugLevel),
+				zap.Hooks(func(e zapcore.Entry) error {
+					if !canceled.IsZero() {
+						after = append(after, e.Message)
+					} else if e.Message == tc.step {
+						canceled = time.Now()
+						cancel()
+					}
+					return nil
+				}))
+
+			var out bytes.Buffer
+			_, err = Convert(ctx, strings.NewReader(large), &out, Options{Format: tc.format, Config: cfg, Log: log})
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if canceled.IsZero() {
+				t.Fatal("Conversion was not canceled")
+			}
+			if elapsed := time.Since(canceled); elapsed > time.Second {
+				t.Fatalf("Conversion took %v after it was canceled", elapsed)
+			}
+			// nothing is transferred or built after cancellation
+			for _, msg := range after {
+				if msg == "Processing images - start" || strings.HasPrefix(msg, "Producing kindle content") {
+					t.Fatalf("Conversion continued after it was canceled: %q", after)
+				}
+			}
+			if out.Len() != 0 {
+				t.Fatal("Canceled conversion produced output")
+			}
+		})
+	}
+}
+
+func TestConvertReproducible(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.Reproducible = true
+	cfg.Doc.Kindlegen.Engine = "native"
+
+	// without id and with document date
+	src := strings.Replace(book, `<document-info><id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id></document-info>`,
+		`<document-info><date value="2021-03-04">March 2021</date></document-info>`, 1)
+
+	for _, format := range []processor.OutputFmt{processor.OEpub, processor.OKepub, processor.OEpub3, processor.OAzw3} {
+		var first, second bytes.Buffer
+		res1, err := Convert(context.Background(), strings.NewReader(src), &first, Options{Format: format, Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: unable to convert: %v", format, err)
+		}
+		res2, err := Convert(context.Background(), strings.NewReader(src), &second, Options{Format: format, Config: cfg})
+		if err != nil {
+			t.Fatalf("%s: unable to convert: %v", format, err)
+		}
+		if res1.ID != res2.ID {
+			t.Fatalf("%s: book ids differ: %s, %s", format, res1.ID, res2.ID)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Fatalf("%s: results differ", format)
+		}
+		if format == processor.OAzw3 {
+			continue
+		}
+		z, err := zip.NewReader(bytes.NewReader(first.Bytes()), int64(first.Len()))
+		if err != nil {
+			t.Fatalf("%s: result is not an epub: %v", format, err)
+		}
+		for _, f := range z.File[1:] {
+			if y, m, d := f.Modified.Date(); y != 2021 || m != 3 || d != 4 {
+				t.Fatalf("%s: unexpected time of %s: %s", format, f.Name, f.Modified)
+			}
+		}
+	}
+
+	// content defines id of the book
+	var out bytes.Buffer
+	res1, err := Convert(context.Background(), strings.NewReader(src), &out, Options{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2, err := Convert(context.Background(), strings.NewReader(strings.Replace(src, "Some text.", "Other text.", 1)), &out, Options{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res1.ID == res2.ID {
+		t.Fatal("Different books got the same id")
+	}
+}
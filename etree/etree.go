@@ -38,6 +38,23 @@ type ReadSettings struct {
 
 	// Entity to be passed to standard xml.Decoder. Default: nil.
 	Entity map[string]string
+
+	// Recover, when set, turns on recovery mode: broken markup is repaired
+	// rather than rejected and Recover is called with input line number and
+	// description for every correction made. Default: nil.
+	Recover func(line int, msg string)
+
+	// KeepEndTags preserves the way empty elements are written: element
+	// read as <tag></tag> gets empty text and is written back the same way
+	// rather than as <tag/>. Default: false.
+	KeepEndTags bool
+
+	// Done, when set, is called for every element as soon as it is read
+	// completely, with all its children. Element is dropped from the
+	// document when Done returns false, so large content could be handled
+	// while document is still being read. Error returned by Done stops
+	// reading. Default: nil.
+	Done func(e *Element) (keep bool, err error)
 }
 
 // newReadSettings creates a default ReadSettings record.
@@ -450,6 +467,9 @@ func (e *Element) RemoveChild(t Token) Token {
 // ReadFrom reads XML from the reader r and stores the result as a new child
 // of element e.
 func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
+	if settings.Recover != nil {
+		return e.recoverFrom(ri, settings)
+	}
 	r := newCountReader(ri)
 	dec := xml.NewDecoder(r)
 	dec.CharsetReader = settings.CharsetReader
@@ -458,6 +478,7 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 	var (
 		stack stack
 		prev  Token
+		start int64 // input offset right after the last start tag
 	)
 	stack.push(e)
 	for {
@@ -481,8 +502,16 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 			}
 			stack.push(e)
 			prev = nil
+			start = dec.InputOffset()
 		case xml.EndElement:
-			prev = stack.pop().(Token)
+			e := stack.pop().(*Element)
+			if settings.KeepEndTags {
+				e.keepEndTag(dec.InputOffset() != start)
+			}
+			if err := e.done(settings.Done); err != nil {
+				return r.bytes, err
+			}
+			prev = e
 		case xml.CharData:
 			data := string(t)
 			if prev == nil {
@@ -500,6 +529,28 @@ func (e *Element) readFrom(ri io.Reader, settings ReadSettings) (n int64, err er
 	}
 }
 
+// keepEndTag makes sure empty element which had end tag in the input is
+// written with it. End tag of self-closing element is reported by decoder
+// without reading anything.
+func (e *Element) keepEndTag(hadEndTag bool) {
+	if hadEndTag && len(e.Child) == 0 {
+		newCharData("", false, e)
+	}
+}
+
+// done passes completely read element e to ReadSettings.Done and removes it
+// from its parent when asked to. Tail of removed element is lost.
+func (e *Element) done(fn func(e *Element) (bool, error)) error {
+	if fn == nil {
+		return nil
+	}
+	keep, err := fn(e)
+	if err == nil && !keep && e.parent != nil {
+		e.parent.RemoveChild(e)
+	}
+	return err
+}
+
 // SelectAttr finds an element attribute matching the requested key and
 // returns it if found. Returns nil if no matching attribute is found. The key
 // may be prefixed by a namespace and a colon.
@@ -6,7 +6,10 @@ package etree
 
 import (
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -574,3 +577,133 @@ func TestCharsetReaderEncoding(t *testing.T) {
 		}
 	}
 }
+
+func TestDocumentRead_Recover(t *testing.T) {
+	s := "<store>\n" +
+		"\t<book lang=\"en>\n" +
+		"\t\t<title>Tom & Jerry < Mickey &nbsp;\x01&#1;</title>\n" +
+		"\t\t<author>Charles <i>Dickens</author>\n" +
+		"\t</book></shelf>\n" +
+		"\t<book><title>Trunc"
+
+	doc := NewDocument()
+	if err := doc.ReadFromString(s); err == nil {
+		t.Fatal("etree: incorrect ReadFromString result")
+	}
+
+	var fixes []string
+	doc = NewDocument()
+	doc.ReadSettings.Recover = func(line int, msg string) {
+		fixes = append(fixes, fmt.Sprintf("%d: %s", line, msg))
+	}
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatalf("etree: unexpected error in recovery mode: %v", err)
+	}
+
+	books := doc.FindElements("./store/book")
+	if len(books) != 2 {
+		t.Fatalf("etree: expected 2 books, got %d", len(books))
+	}
+	checkEq(t, books[0].SelectAttrValue("lang", ""), "en>\n\t\t")
+	checkEq(t, books[0].SelectElement("title").Text(), "Tom & Jerry < Mickey &nbsp;")
+	checkEq(t, books[0].FindElement("author/i").Text(), "Dickens")
+	checkEq(t, books[1].SelectElement("title").Text(), "Trunc")
+
+	expected := []string{
+		"3: unterminated attribute value closed",
+		"3: stray '&' escaped",
+		"3: stray '<' escaped",
+		"3: stray '&' escaped",
+		"3: invalid character U+0001 dropped",
+		"3: reference to invalid character &#1; dropped",
+		"4: unclosed <i> closed by </author>",
+		"5: unexpected </shelf> ignored",
+		"6: unclosed <title> closed at the end of document",
+		"6: unclosed <book> closed at the end of document",
+		"6: unclosed <store> closed at the end of document",
+	}
+	if len(fixes) != len(expected) {
+		t.Fatalf("etree: unexpected repairs:\n%s", strings.Join(fixes, "\n"))
+	}
+	for i := range expected {
+		checkEq(t, fixes[i], expected[i])
+	}
+}
+
+func TestDocumentRead_Done(t *testing.T) {
+	s := `<store><book id="1"><title>A</title></book><blob>data</blob><book id="2"><title>B</title></book><blob>more</blob></store>`
+
+	for _, recovery := range []bool{false, true} {
+		var seen []string
+		doc := NewDocument()
+		if recovery {
+			doc.ReadSettings.Recover = func(int, string) {}
+		}
+		doc.ReadSettings.Done = func(e *Element) (bool, error) {
+			seen = append(seen, e.Tag)
+			return e.Tag != "blob", nil
+		}
+		if err := doc.ReadFromString(s); err != nil {
+			t.Fatalf("etree: unexpected error: %v", err)
+		}
+		checkEq(t, strings.Join(seen, ","), "title,book,blob,title,book,blob,store")
+		if n := len(doc.FindElements("//blob")); n != 0 {
+			t.Errorf("etree: expected dropped elements, got %d", n)
+		}
+		if n := len(doc.FindElements("./store/book")); n != 2 {
+			t.Errorf("etree: expected 2 books, got %d", n)
+		}
+	}
+
+	doc := NewDocument()
+	stop := errors.New("stop")
+	doc.ReadSettings.Done = func(e *Element) (bool, error) {
+		if e.Tag == "blob" {
+			return true, stop
+		}
+		return true, nil
+	}
+	if err := doc.ReadFromString(s); err != stop {
+		t.Fatalf("etree: expected error from Done, got %v", err)
+	}
+
+	// elements closed by recovery are reported as well
+	var seen []string
+	doc = NewDocument()
+	doc.ReadSettings.Recover = func(int, string) {}
+	doc.ReadSettings.Done = func(e *Element) (bool, error) {
+		seen = append(seen, e.Tag)
+		return true, nil
+	}
+	if err := doc.ReadFromString(`<store><book><title>A</book><book>B`); err != nil {
+		t.Fatalf("etree: unexpected error in recovery mode: %v", err)
+	}
+	checkEq(t, strings.Join(seen, ","), "title,book,book,store")
+}
+
+func TestDocumentRead_KeepEndTags(t *testing.T) {
+	s := `<a><b></b><c/><d><e/></d><f></f></a>`
+
+	for _, recovery := range []bool{false, true} {
+		doc := NewDocument()
+		doc.ReadSettings.KeepEndTags = true
+		if recovery {
+			doc.ReadSettings.Recover = func(int, string) {}
+		}
+		if err := doc.ReadFromString(s); err != nil {
+			t.Fatalf("etree: unexpected error: %v", err)
+		}
+		out, err := doc.WriteToString()
+		if err != nil {
+			t.Fatalf("etree: unable to write document: %v", err)
+		}
+		checkEq(t, out, s)
+	}
+
+	doc := NewDocument()
+	if err := doc.ReadFromString(s); err != nil {
+		t.Fatalf("etree: unexpected error: %v", err)
+	}
+	out, _ := doc.WriteToString()
+	checkEq(t, out, `<a><b/><c/><d><e/></d><f/></a>`)
+}
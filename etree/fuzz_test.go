@@ -0,0 +1,57 @@
+package etree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadFrom(f *testing.F) {
+
+	f.Add([]byte(testXML), false)
+	f.Add([]byte(testXML), true)
+	f.Add([]byte(`<a><b>text</a></b>`), true)
+	f.Add([]byte(`<?xml version="1.0"?><!DOCTYPE a [<!ENTITY e "x">]><a>&e;&nbsp;<![CDATA[data]]></a>`), false)
+	f.Add([]byte("<a\x00 b='1'>\xff</a>"), true)
+
+	f.Fuzz(func(t *testing.T, data []byte, recovery bool) {
+		doc := NewDocument()
+		if recovery {
+			doc.ReadSettings.Recover = func(int, string) {}
+		}
+		if err := doc.ReadFromBytes(data); err != nil {
+			if recovery {
+				t.Fatalf("document was not recovered: %v", err)
+			}
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := doc.WriteTo(&buf); err != nil {
+			t.Fatalf("unable to write parsed document: %v", err)
+		}
+	})
+}
+
+func FuzzPath(f *testing.F) {
+
+	for _, test := range tests {
+		f.Add(test.path)
+	}
+	// every step multiplies number of evaluated nodes unless they are deduplicated
+	f.Add("//..//..//..//..//..//..//..//..//..//..//..//..")
+
+	doc := NewDocument()
+	if err := doc.ReadFromString(testXML); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		path, err := CompilePath(s)
+		if err != nil {
+			return
+		}
+		doc.FindElementsPath(path)
+		for _, e := range doc.FindElements("//*") {
+			e.FindElementPath(path)
+		}
+	})
+}
@@ -133,10 +133,19 @@ type pather struct {
 	queue      fifo
 	results    []*Element
 	inResults  map[*Element]bool
+	queued     map[queuedNode]bool
 	candidates []*Element
 	scratch    []*Element // used by filters
 }
 
+// A queuedNode identifies a node by its element and the number of
+// remaining path segments. The same element could be reached many times
+// (for example by "//..//.."), it is evaluated only once.
+type queuedNode struct {
+	e      *Element
+	remain int
+}
+
 // A node represents an element and the remaining path segments that
 // should be applied against it by the pather.
 type node struct {
@@ -148,6 +157,7 @@ func newPather() *pather {
 	return &pather{
 		results:    make([]*Element, 0),
 		inResults:  make(map[*Element]bool),
+		queued:     make(map[queuedNode]bool),
 		candidates: make([]*Element, 0),
 		scratch:    make([]*Element, 0),
 	}
@@ -179,7 +189,10 @@ func (p *pather) eval(n node) {
 		}
 	} else {
 		for _, c := range p.candidates {
-			p.queue.add(node{c, remain})
+			if q := (queuedNode{c, len(remain)}); !p.queued[q] {
+				p.queued[q] = true
+				p.queue.add(node{c, remain})
+			}
 		}
 	}
 }
@@ -240,7 +253,7 @@ func (c *compiler) parseSegment(path string) segment {
 	}
 	for i := 1; i < len(pieces); i++ {
 		fpath := pieces[i]
-		if fpath[len(fpath)-1] != ']' {
+		if len(fpath) == 0 || fpath[len(fpath)-1] != ']' {
 			c.err = ErrPath("path has invalid filter [brackets].")
 			break
 		}
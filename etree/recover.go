@@ -0,0 +1,335 @@
+package etree
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// recoverFrom reads possibly broken XML from the reader r and stores the
+// result as a new child of element e. Input is sanitized first, so only
+// structural problems reach the decoder: end tags are matched against open
+// elements, stray end tags are ignored, elements left open are closed and
+// decoding errors (usually truncated input) end the document. Every
+// correction is passed to settings.Recover.
+func (e *Element) recoverFrom(ri io.Reader, settings ReadSettings) (n int64, err error) {
+	r := newCountReader(ri)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return r.bytes, err
+	}
+	fix := settings.Recover
+	data = sanitize(data, settings.Entity, fix)
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.CharsetReader = settings.CharsetReader
+	dec.Strict = false
+	dec.Entity = settings.Entity
+	var (
+		stack stack
+		prev  Token
+		start int64 // input offset right after the last start tag
+	)
+	stack.push(e)
+	for {
+		t, err := dec.RawToken()
+		if err != nil {
+			if err != io.EOF {
+				line, _ := dec.InputPos()
+				fix(line, fmt.Sprintf("reading stopped: %v", err))
+			}
+			for len(stack.data) > 1 {
+				line, _ := dec.InputPos()
+				e := stack.pop().(*Element)
+				fix(line, fmt.Sprintf("unclosed <%s> closed at the end of document", elementTag(e)))
+				if err := e.done(settings.Done); err != nil {
+					return r.bytes, err
+				}
+			}
+			return r.bytes, nil
+		}
+
+		top := stack.peek().(*Element)
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			e := newElement(t.Name.Space, t.Name.Local, top)
+			for _, a := range t.Attr {
+				e.createAttr(a.Name.Space, a.Name.Local, a.Value)
+			}
+			stack.push(e)
+			prev = nil
+			start = dec.InputOffset()
+		case xml.EndElement:
+			line, _ := dec.InputPos()
+			i := stack.find(t.Name.Space, t.Name.Local)
+			if i < 1 {
+				fix(line, fmt.Sprintf("unexpected </%s> ignored", fullTag(t.Name)))
+				continue
+			}
+			for len(stack.data)-1 > i {
+				e := stack.pop().(*Element)
+				fix(line, fmt.Sprintf("unclosed <%s> closed by </%s>", elementTag(e), fullTag(t.Name)))
+				if err := e.done(settings.Done); err != nil {
+					return r.bytes, err
+				}
+			}
+			e := stack.pop().(*Element)
+			if settings.KeepEndTags {
+				e.keepEndTag(dec.InputOffset() != start)
+			}
+			if err := e.done(settings.Done); err != nil {
+				return r.bytes, err
+			}
+			prev = e
+		case xml.CharData:
+			data := string(t)
+			if prev == nil {
+				newCharData(data, isWhitespace(data), top)
+			} else {
+				prev.setTail(data)
+			}
+		case xml.Comment:
+			prev = interface{}(newComment(string(t), top)).(Token)
+		case xml.Directive:
+			prev = interface{}(newDirective(string(t), top)).(Token)
+		case xml.ProcInst:
+			prev = interface{}(newProcInst(t.Target, string(t.Inst), top)).(Token)
+		}
+	}
+}
+
+// find returns index of the topmost element on the stack with specified tag
+// or -1.
+func (s *stack) find(space, tag string) int {
+	for i := len(s.data) - 1; i >= 0; i-- {
+		if e, ok := s.data[i].(*Element); ok && e.Space == space && e.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+func elementTag(e *Element) string {
+	return fullTag(xml.Name{Space: e.Space, Local: e.Tag})
+}
+
+func fullTag(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// sanitizer rewrites markup so standard decoder could read it: stray '<' and
+// '&' are escaped, invalid characters and references to them are dropped,
+// unterminated tags and attribute values are closed. Line structure of the
+// input is preserved, so reported line numbers stay meaningful.
+type sanitizer struct {
+	src    []byte
+	pos    int
+	line   int
+	dst    bytes.Buffer
+	entity map[string]string
+	fix    func(line int, msg string)
+}
+
+func sanitize(src []byte, entity map[string]string, fix func(line int, msg string)) []byte {
+	s := &sanitizer{src: src, line: 1, entity: entity, fix: fix}
+	s.dst.Grow(len(src))
+	for s.pos < len(s.src) {
+		switch s.src[s.pos] {
+		case '<':
+			s.markup()
+		case '&':
+			s.reference()
+		default:
+			s.char()
+		}
+	}
+	return s.dst.Bytes()
+}
+
+// char copies single valid character to the output.
+func (s *sanitizer) char() {
+	r, size := utf8.DecodeRune(s.src[s.pos:])
+	switch {
+	case r == utf8.RuneError && size == 1:
+		s.fix(s.line, "invalid UTF-8 sequence dropped")
+	case !isInCharacterRange(r):
+		s.fix(s.line, fmt.Sprintf("invalid character U+%04X dropped", r))
+	default:
+		if r == '\n' {
+			s.line++
+		}
+		s.dst.Write(s.src[s.pos : s.pos+size])
+	}
+	s.pos += size
+}
+
+// copyUntil copies input up to and including terminator and reports if it was
+// found.
+func (s *sanitizer) copyUntil(term string) bool {
+	i := bytes.Index(s.src[s.pos:], []byte(term))
+	if i < 0 {
+		return false
+	}
+	end := s.pos + i + len(term)
+	for s.pos < end {
+		s.char()
+	}
+	return true
+}
+
+// dropRest ignores everything left in the input.
+func (s *sanitizer) dropRest(what string) {
+	s.fix(s.line, fmt.Sprintf("unterminated %s dropped", what))
+	s.pos = len(s.src)
+}
+
+var xmlEntities = map[string]bool{"lt": true, "gt": true, "amp": true, "apos": true, "quot": true}
+
+// reference handles '&' - well formed references to known entities and valid
+// characters are kept, anything else is treated as literal text.
+func (s *sanitizer) reference() {
+	rest := s.src[s.pos+1:]
+	end := bytes.IndexByte(rest[:min(len(rest), 32)], ';')
+	if end > 0 {
+		name := string(rest[:end])
+		if name[0] == '#' {
+			var (
+				v   uint64
+				err error
+			)
+			if len(name) > 1 && (name[1] == 'x' || name[1] == 'X') {
+				v, err = strconv.ParseUint(name[2:], 16, 32)
+			} else {
+				v, err = strconv.ParseUint(name[1:], 10, 32)
+			}
+			if err == nil {
+				if !isInCharacterRange(rune(v)) {
+					s.fix(s.line, fmt.Sprintf("reference to invalid character &%s; dropped", name))
+				} else {
+					s.dst.Write(s.src[s.pos : s.pos+end+2])
+				}
+				s.pos += end + 2
+				return
+			}
+		} else if _, ok := s.entity[name]; ok || xmlEntities[name] {
+			s.dst.Write(s.src[s.pos : s.pos+end+2])
+			s.pos += end + 2
+			return
+		}
+	}
+	s.fix(s.line, "stray '&' escaped")
+	s.dst.WriteString("&amp;")
+	s.pos++
+}
+
+func (s *sanitizer) hasPrefix(prefix string) bool {
+	return bytes.HasPrefix(s.src[s.pos:], []byte(prefix))
+}
+
+func isNameStart(b []byte) bool {
+	r, _ := utf8.DecodeRune(b)
+	return r == '_' || r == ':' || unicode.IsLetter(r)
+}
+
+// markup handles '<'.
+func (s *sanitizer) markup() {
+	switch {
+	case s.hasPrefix("<!--"):
+		if !s.copyUntil("-->") {
+			s.dropRest("comment")
+		}
+	case s.hasPrefix("<![CDATA["):
+		if !s.copyUntil("]]>") {
+			s.fix(s.line, "unterminated CDATA section closed")
+			for s.pos < len(s.src) {
+				s.char()
+			}
+			s.dst.WriteString("]]>")
+		}
+	case s.hasPrefix("<?"):
+		if !s.copyUntil("?>") {
+			s.dropRest("processing instruction")
+		}
+	case s.hasPrefix("<!"):
+		s.directive()
+	case s.hasPrefix("</") && isNameStart(s.src[s.pos+2:]):
+		s.tag(2)
+	case isNameStart(s.src[s.pos+1:]):
+		s.tag(1)
+	default:
+		s.fix(s.line, "stray '<' escaped")
+		s.dst.WriteString("&lt;")
+		s.pos++
+	}
+}
+
+// directive copies directive, which may have nested markup declarations.
+func (s *sanitizer) directive() {
+	depth := 0
+	for i := s.pos + 1; i < len(s.src); i++ {
+		switch s.src[i] {
+		case '<':
+			depth++
+		case '>':
+			if depth == 0 {
+				for s.pos <= i {
+					s.char()
+				}
+				return
+			}
+			depth--
+		}
+	}
+	s.dropRest("directive")
+}
+
+// tag copies start or end tag skipping prefix bytes first.
+func (s *sanitizer) tag(prefix int) {
+	start := s.dst.Len()
+	s.dst.Write(s.src[s.pos : s.pos+prefix])
+	s.pos += prefix
+
+	var quote byte
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; {
+		case quote != 0 && c == quote:
+			quote = 0
+			s.dst.WriteByte(c)
+			s.pos++
+		case quote != 0 && c == '<':
+			// markup inside of attribute value - most likely closing quote is missing
+			s.fix(s.line, "unterminated attribute value closed")
+			s.dst.WriteByte(quote)
+			s.dst.WriteByte('>')
+			return
+		case quote != 0 && c == '&':
+			s.reference()
+		case quote != 0:
+			s.char()
+		case c == '"' || c == '\'':
+			quote = c
+			s.dst.WriteByte(c)
+			s.pos++
+		case c == '>':
+			s.dst.WriteByte(c)
+			s.pos++
+			return
+		case c == '<':
+			s.fix(s.line, "unterminated tag closed")
+			s.dst.WriteByte('>')
+			return
+		default:
+			s.char()
+		}
+	}
+	s.fix(s.line, "truncated tag dropped")
+	s.dst.Truncate(start)
+}
@@ -0,0 +1,245 @@
+// Package inpx reads INPX collection indexes used by MyHomeLib and similar library managers to describe Librusec and
+// Flibusta dumps. Index is a zip archive with one inp file per book archive, every line of inp file describes single
+// book.
+package inpx
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Author is a single book author as stored in index.
+type Author struct {
+	First  string
+	Middle string
+	Last   string
+}
+
+// String returns author name in natural order.
+func (a Author) String() string {
+	return strings.Join(strings.Fields(a.First+" "+a.Middle+" "+a.Last), " ")
+}
+
+// Book is a single index record.
+type Book struct {
+	Authors  []Author
+	Genres   []string
+	Title    string
+	Series   string
+	SeqNum   int
+	File     string // name of the book file inside archive without extension
+	Ext      string
+	Size     int64
+	LibID    string
+	Deleted  bool
+	Date     string // date book was added to the library
+	Lang     string
+	Keywords string
+	// Archive is name of the archive with book file, relative to index location.
+	Archive string
+}
+
+// Name returns name of the book file inside archive.
+func (b *Book) Name() string {
+	if len(b.Ext) == 0 {
+		return b.File
+	}
+	return b.File + "." + b.Ext
+}
+
+// Collection is parsed index.
+type Collection struct {
+	Name        string
+	Description string
+	Version     string
+	Books       []*Book
+}
+
+// defaultStructure is used when index does not have structure.info.
+var defaultStructure = []string{"AUTHOR", "GENRE", "TITLE", "SERIES", "SERNO", "FILE", "SIZE", "LIBID", "DEL", "EXT", "DATE", "LANG", "LIBRATE", "KEYWORDS"}
+
+const (
+	fieldSeparator = "\x04"
+	listSeparator  = ":"
+	nameSeparator  = ","
+)
+
+// Open reads index file.
+func Open(fname string) (*Collection, error) {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open index: %w", err)
+	}
+	defer zr.Close()
+	return Read(&zr.Reader)
+}
+
+// Read parses index from zip archive.
+func Read(zr *zip.Reader) (*Collection, error) {
+
+	c := &Collection{}
+	structure := defaultStructure
+
+	var inps []*zip.File
+	for _, f := range zr.File {
+		switch name := strings.ToLower(f.Name); {
+		case name == "collection.info":
+			lines, err := readLines(f)
+			if err != nil {
+				return nil, err
+			}
+			// name, file name, collection type, description, url
+			if len(lines) > 0 {
+				c.Name = lines[0]
+			}
+			if len(lines) > 3 {
+				c.Description = lines[3]
+			}
+		case name == "version.info":
+			lines, err := readLines(f)
+			if err != nil {
+				return nil, err
+			}
+			if len(lines) > 0 {
+				c.Version = lines[0]
+			}
+		case name == "structure.info":
+			lines, err := readLines(f)
+			if err != nil {
+				return nil, err
+			}
+			if len(lines) > 0 {
+				structure = strings.Split(strings.ToUpper(strings.TrimSuffix(lines[0], ";")), ";")
+			}
+		case path.Ext(name) == ".inp":
+			inps = append(inps, f)
+		}
+	}
+	if len(inps) == 0 {
+		return nil, errors.New("index does not have any inp files")
+	}
+
+	for _, f := range inps {
+		lines, err := readLines(f)
+		if err != nil {
+			return nil, err
+		}
+		archive := strings.TrimSuffix(f.Name, path.Ext(f.Name)) + ".zip"
+		for i, line := range lines {
+			if len(line) == 0 {
+				continue
+			}
+			b, err := parseBook(strings.Split(line, fieldSeparator), structure)
+			if err != nil {
+				return nil, fmt.Errorf("%s, line %d: %w", f.Name, i+1, err)
+			}
+			if len(b.Archive) == 0 {
+				b.Archive = archive
+			}
+			c.Books = append(c.Books, b)
+		}
+	}
+	return c, nil
+}
+
+func readLines(f *zip.File) ([]string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", f.Name, err)
+	}
+	defer r.Close()
+
+	var lines []string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		lines = append(lines, strings.TrimSuffix(s.Text(), "\r"))
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", f.Name, err)
+	}
+	if len(lines) > 0 {
+		lines[0] = strings.TrimPrefix(lines[0], "\uFEFF")
+	}
+	return lines, nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, listSeparator) {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func parseBook(fields, structure []string) (*Book, error) {
+
+	b := &Book{}
+	for i, name := range structure {
+		if i >= len(fields) {
+			break
+		}
+		v := strings.TrimSpace(fields[i])
+		switch name {
+		case "AUTHOR":
+			for _, a := range splitList(v) {
+				parts := strings.Split(a, nameSeparator)
+				var author Author
+				author.Last = strings.TrimSpace(parts[0])
+				if len(parts) > 1 {
+					author.First = strings.TrimSpace(parts[1])
+				}
+				if len(parts) > 2 {
+					author.Middle = strings.TrimSpace(parts[2])
+				}
+				b.Authors = append(b.Authors, author)
+			}
+		case "GENRE":
+			b.Genres = splitList(v)
+		case "TITLE":
+			b.Title = v
+		case "SERIES":
+			b.Series = v
+		case "SERNO":
+			if len(v) > 0 {
+				// numbers are sometimes stored with leading zeroes or garbage, ignore what cannot be parsed
+				b.SeqNum, _ = strconv.Atoi(v)
+			}
+		case "FILE":
+			b.File = v
+		case "EXT":
+			b.Ext = v
+		case "SIZE":
+			if len(v) > 0 {
+				size, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad book size %q", v)
+				}
+				b.Size = size
+			}
+		case "LIBID":
+			b.LibID = v
+		case "DEL":
+			b.Deleted = v == "1"
+		case "DATE":
+			b.Date = v
+		case "LANG":
+			b.Lang = v
+		case "KEYWORDS":
+			b.Keywords = v
+		case "FOLDER":
+			b.Archive = v
+		}
+	}
+	if len(b.File) == 0 {
+		return nil, errors.New("book file name is missing")
+	}
+	return b, nil
+}
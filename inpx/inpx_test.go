@@ -0,0 +1,126 @@
+package inpx
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func record(fields ...string) string {
+	return strings.Join(fields, fieldSeparator) + "\r\n"
+}
+
+func buildIndex(t *testing.T, files map[string]string) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func TestRead(t *testing.T) {
+
+	zr := buildIndex(t, map[string]string{
+		"collection.info": "\uFEFFTest library\r\ntest\r\n65536\r\nLibrary for tests\r\n",
+		"version.info":    "20240101\r\n",
+		"fb2-000001-000100.inp": record("Толстой,Лев,Николаевич:", "prose_classic:", "Война и мир", "", "", "10", "1024", "10", "0", "fb2", "2009-01-01", "ru", "5", "") +
+			record("Strugatsky,Arkady,:Strugatsky,Boris,:", "sf_social:sf:", "Roadside Picnic", "Noon Universe", "07", "11", "2048", "11", "1", "fb2", "2009-01-02", "en", "", "") +
+			"\r\n",
+	})
+	c, err := Read(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "Test library" || c.Description != "Library for tests" || c.Version != "20240101" || len(c.Books) != 2 {
+		t.Fatalf("Unexpected collection: %+v", c)
+	}
+	b := c.Books[0]
+	if b.Title != "Война и мир" || len(b.Authors) != 1 || b.Authors[0].String() != "Лев Николаевич Толстой" ||
+		b.Name() != "10.fb2" || b.Archive != "fb2-000001-000100.zip" || b.Size != 1024 || b.Lang != "ru" || b.Deleted {
+		t.Fatalf("Unexpected book: %+v", b)
+	}
+	b = c.Books[1]
+	if len(b.Authors) != 2 || b.Authors[1].String() != "Boris Strugatsky" || b.Series != "Noon Universe" || b.SeqNum != 7 ||
+		len(b.Genres) != 2 || b.Genres[0] != "sf_social" || !b.Deleted {
+		t.Fatalf("Unexpected book: %+v", b)
+	}
+
+	// custom structure with archive name in the record
+	zr = buildIndex(t, map[string]string{
+		"structure.info": "FILE;EXT;TITLE;FOLDER;",
+		"all.inp":        record("20", "fb2", "Title", "books/other.zip"),
+	})
+	if c, err = Read(zr); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Books) != 1 || c.Books[0].Archive != "books/other.zip" || c.Books[0].Title != "Title" {
+		t.Fatalf("Unexpected collection: %+v", c.Books[0])
+	}
+
+	if _, err = Read(buildIndex(t, map[string]string{"collection.info": "Empty"})); err == nil {
+		t.Fatal("Expected error for index without inp files")
+	}
+	if _, err = Read(buildIndex(t, map[string]string{"a.inp": record("Author", "sf", "No file")})); err == nil {
+		t.Fatal("Expected error for record without file name")
+	}
+}
+
+func TestQuery(t *testing.T) {
+
+	books := []*Book{
+		{Authors: []Author{{First: "Лев", Last: "Толстой"}}, Genres: []string{"prose_classic"}, Title: "Война и мир", Lang: "ru", LibID: "10"},
+		{Authors: []Author{{First: "Arkady", Last: "Strugatsky"}, {First: "Boris", Last: "Strugatsky"}}, Genres: []string{"sf_social"}, Title: "Roadside Picnic", Series: "Noon Universe", Lang: "en", LibID: "11"},
+		{Authors: []Author{{First: "Isaac", Last: "Asimov"}}, Genres: []string{"sf"}, Title: "Foundation", Lang: "en", LibID: "12", Deleted: true},
+		{Authors: []Author{{First: "Some", Last: "Body"}}, Genres: []string{"sfx"}, Title: "Other", Lang: "EN", LibID: "13"},
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"10", "11", "13"}},
+		{"author=толстой", []string{"10"}},
+		{"author=boris strug", []string{"11"}},
+		{"genre=sf", []string{"11"}},
+		{"lang=en", []string{"11", "13"}},
+		{"lang=en; title=picnic", []string{"11"}},
+		{"libid=10;libid=13", []string{"10", "13"}},
+		{"series=noon;lang=ru", nil},
+	} {
+		q, err := ParseQuery(tc.query)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		var ids []string
+		for _, b := range books {
+			if q.Match(b) {
+				ids = append(ids, b.LibID)
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("%q: expected %v, got %v", tc.query, tc.expected, ids)
+		}
+	}
+
+	for _, s := range []string{"author", "publisher=x", "lang="} {
+		if _, err := ParseQuery(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package inpx
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Query selects books from collection. Query is a list of "field=value" terms separated by semicolons, for example
+// "author=Толстой;lang=ru". Terms for the same field are alternatives, book has to match every field mentioned.
+// Supported fields are:
+//
+//	author - part of any author name, case insensitive
+//	title  - part of the title, case insensitive
+//	series - part of the series name, case insensitive
+//	genre  - genre code or its prefix, "sf" selects "sf_fantasy" and "sf_history"
+//	lang   - book language
+//	libid  - library id of the book
+type Query map[string][]string
+
+var queryFields = []string{"author", "title", "series", "genre", "lang", "libid"}
+
+// ParseQuery parses query string, empty string selects all books.
+func ParseQuery(s string) (Query, error) {
+	q := make(Query)
+	for _, term := range strings.Split(s, ";") {
+		if term = strings.TrimSpace(term); len(term) == 0 {
+			continue
+		}
+		field, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed query term %q, field=value expected", term)
+		}
+		field, value = strings.ToLower(strings.TrimSpace(field)), strings.ToLower(strings.TrimSpace(value))
+		if !slices.Contains(queryFields, field) {
+			return nil, fmt.Errorf("unknown query field %q (supported fields: %s)", field, strings.Join(queryFields, ", "))
+		}
+		if len(value) == 0 {
+			return nil, fmt.Errorf("empty value for query field %q", field)
+		}
+		q[field] = append(q[field], value)
+	}
+	return q, nil
+}
+
+// Match checks if book satisfies query. Deleted books never match.
+func (q Query) Match(b *Book) bool {
+	if b.Deleted {
+		return false
+	}
+	for field, values := range q {
+		if !slices.ContainsFunc(values, func(v string) bool { return matchField(b, field, v) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s, v string) bool {
+	return strings.Contains(strings.ToLower(s), v)
+}
+
+func matchField(b *Book, field, v string) bool {
+	switch field {
+	case "author":
+		for _, a := range b.Authors {
+			if contains(a.String(), v) {
+				return true
+			}
+		}
+	case "title":
+		return contains(b.Title, v)
+	case "series":
+		return contains(b.Series, v)
+	case "genre":
+		for _, g := range b.Genres {
+			if g = strings.ToLower(g); g == v || strings.HasPrefix(g, v+"_") {
+				return true
+			}
+		}
+	case "lang":
+		return strings.EqualFold(b.Lang, v)
+	case "libid":
+		return b.LibID == v
+	}
+	return false
+}
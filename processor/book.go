@@ -41,17 +41,27 @@ type notelink struct {
 // Book information and parsing context.
 type Book struct {
 	// description
-	ID         uuid.UUID
-	ASIN       string
-	Title      string
-	Lang       language.Tag
-	Cover      string
-	Genres     []string
-	Authors    []*config.AuthorName
-	SeqName    string
-	SeqNum     int
-	Annotation string
-	Date       string
+	ID          uuid.UUID
+	ASIN        string
+	Title       string
+	Lang        language.Tag
+	Cover       string
+	Genres      []string
+	Authors     []*config.AuthorName
+	SeqName     string
+	SeqNum      int
+	Annotation  string
+	Date        string
+	Translators []*config.AuthorName
+	// publish-info
+	Publisher   string
+	PublishCity string
+	PublishYear string
+	ISBN        string
+	// src-title-info - original book
+	SrcTitle   string
+	SrcLang    string
+	SrcAuthors []*config.AuthorName
 	// book structure
 	TOC            []*tocEntry       // collected TOC entries
 	Files          []*dataFile       // generated content
@@ -170,12 +180,15 @@ func (b *Book) flushData(path string) error {
 	return nil
 }
 
-// flushXHTML saves all content files generated by transforming fb2.
-func (b *Book) flushXHTML(path string) error {
+// flushXHTML saves all content files generated by transforming fb2, it stops when "canceled" returns error.
+func (b *Book) flushXHTML(path string, canceled func() error) error {
 
 	if len(b.Files) == 0 {
 		return nil
 	} else if len(b.Files) == 1 {
+		if err := canceled(); err != nil {
+			return err
+		}
 		if err := b.Files[0].flush(path); err != nil {
 			return err // no point continuing
 		}
@@ -199,7 +212,10 @@ func (b *Book) flushXHTML(path string) error {
 				if f == nil || atomic.LoadInt32(&haveError) != 0 {
 					break
 				}
-				err := f.flush(path)
+				err := canceled()
+				if err == nil {
+					err = f.flush(path)
+				}
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
 					res <- err
@@ -226,14 +242,18 @@ func (b *Book) flushXHTML(path string) error {
 	return nil
 }
 
-// flushImages saves all images - coming from fb2 binary tags.
-func (b *Book) flushImages(path string) error {
+// flushImages saves all images - coming from fb2 binary tags, using up to jobs goroutines. It stops when "canceled"
+// returns error.
+func (b *Book) flushImages(path string, jobs int, canceled func() error) error {
 
 	if len(b.Images) == 0 {
 		return nil
 	}
 
 	if len(b.Images) == 1 {
+		if err := canceled(); err != nil {
+			return err
+		}
 		if err := b.Images[0].flush(path); err != nil {
 			return err // no point continuing
 		}
@@ -249,7 +269,7 @@ func (b *Book) flushImages(path string) error {
 	res := make(chan error, len(b.Images))
 
 	// start processing pool
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < jobs; i++ {
 		wg.Add(1)
 		go func(job <-chan *binImage, res chan<- error) {
 			defer wg.Done()
@@ -257,7 +277,10 @@ func (b *Book) flushImages(path string) error {
 				if f == nil || atomic.LoadInt32(&haveError) != 0 {
 					break
 				}
-				err := f.flush(path)
+				err := canceled()
+				if err == nil {
+					err = f.flush(path)
+				}
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
 					res <- err
@@ -0,0 +1,355 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// Statistical detection of legacy single byte code pages for sources without BOM. Many old FB2 files declare one
+// encoding and use another or do not declare anything at all.
+
+// Relative frequencies of non ASCII characters in texts of supported languages, lower case only.
+var (
+	cyrillicWeights = map[rune]float64{
+		// Russian
+		'о': 10.97, 'е': 8.45, 'а': 8.01, 'и': 7.35, 'н': 6.70, 'т': 6.26, 'с': 5.47, 'р': 4.73, 'в': 4.54, 'л': 4.40,
+		'к': 3.49, 'м': 3.21, 'д': 2.98, 'п': 2.81, 'у': 2.62, 'я': 2.01, 'ы': 1.90, 'ь': 1.74, 'г': 1.70, 'з': 1.65,
+		'б': 1.59, 'ч': 1.44, 'й': 1.21, 'х': 0.97, 'ж': 0.94, 'ш': 0.73, 'ю': 0.64, 'ц': 0.48, 'щ': 0.36, 'э': 0.32,
+		'ф': 0.26, 'ъ': 0.04, 'ё': 0.04,
+		// Ukrainian and Belarusian
+		'і': 3.0, 'ї': 0.6, 'є': 0.4, 'ґ': 0.05, 'ў': 0.5,
+		// Serbian and Macedonian
+		'ђ': 0.1, 'ј': 0.5, 'љ': 0.2, 'њ': 0.2, 'ћ': 0.2, 'џ': 0.05, 'ѓ': 0.05, 'ќ': 0.05, 'ѕ': 0.05,
+	}
+	centralWeights = map[rune]float64{
+		'á': 1.0, 'é': 1.0, 'í': 1.0, 'ó': 0.8, 'ú': 0.3, 'ý': 0.6, 'č': 0.8, 'ř': 0.8, 'š': 0.8, 'ž': 0.7, 'ě': 0.8,
+		'ą': 0.7, 'ę': 0.7, 'ł': 0.9, 'ś': 0.5, 'ż': 0.5, 'ź': 0.1, 'ć': 0.3, 'ń': 0.3, 'ő': 0.4, 'ű': 0.1, 'ö': 0.5,
+		'ü': 0.5, 'ď': 0.1, 'ť': 0.1, 'ň': 0.1, 'ů': 0.3, 'ô': 0.1, 'ä': 0.4, 'ĺ': 0.05, 'ľ': 0.1, 'ŕ': 0.05, 'đ': 0.1,
+		'ă': 0.3, 'â': 0.1, 'î': 0.1, 'ş': 0.3, 'ţ': 0.3, 'ß': 0.05,
+	}
+	westernWeights = map[rune]float64{
+		'é': 4.0, 'è': 1.0, 'à': 1.0, 'ê': 0.5, 'ç': 0.3, 'ù': 0.1, 'â': 0.1, 'î': 0.1, 'ô': 0.1, 'û': 0.05, 'œ': 0.05,
+		'ë': 0.05, 'ï': 0.05, 'ü': 1.0, 'ö': 0.8, 'ä': 1.0, 'ß': 0.5, 'ñ': 0.5, 'á': 0.8, 'í': 1.0, 'ó': 1.0, 'ú': 0.3,
+		'ã': 0.5, 'õ': 0.2, 'å': 0.5, 'æ': 0.2, 'ø': 0.4, 'ì': 0.1, 'ò': 0.1, '¿': 0.1, '¡': 0.1,
+	}
+	typographyWeights = map[rune]float64{
+		'«': 1.0, '»': 1.0, '—': 1.0, '–': 0.5, '…': 0.5, '“': 0.5, '”': 0.5, '„': 0.3, '’': 0.5, '‘': 0.2, '№': 0.1,
+		'\u00a0': 0.5, '·': 0.05, '§': 0.05,
+	}
+)
+
+func init() {
+	// make language models comparable
+	for _, m := range []map[rune]float64{cyrillicWeights, centralWeights, westernWeights} {
+		var total float64
+		for _, w := range m {
+			total += w
+		}
+		for r, w := range m {
+			m[r] = w * 100 / total
+		}
+	}
+}
+
+// charsetCandidate is a code page detection could select.
+type charsetCandidate struct {
+	name    string
+	enc     *charmap.Charmap
+	weights map[rune]float64
+}
+
+var charsetCandidates = []charsetCandidate{
+	{"windows-1251", charmap.Windows1251, cyrillicWeights},
+	{"koi8-r", charmap.KOI8R, cyrillicWeights},
+	{"koi8-u", charmap.KOI8U, cyrillicWeights},
+	{"ibm866", charmap.CodePage866, cyrillicWeights},
+	{"iso-8859-5", charmap.ISO8859_5, cyrillicWeights},
+	{"windows-1250", charmap.Windows1250, centralWeights},
+	{"iso-8859-2", charmap.ISO8859_2, centralWeights},
+	{"windows-1252", charmap.Windows1252, westernWeights},
+	{"iso-8859-1", charmap.ISO8859_1, westernWeights},
+}
+
+// charsetAliases maps labels which could be seen in XML declarations to candidate names.
+var charsetAliases = map[string]string{
+	"cp1251": "windows-1251", "win-1251": "windows-1251", "x-cp1251": "windows-1251",
+	"koi8r": "koi8-r", "cskoi8r": "koi8-r",
+	"cp866": "ibm866", "866": "ibm866",
+	"cp1250": "windows-1250", "x-cp1250": "windows-1250",
+	"cp1252": "windows-1252", "latin1": "iso-8859-1", "iso8859-1": "iso-8859-1", "iso_8859-1": "iso-8859-1",
+	"latin2": "iso-8859-2", "iso8859-2": "iso-8859-2",
+	"iso8859-5": "iso-8859-5",
+	"us-ascii":  "utf-8", "ascii": "utf-8", "utf8": "utf-8",
+}
+
+const (
+	unknownCharWeight = 0.001
+	badCharWeight     = 0.00001
+	caseBreakPenalty  = 3.0 // capital letter following small one in the same word
+	mixedWordPenalty  = 5.0 // word mixes Latin and Cyrillic letters
+	alienWordPenalty  = 3.0 // latin word made mostly of non ASCII letters
+	declaredTolerance = 0.1 // declared encoding is kept when its score is this close (relative) to the best one
+	charsetSampleSize = 64 * 1024
+	charsetPrefixSize = 1024 * 1024 // amount of source read to find text sample
+)
+
+var xmlEncodingDecl = regexp.MustCompile(`^\s*<\?xml[^>]*?encoding\s*=\s*["']([^"']+)["']`)
+
+// declaredCharset returns encoding label from XML declaration, if any.
+func declaredCharset(data []byte) string {
+	if m := xmlEncodingDecl.FindSubmatch(data[:min(len(data), 256)]); m != nil {
+		return strings.ToLower(strings.TrimSpace(string(m[1])))
+	}
+	return ""
+}
+
+// canonicalCharset returns candidate name for the label or label itself.
+func canonicalCharset(label string) string {
+	if name, ok := charsetAliases[label]; ok {
+		return name
+	}
+	return label
+}
+
+// scoreCharset estimates how plausible decoded text is, higher is better.
+func scoreCharset(data []byte, c charsetCandidate) float64 {
+
+	var (
+		score                          float64
+		prevLetter, prevLower          bool
+		latin, cyrillic, ascii, nonASC int
+	)
+
+	endWord := func() {
+		if latin > 0 && cyrillic > 0 {
+			score -= mixedWordPenalty
+		}
+		if cyrillic == 0 && nonASC >= 2 && nonASC > ascii && nonASC+ascii >= 4 {
+			score -= alienWordPenalty
+		}
+		latin, cyrillic, ascii, nonASC = 0, 0, 0, 0
+	}
+
+	for _, b := range data {
+		var r rune
+		if b < utf8.RuneSelf {
+			r = rune(b)
+		} else {
+			r = c.enc.DecodeByte(b)
+			w, ok := c.weights[unicode.ToLower(r)]
+			if !ok {
+				w, ok = typographyWeights[r]
+			}
+			switch {
+			case ok:
+			case r == utf8.RuneError || unicode.IsControl(r):
+				w = badCharWeight
+			default:
+				w = unknownCharWeight
+			}
+			score += math.Log(w)
+		}
+
+		if !unicode.IsLetter(r) {
+			if prevLetter {
+				endWord()
+			}
+			prevLetter = false
+			continue
+		}
+		if prevLetter && prevLower && unicode.IsUpper(r) {
+			score -= caseBreakPenalty
+		}
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case r < utf8.RuneSelf:
+			ascii++
+			latin++
+		default:
+			nonASC++
+			latin++
+		}
+		prevLetter, prevLower = true, unicode.IsLower(r)
+	}
+	if prevLetter {
+		endWord()
+	}
+	return score
+}
+
+// charsetSample returns beginning of the text encoding is detected on. Content of binaries is base64 and says nothing
+// about encoding, it is skipped.
+func charsetSample(data []byte) []byte {
+
+	sample := make([]byte, 0, min(len(data), charsetSampleSize))
+	for len(data) > 0 && len(sample) < charsetSampleSize {
+		start := bytes.Index(data, []byte("<binary"))
+		if start < 0 {
+			start = len(data)
+		}
+		sample = append(sample, data[:min(start, charsetSampleSize-len(sample))]...)
+		data = data[start:]
+		end := bytes.Index(data, []byte("</binary>"))
+		if end < 0 {
+			break
+		}
+		data = data[end+len("</binary>"):]
+	}
+	return sample
+}
+
+// validUTF8 checks if data is UTF-8 text, which may end in the middle of multibyte sequence.
+func validUTF8(data []byte) bool {
+	for i := len(data) - 1; i >= max(0, len(data)-utf8.UTFMax+1); i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				data = data[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(data)
+}
+
+// hasNonASCII checks if data has any bytes outside of 7 bit range.
+func hasNonASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// detectCharset selects encoding of BOM-less source looking at its beginning. It returns selected encoding name and nil
+// encoding for UTF-8.
+func detectCharset(data []byte, declared string) (string, encoding.Encoding) {
+
+	declared = canonicalCharset(declared)
+	data = charsetSample(data)
+
+	if !hasNonASCII(data) {
+		return "utf-8", nil
+	}
+	if validUTF8(data) {
+		// multibyte sequences in legacy text are extremely unlikely
+		return "utf-8", nil
+	}
+
+	var (
+		best          = -1
+		bestScore     float64
+		declaredIndex = -1
+		scores        = make([]float64, len(charsetCandidates))
+	)
+	for i, c := range charsetCandidates {
+		scores[i] = scoreCharset(data, c)
+		if best < 0 || scores[i] > bestScore {
+			best, bestScore = i, scores[i]
+		}
+		if c.name == declared {
+			declaredIndex = i
+		}
+	}
+	if declaredIndex >= 0 && scores[declaredIndex] >= bestScore-math.Abs(bestScore)*declaredTolerance {
+		best = declaredIndex
+	}
+	return charsetCandidates[best].name, charsetCandidates[best].enc
+}
+
+// decodeSource returns reader converting source without BOM to UTF-8. When forced is not empty it specifies encoding
+// to use, otherwise encoding is detected on the beginning of the source and checked against XML declaration.
+func decodeSource(r io.Reader, forced string, log *zap.Logger) (io.Reader, error) {
+
+	data, err := io.ReadAll(io.LimitReader(r, charsetPrefixSize))
+	if err != nil {
+		return nil, err
+	}
+	declared := declaredCharset(data)
+
+	var (
+		name string
+		enc  encoding.Encoding
+	)
+	if len(forced) > 0 && !strings.EqualFold(forced, "auto") {
+		name = strings.ToLower(forced)
+		if canonicalCharset(name) != "utf-8" {
+			if enc, err = lookupCharset(name); err != nil {
+				return nil, err
+			}
+		}
+		log.Debug("Using requested source encoding", zap.String("encoding", name), zap.String("declared", declared))
+	} else {
+		name, enc = detectCharset(data, declared)
+		switch known := canonicalCharset(declared); {
+		case name == known || (len(declared) == 0 && enc == nil):
+			log.Debug("Source encoding", zap.String("encoding", name))
+		case len(declared) == 0:
+			log.Info("Source encoding is not declared, using detected", zap.String("encoding", name))
+		case known == "utf-8" || isCharsetCandidate(known):
+			log.Warn("Source encoding does not match declaration, using detected", zap.String("encoding", name), zap.String("declared", declared))
+		default:
+			// we cannot judge encodings we do not know about - trust declaration
+			name = declared
+			if enc, err = lookupCharset(declared); err != nil {
+				return nil, err
+			}
+			log.Debug("Source encoding", zap.String("encoding", name))
+		}
+	}
+
+	src := io.MultiReader(bytes.NewReader(data), r)
+	if enc == nil {
+		return src, nil
+	}
+	return &decodingReader{r: transform.NewReader(src, enc.NewDecoder()), name: name}, nil
+}
+
+// decodingReader reports decoding errors with source encoding.
+type decodingReader struct {
+	r    io.Reader
+	name string
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("unable to decode source as %s: %w", d.name, err)
+	}
+	return n, err
+}
+
+// lookupCharset finds encoding by its WHATWG or IANA label.
+func lookupCharset(label string) (encoding.Encoding, error) {
+	if enc, err := htmlindex.Get(label); err == nil {
+		return enc, nil
+	}
+	if enc, err := ianaindex.IANA.Encoding(label); err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unknown source encoding %s", label)
+}
+
+// isCharsetCandidate checks if detection could select encoding with specified name.
+func isCharsetCandidate(name string) bool {
+	for _, c := range charsetCandidates {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
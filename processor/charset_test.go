@@ -0,0 +1,181 @@
+package processor
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"fb2converter/config"
+)
+
+const (
+	textRussian = `Однажды весною, в час небывало жаркого заката, в Москве, на Патриарших прудах, появились два гражданина.
+Первый из них, одетый в летнюю серенькую пару, был маленького роста, упитан, лыс, свою приличную шляпу пирожком нёс в руке.
+«Вы не немец?» — осведомился Бездомный.`
+	textUkrainian = `Реве та стогне Дніпр широкий, сердитий вітер завива, додолу верби гне високі, горами хвилю підійма.
+І блідий місяць на ту пору із хмари де-де виглядав, неначе човен в синім морі, то виринав, то потопав.`
+	textCzech = `Příliš žluťoučký kůň úpěl ďábelské ódy. Ve škole se učíme číst a psát, večer si čteme knížky a hrajeme šachy.
+Dobrý den, jak se máte? Děkuji, mám se dobře, jen je dnes trochu zima a fouká studený vítr.`
+	textFrench = `Le cœur a ses raisons que la raison ne connaît point. Où êtes-vous allé l'été dernier? Nous sommes allés à la mer.
+Über die Brücke gehen die Mädchen und Jungen, während die Sonne schön scheint. ¿Qué pasó mañana? Él está aquí.`
+)
+
+func TestDetectCharset(t *testing.T) {
+
+	for _, tc := range []struct {
+		name     string
+		text     string
+		enc      *charmap.Charmap
+		declared string
+		expected string
+	}{
+		{"1251 declared as utf-8", textRussian, charmap.Windows1251, "utf-8", "windows-1251"},
+		{"1251 not declared", textRussian, charmap.Windows1251, "", "windows-1251"},
+		{"koi8-r declared as 1251", textRussian, charmap.KOI8R, "windows-1251", "koi8-r"},
+		{"koi8-r not declared", textRussian, charmap.KOI8R, "", "koi8-r"},
+		{"cp866", textRussian, charmap.CodePage866, "utf-8", "ibm866"},
+		{"iso-8859-5", textRussian, charmap.ISO8859_5, "", "iso-8859-5"},
+		{"ukrainian 1251", textUkrainian, charmap.Windows1251, "", "windows-1251"},
+		{"ukrainian koi8-u declared", textUkrainian, charmap.KOI8U, "koi8-u", "koi8-u"},
+		{"czech 1250", textCzech, charmap.Windows1250, "utf-8", "windows-1250"},
+		{"czech iso-8859-2 declared", textCzech, charmap.ISO8859_2, "iso-8859-2", "iso-8859-2"},
+		{"western 1252", textFrench, charmap.Windows1252, "", "windows-1252"},
+		{"western latin1 declared", textFrench, charmap.ISO8859_1, "latin1", "iso-8859-1"},
+		{"correct 1251 declaration", textRussian, charmap.Windows1251, "cp1251", "windows-1251"},
+		{"utf-8 declared as 1251", textRussian, nil, "windows-1251", "utf-8"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := []byte(tc.text)
+			if tc.enc != nil {
+				var err error
+				if data, err = encoding.ReplaceUnsupported(tc.enc.NewEncoder()).Bytes(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if name, _ := detectCharset(data, tc.declared); name != tc.expected {
+				t.Fatalf("Expected %s, detected %s", tc.expected, name)
+			}
+		})
+	}
+}
+
+func TestCharsetSample(t *testing.T) {
+
+	text, err := charmap.Windows1251.NewEncoder().Bytes([]byte(textRussian))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// binaries are skipped
+	data := append([]byte(`<p>`), text...)
+	data = append(data, `<binary id="a.png">`+strings.Repeat("\xd0\xaf", 100)+`</binary><p>`...)
+	data = append(data, text...)
+	data = append(data, `<binary id="b.png">`+strings.Repeat("\xd0\xaf", 100)...)
+	sample := charsetSample(data)
+	if bytes.Contains(sample, []byte("binary")) || len(sample) != 2*len(text)+6 {
+		t.Fatalf("Unexpected sample %q", sample)
+	}
+	if name, _ := detectCharset(data, ""); name != "windows-1251" {
+		t.Fatalf("Expected windows-1251, detected %s", name)
+	}
+
+	// only beginning of the text is used, multibyte sequence cut at the end of sample is ignored
+	data = []byte(strings.Repeat("a", charsetSampleSize-1) + strings.Repeat("я", 10))
+	if sample := charsetSample(data); len(sample) != charsetSampleSize {
+		t.Fatalf("Unexpected sample size %d", len(sample))
+	}
+	if name, _ := detectCharset(data, ""); name != "utf-8" {
+		t.Fatalf("Expected utf-8, detected %s", name)
+	}
+}
+
+// countingReader remembers how much was read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestDecodeSourceStream(t *testing.T) {
+
+	text := strings.Repeat("<p>"+textRussian+"</p>\n", 2*charsetPrefixSize/len(textRussian))
+	data, err := charmap.Windows1251.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &countingReader{r: bytes.NewReader(data)}
+	r, err := decodeSource(src, "", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.n > charsetPrefixSize {
+		t.Fatalf("Source was read beyond detection prefix: %d", src.n)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != text {
+		t.Fatal("Source was not decoded completely")
+	}
+}
+
+func TestDecodeSource(t *testing.T) {
+
+	book := `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+ <description>
+  <title-info>
+   <book-title>Мастер и Маргарита</book-title>
+   <lang>ru</lang>
+  </title-info>
+ </description>
+ <body><section><p>` + textRussian + `</p></section></body>
+</FictionBook>
+`
+	data, err := charmap.Windows1251.NewEncoder().Bytes([]byte(book))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(forced string) (*Processor, error) {
+		return newTestProcessor(t, bytes.NewReader(data), true, OEpub, func(cfg *config.Config) {
+			cfg.Doc.SourceCharset = forced
+		})
+	}
+
+	p, err := parse("")
+	if err != nil {
+		t.Fatalf("Unable to parse book: %v", err)
+	}
+	if title := p.doc.FindElement("./FictionBook/description/title-info/book-title").Text(); title != "Мастер и Маргарита" {
+		t.Fatalf("Unexpected title: %s", title)
+	}
+	if !strings.Contains(p.doc.FindElement("./FictionBook/body/section/p").Text(), "Патриарших прудах") {
+		t.Fatal("Unexpected body text")
+	}
+
+	// forced encoding is used as is
+	p, err = parse("koi8-r")
+	if err != nil {
+		t.Fatalf("Unable to parse book: %v", err)
+	}
+	if title := p.doc.FindElement("./FictionBook/description/title-info/book-title").Text(); title == "Мастер и Маргарита" {
+		t.Fatal("Forced encoding was ignored")
+	}
+
+	if _, err = parse("no-such-encoding"); err == nil {
+		t.Fatal("Expected error for unknown forced encoding")
+	}
+}
@@ -22,8 +22,10 @@ type dataFile struct {
 	relpath   string             // always relative to "root" directory - usually temporary working directory
 	transient dataTransientFlags // Additional information about file placements
 	ct        string
+	props     string // EPUB3 manifest item properties
 	data      []byte
 	doc       *etree.Document
+	released  bool // low memory mode - document was stored early and dropped from memory
 }
 
 func (f *dataFile) String() string {
@@ -58,3 +60,39 @@ func (f *dataFile) flush(path string) error {
 	}
 	return nil
 }
+
+// release stores content document and drops it from memory.
+func (f *dataFile) release(path string) error {
+	if err := f.flush(path); err != nil {
+		return err
+	}
+	f.doc, f.released = nil, true
+	return nil
+}
+
+// update calls fn to modify content document. Released document is read back from disk and stored again after
+// modification, so only one of them is in memory at a time.
+func (f *dataFile) update(path string, fn func(doc *etree.Document) error) error {
+
+	if !f.released {
+		if f.doc == nil {
+			return nil
+		}
+		return fn(f.doc)
+	}
+
+	fname := filepath.Join(path, f.relpath, f.fname)
+	doc := etree.NewDocument()
+	doc.ReadSettings.KeepEndTags = true
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	if err := doc.ReadFromFile(fname); err != nil {
+		return fmt.Errorf("unable to read back XML content from %s: %w", fname, err)
+	}
+	if err := fn(doc); err != nil {
+		return err
+	}
+	if err := doc.WriteToFile(fname); err != nil {
+		return fmt.Errorf("unable to flush XML content to %s: %w", fname, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"io"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+	"golang.org/x/text/transform"
+)
+
+// SrcEncoding is unicode encoding of the source detected by BOM.
+type SrcEncoding int
+
+// Supported source encodings, EncUnknown means there is no BOM and XML declaration should be trusted.
+const (
+	EncUnknown SrcEncoding = iota
+	EncUTF8
+	EncUTF16BigEndian
+	EncUTF16LittleEndian
+	EncUTF32BigEndian
+	EncUTF32LittleEndian
+)
+
+// SelectReader handles various unicode encodings (with or without BOM).
+func SelectReader(r io.Reader, enc SrcEncoding) io.Reader {
+	switch enc {
+	case EncUnknown:
+		return r
+	case EncUTF8:
+		return transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder()))
+	case EncUTF16BigEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
+	case EncUTF16LittleEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	case EncUTF32BigEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.BigEndian, utf32.ExpectBOM).NewDecoder())
+	case EncUTF32LittleEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.LittleEndian, utf32.ExpectBOM).NewDecoder())
+	default:
+		panic("unsupported encoding - should never happen")
+	}
+}
+
+func isUTF32BigEndianBOM4(buf []byte) bool {
+	return buf[0] == 0x00 && buf[1] == 0x00 && buf[2] == 0xFE && buf[3] == 0xFF
+}
+
+func isUTF32LittleEndianBOM4(buf []byte) bool {
+	return buf[0] == 0xFF && buf[1] == 0xFE && buf[2] == 0x00 && buf[3] == 0x00
+}
+
+func isUTF8BOM3(buf []byte) bool {
+	return buf[0] == 0xEF && buf[1] == 0xBB && buf[2] == 0xBF
+}
+
+func isUTF16BigEndianBOM2(buf []byte) bool {
+	return buf[0] == 0xFE && buf[1] == 0xFF
+}
+
+func isUTF16LittleEndianBOM2(buf []byte) bool {
+	return buf[0] == 0xFF && buf[1] == 0xFE
+}
+
+// DetectUTF checks first 4 bytes of the source for unicode BOM.
+func DetectUTF(buf []byte) (enc SrcEncoding) {
+
+	if isUTF32BigEndianBOM4(buf) {
+		return EncUTF32BigEndian
+	}
+	if isUTF32LittleEndianBOM4(buf) {
+		return EncUTF32LittleEndian
+	}
+	if isUTF8BOM3(buf) {
+		return EncUTF8
+	}
+	if isUTF16BigEndianBOM2(buf) {
+		return EncUTF16BigEndian
+	}
+	if isUTF16LittleEndianBOM2(buf) {
+		return EncUTF16LittleEndian
+	}
+	return EncUnknown
+}
@@ -13,6 +13,11 @@ const (
 	OKepub                                // kepub
 	OAzw3                                 // azw3
 	OMobi                                 // mobi
+	OEpub3                                // epub3
+	OFb2                                  // fb2
+	OTxt                                  // txt
+	OMd                                   // md
+	OHtml                                 // html
 	UnsupportedOutputFmt                  //
 )
 
@@ -163,3 +168,27 @@ func ParseCoverProcessingString(format string) CoverProcessing {
 	}
 	return UnsupportedCoverProcessing
 }
+
+// KindleEngine specifies how kindle content (mobi, azw3) is produced.
+type KindleEngine int
+
+// Supported engines
+const (
+	EngineAuto              KindleEngine = iota // auto
+	EngineKindlegen                             // kindlegen
+	EngineNative                                // native
+	EngineCalibre                               // calibre
+	EngineCommand                               // command
+	UnsupportedKindleEngine                     //
+)
+
+// ParseKindleEngineString converts string to enum value. Case insensitive.
+func ParseKindleEngineString(format string) KindleEngine {
+
+	for i := range UnsupportedKindleEngine {
+		if strings.EqualFold(i.String(), format) {
+			return i
+		}
+	}
+	return UnsupportedKindleEngine
+}
@@ -1,4 +1,4 @@
-// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
+// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing,KindleEngine -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
 
 package processor
 
@@ -12,12 +12,17 @@ func _() {
 	_ = x[OKepub-1]
 	_ = x[OAzw3-2]
 	_ = x[OMobi-3]
-	_ = x[UnsupportedOutputFmt-4]
+	_ = x[OEpub3-4]
+	_ = x[OFb2-5]
+	_ = x[OTxt-6]
+	_ = x[OMd-7]
+	_ = x[OHtml-8]
+	_ = x[UnsupportedOutputFmt-9]
 }
 
-const _OutputFmt_name = "epubkepubazw3mobi"
+const _OutputFmt_name = "epubkepubazw3mobiepub3fb2txtmdhtml"
 
-var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 17}
+var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 22, 25, 28, 30, 34, 34}
 
 func (i OutputFmt) String() string {
 	if i < 0 || i >= OutputFmt(len(_OutputFmt_index)-1) {
@@ -150,3 +155,25 @@ func (i CoverProcessing) String() string {
 	}
 	return _CoverProcessing_name[_CoverProcessing_index[i]:_CoverProcessing_index[i+1]]
 }
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[EngineAuto-0]
+	_ = x[EngineKindlegen-1]
+	_ = x[EngineNative-2]
+	_ = x[EngineCalibre-3]
+	_ = x[EngineCommand-4]
+	_ = x[UnsupportedKindleEngine-5]
+}
+
+const _KindleEngine_name = "autokindlegennativecalibrecommand"
+
+var _KindleEngine_index = [...]uint8{0, 4, 13, 19, 26, 33, 33}
+
+func (i KindleEngine) String() string {
+	if i < 0 || i >= KindleEngine(len(_KindleEngine_index)-1) {
+		return "KindleEngine(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _KindleEngine_name[_KindleEngine_index[i]:_KindleEngine_index[i+1]]
+}
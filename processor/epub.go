@@ -6,7 +6,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"time"
 
 	fixzip "github.com/hidez8891/zip"
 	"go.uber.org/zap"
@@ -53,12 +52,15 @@ func (p *Processor) writeEPUB(fname string) error {
 	defer epub.Close()
 
 	var content bool
-	t := time.Now()
+	t := p.timestamp()
 
 	saveFile := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := p.canceled(); err != nil {
+			return err
+		}
 		if !info.Mode().IsRegular() {
 			return nil
 		}
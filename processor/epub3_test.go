@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"bytes"
+	"testing"
+
+	"fb2converter/config"
+)
+
+func TestEPUB3Package(t *testing.T) {
+
+	p, err := NewFB2(bytes.NewReader([]byte(fb2)), false, "path1/path2/file.fb2", "/path3/path4", false, false, false, OEpub3, testEnv(t, nil))
+	if err != nil {
+		t.Fatalf("Unable to parse book: %v", err)
+	}
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+
+	files := make(map[string]*dataFile)
+	for _, f := range p.Book.Files {
+		files[f.id] = f
+	}
+
+	opf, ok := files["content"]
+	if !ok {
+		t.Fatal("No package document")
+	}
+	pkg := opf.doc.FindElement("./package")
+	if v := pkg.SelectAttrValue("version", ""); v != "3.0" {
+		t.Fatalf("Unexpected package version: %s", v)
+	}
+	if opf.doc.FindElement("./package/metadata/meta[@property='dcterms:modified']") == nil {
+		t.Fatal("No dcterms:modified")
+	}
+	if e := opf.doc.FindElement("./package/metadata/meta[@property='belongs-to-collection']"); e == nil || e.Text() != "Тесты" {
+		t.Fatal("No series collection")
+	}
+	if opf.doc.FindElement("./package/metadata/meta[@name='calibre:series']") != nil {
+		t.Fatal("Unexpected calibre:series")
+	}
+	if opf.doc.FindElement("./package/manifest/item[@properties='nav']") == nil {
+		t.Fatal("Navigation document is not in manifest")
+	}
+	if opf.doc.FindElement("./package/spine/itemref[@idref='nav']") != nil {
+		t.Fatal("Navigation document should not be in spine")
+	}
+	if _, ok := files["page-map"]; ok {
+		t.Fatal("Unexpected EPUB2 page map")
+	}
+
+	nav, ok := files["nav"]
+	if !ok {
+		t.Fatal("No navigation document")
+	}
+	for _, kind := range []string{"toc", "landmarks", "page-list"} {
+		if nav.doc.FindElement("./html/body/nav[@epub:type='"+kind+"']/ol/li/a") == nil {
+			t.Fatalf("Navigation document has no %s", kind)
+		}
+	}
+}
+
+func TestEPUB3NoteRefs(t *testing.T) {
+
+	for _, c := range []struct {
+		notes   NotesFmt
+		noteref bool
+	}{
+		{NDefault, true}, // promoted to float-new for EPUB3
+		{NInline, false}, // notes are placed in text, nothing to refer to
+		{NBlock, false},
+		{NFloat, true},
+		{NFloatNewMore, true},
+	} {
+		p := processBook(t, corpusBook(t, "notes"), OEpub3, func(cfg *config.Config) {
+			cfg.Doc.Notes.Mode = c.notes.String()
+		})
+
+		var refs, asides int
+		for _, f := range p.Book.Files {
+			if f.doc == nil {
+				continue
+			}
+			refs += len(f.doc.FindElements("//a[@epub:type='noteref']"))
+			asides += len(f.doc.FindElements("//aside[@epub:type='footnote']"))
+		}
+		if c.noteref != (refs > 0) || c.noteref != (asides > 0) {
+			t.Errorf("%s: unexpected note references %d for %d footnotes", c.notes, refs, asides)
+		}
+	}
+}
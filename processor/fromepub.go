@@ -0,0 +1,1877 @@
+package processor
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// Reverse conversion. EPUB (and KEPUB) content is mapped back to FictionBook 2.1: sections are restored from
+// headings and table of contents, images are embedded as binaries, footnote targets are moved to notes body and
+// description is built from OPF metadata.
+
+// epubItem is manifest entry, href is full path inside container.
+type epubItem struct {
+	id, href, mediaType, properties string
+}
+
+// epubNote is footnote found in EPUB content.
+type epubNote struct {
+	key     string // path#id of the note target
+	label   string // text of the first reference
+	path    string
+	content []*etree.Element
+}
+
+// tocMark is table of contents entry waiting for the section it starts.
+type tocMark struct {
+	level int
+	label string
+}
+
+type epubReader struct {
+	files  map[string]*zip.File
+	log    *zap.Logger
+	opfDir string
+
+	items   map[string]*epubItem // by manifest id
+	byPath  map[string]*epubItem
+	spine   []*epubItem
+	skip    map[string]bool // spine documents which should not be converted
+	meta    *etree.Element
+	refines map[string]map[string]string
+	cover   string // path of cover image
+
+	toc      map[string]int // path or path#id -> depth
+	tocLabel map[string]string
+
+	docs     map[string]*etree.Element // spine document bodies
+	elems    map[string]*etree.Element // path#id -> element
+	notes    []*epubNote
+	noteKeys map[string]*epubNote
+	noteElem map[*etree.Element]bool // note targets
+	noteDocs map[string]bool         // documents notes were taken from
+	consumed map[*etree.Element]bool // elements moved to notes
+	targets  map[string]bool         // link targets
+
+	// output state
+	fb2ids     map[string]string // path#id -> FB2 id
+	used       map[string]bool
+	images     map[string]string // image path -> binary id
+	imageOrder []string
+	pending    []string // anchors waiting for the next element able to carry id
+	mark       *tocMark
+	shift      int // difference between table of contents depth and heading level
+	notesTitle string
+}
+
+// EPUBToFB2 reads EPUB (or KEPUB) book and produces equivalent FictionBook document.
+func EPUBToFB2(r io.ReaderAt, size int64, env *state.LocalEnv) (*etree.Document, error) {
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read EPUB: %w", err)
+	}
+
+	er := &epubReader{
+		files:    make(map[string]*zip.File),
+		log:      env.Log,
+		items:    make(map[string]*epubItem),
+		byPath:   make(map[string]*epubItem),
+		skip:     make(map[string]bool),
+		refines:  make(map[string]map[string]string),
+		toc:      make(map[string]int),
+		tocLabel: make(map[string]string),
+		docs:     make(map[string]*etree.Element),
+		elems:    make(map[string]*etree.Element),
+		noteKeys: make(map[string]*epubNote),
+		noteElem: make(map[*etree.Element]bool),
+		noteDocs: make(map[string]bool),
+		consumed: make(map[*etree.Element]bool),
+		targets:  make(map[string]bool),
+		fb2ids:   make(map[string]string),
+		used:     make(map[string]bool),
+		images:   make(map[string]string),
+	}
+	for _, f := range zr.File {
+		er.files[path.Clean(f.Name)] = f
+	}
+
+	if err := er.readPackage(); err != nil {
+		return nil, err
+	}
+	er.readTOC()
+	if err := er.readContent(); err != nil {
+		return nil, err
+	}
+	er.findNotes()
+	return er.build()
+}
+
+// readFile returns content of the file in EPUB container.
+func (er *epubReader) readFile(name string) ([]byte, error) {
+	f, ok := er.files[path.Clean(name)]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found in EPUB", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// readXML parses XML or XHTML file from EPUB container.
+func (er *epubReader) readXML(name string) (*etree.Document, error) {
+
+	data, err := er.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := prepareHTMLNamedEntities()
+	if err != nil {
+		return nil, fmt.Errorf("unable to write prepare HTML named entities: %w", err)
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings = etree.ReadSettings{
+		CharsetReader: charset.NewReaderLabel,
+		Permissive:    true,
+		Entity:        entities,
+	}
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// readPackage locates and reads OPF package document.
+func (er *epubReader) readPackage() error {
+
+	container, err := er.readXML("META-INF/container.xml")
+	if err != nil {
+		return err
+	}
+	rf := container.FindElement("//rootfile")
+	if rf == nil {
+		return errors.New("EPUB container has no rootfile")
+	}
+	name := path.Clean(rf.SelectAttrValue("full-path", ""))
+	er.opfDir = path.Dir(name)
+
+	opf, err := er.readXML(name)
+	if err != nil {
+		return err
+	}
+	pkg := opf.FindElement("//package")
+	if pkg == nil {
+		return errors.New("OPF has no package")
+	}
+
+	for _, el := range pkg.FindElements("./manifest/item") {
+		href, _ := url.PathUnescape(el.SelectAttrValue("href", ""))
+		item := &epubItem{
+			id:         el.SelectAttrValue("id", ""),
+			href:       path.Join(er.opfDir, href),
+			mediaType:  el.SelectAttrValue("media-type", ""),
+			properties: el.SelectAttrValue("properties", ""),
+		}
+		er.items[item.id] = item
+		er.byPath[item.href] = item
+		if hasWord(item.properties, "nav") {
+			er.skip[item.href] = true
+		}
+		if hasWord(item.properties, "cover-image") {
+			er.cover = item.href
+		}
+	}
+	for _, el := range pkg.FindElements("./spine/itemref") {
+		if item, ok := er.items[el.SelectAttrValue("idref", "")]; ok {
+			er.spine = append(er.spine, item)
+		}
+	}
+	if len(er.spine) == 0 {
+		return errors.New("EPUB has empty spine")
+	}
+	for _, el := range pkg.FindElements("./guide/reference") {
+		switch el.SelectAttrValue("type", "") {
+		case "toc", "cover":
+			if key, ok := resolveHref(name, el.SelectAttrValue("href", "")); ok {
+				er.skip[stripFragment(key)] = true
+			}
+		}
+	}
+
+	er.meta = pkg.SelectElement("metadata")
+	if er.meta == nil {
+		er.meta = etree.NewElement("metadata")
+	}
+	for _, el := range er.meta.SelectElements("meta") {
+		ref := strings.TrimPrefix(el.SelectAttrValue("refines", ""), "#")
+		prop := el.SelectAttrValue("property", "")
+		if len(ref) == 0 || len(prop) == 0 {
+			continue
+		}
+		if er.refines[ref] == nil {
+			er.refines[ref] = make(map[string]string)
+		}
+		er.refines[ref][prop] = strings.TrimSpace(el.Text())
+	}
+	if len(er.cover) == 0 {
+		if id := er.metaContent("cover"); len(id) > 0 {
+			if item, ok := er.items[id]; ok {
+				er.cover = item.href
+			}
+		}
+	}
+	return nil
+}
+
+// metaContent returns content of EPUB2 named meta.
+func (er *epubReader) metaContent(name string) string {
+	for _, el := range er.meta.SelectElements("meta") {
+		if el.SelectAttrValue("name", "") == name {
+			return strings.TrimSpace(el.SelectAttrValue("content", ""))
+		}
+	}
+	return ""
+}
+
+// readTOC reads NCX (or navigation document if there is no NCX) remembering depth of every target.
+func (er *epubReader) readTOC() {
+
+	for _, item := range er.items {
+		if item.mediaType != "application/x-dtbncx+xml" {
+			continue
+		}
+		doc, err := er.readXML(item.href)
+		if err != nil {
+			er.log.Warn("Unable to read NCX", zap.String("file", item.href), zap.Error(err))
+			break
+		}
+		if nm := doc.FindElement("//navMap"); nm != nil {
+			er.readNavPoints(item.href, nm, 1)
+		}
+		if len(er.toc) > 0 {
+			return
+		}
+	}
+
+	for _, item := range er.items {
+		if !hasWord(item.properties, "nav") {
+			continue
+		}
+		doc, err := er.readXML(item.href)
+		if err != nil {
+			er.log.Warn("Unable to read navigation document", zap.String("file", item.href), zap.Error(err))
+			return
+		}
+		for _, nav := range doc.FindElements("//nav") {
+			if hasWord(nav.SelectAttrValue("epub:type", ""), "toc") {
+				if ol := nav.SelectElement("ol"); ol != nil {
+					er.readNavList(item.href, ol, 1)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (er *epubReader) readNavPoints(base string, parent *etree.Element, depth int) {
+	for _, np := range parent.SelectElements("navPoint") {
+		if c := np.SelectElement("content"); c != nil {
+			var label string
+			if t := np.FindElement("./navLabel/text"); t != nil {
+				label = t.Text()
+			}
+			er.addTOC(base, c.SelectAttrValue("src", ""), label, depth)
+		}
+		er.readNavPoints(base, np, depth+1)
+	}
+}
+
+func (er *epubReader) readNavList(base string, ol *etree.Element, depth int) {
+	for _, li := range ol.SelectElements("li") {
+		if a := li.SelectElement("a"); a != nil {
+			er.addTOC(base, a.SelectAttrValue("href", ""), plainText(a), depth)
+		}
+		if sub := li.SelectElement("ol"); sub != nil {
+			er.readNavList(base, sub, depth+1)
+		}
+	}
+}
+
+func (er *epubReader) addTOC(base, href, label string, depth int) {
+	key, ok := resolveHref(base, href)
+	if !ok {
+		return
+	}
+	if _, exists := er.toc[key]; !exists {
+		er.toc[key] = depth
+		er.tocLabel[key] = collapseSpaces(label)
+	}
+}
+
+// readContent parses spine documents and indexes their ids.
+func (er *epubReader) readContent() error {
+
+	for _, item := range er.spine {
+		if er.skip[item.href] || (item.mediaType != "application/xhtml+xml" && item.mediaType != "text/html") {
+			continue
+		}
+		doc, err := er.readXML(item.href)
+		if err != nil {
+			return err
+		}
+		body := doc.FindElement("//body")
+		if body == nil {
+			continue
+		}
+		er.docs[item.href] = body
+		er.index(item.href, body)
+	}
+	if len(er.docs) == 0 {
+		return errors.New("EPUB has no content documents")
+	}
+	return nil
+}
+
+func (er *epubReader) index(base string, el *etree.Element) {
+	if id := el.SelectAttrValue("id", ""); len(id) > 0 {
+		if _, exists := er.elems[base+"#"+id]; !exists {
+			er.elems[base+"#"+id] = el
+		}
+	}
+	for _, c := range el.ChildElements() {
+		er.index(base, c)
+	}
+}
+
+// noteMark matches usual texts of footnote references.
+var noteMark = regexp.MustCompile(`^[\[({<]?\s*(?:\d{1,4}|[*†‡§¶]{1,3})\s*[\])}>]?$`)
+
+// findNotes detects footnote references and collects content of their targets.
+func (er *epubReader) findNotes() {
+
+	for _, item := range er.spine {
+		body, ok := er.docs[item.href]
+		if !ok {
+			continue
+		}
+		for _, a := range body.FindElements(".//a") {
+			key, ok := resolveHref(item.href, a.SelectAttrValue("href", ""))
+			if !ok {
+				continue
+			}
+			er.targets[key] = true
+			if !strings.Contains(key, "#") {
+				continue
+			}
+			if _, ok := er.noteKeys[key]; ok {
+				continue
+			}
+			target, ok := er.elems[key]
+			if !ok || er.consumed[target] {
+				continue
+			}
+			if _, ok := er.toc[key]; ok || !er.isNoteRef(a, target) {
+				continue
+			}
+			note := &epubNote{key: key, label: strings.Trim(plainText(a), "[](){}<> "), path: stripFragment(key)}
+			er.notes = append(er.notes, note)
+			er.noteKeys[key] = note
+			er.noteElem[target] = true
+		}
+	}
+
+	// targets are known now, collect content
+	for _, note := range er.notes {
+		target := er.elems[note.key]
+		note.content = er.noteContent(note.path, target)
+		er.consumed[target] = true
+		er.noteDocs[note.path] = true
+		for _, el := range note.content {
+			er.consumed[el] = true
+		}
+	}
+}
+
+func (er *epubReader) isNoteRef(a, target *etree.Element) bool {
+
+	// link pointing back from note to its reference, some converters mark it as noteref too
+	if target.Tag == "a" && len(target.SelectAttrValue("href", "")) > 0 {
+		return false
+	}
+	if hasWord(a.SelectAttrValue("epub:type", ""), "noteref") {
+		return true
+	}
+	if isInline(target.Tag) && target.FindElement(".//a[@href]") != nil {
+		return false
+	}
+	for e := target; e != nil && e.Tag != "body"; e = e.Parent() {
+		if e.Tag == "aside" {
+			return true
+		}
+		for _, t := range strings.Fields(e.SelectAttrValue("epub:type", "")) {
+			switch t {
+			case "footnote", "footnotes", "endnote", "endnotes", "rearnote", "rearnotes", "note":
+				return true
+			}
+		}
+	}
+	return noteMark.MatchString(strings.TrimSpace(plainText(a)))
+}
+
+// noteContent returns elements which make note. Empty anchors own everything up to the next note or heading.
+func (er *epubReader) noteContent(base string, target *etree.Element) []*etree.Element {
+
+	if len(strings.TrimSpace(plainText(target))) > 0 || target.FindElement(".//img") != nil {
+		if !isInline(target.Tag) {
+			return []*etree.Element{target}
+		}
+		for e := target.Parent(); e != nil && e.Tag != "body"; e = e.Parent() {
+			if !isInline(e.Tag) {
+				return []*etree.Element{e}
+			}
+		}
+		return []*etree.Element{target}
+	}
+
+	parent := target.Parent()
+	if isInline(target.Tag) && parent != nil && parent.Tag != "body" && !isInline(parent.Tag) && len(strings.TrimSpace(plainText(parent))) > 0 {
+		// <p><a id="n1"/>1. Note text</p>
+		return []*etree.Element{parent}
+	}
+
+	var content []*etree.Element
+	if parent == nil {
+		return content
+	}
+	siblings := parent.ChildElements()
+	for i, el := range siblings {
+		if el != target {
+			continue
+		}
+		first := true
+		for _, next := range siblings[i+1:] {
+			if er.noteElem[next] {
+				break
+			}
+			if isInline(next.Tag) && len(strings.TrimSpace(plainText(next))) == 0 && next.FindElement(".//img") == nil {
+				// whitespace wrappers (KEPUB spans)
+				continue
+			}
+			if first && er.isTitle(next) {
+				first = false
+				// note has its own title
+				content = append(content, next)
+				continue
+			}
+			if er.isHeading(next) {
+				break
+			}
+			if _, ok := er.toc[elemKey(base, next)]; ok {
+				break
+			}
+			first = false
+			content = append(content, next)
+		}
+		break
+	}
+	return content
+}
+
+// build produces FictionBook document.
+func (er *epubReader) build() (*etree.Document, error) {
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	fb := doc.CreateElement("FictionBook")
+	fb.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	fb.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	desc := fb.AddNext("description")
+
+	body := fb.AddNext("body")
+	f := newFB2Flow(body, true)
+	for _, item := range er.spine {
+		b, ok := er.docs[item.href]
+		if !ok {
+			continue
+		}
+		er.convertDocument(f, item.href, b)
+	}
+	er.flushMark(f)
+	if len(body.SelectElements("section")) == 0 {
+		return nil, errors.New("no content found in EPUB")
+	}
+
+	if len(er.notes) > 0 {
+		nb := fb.AddNext("body", attr("name", "notes"))
+		if len(er.notesTitle) > 0 {
+			nb.AddNext("title").AddNext("p").SetText(er.notesTitle)
+		}
+		for _, note := range er.notes {
+			er.convertNote(nb, note)
+		}
+	}
+
+	er.buildDescription(desc)
+
+	for _, name := range er.imageOrder {
+		data, err := er.readFile(name)
+		if err != nil {
+			er.log.Warn("Unable to read image", zap.String("file", name), zap.Error(err))
+			continue
+		}
+		fb.AddNext("binary", attr("id", er.images[name]), attr("content-type", er.byPath[name].mediaType)).
+			SetText(base64.StdEncoding.EncodeToString(data))
+	}
+
+	er.resolveLinks(fb)
+
+	doc.Indent(1)
+	return doc, nil
+}
+
+// convertDocument adds content of spine document to the main body.
+func (er *epubReader) convertDocument(f *fb2Flow, base string, body *etree.Element) {
+
+	if !er.hasText(body, false) {
+		if er.noteDocs[base] {
+			// only headings left, everything else was moved to notes
+			if len(er.notesTitle) == 0 {
+				for _, el := range body.FindElements(".//*") {
+					if er.isHeading(el) {
+						er.notesTitle = strings.TrimSpace(collapseSpaces(plainText(el)))
+						break
+					}
+				}
+			}
+			return
+		}
+		if imgs := er.documentImages(base, body); !er.hasText(body, true) && (len(imgs) == 0 || (len(imgs) == 1 && imgs[0] == er.cover)) {
+			// cover page or empty document
+			return
+		}
+	}
+
+	if depth, ok := er.toc[base]; ok {
+		er.flushMark(f)
+		er.mark = &tocMark{level: depth, label: er.tocLabel[base]}
+	}
+	er.pending = append(er.pending, base)
+	er.walk(f, base, body)
+}
+
+// hasText checks if document has any text which was not moved to notes, headings are optional.
+func (er *epubReader) hasText(el *etree.Element, headings bool) bool {
+	if er.consumed[el] || (!headings && er.isHeading(el)) {
+		return false
+	}
+	for _, t := range el.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			if len(strings.TrimSpace(t.Data)) > 0 {
+				return true
+			}
+		case *etree.Element:
+			if er.hasText(t, headings) {
+				return true
+			}
+			if !er.consumed[t] && len(strings.TrimSpace(t.Tail())) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (er *epubReader) documentImages(base string, body *etree.Element) []string {
+	var res []string
+	for _, el := range body.FindElements(".//*") {
+		var src string
+		switch el.Tag {
+		case "img":
+			src = el.SelectAttrValue("src", "")
+		case "image":
+			src = imageHref(el)
+		default:
+			continue
+		}
+		if key, ok := resolveHref(base, src); ok {
+			res = append(res, stripFragment(key))
+		}
+	}
+	return res
+}
+
+// convertNote adds note section to the notes body.
+func (er *epubReader) convertNote(nb *etree.Element, note *epubNote) {
+
+	er.pending, er.mark = nil, nil
+
+	sec := nb.AddNext("section", attr("id", er.idFor(note.key)))
+	content := note.content
+	if len(content) > 0 && er.isTitle(content[0]) {
+		sec.AddChild(er.title(note.path, content[0]))
+		content = content[1:]
+	} else if len(note.label) > 0 {
+		sec.AddNext("title").AddNext("p").SetText(note.label)
+	}
+
+	f := newFB2Flow(sec, false)
+	for i, el := range content {
+		if i == 0 && el == er.elems[note.key] && isContainer(el.Tag) {
+			er.walk(f, note.path, el)
+			continue
+		}
+		er.block(f, note.path, el)
+	}
+	er.pending = nil
+}
+
+// walk converts content of the container element.
+func (er *epubReader) walk(s fb2Sink, base string, from *etree.Element) {
+
+	b := newParaBuilder("p")
+	flush := func() {
+		for _, p := range b.result() {
+			er.add(s, p)
+		}
+		b = newParaBuilder("p")
+	}
+
+	for _, t := range from.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.text(t.Data)
+		case *etree.Element:
+			if !er.consumed[t] {
+				switch {
+				case t.Tag == "br":
+					flush()
+				case (t.Tag == "img" || t.Tag == "svg") && len(b.open) == 0:
+					er.block(s, base, t)
+				case isInline(t.Tag) && !er.isHeading(t):
+					er.inline(b, base, t)
+				default:
+					flush()
+					er.block(s, base, t)
+				}
+			}
+			b.text(t.Tail())
+		}
+	}
+	flush()
+}
+
+// add puts block into the sink opening pending section and attaching pending anchors.
+func (er *epubReader) add(s fb2Sink, el *etree.Element) {
+	er.flushMark(s)
+	er.anchorPending(el)
+	s.add(el)
+}
+
+// flushMark opens section for table of contents entry which was not followed by heading.
+func (er *epubReader) flushMark(s fb2Sink) {
+	if f, ok := s.(*fb2Flow); er.mark == nil || !ok || !f.main {
+		return
+	}
+	m := er.mark
+	er.mark = nil
+	title := etree.NewElement("title")
+	if len(m.label) > 0 {
+		title.AddNext("p").SetText(m.label)
+	}
+	if sec := s.heading(m.level, title); sec != nil {
+		er.anchorPending(sec)
+	}
+}
+
+// block converts single block level element.
+func (er *epubReader) block(s fb2Sink, base string, el *etree.Element) {
+
+	key := elemKey(base, el)
+	depth, inTOC := er.toc[key]
+
+	if level, ok := er.headingLevel(el); ok {
+		title := er.title(base, el)
+		if len(key) > 0 {
+			er.pending = append(er.pending, key)
+		}
+		if f, ok := s.(*fb2Flow); ok && level == 0 && er.mark == nil && f.bodyTitle(title) {
+			// book title converted earlier
+			er.anchorPending(nil)
+			return
+		}
+		switch {
+		case inTOC:
+			er.flushMark(s)
+			er.shift = depth - level
+			level = depth
+		case er.mark != nil:
+			er.shift = er.mark.level - level
+			level = er.mark.level
+			er.mark = nil
+		default:
+			level += er.shift
+		}
+		if sec := s.heading(max(level, 1), title); sec != nil {
+			er.anchorPending(sec)
+		}
+		return
+	}
+
+	if inTOC {
+		er.flushMark(s)
+		er.mark = &tocMark{level: depth, label: er.tocLabel[key]}
+	}
+	if len(key) > 0 {
+		er.pending = append(er.pending, key)
+	}
+
+	class := el.SelectAttrValue("class", "")
+	if strings.HasPrefix(class, "vignette") {
+		// decorations are added by converter
+		return
+	}
+	switch el.Tag {
+	case "head", "script", "style", "noscript", "nav", "form", "button", "input":
+	case "p":
+		if len(strings.TrimSpace(plainText(el))) == 0 {
+			er.image(s, base, el)
+			return
+		}
+		tag := "p"
+		if hasWord(class, "subtitle") {
+			tag = "subtitle"
+		}
+		b := newParaBuilder(tag)
+		er.inlineContent(b, base, el)
+		for _, p := range b.result() {
+			er.add(s, p)
+		}
+	case "blockquote":
+		er.group(s, base, el, "cite")
+	case "ul", "ol", "dl":
+		er.list(s, base, el)
+	case "table":
+		er.add(s, er.table(base, el))
+	case "img", "svg":
+		er.image(s, base, el)
+	case "hr":
+		er.add(s, etree.NewElement("empty-line"))
+	case "pre":
+		for _, line := range strings.Split(strings.Trim(plainText(el), "\n"), "\n") {
+			p := etree.NewElement("p")
+			if len(strings.TrimSpace(line)) > 0 {
+				p.AddNext("code").SetText(line)
+			}
+			er.add(s, p)
+		}
+	case "aside":
+		er.group(s, base, el, "cite")
+	default:
+		switch {
+		case hasWord(class, "epigraph"):
+			er.group(s, base, el, "epigraph")
+		case hasWord(class, "cite") || hasWord(class, "annotation"):
+			er.group(s, base, el, "cite")
+		case hasWord(class, "poem"):
+			er.add(s, er.poem(base, el))
+		case hasWord(class, "stanza"):
+			poem := etree.NewElement("poem")
+			poem.AddChild(er.stanza(base, el))
+			er.add(s, poem)
+		case hasWord(class, "text-author"):
+			b := newParaBuilder("text-author")
+			er.inlineContent(b, base, el)
+			for _, p := range b.result() {
+				er.add(s, p)
+			}
+		case hasWord(class, "emptyline"):
+			er.add(s, etree.NewElement("empty-line"))
+		default:
+			er.walk(s, base, el)
+		}
+	}
+}
+
+// group converts element into epigraph or cite.
+func (er *epubReader) group(s fb2Sink, base string, el *etree.Element, tag string) {
+
+	c := &fb2Collector{}
+	er.walk(c, base, el)
+	if len(c.items) == 0 {
+		return
+	}
+
+	g := etree.NewElement(tag)
+	for _, item := range c.items {
+		g.AddChild(item)
+	}
+	er.flushMark(s)
+	er.anchorPending(g)
+	if tag == "epigraph" {
+		s.epigraph(g)
+		return
+	}
+	s.add(g)
+}
+
+// list converts list items into paragraphs.
+func (er *epubReader) list(s fb2Sink, base string, el *etree.Element) {
+
+	n := 1
+	if start, err := strconv.Atoi(el.SelectAttrValue("start", "")); err == nil {
+		n = start
+	}
+	for _, li := range el.ChildElements() {
+		c := &fb2Collector{}
+		er.walk(c, base, li)
+		if len(c.items) == 0 {
+			continue
+		}
+		var prefix string
+		switch {
+		case el.Tag == "ol" && li.Tag == "li":
+			prefix = strconv.Itoa(n) + ". "
+			n++
+		case li.Tag == "li":
+			prefix = "• "
+		}
+		if first := c.items[0]; len(prefix) > 0 && first.Tag == "p" {
+			prependText(first, prefix)
+		}
+		if li.Tag == "dt" {
+			for _, p := range c.items {
+				if p.Tag == "p" {
+					wrapChildren(p, "strong")
+				}
+			}
+		}
+		for _, item := range c.items {
+			er.add(s, item)
+		}
+	}
+}
+
+// table converts table keeping rows and cells only.
+func (er *epubReader) table(base string, el *etree.Element) *etree.Element {
+
+	t := etree.NewElement("table")
+	var rows func(e *etree.Element)
+	rows = func(e *etree.Element) {
+		for _, c := range e.ChildElements() {
+			switch c.Tag {
+			case "thead", "tbody", "tfoot":
+				rows(c)
+			case "tr":
+				tr := t.AddNext("tr")
+				for _, cell := range c.ChildElements() {
+					if cell.Tag != "td" && cell.Tag != "th" {
+						continue
+					}
+					b := newParaBuilder(cell.Tag)
+					b.flat = true
+					er.inlineContent(b, base, cell)
+					td := etree.NewElement(cell.Tag)
+					if res := b.result(); len(res) > 0 {
+						td = res[0]
+					}
+					for _, name := range []string{"colspan", "rowspan", "align"} {
+						if v := cell.SelectAttrValue(name, ""); len(v) > 0 {
+							td.CreateAttr(name, v)
+						}
+					}
+					tr.AddChild(td)
+				}
+			}
+		}
+	}
+	rows(el)
+	return t
+}
+
+// image converts block image.
+func (er *epubReader) image(s fb2Sink, base string, el *etree.Element) {
+	var srcs []string
+	if el.Tag == "img" {
+		srcs = append(srcs, el.SelectAttrValue("src", ""))
+	}
+	for _, img := range el.FindElements(".//img") {
+		srcs = append(srcs, img.SelectAttrValue("src", ""))
+	}
+	for _, img := range el.FindElements(".//image") {
+		srcs = append(srcs, imageHref(img))
+	}
+	for _, src := range srcs {
+		if id := er.imageRef(base, src); len(id) > 0 {
+			img := etree.NewElement("image")
+			img.CreateAttr("l:href", "#"+id)
+			er.add(s, img)
+		}
+	}
+}
+
+// poem converts poetry, stanzas are optional.
+func (er *epubReader) poem(base string, el *etree.Element) *etree.Element {
+
+	poem := etree.NewElement("poem")
+	var loose *etree.Element
+	for _, c := range el.ChildElements() {
+		class := c.SelectAttrValue("class", "")
+		switch {
+		case er.isHeading(c):
+			if len(poem.ChildElements()) == 0 {
+				poem.AddChild(er.title(base, c))
+			}
+		case hasWord(class, "stanza"):
+			loose = nil
+			poem.AddChild(er.stanza(base, c))
+		case hasWord(class, "text-author"):
+			b := newParaBuilder("text-author")
+			er.inlineContent(b, base, c)
+			for _, p := range b.result() {
+				poem.AddChild(p)
+			}
+		default:
+			if loose == nil {
+				loose = poem.AddNext("stanza")
+			}
+			b := newParaBuilder("v")
+			er.inlineContent(b, base, c)
+			for _, v := range b.result() {
+				loose.AddChild(v)
+			}
+		}
+	}
+	return poem
+}
+
+func (er *epubReader) stanza(base string, el *etree.Element) *etree.Element {
+
+	st := etree.NewElement("stanza")
+	b := newParaBuilder("v")
+	if len(el.SelectElements("p")) == 0 {
+		er.inlineContent(b, base, el)
+	} else {
+		for _, p := range el.ChildElements() {
+			er.inlineContent(b, base, p)
+			b.brk()
+		}
+	}
+	for _, v := range b.result() {
+		st.AddChild(v)
+	}
+	return st
+}
+
+// title converts heading into section title.
+func (er *epubReader) title(base string, el *etree.Element) *etree.Element {
+
+	title := etree.NewElement("title")
+	b := newParaBuilder("p")
+	if ps := el.FindElements(".//p"); len(ps) > 0 {
+		for _, p := range ps {
+			er.inlineContent(b, base, p)
+			b.brk()
+		}
+	} else {
+		er.inlineContent(b, base, el)
+	}
+	for _, p := range b.result() {
+		title.AddChild(p)
+	}
+	return title
+}
+
+// inlineContent converts inline content of the element.
+func (er *epubReader) inlineContent(b *paraBuilder, base string, from *etree.Element) {
+	if key := elemKey(base, from); len(key) > 0 {
+		er.anchorElem(b.para(), key)
+	}
+	for _, t := range from.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.text(t.Data)
+		case *etree.Element:
+			if !er.consumed[t] {
+				er.inline(b, base, t)
+			}
+			b.text(t.Tail())
+		}
+	}
+}
+
+// inline converts single inline element (without its tail).
+func (er *epubReader) inline(b *paraBuilder, base string, el *etree.Element) {
+
+	class := el.SelectAttrValue("class", "")
+	switch el.Tag {
+	case "br":
+		b.brk()
+	case "img":
+		if id := er.imageRef(base, el.SelectAttrValue("src", "")); len(id) > 0 {
+			b.cur().AddNext("image", attr("l:href", "#"+id))
+		}
+	case "svg":
+		for _, img := range el.FindElements(".//image") {
+			if id := er.imageRef(base, imageHref(img)); len(id) > 0 {
+				b.cur().AddNext("image", attr("l:href", "#"+id))
+			}
+		}
+	case "a":
+		href := el.SelectAttrValue("href", "")
+		key, internal := resolveHref(base, href)
+		switch {
+		case len(href) == 0 || strings.HasPrefix(href, "javascript:"):
+			er.inlineContent(b, base, el)
+		case !internal:
+			b.push("a", attr("l:href", href))
+			er.inlineContent(b, base, el)
+			b.pop()
+		case er.noteKeys[key] != nil:
+			b.push("a", attr(linkAttr, key), attr("type", "note"))
+			er.inlineContent(b, base, el)
+			b.pop()
+		default:
+			b.push("a", attr(linkAttr, key))
+			er.inlineContent(b, base, el)
+			b.pop()
+		}
+	case "b", "strong":
+		er.styled(b, base, el, "strong")
+	case "i", "em", "dfn", "var", "cite":
+		er.styled(b, base, el, "emphasis")
+	case "s", "strike", "del":
+		er.styled(b, base, el, "strikethrough")
+	case "sub", "sup":
+		er.styled(b, base, el, el.Tag)
+	case "code", "tt", "kbd", "samp":
+		er.styled(b, base, el, "code")
+	case "span":
+		switch {
+		case hasWord(class, "strong"):
+			er.styled(b, base, el, "strong")
+		case hasWord(class, "emphasis"):
+			er.styled(b, base, el, "emphasis")
+		case hasWord(class, "strike"):
+			er.styled(b, base, el, "strikethrough")
+		default:
+			er.inlineContent(b, base, el)
+		}
+	default:
+		if b.flat && !isInline(el.Tag) {
+			b.text(" ")
+		}
+		er.inlineContent(b, base, el)
+	}
+}
+
+func (er *epubReader) styled(b *paraBuilder, base string, el *etree.Element, tag string) {
+	b.push(tag)
+	er.inlineContent(b, base, el)
+	b.pop()
+}
+
+// imageRef registers image as binary and returns its id.
+func (er *epubReader) imageRef(base, src string) string {
+
+	key, ok := resolveHref(base, src)
+	if !ok {
+		return ""
+	}
+	return er.binary(stripFragment(key))
+}
+
+// binary registers image with given path as binary and returns its id.
+func (er *epubReader) binary(key string) string {
+	if id, ok := er.images[key]; ok {
+		return id
+	}
+	item, ok := er.byPath[key]
+	if !ok {
+		er.log.Warn("Image is not in manifest", zap.String("image", key))
+		return ""
+	}
+	switch item.mediaType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		er.log.Warn("Unsupported image type", zap.String("image", key), zap.String("type", item.mediaType))
+		return ""
+	}
+	id := er.uniqueID(path.Base(key))
+	er.images[key] = id
+	er.imageOrder = append(er.imageOrder, key)
+	return id
+}
+
+// anchorPending assigns ids of all anchors seen before to the element (if FB2 allows it to have id).
+func (er *epubReader) anchorPending(el *etree.Element) {
+	if el == nil {
+		er.pending = nil
+		return
+	}
+	switch el.Tag {
+	case "section", "p", "v", "subtitle", "cite", "poem", "epigraph", "table", "image", "text-author":
+	default:
+		return
+	}
+	for _, key := range er.pending {
+		er.anchorElem(el, key)
+	}
+	er.pending = nil
+}
+
+// anchorElem makes link target available as id of the element.
+func (er *epubReader) anchorElem(el *etree.Element, key string) {
+	if _, ok := er.fb2ids[key]; ok || !er.targets[key] {
+		return
+	}
+	if id := el.SelectAttrValue("id", ""); len(id) > 0 {
+		er.fb2ids[key] = id
+		return
+	}
+	el.CreateAttr("id", er.idFor(key))
+}
+
+// idFor returns FB2 id for link target.
+func (er *epubReader) idFor(key string) string {
+	if id, ok := er.fb2ids[key]; ok {
+		return id
+	}
+	name := key
+	if i := strings.LastIndexByte(key, '#'); i >= 0 {
+		name = key[i+1:]
+	} else {
+		name = strings.TrimSuffix(path.Base(key), path.Ext(key))
+	}
+	id := er.uniqueID(name)
+	er.fb2ids[key] = id
+	return id
+}
+
+// uniqueID makes valid unique XML id out of the name.
+func (er *epubReader) uniqueID(name string) string {
+
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		case i == 0 && unicode.IsDigit(r):
+			sb.WriteRune('_')
+		default:
+			r = '_'
+		}
+		sb.WriteRune(r)
+	}
+	id := sb.String()
+	if len(id) == 0 {
+		id = "id"
+	}
+	res := id
+	for n := 2; er.used[res]; n++ {
+		res = id + "_" + strconv.Itoa(n)
+	}
+	er.used[res] = true
+	return res
+}
+
+// linkAttr temporarily holds target of internal link until all ids are known.
+const linkAttr = "fb2c-link"
+
+// resolveLinks replaces internal link targets with FB2 ids, links to content which did not survive conversion are
+// removed keeping their text.
+func (er *epubReader) resolveLinks(fb *etree.Element) {
+
+	ids := make(map[string]bool)
+	for _, el := range fb.FindElements("//*[@id]") {
+		ids[el.SelectAttrValue("id", "")] = true
+	}
+	for _, a := range fb.FindElements("//a") {
+		key := a.SelectAttrValue(linkAttr, "")
+		if len(key) == 0 {
+			continue
+		}
+		a.RemoveAttr(linkAttr)
+		if id, ok := er.fb2ids[key]; ok && ids[id] {
+			a.CreateAttr("l:href", "#"+id)
+			continue
+		}
+		unwrapElement(a)
+	}
+}
+
+// buildDescription maps OPF metadata to FB2 description.
+func (er *epubReader) buildDescription(desc *etree.Element) {
+
+	ti := desc.AddNext("title-info")
+
+	var (
+		title, lang, date, publisher, annotation, isbn, uid, firstID string
+		creators, translators, subjects                              []*etree.Element
+	)
+	for _, el := range er.meta.ChildElements() {
+		text := strings.TrimSpace(el.Text())
+		switch el.Tag {
+		case "title":
+			if len(title) == 0 {
+				title = collapseSpaces(text)
+			}
+		case "language":
+			if len(lang) == 0 {
+				lang = text
+			}
+		case "date":
+			if len(date) == 0 {
+				date = text
+			}
+		case "publisher":
+			if len(publisher) == 0 {
+				publisher = text
+			}
+		case "description":
+			if len(annotation) == 0 {
+				annotation = text
+			}
+		case "subject":
+			subjects = append(subjects, el)
+		case "creator", "contributor":
+			role := attrLocal(el, "role")
+			if r, ok := er.refines[el.SelectAttrValue("id", "")]["role"]; ok {
+				role = r
+			}
+			switch {
+			case role == "trl":
+				translators = append(translators, el)
+			case el.Tag == "creator" && (role == "aut" || len(role) == 0):
+				creators = append(creators, el)
+			}
+		case "identifier":
+			scheme := strings.ToLower(attrLocal(el, "scheme"))
+			low := strings.ToLower(text)
+			switch {
+			case scheme == "isbn" || strings.HasPrefix(low, "urn:isbn:") || strings.HasPrefix(low, "isbn:"):
+				if len(isbn) == 0 {
+					isbn = text[strings.LastIndexByte(text, ':')+1:]
+				}
+			case scheme == "uuid" || strings.HasPrefix(low, "urn:uuid:"):
+				if u, err := uuid.Parse(strings.TrimPrefix(low, "urn:uuid:")); err == nil && len(uid) == 0 {
+					uid = u.String()
+				}
+			default:
+				if u, err := uuid.Parse(text); err == nil && len(uid) == 0 {
+					uid = u.String()
+				}
+			}
+			if len(firstID) == 0 {
+				firstID = text
+			}
+		}
+	}
+
+	genres := 0
+	for _, el := range subjects {
+		if g := strings.TrimSpace(el.Text()); genreCode.MatchString(g) {
+			ti.AddNext("genre").SetText(g)
+			genres++
+		}
+	}
+	if genres == 0 {
+		ti.AddNext("genre").SetText("other")
+	}
+	for _, el := range creators {
+		er.author(ti.AddNext("author"), el)
+	}
+	if len(creators) == 0 {
+		ti.AddNext("author").AddNext("nickname").SetText("Unknown")
+	}
+	if len(title) == 0 {
+		title = "Unknown"
+	}
+	ti.AddNext("book-title").SetText(title)
+
+	if len(annotation) > 0 {
+		if paras := htmlParagraphs(annotation); len(paras) > 0 {
+			an := ti.AddNext("annotation")
+			for _, p := range paras {
+				an.AddNext("p").SetText(p)
+			}
+		}
+	}
+	if len(date) >= 4 {
+		d := ti.AddNext("date")
+		if len(date) >= 10 {
+			if _, err := time.Parse("2006-01-02", date[:10]); err == nil {
+				d.CreateAttr("value", date[:10])
+			}
+		}
+		d.SetText(date[:4])
+	}
+	if len(er.cover) > 0 {
+		if id := er.binary(er.cover); len(id) > 0 {
+			ti.AddNext("coverpage").AddNext("image", attr("l:href", "#"+id))
+		}
+	}
+	if len(lang) == 0 {
+		lang = "en"
+	}
+	ti.AddNext("lang").SetText(lang)
+	for _, el := range translators {
+		er.author(ti.AddNext("translator"), el)
+	}
+	if name, num := er.series(); len(name) > 0 {
+		ti.AddNext("sequence", attr("name", name), attr("number", num))
+	}
+
+	if len(uid) == 0 {
+		if len(firstID) == 0 {
+			firstID = title
+		}
+		uid = uuid.NewSHA1(uuid.NameSpaceURL, []byte(firstID)).String()
+	}
+	modified := time.Now().Format("2006-01-02")
+	for _, el := range er.meta.SelectElements("meta") {
+		if el.SelectAttrValue("property", "") == "dcterms:modified" && len(el.Text()) >= 10 {
+			modified = el.Text()[:10]
+		}
+	}
+	di := desc.AddNext("document-info")
+	di.AddNext("author").AddNext("nickname").SetText("fb2converter")
+	di.AddNext("program-used").SetText("fb2converter")
+	di.AddNext("date", attr("value", modified)).SetText(modified)
+	di.AddNext("id").SetText(uid)
+	di.AddNext("version").SetText("1.0")
+
+	if len(publisher) > 0 || len(isbn) > 0 {
+		pi := desc.AddNext("publish-info")
+		pi.AddNext("book-name").SetText(title)
+		if len(publisher) > 0 {
+			pi.AddNext("publisher").SetText(publisher)
+		}
+		if len(isbn) > 0 {
+			pi.AddNext("isbn").SetText(isbn)
+		}
+	}
+}
+
+var genreCode = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// author fills FB2 author from OPF creator.
+func (er *epubReader) author(to, el *etree.Element) {
+
+	name := collapseSpaces(el.Text())
+	fileAs := attrLocal(el, "file-as")
+	if v, ok := er.refines[el.SelectAttrValue("id", "")]["file-as"]; ok {
+		fileAs = v
+	}
+
+	var first, middle, last string
+	if last, rest, ok := strings.Cut(fileAs, ","); ok && len(strings.TrimSpace(last)) > 0 {
+		words := strings.Fields(rest)
+		if len(words) > 0 {
+			first, middle = words[0], strings.Join(words[1:], " ")
+		}
+		to.AddNext("first-name").SetText(first)
+		if len(middle) > 0 {
+			to.AddNext("middle-name").SetText(middle)
+		}
+		to.AddNext("last-name").SetText(strings.TrimSpace(last))
+		return
+	}
+
+	words := strings.Fields(name)
+	switch len(words) {
+	case 0:
+		to.AddNext("nickname").SetText("Unknown")
+		return
+	case 1:
+		to.AddNext("nickname").SetText(words[0])
+		return
+	}
+	first, last = words[0], words[len(words)-1]
+	middle = strings.Join(words[1:len(words)-1], " ")
+	to.AddNext("first-name").SetText(first)
+	if len(middle) > 0 {
+		to.AddNext("middle-name").SetText(middle)
+	}
+	to.AddNext("last-name").SetText(last)
+}
+
+// series returns series name and number from calibre or EPUB3 collection metadata.
+func (er *epubReader) series() (string, string) {
+
+	name, num := er.metaContent("calibre:series"), er.metaContent("calibre:series_index")
+	if len(name) == 0 {
+		for _, el := range er.meta.SelectElements("meta") {
+			if el.SelectAttrValue("property", "") != "belongs-to-collection" {
+				continue
+			}
+			refs := er.refines[el.SelectAttrValue("id", "")]
+			if t, ok := refs["collection-type"]; ok && t != "series" {
+				continue
+			}
+			name, num = strings.TrimSpace(el.Text()), refs["group-position"]
+			break
+		}
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil && f > 0 && f < math.MaxInt32 {
+		num = strconv.Itoa(int(f))
+	} else {
+		num = ""
+	}
+	return name, num
+}
+
+// isHeading checks if element is heading.
+func (er *epubReader) isHeading(el *etree.Element) bool {
+	_, ok := er.headingLevel(el)
+	return ok
+}
+
+// headingLevel returns level of HTML heading. Headings in the table of contents produced by this converter are
+// "titleblock" divisions.
+func (er *epubReader) headingLevel(el *etree.Element) (int, bool) {
+	if len(el.Tag) == 2 && el.Tag[0] == 'h' && el.Tag[1] >= '1' && el.Tag[1] <= '6' {
+		return int(el.Tag[1] - '0'), true
+	}
+	if el.Tag == "div" && hasWord(el.SelectAttrValue("class", ""), "titleblock") {
+		for _, c := range el.ChildElements() {
+			class := c.SelectAttrValue("class", "")
+			if len(class) == 2 && class[0] == 'h' && class[1] >= '0' && class[1] <= '9' {
+				// h0 is book title
+				return int(class[1] - '0'), true
+			}
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// isTitle checks if element looks like note title.
+func (er *epubReader) isTitle(el *etree.Element) bool {
+	if er.isHeading(el) {
+		return true
+	}
+	for _, c := range strings.Fields(el.SelectAttrValue("class", "")) {
+		if strings.Contains(strings.ToLower(c), "title") {
+			return true
+		}
+	}
+	return false
+}
+
+// fb2Sink receives converted blocks.
+type fb2Sink interface {
+	add(el *etree.Element)
+	epigraph(el *etree.Element)
+	heading(level int, title *etree.Element) *etree.Element
+}
+
+// fb2Level is section being filled.
+type fb2Level struct {
+	el    *etree.Element
+	level int
+	text  bool           // has content
+	sub   bool           // has subsections
+	spill *etree.Element // untitled section for content following subsections
+}
+
+// fb2Flow builds section hierarchy making sure sections never mix content and subsections.
+type fb2Flow struct {
+	stack []*fb2Level
+	main  bool // building body, otherwise single section without subsections
+}
+
+func newFB2Flow(root *etree.Element, main bool) *fb2Flow {
+	return &fb2Flow{stack: []*fb2Level{{el: root}}, main: main}
+}
+
+func (f *fb2Flow) top() *fb2Level {
+	return f.stack[len(f.stack)-1]
+}
+
+func (f *fb2Flow) add(el *etree.Element) {
+	if f.main && len(f.stack) == 1 {
+		// body cannot have content outside of sections
+		f.open(math.MaxInt32, nil)
+	}
+	top := f.top()
+	if top.sub {
+		if top.spill == nil {
+			top.spill = top.el.AddNext("section")
+		}
+		top.spill.AddChild(el)
+		return
+	}
+	top.el.AddChild(el)
+	top.text = true
+}
+
+func (f *fb2Flow) epigraph(el *etree.Element) {
+	if top := f.top(); !top.text && !top.sub {
+		top.el.AddChild(el)
+		return
+	}
+	el.Tag = "cite"
+	f.add(el)
+}
+
+func (f *fb2Flow) heading(level int, title *etree.Element) *etree.Element {
+	if !f.main {
+		for _, p := range title.SelectElements("p") {
+			p.Tag = "subtitle"
+			f.add(p)
+		}
+		return nil
+	}
+	return f.open(level, title)
+}
+
+// bodyTitle makes title of the body if nothing was added yet.
+func (f *fb2Flow) bodyTitle(title *etree.Element) bool {
+	if !f.main || len(f.stack) > 1 || len(f.stack[0].el.ChildElements()) > 0 || len(title.ChildElements()) == 0 {
+		return false
+	}
+	f.stack[0].el.AddChild(title)
+	return true
+}
+
+func (f *fb2Flow) open(level int, title *etree.Element) *etree.Element {
+
+	for len(f.stack) > 1 && f.top().level >= level {
+		f.stack = f.stack[:len(f.stack)-1]
+	}
+	parent := f.top()
+	if parent.text && !parent.sub {
+		// move content to untitled subsection
+		wrap := etree.NewElement("section")
+		for _, c := range parent.el.ChildElements() {
+			switch c.Tag {
+			case "title", "epigraph", "annotation":
+			default:
+				wrap.AddChild(c)
+			}
+		}
+		parent.el.AddChild(wrap)
+	}
+	parent.sub, parent.spill = true, nil
+
+	sec := parent.el.AddNext("section")
+	if title != nil && len(title.ChildElements()) > 0 {
+		sec.AddChild(title)
+	}
+	f.stack = append(f.stack, &fb2Level{el: sec, level: level})
+	return sec
+}
+
+// fb2Collector gathers blocks for groups and lists, headings become subtitles.
+type fb2Collector struct {
+	items []*etree.Element
+}
+
+func (c *fb2Collector) add(el *etree.Element) {
+	c.items = append(c.items, el)
+}
+
+func (c *fb2Collector) epigraph(el *etree.Element) {
+	el.Tag = "cite"
+	c.add(el)
+}
+
+func (c *fb2Collector) heading(_ int, title *etree.Element) *etree.Element {
+	for _, p := range title.SelectElements("p") {
+		p.Tag = "subtitle"
+		c.add(p)
+	}
+	return nil
+}
+
+// paraBuilder accumulates inline content into paragraphs, line breaks start new paragraph reopening inline formatting.
+type paraBuilder struct {
+	tag   string
+	flat  bool // ignore line breaks
+	paras []*etree.Element
+	open  []*etree.Element // paragraph and inline elements inside it
+}
+
+func newParaBuilder(tag string) *paraBuilder {
+	return &paraBuilder{tag: tag}
+}
+
+// para returns current paragraph.
+func (b *paraBuilder) para() *etree.Element {
+	if len(b.open) == 0 {
+		p := etree.NewElement(b.tag)
+		b.paras = append(b.paras, p)
+		b.open = []*etree.Element{p}
+	}
+	return b.open[0]
+}
+
+// cur returns innermost open element.
+func (b *paraBuilder) cur() *etree.Element {
+	b.para()
+	return b.open[len(b.open)-1]
+}
+
+func (b *paraBuilder) text(s string) {
+	s = strings.ReplaceAll(s, "­", "")
+	if len(s) == 0 || (len(b.open) == 0 && len(strings.TrimSpace(s)) == 0) {
+		return
+	}
+	appendText(b.cur(), collapseSpaces(s))
+}
+
+func (b *paraBuilder) push(tag string, attrs ...*etree.Attr) {
+	b.open = append(b.open, b.cur().AddNext(tag, attrs...))
+}
+
+func (b *paraBuilder) pop() {
+	if len(b.open) > 1 {
+		b.open = b.open[:len(b.open)-1]
+	}
+}
+
+func (b *paraBuilder) brk() {
+	if b.flat {
+		b.text(" ")
+		return
+	}
+	if len(b.open) == 0 {
+		return
+	}
+	chain := b.open[1:]
+	b.open = nil
+	for _, e := range chain {
+		attrs := make([]*etree.Attr, 0, len(e.Attr))
+		for _, a := range e.Attr {
+			attrs = append(attrs, &etree.Attr{Space: a.Space, Key: a.Key, Value: a.Value})
+		}
+		b.push(e.Tag, attrs...)
+	}
+}
+
+// result returns non empty paragraphs with trimmed edges.
+func (b *paraBuilder) result() []*etree.Element {
+	res := make([]*etree.Element, 0, len(b.paras))
+	for _, p := range b.paras {
+		if len(strings.TrimSpace(plainText(p))) == 0 && p.FindElement(".//image") == nil {
+			continue
+		}
+		trimEdges(p)
+		res = append(res, p)
+	}
+	return res
+}
+
+// appendText adds text at the end of element content.
+func appendText(el *etree.Element, s string) {
+	if n := len(el.Child); n > 0 {
+		switch t := el.Child[n-1].(type) {
+		case *etree.CharData:
+			t.Data = collapseSpaces(t.Data + s)
+			return
+		case *etree.Element:
+			t.SetTail(collapseSpaces(t.Tail() + s))
+			return
+		}
+	}
+	el.CreateCharData(s)
+}
+
+// prependText adds text at the start of element content.
+func prependText(el *etree.Element, s string) {
+	if len(el.Child) > 0 {
+		if cd, ok := el.Child[0].(*etree.CharData); ok {
+			cd.Data = s + cd.Data
+			return
+		}
+	}
+	var first etree.Token
+	if len(el.Child) > 0 {
+		first = el.Child[0]
+	}
+	el.InsertChild(first, etree.NewCharData(s))
+}
+
+// wrapChildren moves all element content into new child element.
+func wrapChildren(el *etree.Element, tag string) {
+	w := etree.NewElement(tag)
+	for _, t := range append([]etree.Token(nil), el.Child...) {
+		w.AddChild(t)
+	}
+	el.AddChild(w)
+}
+
+// unwrapElement replaces element with its content.
+func unwrapElement(el *etree.Element) {
+	parent := el.Parent()
+	if parent == nil {
+		return
+	}
+	tail := el.Tail()
+	for _, t := range append([]etree.Token(nil), el.Child...) {
+		parent.InsertChild(el, t)
+	}
+	if len(tail) > 0 {
+		parent.InsertChild(el, etree.NewCharData(tail))
+	}
+	parent.RemoveChild(el)
+}
+
+// trimEdges removes leading and trailing spaces of paragraph.
+func trimEdges(p *etree.Element) {
+	if len(p.Child) == 0 {
+		return
+	}
+	if cd, ok := p.Child[0].(*etree.CharData); ok {
+		cd.Data = strings.TrimLeft(cd.Data, " ")
+	}
+	switch t := p.Child[len(p.Child)-1].(type) {
+	case *etree.CharData:
+		t.Data = strings.TrimRight(t.Data, " ")
+	case *etree.Element:
+		t.SetTail(strings.TrimRight(t.Tail(), " "))
+	}
+}
+
+var spaces = regexp.MustCompile(`[ \t\r\n]+`)
+
+func collapseSpaces(s string) string {
+	return spaces.ReplaceAllString(s, " ")
+}
+
+// plainText returns all text inside element.
+func plainText(el *etree.Element) string {
+	var sb strings.Builder
+	var walk func(e *etree.Element)
+	walk = func(e *etree.Element) {
+		for _, t := range e.Child {
+			switch t := t.(type) {
+			case *etree.CharData:
+				sb.WriteString(t.Data)
+			case *etree.Element:
+				walk(t)
+				sb.WriteString(t.Tail())
+			}
+		}
+	}
+	walk(el)
+	return sb.String()
+}
+
+// htmlParagraphs splits (possibly marked up) text into paragraphs.
+func htmlParagraphs(s string) []string {
+	s = regexp.MustCompile(`(?i)</p>|<br\s*/?>`).ReplaceAllString(s, "\n")
+	s = html.UnescapeString(regexp.MustCompile(`<[^>]*>`).ReplaceAllString(s, ""))
+	var res []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(collapseSpaces(line)); len(line) > 0 {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// resolveHref returns full path of the link target inside container (with fragment) or false for external links.
+func resolveHref(base, href string) (string, bool) {
+	href = strings.TrimSpace(href)
+	if len(href) == 0 {
+		return "", false
+	}
+	u, err := url.Parse(href)
+	if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 {
+		return "", false
+	}
+	p := base
+	if len(u.Path) > 0 {
+		p = path.Join(path.Dir(base), u.Path)
+	}
+	p = strings.TrimPrefix(p, "/")
+	if len(u.Fragment) > 0 {
+		return p + "#" + u.Fragment, true
+	}
+	return p, true
+}
+
+func stripFragment(key string) string {
+	if i := strings.IndexByte(key, '#'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func elemKey(base string, el *etree.Element) string {
+	if id := el.SelectAttrValue("id", ""); len(id) > 0 && len(base) > 0 {
+		return base + "#" + id
+	}
+	return ""
+}
+
+func imageHref(el *etree.Element) string {
+	for _, a := range el.Attr {
+		if a.Key == "href" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// attrLocal returns attribute value ignoring namespace prefix.
+func attrLocal(el *etree.Element, key string) string {
+	for _, a := range el.Attr {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func hasWord(s, word string) bool {
+	for _, w := range strings.Fields(s) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+func isInline(tag string) bool {
+	switch tag {
+	case "a", "abbr", "acronym", "b", "bdi", "bdo", "big", "br", "cite", "code", "del", "dfn", "em", "font", "i", "img",
+		"ins", "kbd", "label", "mark", "q", "rb", "rp", "rt", "ruby", "s", "samp", "small", "span", "strike", "strong",
+		"sub", "sup", "time", "tt", "u", "var", "wbr":
+		return true
+	}
+	return false
+}
+
+func isContainer(tag string) bool {
+	switch tag {
+	case "div", "aside", "section", "article", "li", "dd", "blockquote", "td", "footer":
+		return true
+	}
+	return false
+}
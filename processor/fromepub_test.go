@@ -0,0 +1,159 @@
+package processor
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+const fb2Reverse = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author>
+    <first-name>Иван</first-name>
+    <last-name>Иванов</last-name>
+   </author>
+   <book-title>Обратная книга</book-title>
+   <annotation>
+    <p>Краткое описание.</p>
+   </annotation>
+   <lang>ru</lang>
+   <sequence name="Тесты" number="3"/>
+  </title-info>
+  <document-info>
+   <author>
+    <nickname>tester</nickname>
+   </author>
+   <date>2020</date>
+   <id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id>
+   <version>1.0</version>
+  </document-info>
+ </description>
+ <body>
+  <section id="s_1">
+   <title>
+    <p>Глава 1</p>
+   </title>
+   <epigraph>
+    <p>Эпиграф.</p>
+    <text-author>Автор</text-author>
+   </epigraph>
+   <p>Первый абзац<a l:href="#n_1" type="note">[1]</a>.</p>
+   <image l:href="#pic.png"/>
+   <p>Смотри <a l:href="#s_2">вторую главу</a>.</p>
+  </section>
+  <section id="s_2">
+   <title>
+    <p>Глава 2</p>
+   </title>
+   <p>Второй <strong>абзац</strong>.</p>
+  </section>
+ </body>
+ <body name="notes">
+  <section id="n_1">
+   <title>
+    <p>1</p>
+   </title>
+   <p>Текст сноски.</p>
+  </section>
+ </body>
+ <binary id="pic.png" content-type="image/png">iVBORw0KGgoAAAANSUhEUgAAAAQAAAAECAIAAAAmkwkpAAAAEElEQVR4nGP4z8AARwzEcQCukw/x0F8jngAAAABJRU5ErkJggg==</binary>
+</FictionBook>
+`
+
+func TestEPUBToFB2(t *testing.T) {
+
+	env := testEnv(t, nil)
+
+	for _, format := range []OutputFmt{OEpub, OKepub, OEpub3} {
+		t.Run(format.String(), func(t *testing.T) {
+
+			p, err := NewFB2(strings.NewReader(fb2Reverse), false, "book.fb2", t.TempDir(), false, false, false, format, env)
+			if err != nil {
+				t.Fatalf("Unable to parse book: %v", err)
+			}
+			defer p.Clean()
+			if err := p.Process(); err != nil {
+				t.Fatalf("Unable to process book: %v", err)
+			}
+			fname, err := p.Save()
+			if err != nil {
+				t.Fatalf("Unable to save book: %v", err)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc, err := EPUBToFB2(bytes.NewReader(data), int64(len(data)), env)
+			if err != nil {
+				t.Fatalf("Unable to convert book: %v", err)
+			}
+
+			ti := doc.FindElement("./FictionBook/description/title-info")
+			if ti == nil {
+				t.Fatal("No title-info")
+			}
+			// converter does not keep name order in package metadata
+			if names := plainText(ti.FindElement("./author")); !strings.Contains(names, "Иванов") || !strings.Contains(names, "Иван") {
+				t.Fatalf("Unexpected author: %s", names)
+			}
+			if e := ti.FindElement("./lang"); e == nil || e.Text() != "ru" {
+				t.Fatal("Unexpected language")
+			}
+			if e := ti.FindElement("./sequence"); e == nil || e.SelectAttrValue("name", "") != "Тесты" || e.SelectAttrValue("number", "") != "3" {
+				t.Fatal("Unexpected sequence")
+			}
+			if ti.FindElement("./annotation/p") == nil {
+				t.Fatal("No annotation")
+			}
+
+			sections := doc.FindElements("./FictionBook/body[1]/section")
+			if len(sections) != 2 {
+				t.Fatalf("Unexpected number of sections: %d", len(sections))
+			}
+			for i, title := range []string{"Глава 1", "Глава 2"} {
+				if e := sections[i].FindElement("./title/p"); e == nil || e.Text() != title {
+					t.Fatalf("Unexpected title of section %d", i+1)
+				}
+			}
+			if sections[0].FindElement("./epigraph/text-author") == nil {
+				t.Fatal("No epigraph")
+			}
+			if sections[0].FindElement("./image") == nil {
+				t.Fatal("No image")
+			}
+			if a := sections[0].FindElement(".//a[@type='note']"); a == nil || a.SelectAttrValue("l:href", "") != "#n_1" {
+				t.Fatal("No note link")
+			}
+			if id := sections[1].SelectAttrValue("id", ""); len(id) == 0 || sections[0].FindElement(".//a[@l:href='#"+id+"']") == nil {
+				t.Fatal("Cross reference is not preserved")
+			}
+
+			notes := doc.FindElements("./FictionBook/body[@name='notes']/section")
+			if len(notes) != 1 || notes[0].SelectAttrValue("id", "") != "n_1" || notes[0].FindElement("./p") == nil {
+				t.Fatal("Unexpected notes")
+			}
+			if len(doc.FindElements("./FictionBook/binary")) != 1 {
+				t.Fatal("Unexpected number of binaries")
+			}
+
+			// result should be good enough for converter itself
+			var buf bytes.Buffer
+			if _, err := doc.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			rp, err := NewFB2(&buf, false, "book.fb2", t.TempDir(), false, false, false, OEpub, env)
+			if err != nil {
+				t.Fatalf("Unable to parse converted book: %v", err)
+			}
+			defer rp.Clean()
+			if err := rp.Process(); err != nil {
+				t.Fatalf("Unable to process converted book: %v", err)
+			}
+		})
+	}
+}
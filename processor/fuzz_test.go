@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// maxFuzzBook caps size of generated books, conversion of larger ones is too slow to be useful for fuzzing.
+const maxFuzzBook = 128 * 1024
+
+func fuzzEnv(f *testing.F, setup func(cfg *config.Config)) *state.LocalEnv {
+
+	f.Helper()
+
+	return testEnv(f, func(cfg *config.Config) {
+		cfg.Doc.Reproducible = true
+		cfg.Doc.Kindlegen.Engine = EngineNative.String()
+		if setup != nil {
+			setup(cfg)
+		}
+	})
+}
+
+// corpusBooks returns books from golden test corpus.
+func corpusBooks(f *testing.F) [][]byte {
+
+	f.Helper()
+
+	names, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.fb2"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var books [][]byte
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		books = append(books, data)
+	}
+	return books
+}
+
+func FuzzBinaries(f *testing.F) {
+
+	for _, book := range corpusBooks(f) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(book); err != nil {
+			f.Fatal(err)
+		}
+		for _, el := range doc.FindElements("./FictionBook/binary") {
+			f.Add(el.Text(), getAttrValue(el, "content-type"))
+		}
+	}
+	f.Add(base64.StdEncoding.EncodeToString([]byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`)), "image/svg+xml")
+	f.Add("R0lGODlhAQABAAAAACw=", "image/gif")
+	// 65535x65535 PNG, decoder would allocate 16GiB before finding out there is no data
+	f.Add("iVBORw0KGgoAAAANSUhEUgAA//8AAP//CAYAAAC2BdlQAAAACElEQVR4nAMAAAAAAUgGidI=", "image/png")
+
+	env := fuzzEnv(f, func(cfg *config.Config) {
+		cfg.Doc.OptimizeImages = true
+		cfg.Doc.RemovePNGTransparency = true
+		cfg.Doc.ImagesScaleFactor = 1.5
+		cfg.Doc.UseBrokenImages = true
+	})
+
+	f.Fuzz(func(t *testing.T, content, contentType string) {
+
+		if len(content) > maxFuzzBook {
+			return
+		}
+
+		doc := etree.NewDocument()
+		bin := doc.CreateElement("FictionBook").CreateElement("binary")
+		bin.CreateAttr("id", "image")
+		bin.CreateAttr("content-type", contentType)
+		bin.SetText(content)
+
+		p := &Processor{format: OAzw3, doc: doc, env: env, Book: NewBook(uuid.Nil, "fuzz.fb2")}
+		if err := p.processBinaries(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		dir := t.TempDir()
+		for _, img := range p.Book.Images {
+			// images which cannot be stored are reported as errors, only panics are of interest
+			_ = img.flush(dir)
+		}
+	})
+}
+
+func FuzzConvert(f *testing.F) {
+
+	formats := []OutputFmt{OEpub, OKepub, OEpub3, OAzw3, OTxt, OHtml}
+
+	for i, book := range append(corpusBooks(f), []byte(fb2Text), []byte(fb2Reverse)) {
+		f.Add(book, uint8(i))
+	}
+	f.Add([]byte(`<FictionBook><body><section><p>text`), uint8(0))
+
+	env := fuzzEnv(f, nil)
+
+	f.Fuzz(func(t *testing.T, data []byte, format uint8) {
+
+		if len(data) > maxFuzzBook {
+			return
+		}
+
+		enc := EncUnknown
+		if len(data) >= 4 {
+			enc = DetectUTF(data)
+		}
+		p, err := NewFB2(SelectReader(bytes.NewReader(data), enc), enc == EncUnknown, "fuzz.fb2", t.TempDir(), true, false, true, formats[int(format)%len(formats)], env)
+		if err != nil {
+			return
+		}
+		defer p.Clean()
+		if err := p.Process(); err != nil {
+			return
+		}
+		// books which cannot be saved are reported as errors, only panics are of interest
+		_, _ = p.Save()
+	})
+}
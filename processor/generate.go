@@ -16,6 +16,7 @@ import (
 	"github.com/gosimple/slug"
 	"go.uber.org/zap"
 
+	"fb2converter/config"
 	"fb2converter/etree"
 )
 
@@ -176,6 +177,7 @@ func (p *Processor) generateCover() error {
 		// resizing will be done on device
 		to, f := p.ctx().createXHTML("cover", attr("xmlns", `http://www.w3.org/1999/xhtml`))
 		f.id = "cover-page"
+		f.props = "svg"
 		// Cover page goes first
 		p.Book.Files = append(p.Book.Files, nil)
 		copy(p.Book.Files[1:], p.Book.Files[0:])
@@ -260,6 +262,19 @@ func (p *Processor) generateNCX() error {
 		index++
 	}
 
+	index = p.arrangeTOC(to, index, addNavPoint)
+
+	if p.tocPlacement == TOCAfter && len(p.Book.TOC) > 0 {
+		addNavPoint(to, index, p.env.Cfg.Doc.TOC.Title, "toc.xhtml")
+	}
+	return nil
+}
+
+// arrangeTOC builds TOC hierarchy according to requested TOC type. For every TOC entry add is called with parent
+// element (root for top level) and should return element to be used as parent for nested entries. Returns next
+// available index.
+func (p *Processor) arrangeTOC(root *etree.Element, index int, add func(to *etree.Element, index int, title, link string) *etree.Element) int {
+
 	const (
 		maxLevel       = int(math.MaxInt32)
 		maxKindleLevel = 2
@@ -284,36 +299,110 @@ func (p *Processor) generateNCX() error {
 	for _, e := range p.Book.TOC {
 		switch {
 		case prev == nil: // first time
-			history.push(e.level.Int(), addNavPoint(to, index, AllLines(e.title), e.ref))
+			history.push(e.level.Int(), add(root, index, AllLines(e.title), e.ref))
 		case prev.level.Int() < e.level.Int(): // going in
 			if e.level.Int() < level || history.depth() > barrier {
 				history.pop()
 			}
-			_, inner := history.peek(to)
-			history.push(e.level.Int(), addNavPoint(inner, index, AllLines(e.title), e.ref))
+			_, inner := history.peek(root)
+			history.push(e.level.Int(), add(inner, index, AllLines(e.title), e.ref))
 		case prev.level.Int() == e.level.Int(): // same level
 			history.pop()
-			_, inner := history.peek(to)
-			history.push(e.level.Int(), addNavPoint(inner, index, AllLines(e.title), e.ref))
+			_, inner := history.peek(root)
+			history.push(e.level.Int(), add(inner, index, AllLines(e.title), e.ref))
 		case prev.level.Int() > e.level.Int(): // going out
 			for l, elem := history.peek(nil); elem != nil && l >= e.level.Int(); l, elem = history.peek(nil) {
 				history.pop()
 			}
-			_, inner := history.peek(to)
-			history.push(e.level.Int(), addNavPoint(inner, index, AllLines(e.title), e.ref))
+			_, inner := history.peek(root)
+			history.push(e.level.Int(), add(inner, index, AllLines(e.title), e.ref))
 		default:
 			panic("bad toc, should never happen")
 		}
 		prev = e
 		index++
 	}
+	return index
+}
 
+// generateNav creates EPUB3 navigation document with toc, landmarks and page list.
+func (p *Processor) generateNav() error {
+
+	if p.format != OEpub3 {
+		return nil
+	}
+
+	p.env.Log.Debug("Generating navigation document - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Generating navigation document - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	to, f := p.ctx().createXHTML("nav",
+		attr("xmlns", `http://www.w3.org/1999/xhtml`),
+		attr("xmlns:epub", `http://www.idpf.org/2007/ops`),
+	)
+	f.id = "nav"
+	f.props = "nav"
+	f.transient = dataNotForSpline
+	p.Book.Files = append(p.Book.Files, f)
+
+	// nested entries go into list under parent item, list is created when first needed
+	addItem := func(to *etree.Element, _ int, title, link string) *etree.Element {
+		if to.Tag == "li" {
+			if ol := to.SelectElement("ol"); ol != nil {
+				to = ol
+			} else {
+				to = to.AddNext("ol")
+			}
+		}
+		li := to.AddNext("li")
+		li.AddNext("a", attr("href", link)).SetText(title)
+		return li
+	}
+
+	toc := to.AddNext("nav", attr("epub:type", "toc"), attr("id", "toc"))
+	toc.AddNext("h1").SetText(p.env.Cfg.Doc.TOC.Title)
+	ol := toc.AddNext("ol")
+	if p.tocPlacement == TOCBefore && len(p.Book.TOC) > 0 {
+		addItem(ol, 0, p.env.Cfg.Doc.TOC.Title, "toc.xhtml")
+	}
+	p.arrangeTOC(ol, 0, addItem)
 	if p.tocPlacement == TOCAfter && len(p.Book.TOC) > 0 {
-		addNavPoint(to, index, p.env.Cfg.Doc.TOC.Title, "toc.xhtml")
+		addItem(ol, 0, p.env.Cfg.Doc.TOC.Title, "toc.xhtml")
+	}
+	if len(ol.Child) == 0 {
+		// list may not be empty
+		addItem(ol, 0, p.Book.Title, p.startFile())
+	}
+
+	landmarks := to.AddNext("nav", attr("epub:type", "landmarks"), attr("hidden", "hidden")).AddNext("ol")
+	if len(p.Book.Cover) > 0 {
+		landmarks.AddNext("li").AddNext("a", attr("epub:type", "cover"), attr("href", "cover.xhtml")).SetText("Cover")
+	}
+	if p.tocPlacement != TOCNone && len(p.Book.TOC) > 0 {
+		landmarks.AddNext("li").AddNext("a", attr("epub:type", "toc"), attr("href", "toc.xhtml")).SetText(p.env.Cfg.Doc.TOC.Title)
+	}
+	landmarks.AddNext("li").AddNext("a", attr("epub:type", "bodymatter"), attr("href", p.startFile())).SetText("Starts here")
+
+	if !p.noPages {
+		pages := to.AddNext("nav", attr("epub:type", "page-list"), attr("hidden", "hidden")).AddNext("ol")
+		for _, pg := range p.pageList() {
+			pages.AddNext("li").AddNext("a", attr("href", pg.href)).SetText(pg.name)
+		}
 	}
 	return nil
 }
 
+// startFile returns name of the first content file of the book.
+func (p *Processor) startFile() string {
+	for _, f := range p.Book.Files {
+		if strings.HasPrefix(f.fname, "index") {
+			return f.fname
+		}
+	}
+	return "index1.xhtml"
+}
+
 // process stylesheet and files it references.
 func (p *Processor) prepareStylesheet() error {
 
@@ -404,7 +493,8 @@ func (p *Processor) prepareStylesheet() error {
 // generatePagemap creates epub page map.
 func (p *Processor) generatePagemap() error {
 
-	if p.noPages {
+	// EPUB3 keeps page list in navigation document
+	if p.noPages || p.format == OEpub3 {
 		return nil
 	}
 
@@ -416,14 +506,26 @@ func (p *Processor) generatePagemap() error {
 	to, f := p.ctx().createPM("page-map")
 	p.Book.Files = append(p.Book.Files, f)
 
-	page := 1
+	for _, pg := range p.pageList() {
+		to.AddNext("page", attr("name", pg.name), attr("href", pg.href))
+	}
+	return nil
+}
+
+type pageEntry struct {
+	name, href string
+}
+
+// pageList returns book pages in reading order.
+func (p *Processor) pageList() []pageEntry {
+
+	var pages []pageEntry
 	for _, f := range p.Book.Files {
 		if f.transient&dataNotForSpline != 0 {
 			continue
 		}
 
-		to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", f.fname))
-		page++
+		pages = append(pages, pageEntry{name: strconv.Itoa(len(pages) + 1), href: f.fname})
 
 		additionalPages, ok := p.Book.Pages[f.fname]
 		if !ok {
@@ -431,11 +533,10 @@ func (p *Processor) generatePagemap() error {
 		}
 
 		for i := 0; i < additionalPages; i++ {
-			to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", fmt.Sprintf("%s#page_%d", f.fname, i)))
-			page++
+			pages = append(pages, pageEntry{name: strconv.Itoa(len(pages) + 1), href: fmt.Sprintf("%s#page_%d", f.fname, i)})
 		}
 	}
-	return nil
+	return pages
 }
 
 // generateOPF creates epub Open Package format file.
@@ -446,11 +547,16 @@ func (p *Processor) generateOPF() error {
 		p.env.Log.Debug("Generating OPF - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	to, f := p.ctx().createOPF("content")
-	p.Book.Files = append(p.Book.Files, f)
-
+	epub3 := p.format == OEpub3
 	kindle := p.format == OMobi || p.format == OAzw3
 
+	version := "2.0"
+	if epub3 {
+		version = "3.0"
+	}
+	to, f := p.ctx().createOPF("content", version)
+	p.Book.Files = append(p.Book.Files, f)
+
 	// Metadata generation
 
 	meta := to.AddNext("metadata",
@@ -478,9 +584,14 @@ func (p *Processor) generateOPF() error {
 	}
 	meta.AddNext("dc:title").SetText(title)
 	meta.AddNext("dc:language").SetText(p.Book.Lang.String())
-	meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	if epub3 {
+		meta.AddNext("dc:identifier", attr("id", "BookId")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+		meta.AddNext("meta", attr("property", "dcterms:modified")).SetText(p.timestamp().UTC().Format("2006-01-02T15:04:05Z"))
+	} else {
+		meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	}
 
-	for _, an := range p.Book.Authors {
+	formatName := func(an *config.AuthorName) (string, error) {
 		var a string
 		if p.version == 1 {
 			a = ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an))
@@ -492,16 +603,66 @@ func (p *Processor) generateOPF() error {
 				MiddleName: an.Middle,
 			})
 			if err != nil {
-				return fmt.Errorf("unable to prepare author for opr-author using '%s': %w", p.env.Cfg.Doc.AuthorFormat, err)
+				return "", fmt.Errorf("unable to prepare author for opr-author using '%s': %w", p.env.Cfg.Doc.AuthorFormat, err)
 			}
 		}
 		if p.env.Cfg.Doc.TransliterateMeta {
 			a = slug.Make(a)
 		}
-		meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
+		return a, nil
 	}
 
-	meta.AddNext("dc:publisher")
+	for i, an := range p.Book.Authors {
+		a, err := formatName(an)
+		if err != nil {
+			return err
+		}
+		if epub3 {
+			id := fmt.Sprintf("creator%d", i+1)
+			meta.AddNext("dc:creator", attr("id", id)).SetText(a)
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "role"), attr("scheme", "marc:relators")).SetText("aut")
+		} else {
+			meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
+		}
+	}
+
+	for i, an := range p.Book.Translators {
+		t, err := formatName(an)
+		if err != nil {
+			return err
+		}
+		if epub3 {
+			id := fmt.Sprintf("contributor%d", i+1)
+			meta.AddNext("dc:contributor", attr("id", id)).SetText(t)
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "role"), attr("scheme", "marc:relators")).SetText("trl")
+		} else {
+			meta.AddNext("dc:contributor", attr("opf:role", "trl")).SetText(t)
+		}
+	}
+
+	if len(p.Book.ISBN) > 0 {
+		if epub3 {
+			meta.AddNext("dc:identifier", attr("id", "isbn")).SetText("urn:isbn:" + p.Book.ISBN)
+		} else {
+			meta.AddNext("dc:identifier", attr("opf:scheme", "ISBN")).SetText(p.Book.ISBN)
+		}
+	}
+
+	if len(p.Book.Publisher) > 0 {
+		meta.AddNext("dc:publisher").SetText(p.Book.Publisher)
+	} else if !epub3 {
+		// EPUB3 does not allow empty elements
+		meta.AddNext("dc:publisher")
+	}
+
+	// dc:date has to be valid date, fb2 year is free form text
+	if _, err := strconv.Atoi(p.Book.PublishYear); err == nil && len(p.Book.PublishYear) == 4 {
+		meta.AddNext("dc:date").SetText(p.Book.PublishYear)
+	}
+
+	if len(p.Book.SrcTitle) > 0 {
+		meta.AddNext("dc:source").SetText(p.Book.SrcTitle)
+	}
 
 	for _, g := range p.Book.Genres {
 		meta.AddNext("dc:subject").SetText(g)
@@ -515,8 +676,15 @@ func (p *Processor) generateOPF() error {
 	if len(p.Book.Cover) > 0 {
 		meta.AddNext("meta", attr("name", "cover"), attr("content", "book-cover-image"))
 	}
+	if len(p.Book.SeqName) > 0 && epub3 {
+		meta.AddNext("meta", attr("property", "belongs-to-collection"), attr("id", "series")).SetText(p.Book.SeqName)
+		meta.AddNext("meta", attr("refines", "#series"), attr("property", "collection-type")).SetText("series")
+		if p.Book.SeqNum > 0 {
+			meta.AddNext("meta", attr("refines", "#series"), attr("property", "group-position")).SetText(strconv.Itoa(p.Book.SeqNum))
+		}
+	}
 	// Do not let series metadata to disappear, use calibre meta tags
-	if len(p.Book.SeqName) > 0 {
+	if len(p.Book.SeqName) > 0 && !epub3 {
 		meta.AddNext("meta", attr("name", "calibre:series"), attr("content", p.Book.SeqName))
 		if p.Book.SeqNum > 0 {
 			meta.AddNext("meta", attr("name", "calibre:series_index"), attr("content", strconv.Itoa(p.Book.SeqNum)))
@@ -531,7 +699,11 @@ func (p *Processor) generateOPF() error {
 		if f.transient&dataNotForManifest != 0 {
 			continue
 		}
-		man.AddSame("item", attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname))
+		attrs := append(make([]*etree.Attr, 0, 4), attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname))
+		if epub3 && len(f.props) > 0 {
+			attrs = append(attrs, attr("properties", f.props))
+		}
+		man.AddSame("item", attrs...)
 	}
 
 	for i, f := range p.Book.Images {
@@ -569,7 +741,7 @@ func (p *Processor) generateOPF() error {
 	// Spine generation
 
 	var spine *etree.Element
-	if p.noPages {
+	if p.noPages || epub3 {
 		spine = to.AddNext("spine", attr("toc", "ncx"))
 	} else {
 		spine = to.AddNext("spine", attr("toc", "ncx"), attr("page-map", "page-map"))
@@ -654,8 +826,11 @@ func (p *Processor) KepubifyXHTML() error {
 	}
 
 	for _, f := range p.Book.Files {
-		if f.ct == "application/xhtml+xml" && filepath.Ext(f.fname) == ".xhtml" && f.doc != nil {
-			if body := f.doc.FindElement("./html/body"); body != nil {
+		if f.ct != "application/xhtml+xml" || filepath.Ext(f.fname) != ".xhtml" {
+			continue
+		}
+		if err := f.update(p.tmpDir, func(doc *etree.Document) error {
+			if body := doc.FindElement("./html/body"); body != nil {
 				to := etree.NewElement("div")
 				to.CreateAttr("id", "book-columns")
 				inner := to.AddNext("div", attr("id", "book-inner"))
@@ -665,6 +840,9 @@ func (p *Processor) KepubifyXHTML() error {
 				}
 				body.AddChild(to)
 			}
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
 	return nil
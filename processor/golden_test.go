@@ -0,0 +1,463 @@
+package processor
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/golden with current results")
+
+// goldenCase describes single conversion of book from testdata/corpus, result is compared with testdata/golden/<name>.
+type goldenCase struct {
+	name   string
+	book   string
+	format OutputFmt
+	notes  NotesFmt
+	setup  func(cfg *config.Config)
+}
+
+var goldenCases = []goldenCase{
+	{name: "notes-default", book: "notes", format: OEpub, notes: NDefault},
+	{name: "notes-inline", book: "notes", format: OEpub, notes: NInline},
+	{name: "notes-block", book: "notes", format: OEpub, notes: NBlock},
+	{name: "notes-float", book: "notes", format: OEpub, notes: NFloat},
+	{name: "notes-float-old", book: "notes", format: OEpub, notes: NFloatOld},
+	{name: "notes-float-new", book: "notes", format: OEpub, notes: NFloatNew},
+	{name: "notes-float-new-more", book: "notes", format: OEpub, notes: NFloatNewMore},
+	{name: "notes-float-kepub", book: "notes", format: OKepub, notes: NFloat},
+	{name: "notes-float-epub3", book: "notes", format: OEpub3, notes: NFloat},
+	{name: "notes-renumber", book: "notes", format: OEpub, notes: NFloatNew, setup: func(cfg *config.Config) {
+		cfg.Doc.Notes.Renumber = true
+	}},
+
+	{name: "structure-epub", book: "structure", format: OEpub},
+	{name: "structure-epub3", book: "structure", format: OEpub3},
+	{name: "structure-kepub", book: "structure", format: OKepub},
+	{name: "structure-azw3", book: "structure", format: OAzw3},
+	{name: "structure-mobi", book: "structure", format: OMobi},
+	{name: "structure-txt", book: "structure", format: OTxt},
+	{name: "structure-md", book: "structure", format: OMd},
+	{name: "structure-html", book: "structure", format: OHtml},
+	{name: "structure-fb2", book: "structure", format: OFb2},
+
+	{name: "poems-epub", book: "poems", format: OEpub},
+	{name: "poems-txt", book: "poems", format: OTxt},
+
+	{name: "tables-epub", book: "tables", format: OEpub},
+	{name: "tables-html", book: "tables", format: OHtml},
+	{name: "tables-md", book: "tables", format: OMd},
+
+	{name: "images-epub", book: "images", format: OEpub},
+	{name: "images-kepub", book: "images", format: OKepub},
+	{name: "images-azw3", book: "images", format: OAzw3},
+
+	{name: "bodies-epub", book: "bodies", format: OEpub},
+	{name: "bodies-kepub", book: "bodies", format: OKepub},
+	{name: "bodies-txt", book: "bodies", format: OTxt},
+}
+
+// TestGolden converts every book of the corpus and compares unpacked results with stored golden files. After
+// intentional changes of the output golden files are regenerated with
+//
+//	go test ./processor -run TestGolden -update
+//
+// and the difference is reviewed as part of the change.
+func TestGolden(t *testing.T) {
+
+	for _, gc := range goldenCases {
+		t.Run(gc.name, func(t *testing.T) {
+
+			got := convertGolden(t, gc)
+			dir := filepath.Join("testdata", "golden", gc.name)
+
+			if *updateGolden {
+				if err := writeGolden(dir, got); err != nil {
+					t.Fatalf("Unable to update golden files: %v", err)
+				}
+				return
+			}
+
+			want, err := readGolden(dir)
+			if err != nil {
+				t.Fatalf("Unable to read golden files (run with -update to create them): %v", err)
+			}
+			compareGolden(t, want, got)
+		})
+	}
+
+	if *updateGolden {
+		if err := pruneShared(); err != nil {
+			t.Fatalf("Unable to remove unused shared golden files: %v", err)
+		}
+	}
+}
+
+// pruneShared removes shared golden files no case refers to.
+func pruneShared() error {
+
+	used := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join("testdata", "golden"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, sharedSuffix) {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		used[strings.TrimSpace(string(data))] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(sharedGolden)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !used[e.Name()] {
+			if err := os.Remove(filepath.Join(sharedGolden, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TestGoldenLowMemory makes sure low memory mode produces exactly the same results.
+func TestGoldenLowMemory(t *testing.T) {
+
+	if *updateGolden {
+		t.Skip("golden files are updated by TestGolden")
+	}
+	for _, gc := range goldenCases {
+		t.Run(gc.name, func(t *testing.T) {
+
+			setup := gc.setup
+			gc.setup = func(cfg *config.Config) {
+				cfg.Doc.LowMemory = true
+				if setup != nil {
+					setup(cfg)
+				}
+			}
+			got := convertGolden(t, gc)
+
+			want, err := readGolden(filepath.Join("testdata", "golden", gc.name))
+			if err != nil {
+				t.Fatalf("Unable to read golden files: %v", err)
+			}
+			compareGolden(t, want, got)
+		})
+	}
+}
+
+// convertGolden converts corpus book and returns content of the result keyed by slash separated path.
+func convertGolden(t *testing.T, gc goldenCase) map[string][]byte {
+
+	t.Helper()
+
+	env := testEnv(t, func(cfg *config.Config) {
+		cfg.Doc.Reproducible = true
+		cfg.Doc.Notes.Mode = gc.notes.String()
+		cfg.Doc.Kindlegen.Engine = EngineNative.String()
+		if gc.setup != nil {
+			gc.setup(cfg)
+		}
+	})
+
+	data, err := os.ReadFile(filepath.Join("testdata", "corpus", gc.book+".fb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := gc.format
+	if format == OFb2 {
+		// FB2 is only produced from EPUB
+		format = OEpub
+	}
+
+	dst := t.TempDir()
+	p, err := NewFB2(SelectReader(bytes.NewReader(data), DetectUTF(data)), false, "book.fb2", dst, true, false, true, format, env)
+	if err != nil {
+		t.Fatalf("Unable to prepare book: %v", err)
+	}
+	defer p.Clean()
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+	fname, err := p.Save()
+	if err != nil {
+		t.Fatalf("Unable to save book: %v", err)
+	}
+
+	var res map[string][]byte
+	switch gc.format {
+	case OEpub, OEpub3, OKepub:
+		res, err = unzipGolden(fname)
+	case OAzw3, OMobi:
+		var epub []byte
+		if epub, err = ReadKF8(fname, env.Log); err == nil {
+			res, err = unzipGoldenBytes(epub)
+		}
+	case OFb2:
+		var f *os.File
+		if f, err = os.Open(fname); err != nil {
+			break
+		}
+		defer f.Close()
+		fi, _ := f.Stat()
+		doc, derr := EPUBToFB2(f, fi.Size(), env)
+		if derr != nil {
+			err = derr
+			break
+		}
+		var buf bytes.Buffer
+		if _, err = doc.WriteTo(&buf); err == nil {
+			res = map[string][]byte{"book.fb2": buf.Bytes()}
+		}
+	default:
+		res, err = readTreeGolden(dst)
+	}
+	if err != nil {
+		t.Fatalf("Unable to read result: %v", err)
+	}
+	return res
+}
+
+func unzipGolden(fname string) (map[string][]byte, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return unzipGoldenBytes(data)
+}
+
+func unzipGoldenBytes(data []byte) (map[string][]byte, error) {
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte, len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		res[f.Name] = content
+	}
+	return res, nil
+}
+
+func readTreeGolden(dir string) (map[string][]byte, error) {
+	res := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		res[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	return res, err
+}
+
+// binarySuffix marks golden files which keep digest of binary content instead of content itself.
+const binarySuffix = ".sha256"
+
+// sharedSuffix marks golden files which refer to content stored once in sharedGolden directory. Stylesheets are the
+// same for most of the cases.
+const sharedSuffix = ".shared"
+
+var sharedGolden = filepath.Join("testdata", "golden", "shared")
+
+func isShared(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".css")
+}
+
+func sharedName(name string, data []byte) string {
+	return fmt.Sprintf("%x%s", sha256.Sum256(data), strings.ToLower(path.Ext(name)))
+}
+
+func isXML(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".xhtml", ".html", ".opf", ".ncx", ".xml", ".fb2":
+		return true
+	}
+	return false
+}
+
+// indentXML makes XML reviewable, content which could not be parsed is kept as is.
+func indentXML(data []byte) []byte {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return data
+	}
+	doc.Indent(2)
+	res, err := doc.WriteToBytes()
+	if err != nil {
+		return data
+	}
+	// whitespace kept by indentation at the line ends is meaningless
+	lines := bytes.Split(res, []byte("\n"))
+	for i, l := range lines {
+		lines[i] = bytes.TrimRight(l, " \t")
+	}
+	return append(bytes.TrimRight(bytes.Join(lines, []byte("\n")), "\n"), '\n')
+}
+
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+func binaryDigest(data []byte) []byte {
+	return fmt.Appendf(nil, "%x %d\n", sha256.Sum256(data), len(data))
+}
+
+// goldenContent converts result to the form it is stored in golden directory.
+func goldenContent(name string, data []byte) (string, []byte) {
+	switch {
+	case !isText(data):
+		return name + binarySuffix, binaryDigest(data)
+	case isShared(name):
+		return name + sharedSuffix, []byte(sharedName(name, data) + "\n")
+	case isXML(name):
+		return name, indentXML(data)
+	}
+	return name, data
+}
+
+func writeGolden(dir string, files map[string][]byte) error {
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if isText(data) && isShared(name) {
+			fname := filepath.Join(sharedGolden, sharedName(name, data))
+			if err := os.MkdirAll(sharedGolden, 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(fname, data, 0644); err != nil {
+				return err
+			}
+		}
+		name, data = goldenContent(name, data)
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(fname, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readGolden(dir string) (map[string][]byte, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return readTreeGolden(dir)
+}
+
+func compareGolden(t *testing.T, want, got map[string][]byte) {
+
+	t.Helper()
+
+	stored := make(map[string][]byte, len(got))
+	for name, data := range got {
+		name, data = goldenContent(name, data)
+		stored[name] = data
+	}
+
+	var names []string
+	for name := range want {
+		names = append(names, name)
+	}
+	for name := range stored {
+		if _, ok := want[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		w, inWant := want[name]
+		g, inGot := stored[name]
+		switch {
+		case !inGot:
+			t.Errorf("%s: file is missing from result", name)
+		case !inWant:
+			t.Errorf("%s: unexpected file in result", name)
+		case !bytes.Equal(w, g):
+			if strings.HasSuffix(name, binarySuffix) {
+				t.Errorf("%s: binary content differs", strings.TrimSuffix(name, binarySuffix))
+				continue
+			}
+			if strings.HasSuffix(name, sharedSuffix) {
+				name = strings.TrimSuffix(name, sharedSuffix)
+				g = got[name]
+				var err error
+				if w, err = os.ReadFile(filepath.Join(sharedGolden, strings.TrimSpace(string(w)))); err != nil {
+					t.Errorf("%s: %v", name, err)
+					continue
+				}
+			}
+			line, wl, gl := firstDiff(w, g)
+			t.Errorf("%s: line %d differs\n\twant: %q\n\t got: %q", name, line, wl, gl)
+		}
+	}
+	if t.Failed() {
+		t.Log("If changes are intentional update golden files with: go test ./processor -run TestGolden -update")
+	}
+}
+
+// firstDiff returns number and content of the first different line.
+func firstDiff(want, got []byte) (int, string, string) {
+
+	ws, gs := bufio.NewScanner(bytes.NewReader(want)), bufio.NewScanner(bytes.NewReader(got))
+	ws.Buffer(nil, len(want)+1)
+	gs.Buffer(nil, len(got)+1)
+	for line := 1; ; line++ {
+		wok, gok := ws.Scan(), gs.Scan()
+		if !wok && !gok {
+			// only line endings differ
+			return line, "", ""
+		}
+		if wok != gok || ws.Text() != gs.Text() {
+			return line, ws.Text(), gs.Text()
+		}
+	}
+}
@@ -43,11 +43,70 @@ type binImage struct {
 	img         image.Image
 	imgType     string
 	data        []byte
+	src         string // low memory mode - file content is spooled to until image is stored
+}
+
+// maxImagePixels limits size of images coming from books (8192x8192). Decoders allocate memory for the whole picture
+// before reading image data, so a few bytes of header could otherwise request gigabytes.
+const maxImagePixels = 8192 * 8192
+
+// decodeImageType detects type of image coming from book reading only image header, images which are too large to be
+// decoded are refused.
+func decodeImageType(data []byte) (string, error) {
+	cfg, imgType, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return "", fmt.Errorf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+	return imgType, nil
+}
+
+// decodeImage is image.Decode for images coming from books, it refuses to decode images which are too large.
+func decodeImage(data []byte) (image.Image, string, error) {
+	if _, err := decodeImageType(data); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// load reads image content spooled to disk in low memory mode, image is decoded when requested.
+func (b *binImage) load(decode bool) error {
+
+	if len(b.src) == 0 {
+		return nil
+	}
+	if len(b.data) == 0 {
+		data, err := os.ReadFile(b.src)
+		if err != nil {
+			return fmt.Errorf("unable to read image %s: %w", b.id, err)
+		}
+		b.data = data
+	}
+	if decode && b.img == nil && len(b.imgType) > 0 && b.imgType != "svg" {
+		img, _, err := decodeImage(b.data)
+		if err != nil {
+			return fmt.Errorf("unable to decode image %s: %w", b.id, err)
+		}
+		b.img = img
+	}
+	return nil
 }
 
 // flush is storing image to file
 func (b *binImage) flush(path string) error {
 
+	if len(b.src) > 0 && len(b.data) == 0 {
+		// low memory mode - content is read only now and released as soon as image is stored
+		if err := b.load(false); err != nil {
+			return err
+		}
+		defer func() {
+			b.data, b.img = nil, nil
+		}()
+	}
+
 	// Sanity
 	if len(b.fname) == 0 || (len(b.data) == 0 && b.img == nil) {
 		return nil
@@ -70,7 +129,7 @@ func (b *binImage) flush(path string) error {
 		if b.img == nil && len(b.data) != 0 {
 			// image was not decoded yet
 			var err error
-			b.img, b.imgType, err = image.Decode(bytes.NewReader(b.data))
+			b.img, b.imgType, err = decodeImage(b.data)
 			if err != nil {
 				b.log.Warn("Unable to decode image for processing, storing as is",
 					zap.String("id", b.id),
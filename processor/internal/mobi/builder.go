@@ -0,0 +1,791 @@
+package mobi
+
+// Native mobi writer. It takes OEBPS directory prepared for kindlegen and produces the same kind of combo (MOBI7 + KF8)
+// file kindlegen does, so the rest of the pipeline (Splitter) could be used unchanged.
+// Visit calibre - https://github.com/kovidgoyal/calibre (calibre.ebooks.mobi.writer2 and writer8) for any information.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+const (
+	textRecordSize = 4096
+	nullIndex      = -1
+
+	// mobi header length for both parts
+	mobi7HeaderLength = 0xe8
+	kf8HeaderLength   = 0x108
+
+	// exth records we are producing
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthISBN        = 104
+	exthSubject     = 105
+	exthPubDate     = 106
+	exthContributor = 108
+	exthSource      = 112
+	exthFakeCover   = 203
+	exthResCount    = 125
+	exthCreatorSW   = 204
+	exthCreatorMaj  = 205
+	exthCreatorMin  = 206
+	exthCreatorBld  = 207
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+var (
+	recordFLIS     = []byte("FLIS\x00\x00\x00\x08\x00\x41\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\x00\x01\x00\x03\x00\x00\x00\x03\x00\x00\x00\x01\xff\xff\xff\xff")
+	recordBoundary = []byte("BOUNDARY")
+	recordEOF      = []byte{0xe9, 0x8e, 0x0d, 0x0a}
+)
+
+func recordFCIS(textLength int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("FCIS\x00\x00\x00\x14\x00\x00\x00\x10\x00\x00\x00\x02\x00\x00\x00\x00")
+	binary.Write(&buf, binary.BigEndian, uint32(textLength))
+	buf.WriteString("\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x08\x00\x01\x00\x01\x00\x00\x00\x00")
+	return buf.Bytes()
+}
+
+// Metadata of the book as found in OPF.
+type opfMeta struct {
+	id          string
+	title       string
+	lang        string
+	authors     []string
+	contributor []string
+	publisher   string
+	description string
+	subjects    []string
+	date        string
+	isbn        string
+	source      string
+}
+
+type manifestItem struct {
+	id, href, mediaType, properties string
+}
+
+type guideRef struct {
+	kind, title, href string
+}
+
+type tocEntry struct {
+	label    string
+	href     string
+	children []*tocEntry
+}
+
+type resource struct {
+	href      string
+	mediaType string
+	data      []byte
+}
+
+// Builder - native mobi writer.
+type Builder struct {
+	ctx      context.Context
+	log      *zap.Logger
+	dir      string
+	compress bool
+	created  time.Time
+	//
+	meta      opfMeta
+	manifest  []*manifestItem
+	spine     []string
+	guide     []guideRef
+	toc       []*tocEntry
+	pages     []string
+	resources []*resource
+	resIndex  map[string]int
+	cover     int
+	thumb     int
+	//
+	result []byte
+}
+
+// NewBuilder returns pointer to Builder with mobi file produced out of OEBPS content described by opf. Building stops
+// with context error when ctx is canceled.
+func NewBuilder(ctx context.Context, opf string, compress bool, created time.Time, log *zap.Logger) (*Builder, error) {
+
+	b := &Builder{
+		ctx:      ctx,
+		log:      log,
+		dir:      filepath.Dir(opf),
+		compress: compress,
+		created:  created,
+		resIndex: make(map[string]int),
+		cover:    nullIndex,
+		thumb:    nullIndex,
+	}
+	if err := b.readPackage(opf); err != nil {
+		return nil, err
+	}
+	if len(b.spine) == 0 {
+		return nil, errors.New("nothing to build, spine is empty")
+	}
+	if err := b.build(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SaveResult saves resulting mobi to the requested location.
+func (b *Builder) SaveResult(fname string) error {
+	if len(b.result) == 0 {
+		return errors.New("nothing to save")
+	}
+	return os.WriteFile(fname, b.result, 0644)
+}
+
+func (b *Builder) readPackage(opf string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(opf); err != nil {
+		return fmt.Errorf("unable to read OPF: %w", err)
+	}
+	pkg := doc.SelectElement("package")
+	if pkg == nil {
+		return errors.New("bad OPF, no package element")
+	}
+
+	var coverID string
+	if meta := pkg.SelectElement("metadata"); meta != nil {
+		for _, e := range meta.ChildElements() {
+			text := strings.TrimSpace(e.Text())
+			switch e.Tag {
+			case "title":
+				b.meta.title = text
+			case "language":
+				b.meta.lang = text
+			case "identifier":
+				scheme := strings.ToLower(e.SelectAttrValue("opf:scheme", ""))
+				switch {
+				case scheme == "isbn":
+					b.meta.isbn = text
+				case e.SelectAttrValue("id", "") == pkg.SelectAttrValue("unique-identifier", ""):
+					b.meta.id = strings.TrimPrefix(text, "urn:uuid:")
+				}
+			case "creator":
+				if role := e.SelectAttrValue("opf:role", "aut"); role == "aut" {
+					b.meta.authors = append(b.meta.authors, text)
+				} else {
+					b.meta.contributor = append(b.meta.contributor, text)
+				}
+			case "contributor":
+				b.meta.contributor = append(b.meta.contributor, text)
+			case "publisher":
+				b.meta.publisher = text
+			case "description":
+				b.meta.description = text
+			case "subject":
+				b.meta.subjects = append(b.meta.subjects, text)
+			case "date":
+				b.meta.date = text
+			case "source":
+				b.meta.source = text
+			case "meta":
+				if e.SelectAttrValue("name", "") == "cover" {
+					coverID = e.SelectAttrValue("content", "")
+				}
+			}
+		}
+	}
+
+	var ncxID, pageMapID string
+	items := make(map[string]*manifestItem)
+	if man := pkg.SelectElement("manifest"); man != nil {
+		for _, e := range man.SelectElements("item") {
+			item := &manifestItem{
+				id:         e.SelectAttrValue("id", ""),
+				href:       e.SelectAttrValue("href", ""),
+				mediaType:  e.SelectAttrValue("media-type", ""),
+				properties: e.SelectAttrValue("properties", ""),
+			}
+			b.manifest = append(b.manifest, item)
+			items[item.id] = item
+		}
+	}
+
+	if spine := pkg.SelectElement("spine"); spine != nil {
+		ncxID = spine.SelectAttrValue("toc", "")
+		pageMapID = spine.SelectAttrValue("page-map", "")
+		for _, e := range spine.SelectElements("itemref") {
+			if item, ok := items[e.SelectAttrValue("idref", "")]; ok {
+				b.spine = append(b.spine, item.href)
+			}
+		}
+	}
+
+	if guide := pkg.SelectElement("guide"); guide != nil {
+		for _, e := range guide.SelectElements("reference") {
+			b.guide = append(b.guide, guideRef{
+				kind:  e.SelectAttrValue("type", ""),
+				title: e.SelectAttrValue("title", ""),
+				href:  e.SelectAttrValue("href", ""),
+			})
+		}
+	}
+
+	// resources - images and fonts, in manifest order
+	for _, item := range b.manifest {
+		if !isResource(item) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(b.dir, filepath.FromSlash(item.href)))
+		if err != nil {
+			return fmt.Errorf("unable to read resource: %w", err)
+		}
+		b.resIndex[item.href] = len(b.resources)
+		if item.id == coverID || strings.Contains(item.properties, "cover-image") {
+			b.cover = len(b.resources)
+		}
+		b.resources = append(b.resources, &resource{href: item.href, mediaType: item.mediaType, data: data})
+	}
+	if b.cover != nullIndex {
+		// Splitter will replace it with properly sized thumbnail later
+		b.thumb = len(b.resources)
+		b.resources = append(b.resources, &resource{mediaType: b.resources[b.cover].mediaType, data: b.resources[b.cover].data})
+	}
+
+	if item, ok := items[ncxID]; ok {
+		if err := b.readNCX(filepath.Join(b.dir, filepath.FromSlash(item.href))); err != nil {
+			return err
+		}
+	}
+	if item, ok := items[pageMapID]; ok {
+		if err := b.readPageMap(filepath.Join(b.dir, filepath.FromSlash(item.href))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isResource(item *manifestItem) bool {
+	return strings.HasPrefix(item.mediaType, "image/") || isFont(item)
+}
+
+func isFont(item *manifestItem) bool {
+	switch strings.ToLower(path.Ext(item.href)) {
+	case ".ttf", ".otf", ".woff", ".woff2":
+		return true
+	}
+	return strings.Contains(item.mediaType, "font")
+}
+
+func (b *Builder) readNCX(fname string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(fname); err != nil {
+		return fmt.Errorf("unable to read NCX: %w", err)
+	}
+	navMap := doc.FindElement("./ncx/navMap")
+	if navMap == nil {
+		return nil
+	}
+
+	var walk func(from *etree.Element) []*tocEntry
+	walk = func(from *etree.Element) []*tocEntry {
+		var res []*tocEntry
+		for _, np := range from.SelectElements("navPoint") {
+			e := &tocEntry{}
+			if label := np.FindElement("./navLabel/text"); label != nil {
+				e.label = strings.TrimSpace(label.Text())
+			}
+			if content := np.SelectElement("content"); content != nil {
+				e.href = content.SelectAttrValue("src", "")
+			}
+			e.children = walk(np)
+			res = append(res, e)
+		}
+		return res
+	}
+	b.toc = walk(navMap)
+	return nil
+}
+
+func (b *Builder) readPageMap(fname string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(fname); err != nil {
+		return fmt.Errorf("unable to read page map: %w", err)
+	}
+	if pm := doc.SelectElement("page-map"); pm != nil {
+		for _, e := range pm.SelectElements("page") {
+			b.pages = append(b.pages, e.SelectAttrValue("href", ""))
+		}
+	}
+	return nil
+}
+
+// build assembles all records and produces resulting file.
+func (b *Builder) build() error {
+
+	docs := make([]*etree.Document, 0, len(b.spine))
+	for _, href := range b.spine {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+		doc := etree.NewDocument()
+		if err := doc.ReadFromFile(filepath.Join(b.dir, filepath.FromSlash(href))); err != nil {
+			return fmt.Errorf("unable to read %s: %w", href, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	m7, err := b.buildMobi7(docs)
+	if err != nil {
+		return err
+	}
+	k8, err := b.buildKF8(docs)
+	if err != nil {
+		return err
+	}
+
+	uid := crc32.ChecksumIEEE([]byte(b.meta.id))
+	if len(b.meta.id) == 0 {
+		uid = crc32.ChecksumIEEE([]byte(b.meta.title))
+	}
+
+	records := [][]byte{nil}
+
+	// MOBI7 part - text, shared resources, etc.
+	m7Text, err := b.textRecords(m7.text)
+	if err != nil {
+		return err
+	}
+	records = append(records, m7Text...)
+	if size := recordsSize(m7Text); size%4 != 0 {
+		records = append(records, make([]byte, 4-size%4))
+	}
+	firstNonText := len(records)
+	firstResource := len(records)
+	for _, r := range b.resources {
+		if isFont(&manifestItem{href: r.href, mediaType: r.mediaType}) {
+			records = append(records, fontRecord(r.data))
+		} else {
+			records = append(records, r.data)
+		}
+	}
+	lastContent := len(records) - 1
+	flis := len(records)
+	records = append(records, recordFLIS)
+	fcis := len(records)
+	records = append(records, recordFCIS(len(m7.text)))
+	if page := b.pageRecord(k8); page != nil {
+		records = append(records, page)
+	}
+	records = append(records, recordBoundary)
+
+	// KF8 part, all indexes are relative to its record 0
+	kf8Base := len(records)
+	records = append(records, nil)
+
+	k8Text, err := b.textRecords(k8.text)
+	if err != nil {
+		return err
+	}
+	records = append(records, k8Text...)
+	if size := recordsSize(k8Text); size%4 != 0 {
+		records = append(records, make([]byte, 4-size%4))
+	}
+	k8hdr := mobiHeader{
+		version:       8,
+		textLength:    len(k8.text),
+		textRecords:   len(k8Text),
+		firstNonText:  len(records) - kf8Base,
+		ncx:           nullIndex,
+		guide:         nullIndex,
+		fragments:     len(records) - kf8Base,
+		exthFlags:     0x1050,
+		extraDataFlag: 1,
+	}
+	records = append(records, k8.fragIndex...)
+	k8hdr.skeletons = len(records) - kf8Base
+	records = append(records, k8.skelIndex...)
+	if len(k8.guideIndex) > 0 {
+		k8hdr.guide = len(records) - kf8Base
+		records = append(records, k8.guideIndex...)
+	}
+	if len(k8.ncxIndex) > 0 {
+		k8hdr.ncx = len(records) - kf8Base
+		records = append(records, k8.ncxIndex...)
+	}
+	// in combo file resources are shared with MOBI7 part, this is where they would be inserted
+	k8hdr.firstResource = len(records) - kf8Base
+	k8hdr.fdst, k8hdr.fdstCount = len(records)-kf8Base, len(k8.flows)
+	records = append(records, fdstRecord(k8.flows))
+	k8hdr.flis = len(records) - kf8Base
+	records = append(records, recordFLIS)
+	k8hdr.fcis = len(records) - kf8Base
+	records = append(records, recordFCIS(len(k8.text)))
+	records = append(records, recordEOF)
+
+	m7hdr := mobiHeader{
+		version:       6,
+		textLength:    len(m7.text),
+		textRecords:   len(m7Text),
+		firstNonText:  firstNonText,
+		firstResource: firstResource,
+		lastContent:   lastContent,
+		fcis:          fcis,
+		flis:          flis,
+		ncx:           nullIndex,
+		exthFlags:     0x1850,
+		extraDataFlag: 1,
+	}
+
+	exth := b.commonExth()
+	m7exth := append(slices.Clone(exth), exthRecord{exthKF8Offset, uint32Bytes(kf8Base)})
+	if m7.start >= 0 {
+		m7exth = append(m7exth, exthRecord{exthStartReading, uint32Bytes(m7.start)})
+	}
+	k8exth := append(slices.Clone(exth), exthRecord{exthResCount, uint32Bytes(len(b.resources))})
+	if k8.start >= 0 {
+		k8exth = append(k8exth, exthRecord{exthStartReading, uint32Bytes(k8.start)})
+	}
+
+	if b.compress {
+		m7hdr.compression, k8hdr.compression = 2, 2
+	} else {
+		m7hdr.compression, k8hdr.compression = 1, 1
+	}
+	m7hdr.uid, k8hdr.uid = uid, uid
+
+	records[0] = b.record0(&m7hdr, m7exth)
+	records[kf8Base] = b.record0(&k8hdr, k8exth)
+
+	b.result = b.pdb(records)
+	return nil
+}
+
+// textRecords splits text into records, compressing them if necessary and adding trailing multibyte bytes.
+func (b *Builder) textRecords(text []byte) ([][]byte, error) {
+
+	var records [][]byte
+	for pos := 0; pos < len(text); {
+		if err := b.ctx.Err(); err != nil {
+			return nil, err
+		}
+		next := min(pos+textRecordSize, len(text))
+		// number of bytes from the next record needed to complete last character in this one
+		extra := 0
+		if next < len(text) {
+			for extra < 3 && next+extra < len(text) && text[next+extra]&0xc0 == 0x80 {
+				extra++
+			}
+		}
+		data := text[pos:next]
+		if b.compress {
+			data = compressPalmDoc(data)
+		} else {
+			data = bytes.Clone(data)
+		}
+		data = append(data, text[next:next+extra]...)
+		data = append(data, byte(extra))
+		records = append(records, data)
+		pos = next
+	}
+	return records, nil
+}
+
+func recordsSize(records [][]byte) (size int) {
+	for _, r := range records {
+		size += len(r)
+	}
+	return
+}
+
+func uint32Bytes(v int) []byte {
+	return putInt32(nil, 0, v)
+}
+
+// fontRecord produces zlib compressed FONT record.
+func fontRecord(data []byte) []byte {
+
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(data)
+	w.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString("FONT")
+	binary.Write(&buf, binary.BigEndian, uint32(len(data))) // decompressed size
+	binary.Write(&buf, binary.BigEndian, uint32(1))         // flags - compressed, not obfuscated
+	binary.Write(&buf, binary.BigEndian, uint32(24))        // data offset
+	binary.Write(&buf, binary.BigEndian, uint32(0))         // xor key length
+	binary.Write(&buf, binary.BigEndian, uint32(24))        // xor key offset
+	buf.Write(z.Bytes())
+	return buf.Bytes()
+}
+
+func fdstRecord(flows [][2]int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("FDST")
+	binary.Write(&buf, binary.BigEndian, uint32(12))
+	binary.Write(&buf, binary.BigEndian, uint32(len(flows)))
+	for _, f := range flows {
+		binary.Write(&buf, binary.BigEndian, uint32(f[0]))
+		binary.Write(&buf, binary.BigEndian, uint32(f[1]))
+	}
+	return buf.Bytes()
+}
+
+// pageRecord produces PAGE record with page map, so Splitter could generate APNX.
+func (b *Builder) pageRecord(k8 *kf8Book) []byte {
+
+	if len(b.pages) == 0 {
+		return nil
+	}
+
+	offsets := make([]int, 0, len(b.pages))
+	for _, href := range b.pages {
+		pos, ok := k8.positions[href]
+		if !ok {
+			b.log.Debug("Unable to locate page, ignoring", zap.String("href", href))
+			continue
+		}
+		offsets = append(offsets, pos.pos)
+	}
+
+	const revision = "0000000000000000000000000000000000000000"
+	pmstr := `{"description":"fb2converter page map","pageMap":"(1,a,1)"}`
+
+	var buf bytes.Buffer
+	buf.WriteString("PAGE")
+	buf.Write(make([]byte, 6))
+	binary.Write(&buf, binary.BigEndian, uint16(1)) // version
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.BigEndian, uint32(len(revision)))
+	buf.WriteString(revision)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint16(len(pmstr)))
+	binary.Write(&buf, binary.BigEndian, uint16(len(offsets)))
+	binary.Write(&buf, binary.BigEndian, uint16(32))
+	buf.WriteString(pmstr)
+	for _, ofs := range offsets {
+		binary.Write(&buf, binary.BigEndian, uint32(ofs))
+	}
+	return buf.Bytes()
+}
+
+type exthRecord struct {
+	id   int
+	data []byte
+}
+
+func (b *Builder) commonExth() []exthRecord {
+
+	var res []exthRecord
+	str := func(id int, s string) {
+		if len(s) > 0 {
+			res = append(res, exthRecord{id, []byte(s)})
+		}
+	}
+
+	for _, a := range b.meta.authors {
+		str(exthAuthor, a)
+	}
+	str(exthPublisher, b.meta.publisher)
+	str(exthDescription, b.meta.description)
+	str(exthISBN, b.meta.isbn)
+	for _, s := range b.meta.subjects {
+		str(exthSubject, s)
+	}
+	str(exthPubDate, b.meta.date)
+	for _, c := range b.meta.contributor {
+		str(exthContributor, c)
+	}
+	str(exthSource, b.meta.source)
+	str(exthTitle, b.meta.title)
+	str(exthLanguage, b.meta.lang)
+
+	if b.cover != nullIndex {
+		res = append(res, exthRecord{exthCoverOffset, uint32Bytes(b.cover)})
+		res = append(res, exthRecord{exthThumbOffset, uint32Bytes(b.thumb)})
+		res = append(res, exthRecord{exthFakeCover, uint32Bytes(0)})
+	}
+
+	// pretend to be kindlegen 2.9 (build 0) for Linux, device firmware pays attention to this
+	res = append(res,
+		exthRecord{exthCreatorSW, uint32Bytes(202)},
+		exthRecord{exthCreatorMaj, uint32Bytes(2)},
+		exthRecord{exthCreatorMin, uint32Bytes(9)},
+		exthRecord{exthCreatorBld, uint32Bytes(0)},
+	)
+	return res
+}
+
+func buildExth(recs []exthRecord) []byte {
+
+	var data bytes.Buffer
+	for _, r := range recs {
+		binary.Write(&data, binary.BigEndian, uint32(r.id))
+		binary.Write(&data, binary.BigEndian, uint32(len(r.data)+8))
+		data.Write(r.data)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("EXTH")
+	binary.Write(&buf, binary.BigEndian, uint32(data.Len()+12))
+	binary.Write(&buf, binary.BigEndian, uint32(len(recs)))
+	buf.Write(data.Bytes())
+	// always pad with at least one byte
+	buf.Write(make([]byte, 4-data.Len()%4))
+	return buf.Bytes()
+}
+
+type mobiHeader struct {
+	version       int
+	compression   int
+	textLength    int
+	textRecords   int
+	uid           uint32
+	firstNonText  int
+	firstResource int
+	lastContent   int
+	fdst          int
+	fdstCount     int
+	fcis          int
+	flis          int
+	extraDataFlag int
+	ncx           int
+	fragments     int
+	skeletons     int
+	guide         int
+	exthFlags     uint32
+}
+
+func (b *Builder) record0(h *mobiHeader, exth []exthRecord) []byte {
+
+	var buf bytes.Buffer
+	put := func(vals ...any) {
+		for _, v := range vals {
+			switch t := v.(type) {
+			case int:
+				binary.Write(&buf, binary.BigEndian, uint32(int32(t)))
+			default:
+				binary.Write(&buf, binary.BigEndian, t)
+			}
+		}
+	}
+
+	headerLength := mobi7HeaderLength
+	if h.version == 8 {
+		headerLength = kf8HeaderLength
+	}
+
+	// PalmDOC header
+	put(uint16(h.compression), uint16(0), h.textLength, uint16(h.textRecords), uint16(textRecordSize), uint16(0), uint16(0))
+	// MOBI header
+	buf.WriteString("MOBI")
+	put(headerLength, 2, 65001, h.uid, h.version)
+	for i := 0; i < 10; i++ {
+		put(nullIndex) // orth, infl, names, keys, extra indexes
+	}
+	put(h.firstNonText)
+	titleOffsetPos := buf.Len()
+	title := []byte(b.meta.title)
+	put(0, len(title), languageCode(b.meta.lang), 0, 0, h.version, h.firstResource)
+	put(0, 0)                   // huffman
+	put(nullIndex, 0)           // huffman table
+	put(h.exthFlags)            // exth flags
+	buf.Write(make([]byte, 32)) // unknown
+	put(nullIndex)              // unknown
+	put(nullIndex, 0, 0, 0)     // DRM
+	buf.Write(make([]byte, 8))  // unknown
+	if h.version == 8 {
+		put(h.fdst, h.fdstCount)
+	} else {
+		put(uint16(1), uint16(h.lastContent), 1)
+	}
+	put(h.fcis, 1, h.flis, 1)
+	buf.Write(make([]byte, 8))
+	put(nullIndex, 0) // SRCS
+	put(nullIndex, nullIndex)
+	put(h.extraDataFlag, h.ncx)
+	if h.version == 8 {
+		put(h.fragments, h.skeletons, nullIndex, h.guide)
+		put(nullIndex, 0, nullIndex, 0)
+	}
+
+	buf.Write(buildExth(exth))
+
+	data := buf.Bytes()
+	putInt32(data, titleOffsetPos, len(data))
+	buf.Write(title)
+	// padding to allow for later modifications
+	buf.Write(make([]byte, 8192))
+	return buf.Bytes()
+}
+
+var reNotPDBName = regexp.MustCompile(`[^-A-Za-z0-9]+`)
+
+// pdb produces resulting PalmDB file out of records.
+func (b *Builder) pdb(records [][]byte) []byte {
+
+	var buf bytes.Buffer
+
+	name := make([]byte, 32)
+	copy(name, reNotPDBName.ReplaceAllString(b.meta.title, "_"))
+	name[31] = 0
+	buf.Write(name)
+
+	ts := uint32(b.created.Unix())
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // attributes
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // version
+	binary.Write(&buf, binary.BigEndian, ts)        // created
+	binary.Write(&buf, binary.BigEndian, ts)        // modified
+	buf.Write(make([]byte, 16))                     // last backup, modification number, app info, sort info
+	buf.WriteString("BOOKMOBI")
+	binary.Write(&buf, binary.BigEndian, uint32(2*len(records)-1))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, uint16(len(records)))
+
+	offset := firstPdbRecord + 8*len(records) + 2
+	for i, r := range records {
+		binary.Write(&buf, binary.BigEndian, uint32(offset))
+		binary.Write(&buf, binary.BigEndian, uint32(2*i))
+		offset += len(r)
+	}
+	buf.Write([]byte{0, 0})
+	for _, r := range records {
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+// languageCodes maps language to Windows LCID (primary language only) used by mobi format.
+var languageCodes = map[string]int{
+	"ar": 0x01, "bg": 0x02, "ca": 0x03, "zh": 0x04, "cs": 0x05, "da": 0x06, "de": 0x07, "el": 0x08,
+	"en": 0x09, "es": 0x0a, "fi": 0x0b, "fr": 0x0c, "he": 0x0d, "hu": 0x0e, "is": 0x0f, "it": 0x10,
+	"ja": 0x11, "ko": 0x12, "nl": 0x13, "no": 0x14, "pl": 0x15, "pt": 0x16, "ro": 0x18, "ru": 0x19,
+	"hr": 0x1a, "sr": 0x1a, "sk": 0x1b, "sq": 0x1c, "sv": 0x1d, "th": 0x1e, "tr": 0x1f, "ur": 0x20,
+	"id": 0x21, "uk": 0x22, "be": 0x23, "sl": 0x24, "et": 0x25, "lv": 0x26, "lt": 0x27, "fa": 0x29,
+	"vi": 0x2a, "hy": 0x2b, "az": 0x2c, "eu": 0x2d, "mk": 0x2f, "ka": 0x37, "hi": 0x39, "kk": 0x3f,
+}
+
+// languageCode returns Windows LCID used by mobi format to specify book language.
+func languageCode(lang string) int {
+	primary := strings.ToLower(strings.SplitN(strings.ReplaceAll(lang, "_", "-"), "-", 2)[0])
+	return languageCodes[primary]
+}
@@ -0,0 +1,137 @@
+package mobi
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bookText restores text of the book part which header is in record "rec0".
+func bookText(t *testing.T, data []byte, base int) []byte {
+
+	t.Helper()
+
+	rec0 := readSection(data, base)
+	compressed := getUInt16(rec0, 0) == 2
+
+	var text []byte
+	for i := 1; i <= getUInt16(rec0, 8); i++ {
+		rec := readSection(data, base+i)
+		// trailing multibyte bytes, last byte has their count
+		rec = rec[:len(rec)-int(rec[len(rec)-1]&3)-1]
+		if compressed {
+			var err error
+			if rec, err = decompressPalmDoc(rec); err != nil {
+				t.Fatalf("record %d: %v", base+i, err)
+			}
+		}
+		text = append(text, rec...)
+	}
+	if len(text) != getInt32(rec0, lengthOfBook) {
+		t.Fatalf("text length %d, header says %d", len(text), getInt32(rec0, lengthOfBook))
+	}
+	return text
+}
+
+func TestBuilderLayout(t *testing.T) {
+
+	for _, compress := range []bool{false, true} {
+
+		b, err := NewBuilder(context.Background(), writeUnpackSources(t), compress, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), zap.NewNop())
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		fname := filepath.Join(t.TempDir(), "book.azw3")
+		if err := b.SaveResult(fname); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// PalmDB header
+		if name := string(bytes.TrimRight(data[:32], "\x00")); name != "Unpack_test" {
+			t.Fatalf("unexpected database name %q", name)
+		}
+		if string(data[60:68]) != "BOOKMOBI" {
+			t.Fatalf("unexpected type/creator %q", data[60:68])
+		}
+		nsec := getUInt16(data, numberOfPdbRecords)
+		for i := range nsec {
+			start, end := getSectionAddr(data, i)
+			if start > end || end > len(data) {
+				t.Fatalf("record %d is out of file: %d-%d", i, start, end)
+			}
+		}
+		if !bytes.Equal(readSection(data, nsec-1), recordEOF) {
+			t.Fatal("last record is not EOF")
+		}
+
+		// MOBI7 header
+		rec0 := readSection(data, 0)
+		compression := 1
+		if compress {
+			compression = 2
+		}
+		if getUInt16(rec0, 0) != compression {
+			t.Fatalf("unexpected compression %d", getUInt16(rec0, 0))
+		}
+		if string(rec0[mobiHeaderBase:mobiHeaderBase+4]) != "MOBI" || getInt32(rec0, mobiHeaderLength) != mobi7HeaderLength || getInt32(rec0, mobiVersion) != 6 {
+			t.Fatal("unexpected MOBI7 header")
+		}
+		if getInt32(rec0, 28) != 65001 {
+			t.Fatal("text is not UTF-8")
+		}
+		if title := rec0[getInt32(rec0, titleOffset):][:getInt32(rec0, titleOffset+4)]; string(title) != "Unpack test" {
+			t.Fatalf("unexpected full title %q", title)
+		}
+		for id, want := range map[int]string{exthTitle: "Unpack test", exthAuthor: "Иван Иванов", exthPublisher: "Test House", exthLanguage: "ru"} {
+			if v := readExth(rec0, id); len(v) != 1 || string(v[0]) != want {
+				t.Fatalf("EXTH %d: expected %q, got %q", id, want, v)
+			}
+		}
+		if _, ok := exthNumber(readExth(rec0, exthCoverOffset)); !ok {
+			t.Fatal("cover is not set")
+		}
+		if text := bookText(t, data, 0); !bytes.Contains(text, []byte("Target paragraph.")) {
+			t.Fatalf("unexpected MOBI7 text:\n%s", text)
+		}
+		if first := getInt32(rec0, firstRescRecord); !strings.HasPrefix(string(readSection(data, first)), "\x89PNG") {
+			t.Fatal("first resource record is not image")
+		}
+
+		// KF8 part
+		kf8, ok := exthNumber(readExth(rec0, exthKF8Offset))
+		if !ok {
+			t.Fatal("KF8 offset is not set")
+		}
+		if !bytes.Equal(readSection(data, kf8-1), recordBoundary) {
+			t.Fatal("KF8 part does not follow BOUNDARY")
+		}
+		k8rec0 := readSection(data, kf8)
+		if getInt32(k8rec0, mobiHeaderLength) != kf8HeaderLength || getInt32(k8rec0, mobiVersion) != 8 {
+			t.Fatal("unexpected KF8 header")
+		}
+		if v := readExth(k8rec0, exthTitle); len(v) != 1 || string(v[0]) != "Unpack test" {
+			t.Fatalf("unexpected KF8 title %q", v)
+		}
+		fdst := readSection(data, kf8+getInt32(k8rec0, kf8FdstIndex))
+		if !bytes.HasPrefix(fdst, []byte("FDST")) || getInt32(fdst, 8) == 0 {
+			t.Fatal("FDST record is missing")
+		}
+		text := bookText(t, data, kf8)
+		if !bytes.Contains(text, []byte("Target paragraph.")) || !bytes.Contains(text, []byte("kindle:embed:")) {
+			t.Fatalf("unexpected KF8 text:\n%s", text)
+		}
+		if flows := getInt32(fdst, 8); getInt32(fdst, 12+8*(flows-1)+4) != len(text) {
+			t.Fatal("flows do not cover KF8 text")
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package mobi
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// fuzzSeeds returns valid books to start fuzzing from.
+func fuzzSeeds(f *testing.F) {
+
+	f.Helper()
+
+	data, err := os.ReadFile(buildUnpackBook(f))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	// KF8 part only, as in azw3
+	if kf8, ok := exthNumber(readExth(readSection(data, 0), exthKF8Offset)); ok {
+		f.Add(deleteSectionRange(data, 0, kf8-1))
+	}
+	f.Add([]byte{})
+}
+
+func FuzzUnpack(f *testing.F) {
+
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		u, err := unpack(data, "fuzz.azw3", zap.NewNop())
+		if err != nil {
+			return
+		}
+		if len(u.Result()) == 0 {
+			t.Fatal("book unpacked without errors, but there is no result")
+		}
+	})
+}
+
+func FuzzThumbnail(f *testing.F) {
+
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &Reader{log: zap.NewNop(), fname: "fuzz.mobi", width: 16, height: 16}
+		r.produceThumbnail(data)
+	})
+}
@@ -0,0 +1,146 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// HTML elements which could not have content and are written self-closed, everything else gets explicit end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+func escapeText(buf *bytes.Buffer, s string, attr bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			buf.WriteString("&amp;")
+		case r == '<':
+			buf.WriteString("&lt;")
+		case r == '>' && !attr:
+			buf.WriteString("&gt;")
+		case r == '"' && attr:
+			buf.WriteString("&quot;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+}
+
+func fullName(space, name string) string {
+	if len(space) == 0 {
+		return name
+	}
+	return space + ":" + name
+}
+
+// htmlWriter serializes XHTML trees, keeping track of positions of elements having "id" attribute.
+type htmlWriter struct {
+	bytes.Buffer
+	ids map[string]int
+	// attr allows caller to change attribute value
+	attr func(e *etree.Element, a *etree.Attr) string
+	// when hollow element is reached its content is not written, instead position is remembered
+	hollow *etree.Element
+	insert int
+}
+
+func newHTMLWriter(attr func(e *etree.Element, a *etree.Attr) string) *htmlWriter {
+	return &htmlWriter{ids: make(map[string]int), attr: attr, insert: -1}
+}
+
+func (w *htmlWriter) token(t etree.Token) {
+	switch v := t.(type) {
+	case *etree.Element:
+		w.element(v)
+	case *etree.CharData:
+		escapeText(&w.Buffer, v.Data, false)
+	}
+}
+
+func (w *htmlWriter) element(e *etree.Element) {
+
+	if id := e.SelectAttrValue("id", ""); len(id) > 0 {
+		if _, exists := w.ids[id]; !exists {
+			w.ids[id] = w.Len()
+		}
+	}
+
+	name := fullName(e.Space, e.Tag)
+	w.WriteByte('<')
+	w.WriteString(name)
+	for i := range e.Attr {
+		a := &e.Attr[i]
+		value := a.Value
+		if w.attr != nil {
+			value = w.attr(e, a)
+		}
+		w.WriteByte(' ')
+		w.WriteString(fullName(a.Space, a.Key))
+		w.WriteString(`="`)
+		escapeText(&w.Buffer, value, true)
+		w.WriteByte('"')
+	}
+
+	switch {
+	case e == w.hollow:
+		w.WriteByte('>')
+		w.insert = w.Len()
+		fmt.Fprintf(w, "</%s>", name)
+	case len(e.Child) == 0 && (voidElements[e.Tag] || len(e.Space) > 0):
+		w.WriteString("/>")
+	default:
+		w.WriteByte('>')
+		for _, c := range e.Child {
+			w.token(c)
+		}
+		fmt.Fprintf(w, "</%s>", name)
+	}
+	escapeText(&w.Buffer, e.TailData, false)
+}
+
+// isExternalLink checks if href points outside of the book.
+func isExternalLink(href string) bool {
+	u, err := url.Parse(href)
+	return err != nil || len(u.Scheme) > 0 || len(u.Host) > 0
+}
+
+// resolveHref returns link target relative to content directory: "file" or "file#id".
+func resolveHref(base, href string) string {
+	file, frag, _ := strings.Cut(href, "#")
+	if f, err := url.PathUnescape(file); err == nil {
+		file = f
+	}
+	if len(file) == 0 {
+		file = base
+	} else {
+		file = path.Join(path.Dir(base), file)
+	}
+	if len(frag) == 0 {
+		return file
+	}
+	return file + "#" + frag
+}
+
+// toBase32 converts number to the base 32 representation used by kindle for references.
+func toBase32(n, width int) string {
+	const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+	var res []byte
+	for n > 0 {
+		res = append(res, digits[n%32])
+		n /= 32
+	}
+	for len(res) < width {
+		res = append(res, '0')
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return string(res)
+}
@@ -0,0 +1,128 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// HUFF/CDIC decompression used by kindlegen for some books. We never produce it, but have to be able to read it.
+// Implementation follows calibre.ebooks.mobi.huffcdic.
+
+type huffSlice struct {
+	data     []byte
+	unpacked bool
+}
+
+type huffReader struct {
+	dict1      [256]struct{ codelen, term, maxcode uint64 }
+	mincode    [33]uint64
+	maxcode    [33]uint64
+	dictionary []*huffSlice
+	depth      int
+}
+
+// newHuffReader prepares decompressor out of HUFF record followed by CDIC records.
+func newHuffReader(records [][]byte) (*huffReader, error) {
+
+	if len(records) == 0 {
+		return nil, errors.New("huffcdic: no HUFF record")
+	}
+	huff := records[0]
+	if len(huff) < 24 || !bytes.Equal(huff[:8], []byte("HUFF\x00\x00\x00\x18")) {
+		return nil, errors.New("huffcdic: bad HUFF record")
+	}
+	off1, off2 := int(binary.BigEndian.Uint32(huff[8:])), int(binary.BigEndian.Uint32(huff[12:]))
+	if off1+256*4 > len(huff) || off2+64*4 > len(huff) {
+		return nil, errors.New("huffcdic: bad HUFF record")
+	}
+
+	h := &huffReader{}
+	for i := range h.dict1 {
+		v := uint64(binary.BigEndian.Uint32(huff[off1+4*i:]))
+		codelen, term, maxcode := v&0x1f, v&0x80, v>>8
+		if codelen == 0 {
+			return nil, errors.New("huffcdic: bad code length")
+		}
+		h.dict1[i].codelen, h.dict1[i].term, h.dict1[i].maxcode = codelen, term, ((maxcode+1)<<(32-codelen))-1
+	}
+	for codelen := 1; codelen <= 32; codelen++ {
+		mincode := uint64(binary.BigEndian.Uint32(huff[off2+8*(codelen-1):]))
+		maxcode := uint64(binary.BigEndian.Uint32(huff[off2+8*(codelen-1)+4:]))
+		h.mincode[codelen] = mincode << (32 - codelen)
+		h.maxcode[codelen] = ((maxcode + 1) << (32 - codelen)) - 1
+	}
+
+	for _, cdic := range records[1:] {
+		if len(cdic) < 16 || !bytes.Equal(cdic[:8], []byte("CDIC\x00\x00\x00\x10")) {
+			return nil, errors.New("huffcdic: bad CDIC record")
+		}
+		phrases, bits := int(binary.BigEndian.Uint32(cdic[8:])), binary.BigEndian.Uint32(cdic[12:])
+		n := min(1<<bits, phrases-len(h.dictionary))
+		for i := 0; i < n; i++ {
+			if 16+2*i+2 > len(cdic) {
+				return nil, errors.New("huffcdic: bad CDIC record")
+			}
+			off := int(binary.BigEndian.Uint16(cdic[16+2*i:]))
+			if 18+off > len(cdic) {
+				return nil, errors.New("huffcdic: bad CDIC record")
+			}
+			blen := int(binary.BigEndian.Uint16(cdic[16+off:]))
+			end := min(18+off+blen&0x7fff, len(cdic))
+			h.dictionary = append(h.dictionary, &huffSlice{data: cdic[18+off : end], unpacked: blen&0x8000 != 0})
+		}
+	}
+	return h, nil
+}
+
+// unpack decompresses single text record.
+func (h *huffReader) unpack(data []byte) ([]byte, error) {
+
+	h.depth++
+	defer func() { h.depth-- }()
+	if h.depth > 32 {
+		return nil, errors.New("huffcdic: dictionary recursion is too deep")
+	}
+
+	bitsLeft := len(data) * 8
+	data = append(bytes.Clone(data), make([]byte, 8)...)
+
+	var out []byte
+	pos, n := 0, 32
+	x := binary.BigEndian.Uint64(data)
+	for {
+		if n <= 0 {
+			pos += 4
+			x = binary.BigEndian.Uint64(data[pos:])
+			n += 32
+		}
+		code := (x >> uint(n)) & 0xffffffff
+		d := h.dict1[code>>24]
+		codelen, maxcode := d.codelen, d.maxcode
+		if d.term == 0 {
+			for codelen < 32 && code < h.mincode[codelen] {
+				codelen++
+			}
+			maxcode = h.maxcode[codelen]
+		}
+		n -= int(codelen)
+		bitsLeft -= int(codelen)
+		if bitsLeft < 0 {
+			break
+		}
+		r := int((maxcode - code) >> (32 - codelen))
+		if r >= len(h.dictionary) {
+			return nil, errors.New("huffcdic: dictionary index out of range")
+		}
+		s := h.dictionary[r]
+		if !s.unpacked {
+			res, err := h.unpack(s.data)
+			if err != nil {
+				return nil, err
+			}
+			s.data, s.unpacked = res, true
+		}
+		out = append(out, s.data...)
+	}
+	return out, nil
+}
@@ -0,0 +1,239 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// Test HUFF/CDIC code, kindlegen never gives us anything simpler to check against. Dictionary has phrases 0-5 followed
+// by every single byte. Phrases 0 and 1 have 2 bits codes ("11", "10"), terminal in first level table. Phrases 2-5 have
+// 4 bits codes ("0111" - "0100"), terminal too. Bytes have 10 bits codes starting with "00" and are looked up through
+// mincode table, byte v is encoded as 255-v. Phrases 2 and 3 are stored compressed, so dictionary is unpacked
+// recursively.
+var huffPhrases = []struct {
+	text   string
+	packed bool
+}{
+	{"</p>", false},
+	{"kindle:", false},
+	{`class="`, true},
+	{"</p><p", true},
+	{"</div>", false},
+	{` aid="`, false},
+}
+
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) write(code uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(code>>i&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+// huffEncode compresses data with test code, greedily using phrases when "phrases" is set.
+func huffEncode(data []byte, phrases bool) []byte {
+
+	w := &bitWriter{}
+	for len(data) > 0 {
+		best := -1
+		for i, ph := range huffPhrases {
+			if phrases && bytes.HasPrefix(data, []byte(ph.text)) && (best < 0 || len(ph.text) > len(huffPhrases[best].text)) {
+				best = i
+			}
+		}
+		switch {
+		case best < 0:
+			w.write(uint32(255-data[0]), 10)
+			data = data[1:]
+		case best < 2:
+			w.write(uint32(3-best), 2)
+			data = data[len(huffPhrases[best].text):]
+		default:
+			w.write(uint32(9-best), 4)
+			data = data[len(huffPhrases[best].text):]
+		}
+	}
+	// padding zero bits are shorter than any code starting with "00"
+	return w.buf
+}
+
+// huffRecords produces HUFF record followed by two CDIC records for test code.
+func huffRecords() [][]byte {
+
+	u32 := binary.BigEndian.AppendUint32
+
+	huff := append([]byte("HUFF\x00\x00\x00\x18"), make([]byte, 16)...)
+	binary.BigEndian.PutUint32(huff[8:], 24)
+	binary.BigEndian.PutUint32(huff[12:], 24+256*4)
+	for i := range 256 {
+		switch {
+		case i >= 0x80:
+			huff = u32(huff, 3<<8|0x80|2)
+		case i >= 0x40:
+			huff = u32(huff, 9<<8|0x80|4)
+		default:
+			// not terminal, code length is found starting from 9 bits
+			huff = u32(huff, 9)
+		}
+	}
+	for codelen := 1; codelen <= 32; codelen++ {
+		switch codelen {
+		case 2:
+			huff = u32(u32(huff, 2), 3)
+		case 4:
+			huff = u32(u32(huff, 4), 9)
+		case 9:
+			huff = u32(u32(huff, 0x1ff), 0)
+		case 10:
+			huff = u32(u32(huff, 0), 255+6)
+		default:
+			huff = u32(u32(huff, 0), 0)
+		}
+	}
+
+	var dict [][]byte
+	for _, ph := range huffPhrases {
+		if ph.packed {
+			data := huffEncode([]byte(ph.text), false)
+			dict = append(dict, binary.BigEndian.AppendUint16(nil, uint16(len(data))), data)
+		} else {
+			dict = append(dict, binary.BigEndian.AppendUint16(nil, uint16(len(ph.text)|0x8000)), []byte(ph.text))
+		}
+	}
+	for v := range 256 {
+		dict = append(dict, []byte{0x80, 1}, []byte{byte(v)})
+	}
+	// pairs of length and data
+	entries := len(dict) / 2
+
+	records := [][]byte{huff}
+	const bits = 8
+	for first := 0; first < entries; first += 1 << bits {
+		n := min(1<<bits, entries-first)
+		cdic := u32(u32([]byte("CDIC\x00\x00\x00\x10"), uint32(entries)), bits)
+		var body []byte
+		for i := first; i < first+n; i++ {
+			cdic = binary.BigEndian.AppendUint16(cdic, uint16(2*n+len(body)))
+			body = append(append(body, dict[2*i]...), dict[2*i+1]...)
+		}
+		records = append(records, append(cdic, body...))
+	}
+	return records
+}
+
+// huffBook recompresses KF8 text of the book with test HUFF/CDIC code.
+func huffBook(t *testing.T, data []byte) []byte {
+
+	t.Helper()
+
+	nsec := getUInt16(data, numberOfPdbRecords)
+	records := make([][]byte, 0, nsec+3)
+	for i := range nsec {
+		records = append(records, readSection(data, i))
+	}
+
+	kf8, ok := exthNumber(readExth(records[0], exthKF8Offset))
+	if !ok {
+		t.Fatal("KF8 offset is not set")
+	}
+	rec0 := bytes.Clone(records[kf8])
+	flags := getUInt16(rec0, extraDataFlags)
+	for i := 1; i <= getUInt16(rec0, bookRecordCount); i++ {
+		rec := records[kf8+i]
+		trailing := trailingSize(rec, flags)
+		text, err := decompressPalmDoc(rec[:len(rec)-trailing])
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[kf8+i] = append(huffEncode(text, true), rec[len(rec)-trailing:]...)
+	}
+
+	binary.BigEndian.PutUint16(rec0, compressionHuff)
+	binary.BigEndian.PutUint32(rec0[huffOffset:], uint32(len(records)-kf8))
+	binary.BigEndian.PutUint32(rec0[huffRecordCount:], 3)
+	records[kf8] = rec0
+	records = append(records, huffRecords()...)
+
+	// PalmDB header with new records table
+	var buf bytes.Buffer
+	buf.Write(data[:numberOfPdbRecords])
+	binary.Write(&buf, binary.BigEndian, uint16(len(records)))
+	offset := firstPdbRecord + 8*len(records) + 2
+	for i, r := range records {
+		binary.Write(&buf, binary.BigEndian, uint32(offset))
+		binary.Write(&buf, binary.BigEndian, uint32(2*i))
+		offset += len(r)
+	}
+	buf.Write([]byte{0, 0})
+	for _, r := range records {
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+func TestHuffCDIC(t *testing.T) {
+
+	h, err := newHuffReader(huffRecords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.dictionary) != len(huffPhrases)+256 {
+		t.Fatalf("unexpected dictionary size %d", len(h.dictionary))
+	}
+	text := []byte(`<p class="x">Текст</p><p aid="1">kindle:embed</p></div>`)
+	res, err := h.unpack(huffEncode(text, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, text) {
+		t.Fatalf("expected %q, got %q", text, res)
+	}
+
+	// index past the dictionary
+	h.dictionary = h.dictionary[:len(huffPhrases)]
+	if _, err := h.unpack(huffEncode([]byte("x"), false)); err == nil {
+		t.Fatal("bad dictionary index was not detected")
+	}
+	if _, err := newHuffReader([][]byte{[]byte("HUFF")}); err == nil {
+		t.Fatal("bad HUFF record was not detected")
+	}
+}
+
+func TestUnpackHuffCDIC(t *testing.T) {
+
+	data, err := os.ReadFile(buildUnpackBook(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := unpack(data, "book.mobi", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := unpack(huffBook(t, data), "book.mobi", zap.NewNop())
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+
+	want, got := epubFiles(t, expected.Result()), epubFiles(t, u.Result())
+	if names := slices.Sorted(maps.Keys(got)); !slices.Equal(names, slices.Sorted(maps.Keys(want))) {
+		t.Fatalf("unexpected files %q", names)
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Fatalf("%s differs:\n%s\nexpected:\n%s", name, got[name], content)
+		}
+	}
+}
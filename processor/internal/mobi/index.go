@@ -0,0 +1,362 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Index records (INDX) writer and reader. Layout follows calibre.ebooks.mobi.writer8.index and could be read back by KindleUnpack.
+
+const (
+	indxHeaderLength  = 192
+	indxRecordLimit   = 0x10000 - indxHeaderLength - 1048
+	cncxRecordLimit   = 0x10000 - 1024
+	cncxMaxStringSize = 500
+)
+
+// tagMeta describes single tag in TAGX table.
+type tagMeta struct {
+	name   string
+	number byte
+	values byte // values per entry
+	mask   byte
+	end    byte
+}
+
+var endTagTable = tagMeta{end: 1}
+
+// indexEntry is a single entry of the index - key and tag values.
+type indexEntry struct {
+	key  string
+	tags map[string][]int
+}
+
+// encodeVarint produces forward encoded variable width integer - 7 bits per byte, last byte has high bit set.
+func encodeVarint(value int) []byte {
+	var res []byte
+	for {
+		res = append(res, byte(value&0x7f))
+		value >>= 7
+		if value == 0 {
+			break
+		}
+	}
+	res[0] |= 0x80
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// decodeVarint reads forward encoded variable width integer, returns value and number of bytes consumed.
+func decodeVarint(data []byte) (int, int) {
+	var value, n int
+	for n < len(data) {
+		b := data[n]
+		n++
+		value = value<<7 | int(b&0x7f)
+		if b&0x80 != 0 {
+			break
+		}
+	}
+	return value, n
+}
+
+// alignBlock pads data to 4 bytes boundary.
+func alignBlock(data []byte) []byte {
+	if extra := len(data) % 4; extra != 0 {
+		data = append(data, make([]byte, 4-extra)...)
+	}
+	return data
+}
+
+// cncx keeps strings referenced from index entries.
+type cncx struct {
+	offsets map[string]int
+	records [][]byte
+}
+
+func newCNCX(strs []string) *cncx {
+
+	c := &cncx{offsets: make(map[string]int)}
+
+	var (
+		buf    bytes.Buffer
+		offset int
+	)
+	for _, s := range strs {
+		if _, ok := c.offsets[s]; ok {
+			continue
+		}
+		raw := []byte(s)
+		if len(raw) > cncxMaxStringSize {
+			raw = raw[:cncxMaxStringSize]
+		}
+		raw = append(encodeVarint(len(raw)), raw...)
+		if buf.Len()+len(raw) > cncxRecordLimit {
+			c.records = append(c.records, alignBlock(bytes.Clone(buf.Bytes())))
+			buf.Reset()
+			offset = len(c.records) * 0x10000
+		}
+		buf.Write(raw)
+		c.offsets[s] = offset
+		offset += len(raw)
+	}
+	if buf.Len() > 0 {
+		c.records = append(c.records, alignBlock(bytes.Clone(buf.Bytes())))
+	}
+	return c
+}
+
+// buildIndex produces INDX header record followed by index records and CNCX records.
+func buildIndex(tags []tagMeta, entries []indexEntry, strs *cncx) [][]byte {
+
+	// TAGX
+	tagx := new(bytes.Buffer)
+	tagx.WriteString("TAGX")
+	binary.Write(tagx, binary.BigEndian, uint32(12+4*len(tags)))
+	binary.Write(tagx, binary.BigEndian, uint32(1)) // control byte count
+	for _, t := range tags {
+		tagx.Write([]byte{t.number, t.values, t.mask, t.end})
+	}
+
+	type block struct {
+		data    bytes.Buffer
+		offsets []int
+		last    string
+	}
+
+	var blocks []*block
+	for _, e := range entries {
+
+		var cb byte
+		for _, t := range tags {
+			if t.end == 1 {
+				continue
+			}
+			if vals, ok := e.tags[t.name]; ok && len(vals) > 0 {
+				n := len(vals) / int(t.values)
+				cb |= t.mask & byte(n<<bits.TrailingZeros8(t.mask))
+			}
+		}
+
+		var raw bytes.Buffer
+		raw.WriteByte(byte(len(e.key)))
+		raw.WriteString(e.key)
+		raw.WriteByte(cb)
+		for _, t := range tags {
+			for _, v := range e.tags[t.name] {
+				raw.Write(encodeVarint(v))
+			}
+		}
+
+		if len(blocks) == 0 || blocks[len(blocks)-1].data.Len()+raw.Len()+2*(len(blocks[len(blocks)-1].offsets)+1) > indxRecordLimit {
+			blocks = append(blocks, &block{})
+		}
+		b := blocks[len(blocks)-1]
+		b.offsets = append(b.offsets, b.data.Len())
+		b.data.Write(raw.Bytes())
+		b.last = e.key
+	}
+
+	records := make([][]byte, 0, 1+len(blocks)+len(strs.records))
+	records = append(records, nil) // header placeholder
+
+	var geometry bytes.Buffer
+	geometryOffsets := make([]int, 0, len(blocks))
+	for _, b := range blocks {
+		data := alignBlock(bytes.Clone(b.data.Bytes()))
+
+		var rec bytes.Buffer
+		rec.WriteString("INDX")
+		binary.Write(&rec, binary.BigEndian, uint32(indxHeaderLength))
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(1)) // type
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(indxHeaderLength+len(data))) // IDXT offset
+		binary.Write(&rec, binary.BigEndian, uint32(len(b.offsets)))
+		rec.Write(bytes.Repeat([]byte{0xff}, 8))
+		rec.Write(make([]byte, indxHeaderLength-rec.Len()))
+		rec.Write(data)
+		rec.WriteString("IDXT")
+		for _, ofs := range b.offsets {
+			binary.Write(&rec, binary.BigEndian, uint16(indxHeaderLength+ofs))
+		}
+		records = append(records, alignBlock(rec.Bytes()))
+
+		geometryOffsets = append(geometryOffsets, geometry.Len())
+		geometry.WriteByte(byte(len(b.last)))
+		geometry.WriteString(b.last)
+		binary.Write(&geometry, binary.BigEndian, uint16(len(b.offsets)))
+	}
+	geom := alignBlock(geometry.Bytes())
+
+	var hdr bytes.Buffer
+	hdr.WriteString("INDX")
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength))
+	hdr.Write(make([]byte, 8))
+	binary.Write(&hdr, binary.BigEndian, uint32(2))                                     // type
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength+tagx.Len()+len(geom))) // IDXT offset
+	binary.Write(&hdr, binary.BigEndian, uint32(len(blocks)))
+	binary.Write(&hdr, binary.BigEndian, uint32(65001))
+	binary.Write(&hdr, binary.BigEndian, uint32(0xffffffff))
+	binary.Write(&hdr, binary.BigEndian, uint32(len(entries)))
+	hdr.Write(make([]byte, 12)) // ORDT, LIGT, number of LIGT entries
+	binary.Write(&hdr, binary.BigEndian, uint32(len(strs.records)))
+	hdr.Write(make([]byte, 124))
+	binary.Write(&hdr, binary.BigEndian, uint32(indxHeaderLength)) // TAGX offset
+	hdr.Write(make([]byte, 8))
+	hdr.Write(tagx.Bytes())
+	hdr.Write(geom)
+	hdr.WriteString("IDXT")
+	for _, ofs := range geometryOffsets {
+		binary.Write(&hdr, binary.BigEndian, uint16(indxHeaderLength+tagx.Len()+ofs))
+	}
+	records[0] = alignBlock(hdr.Bytes())
+
+	return append(records, strs.records...)
+}
+
+// indexRecord is a single entry read from the index - key and tag values by tag number.
+type indexRecord struct {
+	key  string
+	tags map[byte][]int
+}
+
+// readIndex reads index starting with INDX header record idx. Returned strings are CNCX content by offset.
+func readIndex(section func(int) ([]byte, error), idx int) ([]indexRecord, map[int]string, error) {
+
+	hdr, err := section(idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hdr) < indxHeaderLength || !bytes.Equal(hdr[:4], []byte("INDX")) {
+		return nil, nil, fmt.Errorf("bad index header in record %d", idx)
+	}
+	count, ncncx := getInt32(hdr, 24), getInt32(hdr, 52)
+
+	strs := make(map[int]string)
+	for i := range ncncx {
+		data, err := section(idx + count + 1 + i)
+		if err != nil {
+			return nil, nil, err
+		}
+		for ofs := 0; ofs < len(data) && data[ofs] != 0; {
+			l, n := decodeVarint(data[ofs:])
+			if ofs+n+l > len(data) {
+				break
+			}
+			strs[i*0x10000+ofs] = string(data[ofs+n : ofs+n+l])
+			ofs += n + l
+		}
+	}
+
+	// TAGX
+	tagxStart := getInt32(hdr, 4)
+	if tagxStart < 0 || len(hdr) < tagxStart+12 || !bytes.Equal(hdr[tagxStart:tagxStart+4], []byte("TAGX")) {
+		return nil, nil, errors.New("index has no TAGX section")
+	}
+	tagxEnd, controlBytes := tagxStart+getInt32(hdr, tagxStart+4), getInt32(hdr, tagxStart+8)
+	if tagxEnd > len(hdr) || controlBytes < 0 {
+		return nil, nil, errors.New("bad TAGX section")
+	}
+	var tags []tagMeta
+	for ofs := tagxStart + 12; ofs+4 <= tagxEnd; ofs += 4 {
+		tags = append(tags, tagMeta{number: hdr[ofs], values: hdr[ofs+1], mask: hdr[ofs+2], end: hdr[ofs+3]})
+	}
+
+	var res []indexRecord
+	for i := idx + 1; i <= idx+count; i++ {
+		data, err := section(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) < indxHeaderLength || !bytes.Equal(data[:4], []byte("INDX")) {
+			return nil, nil, fmt.Errorf("bad index record %d", i)
+		}
+		idxt, entries := getInt32(data, 20), getInt32(data, 24)
+		if idxt < 0 || entries < 0 || idxt+4+2*entries > len(data) {
+			return nil, nil, fmt.Errorf("bad index record %d", i)
+		}
+		for j := range entries {
+			start, end := getUInt16(data, idxt+4+2*j), idxt
+			if j < entries-1 {
+				end = getUInt16(data, idxt+4+2*(j+1))
+			}
+			if start >= end || end > len(data) {
+				return nil, nil, fmt.Errorf("bad entry in index record %d", i)
+			}
+			l := int(data[start])
+			if start+1+l+controlBytes > end {
+				return nil, nil, fmt.Errorf("bad entry in index record %d", i)
+			}
+			rec := indexRecord{key: string(data[start+1 : start+1+l]), tags: readTags(tags, controlBytes, data[start+1+l:end])}
+			res = append(res, rec)
+		}
+	}
+	return res, strs, nil
+}
+
+// readTags decodes tag values of index entry following the entry key.
+func readTags(tags []tagMeta, controlBytes int, data []byte) map[byte][]int {
+
+	type tagCount struct {
+		tag          tagMeta
+		count, bytes int
+	}
+
+	var (
+		counts []tagCount
+		cbi    int
+	)
+	for _, t := range tags {
+		if t.end == 1 {
+			cbi++
+			continue
+		}
+		if cbi >= len(data) {
+			break
+		}
+		v := data[cbi] & t.mask
+		switch {
+		case v == 0:
+		case v == t.mask && bits.OnesCount8(t.mask) > 1:
+			// number of bytes taken by values follows control bytes
+			counts = append(counts, tagCount{tag: t, bytes: -1})
+		default:
+			counts = append(counts, tagCount{tag: t, count: int(v >> bits.TrailingZeros8(t.mask))})
+		}
+	}
+
+	res := make(map[byte][]int)
+	pos := controlBytes
+	for i := range counts {
+		if counts[i].bytes < 0 && pos < len(data) {
+			v, n := decodeVarint(data[pos:])
+			counts[i].bytes = v
+			pos += n
+		}
+	}
+	for _, c := range counts {
+		var vals []int
+		if c.bytes > 0 {
+			for consumed := 0; consumed < c.bytes && pos < len(data); {
+				v, n := decodeVarint(data[pos:])
+				vals = append(vals, v)
+				consumed += n
+				pos += n
+			}
+		} else {
+			for k := 0; k < c.count*int(c.tag.values) && pos < len(data); k++ {
+				v, n := decodeVarint(data[pos:])
+				vals = append(vals, v)
+				pos += n
+			}
+		}
+		res[c.tag.number] = vals
+	}
+	return res
+}
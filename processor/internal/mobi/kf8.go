@@ -0,0 +1,390 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// KF8 part of the book. Every content document becomes skeleton (document with empty body) and set of fragments
+// (body content split into chunks), all of them in the first text flow. Stylesheets are stored in the following flows.
+// Layout follows calibre.ebooks.mobi.writer8.
+
+const chunkSize = 8192
+
+// kf8Position describes location of the link target in KF8 text.
+type kf8Position struct {
+	fid int // fragment sequence number
+	off int // offset inside fragment
+	pos int // offset in the text
+}
+
+type kf8Book struct {
+	text       []byte
+	flows      [][2]int
+	fragIndex  [][]byte
+	skelIndex  [][]byte
+	guideIndex [][]byte
+	ncxIndex   [][]byte
+	start      int
+	positions  map[string]kf8Position
+}
+
+type kf8Chunk struct {
+	insert, file, seq, start, length int
+	selector                         string
+}
+
+type kf8Skeleton struct {
+	file, chunks, start, length int
+}
+
+var (
+	reKF8Link = regexp.MustCompile(`kindle:pos:fid:\?\?\?\?:off:(\d{10})`)
+	reCSSURL  = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+)
+
+func (b *Builder) embedRef(idx int) string {
+	return fmt.Sprintf("kindle:embed:%s?mime=%s", toBase32(idx+1, 4), b.resources[idx].mediaType)
+}
+
+func (b *Builder) buildKF8(docs []*etree.Document) (*kf8Book, error) {
+
+	k := &kf8Book{positions: make(map[string]kf8Position), start: nullIndex}
+
+	// stylesheets
+	flowIndex := make(map[string]int)
+	var styles [][]byte
+	for _, item := range b.manifest {
+		if item.mediaType != "text/css" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(b.dir, filepath.FromSlash(item.href)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read stylesheet: %w", err)
+		}
+		styles = append(styles, b.rewriteCSS(item.href, data))
+		flowIndex[item.href] = len(styles)
+	}
+
+	var links []string
+	attr := func(base string) func(e *etree.Element, a *etree.Attr) string {
+		return func(e *etree.Element, a *etree.Attr) string {
+			switch {
+			case e.Tag == "a" && a.Key == "href" && !isExternalLink(a.Value):
+				links = append(links, resolveHref(base, a.Value))
+				return fmt.Sprintf("kindle:pos:fid:????:off:%010d", len(links)-1)
+			case e.Tag == "link" && a.Key == "href":
+				if flow, ok := flowIndex[resolveHref(base, a.Value)]; ok {
+					return fmt.Sprintf("kindle:flow:%s?mime=text/css", toBase32(flow, 4))
+				}
+			case e.Tag == "img" && a.Key == "src", e.Tag == "image" && a.Key == "href":
+				if idx, ok := b.resIndex[resolveHref(base, a.Value)]; ok {
+					return b.embedRef(idx)
+				}
+			}
+			return a.Value
+		}
+	}
+
+	var (
+		text   bytes.Buffer
+		skels  []kf8Skeleton
+		chunks []kf8Chunk
+	)
+	for i, doc := range docs {
+
+		href := b.spine[i]
+		root := doc.Root()
+		if root == nil || root.SelectElement("body") == nil {
+			return nil, fmt.Errorf("bad content document %s, no body", href)
+		}
+		body := root.SelectElement("body")
+		aid := toBase32(i, 4)
+		body.CreateAttr("aid", aid)
+
+		skel := newHTMLWriter(attr(href))
+		skel.hollow = body
+		skel.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+		skel.element(root)
+
+		content := newHTMLWriter(attr(href))
+		var bounds []int
+		for _, t := range body.Child {
+			content.token(t)
+			bounds = append(bounds, content.Len())
+		}
+		if content.Len() == 0 {
+			content.WriteString(" ")
+			bounds = append(bounds, content.Len())
+		}
+
+		start := text.Len()
+		base := start + skel.insert
+		first := len(chunks)
+		from := 0
+		for j, end := range bounds {
+			if end > from && (end-from >= chunkSize || j == len(bounds)-1) {
+				chunks = append(chunks, kf8Chunk{
+					insert:   base + from,
+					file:     i,
+					seq:      len(chunks),
+					start:    from,
+					length:   end - from,
+					selector: fmt.Sprintf("P-//*[@aid='%s']", aid),
+				})
+				from = end
+			}
+		}
+		skels = append(skels, kf8Skeleton{file: i, chunks: len(chunks) - first, start: start, length: skel.Len()})
+
+		k.positions[href] = kf8Position{fid: first, pos: base}
+		for id, ofs := range skel.ids {
+			k.positions[href+"#"+id] = kf8Position{fid: first, pos: start + ofs}
+		}
+		for id, ofs := range content.ids {
+			c := first
+			for c < len(chunks)-1 && chunks[c+1].start <= ofs {
+				c++
+			}
+			k.positions[href+"#"+id] = kf8Position{fid: c, off: ofs - chunks[c].start, pos: base + ofs}
+		}
+
+		// raw text keeps skeleton followed by its fragments, positions above are in assembled document
+		text.Write(skel.Bytes())
+		text.Write(content.Bytes())
+	}
+
+	// now, when everything is in place, links could be resolved
+	k.text = reKF8Link.ReplaceAllFunc(text.Bytes(), func(m []byte) []byte {
+		n, _ := strconv.Atoi(string(m[len(m)-10:]))
+		p := k.locate(links[n], b.log)
+		return fmt.Appendf(nil, "kindle:pos:fid:%s:off:%s", toBase32(p.fid, 4), toBase32(p.off, 10))
+	})
+
+	k.flows = append(k.flows, [2]int{0, len(k.text)})
+	for _, s := range styles {
+		k.flows = append(k.flows, [2]int{len(k.text), len(k.text) + len(s)})
+		k.text = append(k.text, s...)
+	}
+	textLength := k.flows[0][1]
+
+	// indexes
+	selectors := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		selectors = append(selectors, c.selector)
+	}
+	strs := newCNCX(selectors)
+	entries := make([]indexEntry, 0, len(chunks))
+	for _, c := range chunks {
+		entries = append(entries, indexEntry{
+			key: fmt.Sprintf("%010d", c.insert),
+			tags: map[string][]int{
+				"cncx_offset":     {strs.offsets[c.selector]},
+				"file_number":     {c.file},
+				"sequence_number": {c.seq},
+				"geometry":        {c.start, c.length},
+			},
+		})
+	}
+	k.fragIndex = buildIndex([]tagMeta{
+		{name: "cncx_offset", number: 2, values: 1, mask: 1},
+		{name: "file_number", number: 3, values: 1, mask: 2},
+		{name: "sequence_number", number: 4, values: 1, mask: 4},
+		{name: "geometry", number: 6, values: 2, mask: 8},
+		endTagTable,
+	}, entries, strs)
+
+	entries = make([]indexEntry, 0, len(skels))
+	for _, s := range skels {
+		entries = append(entries, indexEntry{
+			key: fmt.Sprintf("SKEL%010d", s.file),
+			tags: map[string][]int{
+				"chunk_count": {s.chunks, s.chunks},
+				"geometry":    {s.start, s.length, s.start, s.length},
+			},
+		})
+	}
+	k.skelIndex = buildIndex([]tagMeta{
+		{name: "chunk_count", number: 1, values: 1, mask: 3},
+		{name: "geometry", number: 6, values: 2, mask: 12},
+		endTagTable,
+	}, entries, &cncx{})
+
+	k.guideIndex = b.kf8Guide(k)
+	k.ncxIndex = b.kf8NCX(k, textLength)
+
+	k.start = k.positions[b.spine[0]].pos
+	for _, g := range b.guide {
+		if g.kind == "text" {
+			if p, ok := k.positions[resolveHref("", g.href)]; ok {
+				k.start = p.pos
+			}
+		}
+	}
+	return k, nil
+}
+
+// locate finds link target, falling back to the beginning of the file when anchor is unknown.
+func (k *kf8Book) locate(target string, log *zap.Logger) kf8Position {
+	if p, ok := k.positions[target]; ok {
+		return p
+	}
+	file, _, _ := strings.Cut(target, "#")
+	if p, ok := k.positions[file]; ok {
+		return p
+	}
+	log.Debug("Unable to resolve link target, ignoring", zap.String("target", target))
+	return kf8Position{}
+}
+
+// rewriteCSS replaces references to images and fonts in stylesheet with kindle embedded references.
+func (b *Builder) rewriteCSS(href string, data []byte) []byte {
+	return reCSSURL.ReplaceAllFunc(data, func(m []byte) []byte {
+		ref := string(reCSSURL.FindSubmatch(m)[1])
+		if idx, ok := b.resIndex[path.Join(path.Dir(href), ref)]; ok {
+			return []byte("url(" + b.embedRef(idx) + ")")
+		}
+		return m
+	})
+}
+
+func (b *Builder) kf8Guide(k *kf8Book) [][]byte {
+
+	refs := slices.Clone(b.guide)
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].kind < refs[j].kind })
+
+	var titles []string
+	for _, g := range refs {
+		titles = append(titles, g.title)
+	}
+	strs := newCNCX(titles)
+
+	var entries []indexEntry
+	for _, g := range refs {
+		p, ok := k.positions[resolveHref("", g.href)]
+		if !ok || len(g.kind) == 0 {
+			continue
+		}
+		entries = append(entries, indexEntry{
+			key: g.kind,
+			tags: map[string][]int{
+				"title":   {strs.offsets[g.title]},
+				"pos_fid": {p.fid, p.off},
+			},
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return buildIndex([]tagMeta{
+		{name: "title", number: 1, values: 1, mask: 1},
+		{name: "pos_fid", number: 6, values: 2, mask: 2},
+		endTagTable,
+	}, entries, strs)
+}
+
+func (b *Builder) kf8NCX(k *kf8Book, textLength int) [][]byte {
+
+	type node struct {
+		label    string
+		depth    int
+		pos      kf8Position
+		parent   int
+		children []int
+	}
+
+	var nodes []*node
+	var walk func(entries []*tocEntry, depth, parent int)
+	walk = func(entries []*tocEntry, depth, parent int) {
+		for _, e := range entries {
+			n := &node{label: e.label, depth: depth, pos: k.locate(resolveHref("", e.href), b.log), parent: parent}
+			idx := len(nodes)
+			nodes = append(nodes, n)
+			if parent >= 0 {
+				nodes[parent].children = append(nodes[parent].children, idx)
+			}
+			walk(e.children, depth+1, idx)
+		}
+	}
+	walk(b.toc, 0, nullIndex)
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ni, nj := nodes[order[i]], nodes[order[j]]
+		if ni.depth != nj.depth {
+			return ni.depth < nj.depth
+		}
+		return ni.pos.pos < nj.pos.pos
+	})
+	index := make([]int, len(nodes))
+	for i, o := range order {
+		index[o] = i
+	}
+
+	labels := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		labels = append(labels, n.label)
+	}
+	strs := newCNCX(labels)
+
+	width := max(2, len(fmt.Sprintf("%X", len(nodes)-1)))
+	entries := make([]indexEntry, 0, len(nodes))
+	for i, o := range order {
+		n := nodes[o]
+		end := textLength
+		for _, other := range nodes {
+			if other.depth <= n.depth && other.pos.pos > n.pos.pos && other.pos.pos < end {
+				end = other.pos.pos
+			}
+		}
+		tags := map[string][]int{
+			"offset":  {n.pos.pos},
+			"length":  {max(0, end-n.pos.pos)},
+			"label":   {strs.offsets[n.label]},
+			"depth":   {n.depth},
+			"pos_fid": {n.pos.fid, n.pos.off},
+		}
+		if n.parent >= 0 {
+			tags["parent"] = []int{index[n.parent]}
+		}
+		if len(n.children) > 0 {
+			first, last := len(nodes), -1
+			for _, c := range n.children {
+				first, last = min(first, index[c]), max(last, index[c])
+			}
+			tags["first_child"] = []int{first}
+			tags["last_child"] = []int{last}
+		}
+		entries = append(entries, indexEntry{key: fmt.Sprintf("%0*X", width, i), tags: tags})
+	}
+
+	return buildIndex([]tagMeta{
+		{name: "offset", number: 1, values: 1, mask: 1},
+		{name: "length", number: 2, values: 1, mask: 2},
+		{name: "label", number: 3, values: 1, mask: 4},
+		{name: "depth", number: 4, values: 1, mask: 8},
+		{name: "parent", number: 21, values: 1, mask: 16},
+		{name: "first_child", number: 22, values: 1, mask: 32},
+		{name: "last_child", number: 23, values: 1, mask: 64},
+		{name: "pos_fid", number: 6, values: 2, mask: 128},
+		endTagTable,
+	}, entries, strs)
+}
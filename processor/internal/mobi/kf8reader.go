@@ -0,0 +1,569 @@
+package mobi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/h2non/filetype"
+	"go.uber.org/zap"
+)
+
+// KF8 reader. Reverses what kf8.go (and kindlegen) does: text records are decompressed, skeletons and fragments are
+// assembled back into XHTML documents and kindle references are replaced with regular links.
+// Layout follows KindleUnpack (mobi_k8proc.py) and calibre.ebooks.mobi.reader.mobi8.
+
+const (
+	compressionNone    = 1
+	compressionPalmDoc = 2
+	compressionHuff    = 17480
+
+	// KF8 header offsets
+	extraDataFlags  = 0xf2
+	kf8FragIndex    = 0xf8
+	kf8SkelIndex    = 0xfc
+	kf8GuideIndex   = 0x104
+	huffRecordCount = 116
+
+	// kf8HeaderSize is the smallest record 0 which has all KF8 header fields we use
+	kf8HeaderSize = kf8GuideIndex + 4
+	// maxFontSize limits unpacked embedded font
+	maxFontSize = 32 * 1024 * 1024
+)
+
+var (
+	reKF8Pos   = regexp.MustCompile(`kindle:pos:fid:([0-9A-V]{4}):off:([0-9A-V]{10})`)
+	reKF8Embed = regexp.MustCompile(`kindle:embed:([0-9A-V]{4})(?:\?mime=[^"')\s]*)?`)
+	reKF8Flow  = regexp.MustCompile(`kindle:flow:([0-9A-V]{4})(?:\?mime=[^"')\s]*)?`)
+	reKF8ID    = regexp.MustCompile(`<[^>]*\sid\s*=\s*['"]([^'"]*)['"]`)
+	reKF8Aid   = regexp.MustCompile(`\s(?:aid|data-Amzn[A-Za-z]*)\s*=\s*(?:"[^"]*"|'[^']*')`)
+)
+
+// kf8Part is assembled content document.
+type kf8Part struct {
+	start, end int // position in assembled text
+	text       []byte
+}
+
+// kf8Resource is image or font stored in the book.
+type kf8Resource struct {
+	index     int // kindle:embed index
+	mediaType string
+	ext       string
+	data      []byte
+	font      bool
+}
+
+// kf8NCXEntry is table of contents entry.
+type kf8NCXEntry struct {
+	label    string
+	depth    int
+	parent   int
+	fid, off int
+}
+
+type kf8Reader struct {
+	log  *zap.Logger
+	data []byte
+	base int // KF8 record 0
+	rec0 []byte
+
+	text      []byte
+	flows     [][]byte
+	skels     []kf8Skeleton
+	chunks    []kf8Chunk
+	parts     []*kf8Part
+	resources []*kf8Resource
+	guide     []guideRef
+	ncx       []kf8NCXEntry
+	thumb     int // kindle:embed index of thumbnail, it is not part of the content
+	cover     int // kindle:embed index of cover image
+}
+
+// newKF8Reader locates KF8 part of the book (either standalone or in combo file) and parses it.
+func newKF8Reader(data []byte, log *zap.Logger) (*kf8Reader, error) {
+
+	if len(data) < firstPdbRecord+2 || !bytes.Equal(data[60:68], []byte("BOOKMOBI")) {
+		return nil, errors.New("not a mobi book")
+	}
+	r := &kf8Reader{log: log, data: data, thumb: nullIndex, cover: nullIndex}
+
+	rec0 := readSection(data, 0)
+	if len(rec0) < firstRescRecord+4 || !bytes.Equal(rec0[mobiHeaderBase:mobiHeaderBase+4], []byte("MOBI")) {
+		return nil, errors.New("no mobi header")
+	}
+	if getUInt16(rec0, cryptoType) != 0 {
+		return nil, errors.New("book is encrypted")
+	}
+
+	firstResource := getInt32(rec0, firstRescRecord)
+	if getInt32(rec0, mobiVersion) != 8 {
+		kf8off, ok := exthNumber(readExth(rec0, exthKF8Offset))
+		if !ok || kf8off <= 0 {
+			return nil, errors.New("book has no KF8 part")
+		}
+		r.base = kf8off
+		// in combo file resources are shared and located in MOBI7 part
+	} else {
+		firstResource = nullIndex
+	}
+
+	var err error
+	if r.rec0, err = r.section(0); err != nil {
+		return nil, err
+	}
+	if len(r.rec0) < kf8HeaderSize || !bytes.Equal(r.rec0[mobiHeaderBase:mobiHeaderBase+4], []byte("MOBI")) {
+		return nil, errors.New("bad KF8 header")
+	}
+	if firstResource == nullIndex {
+		firstResource = getInt32(r.rec0, firstRescRecord)
+	}
+
+	if err := r.readText(); err != nil {
+		return nil, err
+	}
+	if err := r.readFlows(); err != nil {
+		return nil, err
+	}
+	if err := r.readParts(); err != nil {
+		return nil, err
+	}
+	r.readResources(firstResource)
+	if err := r.readGuide(); err != nil {
+		return nil, err
+	}
+	if err := r.readNCX(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// section returns KF8 record by its index relative to KF8 record 0.
+func (r *kf8Reader) section(n int) ([]byte, error) {
+	start, end, ok := sectionAddr(r.data, r.base+n)
+	if n < 0 || !ok {
+		return nil, fmt.Errorf("record %d is out of range or damaged", n)
+	}
+	return r.data[start:end], nil
+}
+
+// exth returns values of EXTH record from KF8 header.
+func (r *kf8Reader) exth(id int) [][]byte {
+	if getInt32(r.rec0, 0x80)&0x40 == 0 {
+		return nil
+	}
+	return readExth(r.rec0, id)
+}
+
+// trailingSize returns size of extra data at the end of text record.
+func trailingSize(data []byte, flags int) int {
+
+	size := len(data)
+	num := 0
+	for f := flags >> 1; f != 0; f >>= 1 {
+		if f&1 == 0 {
+			continue
+		}
+		// backward encoded variable width integer
+		var v, shift int
+		for end := size - num; end > 0; end-- {
+			b := data[end-1]
+			v |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 != 0 || shift >= 28 {
+				break
+			}
+		}
+		num += v
+	}
+	if flags&1 != 0 && size-num > 0 {
+		num += int(data[size-num-1]&3) + 1
+	}
+	return min(num, size)
+}
+
+func (r *kf8Reader) readText() error {
+
+	compression := getUInt16(r.rec0, 0)
+	length, count := getInt32(r.rec0, lengthOfBook), getUInt16(r.rec0, bookRecordCount)
+
+	var flags int
+	if getInt32(r.rec0, mobiHeaderLength) >= 0xe4 {
+		flags = getUInt16(r.rec0, extraDataFlags)
+	}
+
+	var huff *huffReader
+	switch compression {
+	case compressionNone, compressionPalmDoc:
+	case compressionHuff:
+		first, n := getInt32(r.rec0, huffOffset), getInt32(r.rec0, huffRecordCount)
+		if n <= 0 || n > getUInt16(r.data, numberOfPdbRecords) {
+			return fmt.Errorf("bad number of HUFF/CDIC records %d", n)
+		}
+		records := make([][]byte, 0, n)
+		for i := range n {
+			rec, err := r.section(first + i)
+			if err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+		var err error
+		if huff, err = newHuffReader(records); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported compression %d", compression)
+	}
+
+	if length < 0 {
+		return fmt.Errorf("bad text length %d", length)
+	}
+	// length is only a hint, do not trust it with memory
+	text := make([]byte, 0, min(length, len(r.data)))
+	for i := 1; i <= count; i++ {
+		rec, err := r.section(i)
+		if err != nil {
+			return err
+		}
+		rec = rec[:len(rec)-trailingSize(rec, flags)]
+		switch compression {
+		case compressionPalmDoc:
+			rec, err = decompressPalmDoc(rec)
+		case compressionHuff:
+			rec, err = huff.unpack(rec)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to decompress text record %d: %w", i, err)
+		}
+		text = append(text, rec...)
+	}
+	if len(text) > length {
+		text = text[:length]
+	}
+	r.text = text
+	return nil
+}
+
+func (r *kf8Reader) readFlows() error {
+
+	if idx := getInt32(r.rec0, kf8FdstIndex); idx != nullIndex && getInt32(r.rec0, kf8FdstIndex+4) > 1 {
+		rec, err := r.section(idx)
+		if err != nil {
+			return err
+		}
+		if len(rec) < 12 || !bytes.Equal(rec[:4], []byte("FDST")) {
+			return errors.New("bad FDST record")
+		}
+		count := getInt32(rec, 8)
+		for i := range count {
+			if 12+8*i+8 > len(rec) {
+				return errors.New("bad FDST record")
+			}
+			start, end := getInt32(rec, 12+8*i), getInt32(rec, 16+8*i)
+			if start < 0 || start > end || end > len(r.text) {
+				return errors.New("bad flow boundaries")
+			}
+			r.flows = append(r.flows, r.text[start:end])
+		}
+	}
+	if len(r.flows) == 0 {
+		r.flows = [][]byte{r.text}
+	}
+	return nil
+}
+
+// readParts assembles content documents out of skeletons and fragments.
+func (r *kf8Reader) readParts() error {
+
+	idx := getInt32(r.rec0, kf8SkelIndex)
+	if idx == nullIndex {
+		return errors.New("book has no skeleton index")
+	}
+	entries, _, err := readIndex(r.section, idx)
+	if err != nil {
+		return fmt.Errorf("unable to read skeleton index: %w", err)
+	}
+	for i, e := range entries {
+		count, geometry := e.tags[1], e.tags[6]
+		if len(count) == 0 || len(geometry) < 2 {
+			return errors.New("bad skeleton index entry")
+		}
+		r.skels = append(r.skels, kf8Skeleton{file: i, chunks: count[0], start: geometry[0], length: geometry[1]})
+	}
+
+	if idx = getInt32(r.rec0, kf8FragIndex); idx != nullIndex {
+		entries, strs, err := readIndex(r.section, idx)
+		if err != nil {
+			return fmt.Errorf("unable to read fragment index: %w", err)
+		}
+		for _, e := range entries {
+			insert, err := strconv.Atoi(e.key)
+			if err != nil {
+				return fmt.Errorf("bad fragment index entry: %w", err)
+			}
+			c := kf8Chunk{insert: insert}
+			if v := e.tags[2]; len(v) > 0 {
+				c.selector = strs[v[0]]
+			}
+			if v := e.tags[3]; len(v) > 0 {
+				c.file = v[0]
+			}
+			if v := e.tags[4]; len(v) > 0 {
+				c.seq = v[0]
+			}
+			if v := e.tags[6]; len(v) > 1 {
+				c.start, c.length = v[0], v[1]
+			}
+			r.chunks = append(r.chunks, c)
+		}
+	}
+
+	text := r.flows[0]
+	next := 0
+	for _, s := range r.skels {
+		if s.start < 0 || s.length < 0 || s.start+s.length > len(text) {
+			return errors.New("skeleton is out of text boundaries")
+		}
+		doc := bytes.Clone(text[s.start : s.start+s.length])
+		pos := s.start + s.length
+		for range s.chunks {
+			if next >= len(r.chunks) {
+				return errors.New("fragment index does not match skeletons")
+			}
+			c := r.chunks[next]
+			next++
+			insert := c.insert - s.start
+			if c.length < 0 || pos+c.length > len(text) || insert < 0 || insert > len(doc) {
+				return errors.New("fragment is out of text boundaries")
+			}
+			doc = append(doc[:insert], append(bytes.Clone(text[pos:pos+c.length]), doc[insert:]...)...)
+			pos += c.length
+		}
+		r.parts = append(r.parts, &kf8Part{start: s.start, end: pos, text: doc})
+	}
+	return nil
+}
+
+// readResources collects images and fonts, their index is used in kindle:embed references.
+func (r *kf8Reader) readResources(first int) {
+
+	if v, ok := exthNumber(r.exth(exthThumbOffset)); ok {
+		r.thumb = v + 1
+	}
+	if v, ok := exthNumber(r.exth(exthCoverOffset)); ok {
+		r.cover = v + 1
+	}
+
+	total := getUInt16(r.data, numberOfPdbRecords)
+	for i := first; i > 0 && i < total; i++ {
+		data := readSection(r.data, i)
+		if bytes.Equal(data, recordEOF) || bytes.HasPrefix(data, recordBoundary) {
+			break
+		}
+		res := &kf8Resource{index: i - first + 1}
+		switch {
+		case bytes.HasPrefix(data, []byte("FONT")):
+			font, err := decodeFont(data)
+			if err != nil {
+				r.log.Debug("Unable to decode font, ignoring", zap.Int("record", i), zap.Error(err))
+				continue
+			}
+			res.data, res.font = font, true
+			switch {
+			case bytes.HasPrefix(font, []byte("OTTO")):
+				res.mediaType, res.ext = "application/vnd.ms-opentype", "otf"
+			default:
+				res.mediaType, res.ext = "application/x-font-truetype", "ttf"
+			}
+		default:
+			kind, err := filetype.Image(data)
+			if err != nil || kind == filetype.Unknown {
+				// FLIS, FCIS, RESC and such
+				continue
+			}
+			res.data, res.mediaType, res.ext = data, kind.MIME.Value, kind.Extension
+			if res.ext == "jpg" {
+				res.ext = "jpeg"
+			}
+		}
+		r.resources = append(r.resources, res)
+	}
+}
+
+// decodeFont extracts font from FONT record.
+func decodeFont(data []byte) ([]byte, error) {
+
+	if len(data) < 24 {
+		return nil, errors.New("FONT record is too short")
+	}
+	size, flags := int(binary.BigEndian.Uint32(data[4:])), binary.BigEndian.Uint32(data[8:])
+	start, xorLen, xorStart := int(binary.BigEndian.Uint32(data[12:])), int(binary.BigEndian.Uint32(data[16:])), int(binary.BigEndian.Uint32(data[20:]))
+	if start > len(data) || xorStart+xorLen > len(data) {
+		return nil, errors.New("bad FONT record")
+	}
+	font := bytes.Clone(data[start:])
+	if flags&2 != 0 && xorLen > 0 {
+		key := data[xorStart : xorStart+xorLen]
+		for i := 0; i < min(len(font), 1040); i++ {
+			font[i] ^= key[i%xorLen]
+		}
+	}
+	if flags&1 != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(font))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		if font, err = io.ReadAll(io.LimitReader(zr, maxFontSize+1)); err != nil {
+			return nil, err
+		}
+		if len(font) > maxFontSize {
+			return nil, errors.New("font is too large")
+		}
+	}
+	if size > 0 && len(font) != size {
+		return nil, errors.New("font size mismatch")
+	}
+	return font, nil
+}
+
+func (r *kf8Reader) readGuide() error {
+
+	idx := getInt32(r.rec0, kf8GuideIndex)
+	if idx == nullIndex {
+		return nil
+	}
+	entries, strs, err := readIndex(r.section, idx)
+	if err != nil {
+		return fmt.Errorf("unable to read guide index: %w", err)
+	}
+	for _, e := range entries {
+		pos := e.tags[6]
+		if len(pos) < 2 {
+			// old style reference to NCX entry is not supported
+			continue
+		}
+		g := guideRef{kind: e.key, href: r.target(pos[0], pos[1])}
+		if v := e.tags[1]; len(v) > 0 {
+			g.title = strs[v[0]]
+		}
+		r.guide = append(r.guide, g)
+	}
+	return nil
+}
+
+func (r *kf8Reader) readNCX() error {
+
+	idx := getInt32(r.rec0, primaryIndex)
+	if idx == nullIndex {
+		return nil
+	}
+	entries, strs, err := readIndex(r.section, idx)
+	if err != nil {
+		return fmt.Errorf("unable to read NCX index: %w", err)
+	}
+	for _, e := range entries {
+		n := kf8NCXEntry{parent: nullIndex}
+		if v := e.tags[3]; len(v) > 0 {
+			n.label = strs[v[0]]
+		}
+		if v := e.tags[4]; len(v) > 0 {
+			n.depth = v[0]
+		}
+		if v := e.tags[21]; len(v) > 0 {
+			n.parent = v[0]
+		}
+		if v := e.tags[6]; len(v) > 1 {
+			n.fid, n.off = v[0], v[1]
+		} else if v := e.tags[1]; len(v) > 0 {
+			// position in text without fragment reference
+			n.fid, n.off = nullIndex, v[0]
+		}
+		r.ncx = append(r.ncx, n)
+	}
+	return nil
+}
+
+// partName returns name of the content document.
+func partName(n int) string {
+	return fmt.Sprintf("part%04d.xhtml", n)
+}
+
+// locate returns content document and the closest element id at or before the position in assembled text.
+func (r *kf8Reader) locate(pos int) (int, string) {
+
+	part := nullIndex
+	for i, p := range r.parts {
+		if pos >= p.start && pos < p.end {
+			part = i
+			break
+		}
+	}
+	if part == nullIndex {
+		if len(r.parts) == 0 || pos < r.parts[0].start {
+			return nullIndex, ""
+		}
+		// position at the very end of the text
+		part = len(r.parts) - 1
+	}
+
+	text := r.parts[part].text
+	ofs := min(max(pos-r.parts[part].start, 0), len(text))
+	// make sure tag starting at the position is included
+	if gt := bytes.IndexByte(text[ofs:], '>'); gt >= 0 {
+		if lt := bytes.IndexByte(text[ofs:], '<'); lt == 0 || gt < lt {
+			ofs += gt + 1
+		}
+	}
+	if ids := reKF8ID.FindAllSubmatch(text[:ofs], -1); len(ids) > 0 {
+		return part, string(ids[len(ids)-1][1])
+	}
+	return part, ""
+}
+
+// target returns link to position specified by fragment and offset in it.
+func (r *kf8Reader) target(fid, off int) string {
+
+	pos := off
+	if fid != nullIndex {
+		if fid >= len(r.chunks) {
+			return partName(0)
+		}
+		pos += r.chunks[fid].insert
+	}
+	part, id := r.locate(pos)
+	if part == nullIndex {
+		return partName(0)
+	}
+	if len(id) == 0 {
+		return partName(part)
+	}
+	return partName(part) + "#" + id
+}
+
+// rewrite replaces kindle references in content documents and stylesheets. Functions return new references for
+// resources and flows by their index.
+func (r *kf8Reader) rewrite(data []byte, embed, flow func(int) string) []byte {
+
+	data = reKF8Pos.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := reKF8Pos.FindSubmatch(m)
+		fid, _ := strconv.ParseInt(string(sub[1]), 32, 64)
+		off, _ := strconv.ParseInt(string(sub[2]), 32, 64)
+		return []byte(r.target(int(fid), int(off)))
+	})
+	data = reKF8Embed.ReplaceAllFunc(data, func(m []byte) []byte {
+		n, _ := strconv.ParseInt(string(reKF8Embed.FindSubmatch(m)[1]), 32, 64)
+		return []byte(embed(int(n)))
+	})
+	data = reKF8Flow.ReplaceAllFunc(data, func(m []byte) []byte {
+		n, _ := strconv.ParseInt(string(reKF8Flow.FindSubmatch(m)[1]), 32, 64)
+		return []byte(flow(int(n)))
+	})
+	return data
+}
@@ -0,0 +1,191 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// MOBI7 part of the book - single simplified HTML document for older devices. Internal links are expressed as byte
+// offsets in the text (filepos) and images are referenced by resource record number (recindex).
+
+type mobi7Book struct {
+	text  []byte
+	start int
+}
+
+type mobi7Link struct {
+	at     int
+	target string
+}
+
+type mobi7Writer struct {
+	bytes.Buffer
+	b         *Builder
+	base      string
+	positions map[string]int
+	links     []mobi7Link
+}
+
+func (b *Builder) buildMobi7(docs []*etree.Document) (*mobi7Book, error) {
+
+	w := &mobi7Writer{b: b, positions: make(map[string]int)}
+
+	w.WriteString("<html><head><guide>")
+	for _, g := range b.guide {
+		target := resolveHref("", g.href)
+		if file, _, _ := strings.Cut(target, "#"); !slices.Contains(b.spine, file) {
+			continue
+		}
+		w.WriteString(`<reference type="`)
+		escapeText(&w.Buffer, g.kind, true)
+		w.WriteString(`" title="`)
+		escapeText(&w.Buffer, g.title, true)
+		w.WriteString(`" `)
+		w.link(target)
+		w.WriteString(" />")
+	}
+	w.WriteString("</guide></head><body>")
+
+	for i, doc := range docs {
+		w.base = b.spine[i]
+		body := doc.FindElement("./html/body")
+		if body == nil {
+			return nil, fmt.Errorf("bad content document %s, no body", w.base)
+		}
+		if i > 0 {
+			w.WriteString("<mbp:pagebreak/>")
+		}
+		w.positions[w.base] = w.Len()
+		for _, t := range body.Child {
+			w.token(t)
+		}
+	}
+	w.WriteString("</body></html>")
+
+	text := w.Bytes()
+	for _, l := range w.links {
+		copy(text[l.at:], fmt.Sprintf("%010d", w.locate(l.target)))
+	}
+
+	m := &mobi7Book{text: text, start: w.positions[b.spine[0]]}
+	for _, g := range b.guide {
+		if g.kind == "text" {
+			if pos, ok := w.positions[resolveHref("", g.href)]; ok {
+				m.start = pos
+			}
+		}
+	}
+	return m, nil
+}
+
+// link writes filepos attribute with placeholder to be replaced when all positions are known.
+func (w *mobi7Writer) link(target string) {
+	w.WriteString("filepos=")
+	w.links = append(w.links, mobi7Link{at: w.Len(), target: target})
+	w.WriteString("0000000000")
+}
+
+func (w *mobi7Writer) locate(target string) int {
+	if pos, ok := w.positions[target]; ok {
+		return pos
+	}
+	file, _, _ := strings.Cut(target, "#")
+	if pos, ok := w.positions[file]; ok {
+		return pos
+	}
+	w.b.log.Debug("Unable to resolve link target, ignoring", zap.String("target", target))
+	return 0
+}
+
+func (w *mobi7Writer) token(t etree.Token) {
+	switch v := t.(type) {
+	case *etree.Element:
+		w.element(v)
+	case *etree.CharData:
+		escapeText(&w.Buffer, v.Data, false)
+	}
+}
+
+func (w *mobi7Writer) element(e *etree.Element) {
+
+	if id := e.SelectAttrValue("id", ""); len(id) > 0 {
+		if _, exists := w.positions[w.base+"#"+id]; !exists {
+			w.positions[w.base+"#"+id] = w.Len()
+		}
+	}
+
+	switch e.Tag {
+	case "img", "image":
+		src := e.SelectAttrValue("src", e.SelectAttrValue("xlink:href", e.SelectAttrValue("href", "")))
+		if idx, ok := w.b.resIndex[resolveHref(w.base, src)]; ok {
+			fmt.Fprintf(w, `<img recindex="%05d" />`, idx+1)
+		}
+	case "a":
+		href := e.SelectAttrValue("href", "")
+		switch {
+		case len(href) == 0:
+			w.WriteString("<a>")
+		case isExternalLink(href):
+			w.WriteString(`<a href="`)
+			escapeText(&w.Buffer, href, true)
+			w.WriteString(`">`)
+		default:
+			w.WriteString("<a ")
+			w.link(resolveHref(w.base, href))
+			w.WriteString(">")
+		}
+		w.children(e)
+		w.WriteString("</a>")
+	case "br", "hr":
+		fmt.Fprintf(w, "<%s/>", e.Tag)
+	case "head", "script", "style":
+	default:
+		if tag := mobi7Tag(e); len(tag) > 0 {
+			fmt.Fprintf(w, "<%s>", tag)
+			w.children(e)
+			fmt.Fprintf(w, "</%s>", tag)
+		} else {
+			w.children(e)
+		}
+	}
+	escapeText(&w.Buffer, e.TailData, false)
+}
+
+func (w *mobi7Writer) children(e *etree.Element) {
+	for _, c := range e.Child {
+		w.token(c)
+	}
+}
+
+// mobi7Tag maps XHTML element to the tag older devices understand, empty result means element should be dropped
+// keeping its content.
+func mobi7Tag(e *etree.Element) string {
+	class := e.SelectAttrValue("class", "")
+	switch e.Tag {
+	case "div":
+		if len(class) == 2 && class[0] == 'h' && class[1] >= '0' && class[1] <= '6' {
+			return "h" + string(max(class[1], '1'))
+		}
+		return "div"
+	case "span":
+		switch class {
+		case "strong":
+			return "b"
+		case "emphasis":
+			return "i"
+		case "strike":
+			return "s"
+		}
+		return ""
+	case "p", "h1", "h2", "h3", "h4", "h5", "h6", "b", "i", "u", "s", "em", "strong", "sub", "sup", "code", "pre",
+		"blockquote", "table", "tr", "td", "th", "ul", "ol", "li", "small", "big":
+		return e.Tag
+	}
+	return ""
+}
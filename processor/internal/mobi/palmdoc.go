@@ -0,0 +1,111 @@
+package mobi
+
+import (
+	"bytes"
+	"errors"
+)
+
+// PalmDoc (LZ77 variant) compression used for mobi text records.
+// Implementation follows calibre.ebooks.compression.palmdoc.
+
+const (
+	palmdocWindow   = 2047
+	palmdocMaxMatch = 10
+	palmdocMinMatch = 3
+)
+
+// compressPalmDoc compresses single text record (at most 4096 bytes).
+func compressPalmDoc(data []byte) []byte {
+
+	out := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); {
+
+		if i > palmdocMaxMatch && len(data)-i > palmdocMaxMatch {
+			start := max(0, i-palmdocWindow)
+			found := false
+			for n := palmdocMaxMatch; n >= palmdocMinMatch; n-- {
+				if m := bytes.LastIndex(data[start:i], data[i:i+n]); m >= 0 {
+					dist := i - (start + m)
+					code := 0x8000 + ((dist << 3) & 0x3ff8) + (n - palmdocMinMatch)
+					out = append(out, byte(code>>8), byte(code))
+					i += n
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+
+		ch := data[i]
+		i++
+
+		if ch == ' ' && i+1 < len(data) {
+			if next := data[i]; next >= 0x40 && next < 0x80 {
+				out = append(out, next^0x80)
+				i++
+				continue
+			}
+		}
+
+		if ch == 0 || (ch > 8 && ch < 0x80) {
+			out = append(out, ch)
+			continue
+		}
+
+		// sequence of bytes which has to be escaped
+		j := i
+		seq := []byte{ch}
+		for j < len(data) && len(seq) < 8 {
+			ch = data[j]
+			if ch == 0 || (ch > 8 && ch < 0x80) {
+				break
+			}
+			seq = append(seq, ch)
+			j++
+		}
+		out = append(out, byte(len(seq)))
+		out = append(out, seq...)
+		i += len(seq) - 1
+	}
+	return out
+}
+
+// decompressPalmDoc reverses compressPalmDoc.
+func decompressPalmDoc(data []byte) ([]byte, error) {
+
+	out := make([]byte, 0, 4096)
+
+	for i := 0; i < len(data); {
+		ch := data[i]
+		i++
+		switch {
+		case ch >= 1 && ch <= 8:
+			if i+int(ch) > len(data) {
+				return nil, errors.New("palmdoc: literal sequence out of range")
+			}
+			out = append(out, data[i:i+int(ch)]...)
+			i += int(ch)
+		case ch < 0x80:
+			out = append(out, ch)
+		case ch >= 0xc0:
+			out = append(out, ' ', ch^0x80)
+		default:
+			if i >= len(data) {
+				return nil, errors.New("palmdoc: truncated back reference")
+			}
+			code := int(ch)<<8 | int(data[i])
+			i++
+			dist, n := (code>>3)&0x7ff, (code&7)+palmdocMinMatch
+			if dist == 0 || dist > len(out) {
+				return nil, errors.New("palmdoc: back reference out of range")
+			}
+			for k := 0; k < n; k++ {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+	}
+	return out, nil
+}
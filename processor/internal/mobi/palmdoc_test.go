@@ -0,0 +1,56 @@
+package mobi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPalmDocRoundTrip(t *testing.T) {
+
+	inputs := [][]byte{
+		[]byte(""),
+		[]byte("a"),
+		[]byte("<p>Hello, world! Hello, world! Hello, world!</p>"),
+		[]byte(strings.Repeat("Ещё немного русского текста для проверки. ", 100))[:textRecordSize],
+		{0, 1, 2, 3, 8, 9, 0x7f, 0x80, 0xff, ' ', 'A', ' ', 0xc0},
+	}
+
+	for i, in := range inputs {
+		out, err := decompressPalmDoc(compressPalmDoc(in))
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("case %d: round trip mismatch\n%q\n%q", i, in, out)
+		}
+	}
+}
+
+func TestVarint(t *testing.T) {
+
+	for _, v := range []int{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 1 << 28} {
+		data := encodeVarint(v)
+		if got, n := decodeVarint(data); got != v || n != len(data) {
+			t.Fatalf("varint %d: got %d (%d bytes of %d)", v, got, n, len(data))
+		}
+	}
+}
+
+func TestBase32(t *testing.T) {
+
+	for _, c := range []struct {
+		n     int
+		width int
+		out   string
+	}{
+		{0, 4, "0000"},
+		{31, 4, "000V"},
+		{32, 4, "0010"},
+		{1234567, 10, "0000015LK7"},
+	} {
+		if got := toBase32(c.n, c.width); got != c.out {
+			t.Fatalf("base32 %d: expected %s, got %s", c.n, c.out, got)
+		}
+	}
+}
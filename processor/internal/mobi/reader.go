@@ -73,6 +73,10 @@ func (r *Reader) SaveResult(dir string) (bool, error) {
 func (r *Reader) produceThumbnail(data []byte) {
 
 	rec0 := readSection(data, 0)
+	if len(data) < firstPdbRecord || len(rec0) < firstRescRecord+4 {
+		r.log.Debug("Not a mobi book", zap.String("file", r.fname))
+		return
+	}
 
 	if getUInt16(rec0, cryptoType) != 0 {
 		r.log.Debug("Encrypted book", zap.String("file", r.fname))
@@ -84,10 +88,9 @@ func (r *Reader) produceThumbnail(data []byte) {
 		kfrec0 []byte
 	)
 
-	kf8off := readExth(rec0, exthKF8Offset)
-	if len(kf8off) > 0 {
-		// only pay attention to first KF8 offfset - there should only be one
-		if kf8 = getInt32(kf8off[0], 0); kf8 >= 0 {
+	// only pay attention to first KF8 offfset - there should only be one
+	if kf8off, ok := exthNumber(readExth(rec0, exthKF8Offset)); ok {
+		if kf8 = kf8off; kf8 >= 0 {
 			kfrec0 = readSection(data, kf8)
 		}
 	}
@@ -119,18 +122,14 @@ func (r *Reader) produceThumbnail(data []byte) {
 	}
 
 	firstimage := getInt32(rec0, firstRescRecord)
-	exthCover := readExth(rec0, exthCoverOffset)
 	coverIndex := -1
-	if len(exthCover) > 0 {
-		coverIndex = getInt32(exthCover[0], 0)
-		coverIndex += firstimage
+	if v, ok := exthNumber(readExth(rec0, exthCoverOffset)); ok {
+		coverIndex = v + firstimage
 	}
 
-	exthThumb := readExth(rec0, exthThumbOffset)
 	thumbIndex := -1
-	if len(exthThumb) > 0 {
-		thumbIndex = getInt32(exthThumb[0], 0)
-		thumbIndex += firstimage
+	if v, ok := exthNumber(readExth(rec0, exthThumbOffset)); ok {
+		thumbIndex = v + firstimage
 	}
 
 	if coverIndex >= 0 {
@@ -0,0 +1,462 @@
+package mobi
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// Unpacker - KF8 extractor, produces EPUB out of azw3 (or KF8 part of combo mobi) book.
+type Unpacker struct {
+	log   *zap.Logger
+	fname string
+	//
+	exth   []ExthValue
+	result []byte
+}
+
+// ExthValue is single EXTH record. Value is number for known numeric records, string for text and hex encoded
+// string for everything else.
+type ExthValue struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Value any    `json:"value"`
+}
+
+var exthNames = map[int]string{
+	100: "author", 101: "publisher", 102: "imprint", 103: "description", 104: "isbn", 105: "subject",
+	106: "publishingdate", 107: "review", 108: "contributor", 109: "rights", 110: "subjectcode", 111: "type",
+	112: "source", 113: "asin", 114: "versionnumber", 115: "sample", 116: "startreading", 117: "adult",
+	118: "retailprice", 119: "retailpricecurrency", 121: "kf8_boundary_offset", 122: "fixed-layout",
+	125: "kf8_resource_count", 129: "kf8_cover_uri", 131: "kf8_unknown_count", 200: "dictionary_short_name",
+	201: "coveroffset", 202: "thumboffset", 203: "hasfakecover", 204: "creator_software",
+	205: "creator_major_version", 206: "creator_minor_version", 207: "creator_build_number", 208: "watermark",
+	209: "tamper_proof_keys", 300: "fontsignature", 401: "clippinglimit", 402: "publisherlimit", 404: "ttsflag",
+	501: "cde_type", 502: "lastupdatetime", 503: "updatedtitle", 504: "asin", 524: "language",
+	525: "writingmode", 527: "pageprogressiondirection", 535: "creator_build_tag",
+}
+
+var exthNumbers = map[int]bool{
+	115: true, 116: true, 121: true, 125: true, 131: true, 201: true, 202: true, 203: true, 204: true,
+	205: true, 206: true, 207: true, 401: true, 404: true,
+}
+
+// NewUnpacker returns pointer to Unpacker with EPUB extracted from mobi file.
+func NewUnpacker(fname string, log *zap.Logger) (*Unpacker, error) {
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return unpack(data, fname, log)
+}
+
+// unpack produces EPUB out of book content.
+func unpack(data []byte, fname string, log *zap.Logger) (*Unpacker, error) {
+
+	r, err := newKF8Reader(data, log)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Unpacker{log: log, fname: fname}
+	u.readExth(r)
+	if u.result, err = u.produceEPUB(r); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Result returns produced EPUB.
+func (u *Unpacker) Result() []byte {
+	return u.result
+}
+
+// Exth returns EXTH metadata of the KF8 part.
+func (u *Unpacker) Exth() []ExthValue {
+	return u.exth
+}
+
+// SaveResult saves resulting EPUB to the requested location.
+func (u *Unpacker) SaveResult(fname string) error {
+	if len(u.result) == 0 {
+		return errors.New("nothing to save")
+	}
+	return os.WriteFile(fname, u.result, 0644)
+}
+
+// SaveExth saves EXTH metadata as JSON to the requested location.
+func (u *Unpacker) SaveExth(fname string) error {
+	data, err := json.MarshalIndent(u.exth, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fname, append(data, '\n'), 0644)
+}
+
+func (u *Unpacker) readExth(r *kf8Reader) {
+
+	if getInt32(r.rec0, 0x80)&0x40 == 0 {
+		return
+	}
+	ebase := mobiHeaderBase + getInt32(r.rec0, mobiHeaderLength)
+	if ebase < mobiHeaderBase || ebase+12 > len(r.rec0) {
+		return
+	}
+	enum := getInt32(r.rec0, ebase+8)
+	ebase += 12
+	for ; enum > 0 && ebase+8 <= len(r.rec0); enum-- {
+		id, size := getInt32(r.rec0, ebase), getInt32(r.rec0, ebase+4)
+		if size < 8 || ebase+size > len(r.rec0) {
+			break
+		}
+		data := r.rec0[ebase+8 : ebase+size]
+		v := ExthValue{ID: id, Name: exthNames[id]}
+		switch {
+		case exthNumbers[id] && len(data) == 4:
+			v.Value = getInt32(data, 0)
+		case exthNumbers[id] && len(data) == 1:
+			v.Value = int(data[0])
+		case utf8.Valid(data) && !bytes.ContainsRune(data, 0):
+			v.Value = string(data)
+		default:
+			v.Value = hex.EncodeToString(data)
+		}
+		u.exth = append(u.exth, v)
+		ebase += size
+	}
+}
+
+// text returns all values of textual EXTH record.
+func (u *Unpacker) text(id int) []string {
+	var res []string
+	for _, v := range u.exth {
+		if s, ok := v.Value.(string); ok && v.ID == id && len(strings.TrimSpace(s)) > 0 {
+			res = append(res, strings.TrimSpace(s))
+		}
+	}
+	return res
+}
+
+func (u *Unpacker) first(id int) string {
+	if v := u.text(id); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+const (
+	epubContentDir = "OEBPS"
+	epubTextDir    = "Text"
+	epubStyleDir   = "Styles"
+	epubImageDir   = "Images"
+	epubFontDir    = "Fonts"
+)
+
+type epubFile struct {
+	name, id, mediaType string
+	data                []byte
+}
+
+func (u *Unpacker) produceEPUB(r *kf8Reader) ([]byte, error) {
+
+	var files []*epubFile
+
+	// resources
+	names := make(map[int]string)
+	var coverID string
+	for _, res := range r.resources {
+		if res.index == r.thumb && res.index != r.cover {
+			continue
+		}
+		f := &epubFile{data: res.data, mediaType: res.mediaType}
+		if res.font {
+			f.id, f.name = fmt.Sprintf("font%05d", res.index), fmt.Sprintf("%s/font%05d.%s", epubFontDir, res.index, res.ext)
+		} else {
+			f.id, f.name = fmt.Sprintf("image%05d", res.index), fmt.Sprintf("%s/image%05d.%s", epubImageDir, res.index, res.ext)
+		}
+		if res.index == r.cover {
+			coverID = f.id
+		}
+		names[res.index] = f.name
+		files = append(files, f)
+	}
+
+	// flows other than text are stylesheets or svg images
+	flows := make(map[int]string)
+	var flowFiles []*epubFile
+	for i, data := range r.flows[1:] {
+		n := i + 1
+		f := &epubFile{data: data}
+		if bytes.Contains(data[:min(len(data), 1024)], []byte("<svg")) {
+			f.id, f.name, f.mediaType = fmt.Sprintf("svgimg%04d", n), fmt.Sprintf("%s/svgimg%04d.svg", epubImageDir, n), "image/svg+xml"
+		} else {
+			f.id, f.name, f.mediaType = fmt.Sprintf("style%04d", n), fmt.Sprintf("%s/style%04d.css", epubStyleDir, n), "text/css"
+		}
+		flows[n] = f.name
+		flowFiles = append(flowFiles, f)
+	}
+
+	embed := func(n int) string {
+		if name, ok := names[n]; ok {
+			return "../" + name
+		}
+		u.log.Debug("Unable to resolve embedded resource, ignoring", zap.Int("index", n))
+		return ""
+	}
+	flow := func(n int) string {
+		if name, ok := flows[n]; ok {
+			return "../" + name
+		}
+		u.log.Debug("Unable to resolve flow, ignoring", zap.Int("index", n))
+		return ""
+	}
+	for _, f := range flowFiles {
+		f.data = r.rewrite(f.data, embed, flow)
+	}
+	files = append(files, flowFiles...)
+
+	var spine []*epubFile
+	for i, p := range r.parts {
+		text := r.rewrite(p.text, embed, flow)
+		text = reKF8Aid.ReplaceAll(text, nil)
+		f := &epubFile{
+			id:        fmt.Sprintf("part%04d", i),
+			name:      epubTextDir + "/" + partName(i),
+			mediaType: "application/xhtml+xml",
+			data:      text,
+		}
+		spine = append(spine, f)
+	}
+	if len(spine) == 0 {
+		return nil, errors.New("book has no content")
+	}
+
+	ncx := u.produceNCX(r)
+	opf := u.produceOPF(r, spine, files, coverID)
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	add := func(name string, data []byte, method uint16) error {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	if err := add("mimetype", []byte("application/epub+zip"), zip.Store); err != nil {
+		return nil, err
+	}
+	if err := add("META-INF/container.xml", []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="`+epubContentDir+`/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`), zip.Deflate); err != nil {
+		return nil, err
+	}
+	if err := add(epubContentDir+"/content.opf", opf, zip.Deflate); err != nil {
+		return nil, err
+	}
+	if err := add(epubContentDir+"/toc.ncx", ncx, zip.Deflate); err != nil {
+		return nil, err
+	}
+	for _, f := range append(spine, files...) {
+		if err := add(epubContentDir+"/"+f.name, f.data, zip.Deflate); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// bookID returns identifier of the book, it is not stored in mobi so it is derived from content.
+func (u *Unpacker) bookID(r *kf8Reader) string {
+	return uuid.NewSHA1(uuid.Nil, r.text).String()
+}
+
+func (u *Unpacker) title(r *kf8Reader) string {
+	if t := u.first(exthTitle); len(t) > 0 {
+		return t
+	}
+	ofs, l := getInt32(r.rec0, titleOffset), getInt32(r.rec0, titleOffset+4)
+	if ofs > 0 && l > 0 && ofs+l <= len(r.rec0) {
+		return string(r.rec0[ofs : ofs+l])
+	}
+	return "Unknown"
+}
+
+func (u *Unpacker) language(r *kf8Reader) string {
+	if l := u.first(exthLanguage); len(l) > 0 {
+		return l
+	}
+	lcid := getInt32(r.rec0, titleOffset+8) & 0xff
+	res := ""
+	for lang, code := range languageCodes {
+		if code == lcid && (len(res) == 0 || lang < res) {
+			res = lang
+		}
+	}
+	if len(res) == 0 {
+		return "en"
+	}
+	return res
+}
+
+func (u *Unpacker) produceOPF(r *kf8Reader, spine, files []*epubFile, coverID string) []byte {
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	pkg := doc.CreateElement("package")
+	pkg.CreateAttr("version", "2.0")
+	pkg.CreateAttr("xmlns", "http://www.idpf.org/2007/opf")
+	pkg.CreateAttr("unique-identifier", "BookId")
+
+	meta := pkg.CreateElement("metadata")
+	meta.CreateAttr("xmlns:dc", "http://purl.org/dc/elements/1.1/")
+	meta.CreateAttr("xmlns:opf", "http://www.idpf.org/2007/opf")
+	meta.CreateElement("dc:title").SetText(u.title(r))
+	meta.CreateElement("dc:language").SetText(u.language(r))
+	id := meta.CreateElement("dc:identifier")
+	id.CreateAttr("id", "BookId")
+	id.CreateAttr("opf:scheme", "uuid")
+	id.SetText("urn:uuid:" + u.bookID(r))
+	if isbn := u.first(exthISBN); len(isbn) > 0 {
+		e := meta.CreateElement("dc:identifier")
+		e.CreateAttr("opf:scheme", "ISBN")
+		e.SetText(isbn)
+	}
+	if asin := u.first(exthASIN); len(asin) > 0 {
+		e := meta.CreateElement("dc:identifier")
+		e.CreateAttr("opf:scheme", "ASIN")
+		e.SetText(asin)
+	}
+	for _, a := range u.text(exthAuthor) {
+		e := meta.CreateElement("dc:creator")
+		e.CreateAttr("opf:role", "aut")
+		e.SetText(a)
+	}
+	for _, c := range u.text(exthContributor) {
+		meta.CreateElement("dc:contributor").SetText(c)
+	}
+	simple := []struct {
+		tag string
+		id  int
+	}{
+		{"dc:publisher", exthPublisher}, {"dc:description", exthDescription}, {"dc:date", exthPubDate}, {"dc:source", exthSource},
+	}
+	for _, s := range simple {
+		if v := u.first(s.id); len(v) > 0 {
+			meta.CreateElement(s.tag).SetText(v)
+		}
+	}
+	for _, s := range u.text(exthSubject) {
+		meta.CreateElement("dc:subject").SetText(s)
+	}
+	if len(coverID) > 0 {
+		e := meta.CreateElement("meta")
+		e.CreateAttr("name", "cover")
+		e.CreateAttr("content", coverID)
+	}
+
+	manifest := pkg.CreateElement("manifest")
+	item := func(id, href, mediaType string) {
+		e := manifest.CreateElement("item")
+		e.CreateAttr("id", id)
+		e.CreateAttr("href", href)
+		e.CreateAttr("media-type", mediaType)
+	}
+	item("ncx", "toc.ncx", "application/x-dtbncx+xml")
+	for _, f := range append(spine, files...) {
+		item(f.id, f.name, f.mediaType)
+	}
+
+	sp := pkg.CreateElement("spine")
+	sp.CreateAttr("toc", "ncx")
+	for _, f := range spine {
+		sp.CreateElement("itemref").CreateAttr("idref", f.id)
+	}
+
+	if len(r.guide) > 0 {
+		guide := pkg.CreateElement("guide")
+		for _, g := range r.guide {
+			e := guide.CreateElement("reference")
+			e.CreateAttr("type", g.kind)
+			e.CreateAttr("title", g.title)
+			e.CreateAttr("href", epubTextDir+"/"+g.href)
+		}
+	}
+
+	doc.Indent(2)
+	data, _ := doc.WriteToBytes()
+	return data
+}
+
+func (u *Unpacker) produceNCX(r *kf8Reader) []byte {
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	ncx := doc.CreateElement("ncx")
+	ncx.CreateAttr("xmlns", "http://www.daisy.org/z3986/2005/ncx/")
+	ncx.CreateAttr("version", "2005-1")
+
+	depth := 0
+	for _, n := range r.ncx {
+		depth = max(depth, n.depth+1)
+	}
+	head := ncx.CreateElement("head")
+	for _, m := range [][2]string{{"dtb:uid", "urn:uuid:" + u.bookID(r)}, {"dtb:depth", fmt.Sprint(max(depth, 1))}, {"dtb:totalPageCount", "0"}, {"dtb:maxPageNumber", "0"}} {
+		e := head.CreateElement("meta")
+		e.CreateAttr("name", m[0])
+		e.CreateAttr("content", m[1])
+	}
+	ncx.CreateElement("docTitle").CreateElement("text").SetText(u.title(r))
+
+	navMap := ncx.CreateElement("navMap")
+	points := make([]*etree.Element, len(r.ncx))
+	var children func(parent int, to *etree.Element)
+	order := 0
+	children = func(parent int, to *etree.Element) {
+		for i, n := range r.ncx {
+			if n.parent != parent || points[i] != nil {
+				continue
+			}
+			order++
+			np := to.CreateElement("navPoint")
+			np.CreateAttr("id", fmt.Sprintf("navpoint%d", order))
+			np.CreateAttr("playOrder", fmt.Sprint(order))
+			np.CreateElement("navLabel").CreateElement("text").SetText(n.label)
+			np.CreateElement("content").CreateAttr("src", epubTextDir+"/"+r.target(n.fid, n.off))
+			points[i] = np
+			children(i, np)
+		}
+	}
+	children(nullIndex, navMap)
+	if len(navMap.ChildElements()) == 0 {
+		np := navMap.CreateElement("navPoint")
+		np.CreateAttr("id", "navpoint1")
+		np.CreateAttr("playOrder", "1")
+		np.CreateElement("navLabel").CreateElement("text").SetText(u.title(r))
+		np.CreateElement("content").CreateAttr("src", epubTextDir+"/"+partName(0))
+	}
+
+	doc.Indent(2)
+	data, _ := doc.WriteToBytes()
+	return data
+}
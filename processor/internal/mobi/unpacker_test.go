@@ -0,0 +1,269 @@
+package mobi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	unpackPNG = "iVBORw0KGgoAAAANSUhEUgAAAAQAAAAECAIAAAAmkwkpAAAAEElEQVR4nGP4z8AARwzEcQCukw/x0F8jngAAAABJRU5ErkJggg=="
+
+	unpackOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="BookId">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Unpack test</dc:title>
+    <dc:language>ru</dc:language>
+    <dc:identifier id="BookId">urn:uuid:0b4a7f34-7d4e-4b76-9a3c-3a4c5e6f7a8b</dc:identifier>
+    <dc:creator opf:role="aut">Иван Иванов</dc:creator>
+    <dc:publisher>Test House</dc:publisher>
+    <meta name="cover" content="cover"/>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+    <item id="cover" href="cover.png" media-type="image/png"/>
+    <item id="pic" href="pic.png" media-type="image/png"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+  <guide>
+    <reference type="text" title="Start" href="ch1.xhtml"/>
+  </guide>
+</package>`
+
+	unpackNCX = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="np1" playOrder="1">
+      <navLabel><text>Chapter one</text></navLabel>
+      <content src="ch1.xhtml"/>
+      <navPoint id="np2" playOrder="2">
+        <navLabel><text>Part two</text></navLabel>
+        <content src="ch1.xhtml#p2"/>
+      </navPoint>
+    </navPoint>
+    <navPoint id="np3" playOrder="3">
+      <navLabel><text>Chapter two</text></navLabel>
+      <content src="ch2.xhtml"/>
+    </navPoint>
+  </navMap>
+</ncx>`
+
+	unpackCh1 = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Chapter one</title><link rel="stylesheet" type="text/css" href="style.css"/></head>
+<body>
+<h1>Chapter one</h1>
+<p>First paragraph, see <a href="ch2.xhtml#target">there</a>.</p>
+<div id="p2"><p>Second part.</p><img src="pic.png" alt="pic"/></div>
+</body>
+</html>`
+
+	unpackCh2 = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Chapter two</title><link rel="stylesheet" type="text/css" href="style.css"/></head>
+<body>
+<h1>Chapter two</h1>
+<p id="target">Target paragraph.</p>
+</body>
+</html>`
+)
+
+// writeUnpackSources writes test OEBPS sources to temporary directory and returns name of OPF.
+func writeUnpackSources(tb testing.TB) string {
+
+	tb.Helper()
+
+	dir := tb.TempDir()
+	png, err := base64.StdEncoding.DecodeString(unpackPNG)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"content.opf": []byte(unpackOPF),
+		"toc.ncx":     []byte(unpackNCX),
+		"style.css":   []byte("p { text-indent: 1em; }\n"),
+		"cover.png":   png,
+		"pic.png":     png,
+		"ch1.xhtml":   []byte(unpackCh1),
+		"ch2.xhtml":   []byte(unpackCh2),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "content.opf")
+}
+
+// buildUnpackBook builds combo mobi out of test sources and returns its name.
+func buildUnpackBook(tb testing.TB) string {
+
+	tb.Helper()
+
+	opf := writeUnpackSources(tb)
+	b, err := NewBuilder(context.Background(), opf, true, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), zap.NewNop())
+	if err != nil {
+		tb.Fatalf("build: %v", err)
+	}
+	book := filepath.Join(filepath.Dir(opf), "book.mobi")
+	if err := b.SaveResult(book); err != nil {
+		tb.Fatal(err)
+	}
+	return book
+}
+
+// epubFiles returns content of every file in EPUB produced by unpacker.
+func epubFiles(t *testing.T, epub []byte) map[string]string {
+
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(epub), int64(len(epub)))
+	if err != nil {
+		t.Fatalf("result is not zip: %v", err)
+	}
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Fatal("mimetype must be first stored entry")
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestUnpackKF8(t *testing.T) {
+
+	log := zap.NewNop()
+	book := buildUnpackBook(t)
+
+	u, err := NewUnpacker(book, log)
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+
+	files := epubFiles(t, u.Result())
+
+	for _, name := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/Styles/style0001.css"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("%s is missing", name)
+		}
+	}
+
+	var parts, images int
+	for name := range files {
+		switch {
+		case strings.HasPrefix(name, "OEBPS/Text/"):
+			parts++
+		case strings.HasPrefix(name, "OEBPS/Images/"):
+			images++
+		}
+	}
+	if parts != 2 {
+		t.Fatalf("expected 2 text parts, got %d", parts)
+	}
+	if images != 2 {
+		t.Fatalf("expected 2 images (thumbnail skipped), got %d", images)
+	}
+
+	ch1, ch2 := files["OEBPS/Text/part0000.xhtml"], files["OEBPS/Text/part0001.xhtml"]
+	if !strings.Contains(ch1, `href="part0001.xhtml#target"`) {
+		t.Fatalf("link was not resolved:\n%s", ch1)
+	}
+	if !strings.Contains(ch1, `src="../Images/`) || !strings.Contains(ch1, `href="../Styles/style0001.css"`) {
+		t.Fatalf("resource references were not resolved:\n%s", ch1)
+	}
+	if strings.Contains(ch1, "kindle:") || strings.Contains(ch1, "aid=") {
+		t.Fatalf("kindle markup left in text:\n%s", ch1)
+	}
+	if !strings.Contains(ch2, `id="target"`) || !strings.Contains(ch2, "Target paragraph.") {
+		t.Fatalf("unexpected second part:\n%s", ch2)
+	}
+
+	opf := files["OEBPS/content.opf"]
+	for _, s := range []string{"Unpack test", "Иван Иванов", "Test House", "<dc:language>ru</dc:language>", `name="cover"`} {
+		if !strings.Contains(opf, s) {
+			t.Fatalf("%q is missing from OPF:\n%s", s, opf)
+		}
+	}
+
+	ncx := files["OEBPS/toc.ncx"]
+	for _, s := range []string{"Chapter one", "Part two", "Chapter two", "part0000.xhtml#p2"} {
+		if !strings.Contains(ncx, s) {
+			t.Fatalf("%q is missing from NCX:\n%s", s, ncx)
+		}
+	}
+	if strings.Index(ncx, "Part two") > strings.Index(ncx, "Chapter two") {
+		t.Fatalf("NCX order is broken:\n%s", ncx)
+	}
+
+	var title bool
+	for _, v := range u.Exth() {
+		if v.ID == 503 && v.Value == "Unpack test" {
+			title = true
+		}
+	}
+	if !title {
+		t.Fatalf("EXTH updated title is missing: %+v", u.Exth())
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+
+	tags := []tagMeta{
+		{name: "cncx_offset", number: 2, values: 1, mask: 1},
+		{name: "file_number", number: 3, values: 1, mask: 2},
+		{name: "geometry", number: 6, values: 2, mask: 8},
+		endTagTable,
+	}
+	strs := newCNCX([]string{"P-//*[@aid='0']", "P-//*[@aid='1']"})
+	entries := []indexEntry{
+		{key: "0000000100", tags: map[string][]int{"cncx_offset": {strs.offsets["P-//*[@aid='0']"]}, "file_number": {0}, "geometry": {0, 10}}},
+		{key: "0000000300", tags: map[string][]int{"cncx_offset": {strs.offsets["P-//*[@aid='1']"]}, "file_number": {1}, "geometry": {10, 20}}},
+	}
+	records := buildIndex(tags, entries, strs)
+
+	got, cncx, err := readIndex(func(n int) ([]byte, error) { return records[n], nil }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(got))
+	}
+	for i, e := range entries {
+		if got[i].key != e.key {
+			t.Fatalf("entry %d: expected key %s, got %s", i, e.key, got[i].key)
+		}
+		for _, tag := range tags[:len(tags)-1] {
+			if !slices.Equal(got[i].tags[tag.number], e.tags[tag.name]) {
+				t.Fatalf("entry %d tag %d: expected %v, got %v", i, tag.number, e.tags[tag.name], got[i].tags[tag.number])
+			}
+		}
+	}
+	if s := cncx[strs.offsets["P-//*[@aid='1']"]]; s != "P-//*[@aid='1']" {
+		t.Fatalf("CNCX string was not read back: %v", cncx)
+	}
+}
@@ -131,26 +131,44 @@ func getExthParams(rec0 []byte) (int, int, int) {
 	return ebase, getInt32(rec0, ebase+4), getInt32(rec0, ebase+8)
 }
 
+// readExth returns values of EXTH record. Damaged EXTH header is treated as missing and reading stops at the
+// first damaged record.
 func readExth(rec0 []byte, recnum int) [][]byte {
 
-	var values [][]byte
-
-	ebase, _, enum := getExthParams(rec0)
+	if len(rec0) < mobiHeaderLength+4 {
+		return nil
+	}
+	ebase := mobiHeaderBase + getInt32(rec0, mobiHeaderLength)
+	if ebase < mobiHeaderBase || ebase+12 > len(rec0) || !bytes.Equal(rec0[ebase:ebase+4], []byte("EXTH")) {
+		return nil
+	}
+	enum := getInt32(rec0, ebase+8)
 	ebase += 12
 
-	for enum > 0 {
+	var values [][]byte
+	for ; enum > 0 && ebase+8 <= len(rec0); enum-- {
 		exthID := getInt32(rec0, ebase)
 		exthLen := getInt32(rec0, ebase+4)
+		if exthLen < 8 || exthLen > len(rec0)-ebase {
+			break
+		}
 		if exthID == recnum {
 			// We might have multiple exths, so build a list.
 			values = append(values, rec0[ebase+8:ebase+exthLen])
 		}
-		enum--
 		ebase += exthLen
 	}
 	return values
 }
 
+// exthNumber returns value of the first numeric EXTH record.
+func exthNumber(values [][]byte) (int, bool) {
+	if len(values) == 0 || len(values[0]) < 4 {
+		return 0, false
+	}
+	return getInt32(values[0], 0), true
+}
+
 func writeExth(rec0 []byte, recnum int, data []byte) []byte {
 
 	var newrec0 bytes.Buffer
@@ -232,8 +250,29 @@ func delExth(rec0 []byte, recnum int) []byte {
 	return rec0
 }
 
-func readSection(data []byte, secno int) []byte {
+// sectionAddr is getSectionAddr for data which could be damaged, it reports if section boundaries make sense.
+func sectionAddr(data []byte, secno int) (int, int, bool) {
+
+	if len(data) < firstPdbRecord {
+		return 0, 0, false
+	}
+	nsec := getUInt16(data, numberOfPdbRecords)
+	if secno < 0 || secno >= nsec || firstPdbRecord+nsec*8 > len(data) {
+		return 0, 0, false
+	}
 	start, end := getSectionAddr(data, secno)
+	if start < 0 || start > end || end > len(data) {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// readSection returns section content, sections which do not exist or are damaged are empty.
+func readSection(data []byte, secno int) []byte {
+	start, end, ok := sectionAddr(data, secno)
+	if !ok {
+		return nil
+	}
 	return data[start:end]
 }
 
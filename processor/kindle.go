@@ -0,0 +1,294 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor/internal/mobi"
+	"fb2converter/state"
+)
+
+// KindleBackend turns prepared OEBPS directory into kindle content. Result is expected to be joint (KF7 and KF8) mobi
+// file, similar to what kindlegen produces, it is later split and optimized according to requested output format.
+type KindleBackend interface {
+	// Name is used for diagnostics.
+	Name() string
+	// Build produces file with requested name in directory dir, which has content.opf, and returns its full path.
+	// Building stops with context error when ctx is canceled.
+	Build(ctx gocontext.Context, dir, name string) (string, error)
+}
+
+// KindleToolValues are available for expansion in external program arguments.
+type KindleToolValues struct {
+	OPF         string
+	Dir         string
+	Output      string
+	Compression int
+	Verbose     bool
+}
+
+// calibreDefaultArgs are used when no arguments for ebook-convert are configured.
+var calibreDefaultArgs = []string{"{{.OPF}}", "{{.Output}}", "--mobi-file-type=both", "{{if eq .Compression 0}}--dont-compress{{end}}"}
+
+// commandDefaultArgs are used when no arguments for external command are configured.
+var commandDefaultArgs = []string{"{{.OPF}}", "{{.Output}}"}
+
+// NewKindleBackend returns backend for requested engine. EngineAuto selects kindlegen when it could be found and native
+// builder otherwise. Native builder stores time returned by "created" in resulting file.
+func NewKindleBackend(engine KindleEngine, created func() time.Time, env *state.LocalEnv) (KindleBackend, error) {
+
+	cfg := &env.Cfg.Doc.Kindlegen
+
+	switch engine {
+	case EngineAuto:
+		path, err := env.Cfg.GetKindlegenPath()
+		if err != nil {
+			env.Log.Debug("Kindlegen is not available, using native engine", zap.Error(err))
+			return &nativeBackend{compress: cfg.CompressionLevel > 0, created: created, log: env.Log}, nil
+		}
+		return &kindlegenBackend{path: path, compression: cfg.CompressionLevel, verbose: cfg.Verbose, log: env.Log}, nil
+	case EngineKindlegen:
+		// Fail early
+		path, err := env.Cfg.GetKindlegenPath()
+		if err != nil {
+			return nil, err
+		}
+		return &kindlegenBackend{path: path, compression: cfg.CompressionLevel, verbose: cfg.Verbose, log: env.Log}, nil
+	case EngineNative:
+		return &nativeBackend{compress: cfg.CompressionLevel > 0, created: created, log: env.Log}, nil
+	case EngineCalibre:
+		return newToolBackend("ebook-convert", cfg.Calibre, calibreDefaultArgs, cfg.CompressionLevel, cfg.Verbose, env.Log)
+	case EngineCommand:
+		if len(cfg.Command.Path) == 0 {
+			return nil, errors.New("command kindle engine requested, but no command path is configured")
+		}
+		return newToolBackend("", cfg.Command, commandDefaultArgs, cfg.CompressionLevel, cfg.Verbose, env.Log)
+	}
+	return nil, fmt.Errorf("unsupported kindle engine %s", engine)
+}
+
+// nativeBackend builds mobi without any external programs.
+type nativeBackend struct {
+	compress bool
+	created  func() time.Time
+	log      *zap.Logger
+}
+
+func (b *nativeBackend) Name() string {
+	return EngineNative.String()
+}
+
+func (b *nativeBackend) Build(ctx gocontext.Context, dir, name string) (string, error) {
+
+	builder, err := mobi.NewBuilder(ctx, filepath.Join(dir, "content.opf"), b.compress, b.created(), b.log)
+	if err != nil {
+		return "", fmt.Errorf("unable to build mobi: %w", err)
+	}
+	result := filepath.Join(dir, name)
+	if err := builder.SaveResult(result); err != nil {
+		return "", fmt.Errorf("unable to save mobi: %w", err)
+	}
+	return result, nil
+}
+
+// kindlegenBackend runs Amazon's kindlegen.
+type kindlegenBackend struct {
+	path        string
+	compression int
+	verbose     bool
+	log         *zap.Logger
+}
+
+func (b *kindlegenBackend) Name() string {
+	return EngineKindlegen.String()
+}
+
+func (b *kindlegenBackend) Build(ctx gocontext.Context, dir, name string) (string, error) {
+
+	args := make([]string, 0, 10)
+	args = append(args, filepath.Join(dir, "content.opf"))
+	args = append(args, fmt.Sprintf("-c%d", b.compression))
+	args = append(args, "-locale", "en")
+	if b.verbose {
+		args = append(args, "-verbose")
+	}
+	args = append(args, "-o", name)
+
+	cmd := exec.CommandContext(ctx, b.path, args...)
+
+	b.log.Debug("kindlegen staring")
+	defer func(start time.Time) {
+		b.log.Debug("kindlegen done",
+			zap.Duration("elapsed", time.Since(start)),
+			zap.String("path", cmd.Path),
+			zap.Strings("args", args),
+		)
+	}(time.Now())
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("unable to redirect kindlegen stdout: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("unable to start kindlegen: %w", err)
+	}
+
+	// read and print kindlegen stdout
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		b.log.Debug(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("kindlegen stdout pipe broken: %w", err)
+	}
+
+	result := filepath.Join(dir, name)
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			// kindlegen was killed
+			return "", ctx.Err()
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			if len(ee.Stderr) > 0 {
+				b.log.Error("kindlegen", zap.String("stderr", string(ee.Stderr)), zap.Error(err))
+			}
+			ws := ee.Sys().(syscall.WaitStatus)
+			switch ws.ExitStatus() {
+			case 1:
+				// warnings
+				b.log.Warn("kindlegen has some warnings, see log for details")
+				fallthrough
+			case 0:
+				// success
+				if _, err := os.Stat(result); err != nil {
+					// kindlegen lied
+					return "", fmt.Errorf("kindlegen did not return an error, but there is no content %s: %w", result, err)
+				}
+			case 2:
+				// error - unable to create mobi
+				fallthrough
+			default:
+				return "", fmt.Errorf("kindlegen returned error: %w", err)
+			}
+		} else {
+			return "", fmt.Errorf("kindlegen returned error: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// toolBackend runs external program with configured argument templates, calibre's ebook-convert is one of them.
+type toolBackend struct {
+	path        string
+	args        []*template.Template
+	compression int
+	verbose     bool
+	log         *zap.Logger
+}
+
+func newToolBackend(program string, tool config.KindleTool, defaultArgs []string, compression int, verbose bool, log *zap.Logger) (*toolBackend, error) {
+
+	path := tool.Path
+	if len(path) == 0 {
+		path = program
+	}
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find kindle content builder: %w", err)
+	}
+
+	args := tool.Args
+	if len(args) == 0 {
+		args = defaultArgs
+	}
+
+	b := &toolBackend{path: path, compression: compression, verbose: verbose, log: log}
+	for i, arg := range args {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad argument template %q: %w", arg, err)
+		}
+		b.args = append(b.args, t)
+	}
+	return b, nil
+}
+
+func (b *toolBackend) Name() string {
+	return filepath.Base(b.path)
+}
+
+func (b *toolBackend) Build(ctx gocontext.Context, dir, name string) (string, error) {
+
+	result := filepath.Join(dir, name)
+	values := KindleToolValues{
+		OPF:         filepath.Join(dir, "content.opf"),
+		Dir:         dir,
+		Output:      result,
+		Compression: b.compression,
+		Verbose:     b.verbose,
+	}
+
+	args := make([]string, 0, len(b.args))
+	for _, t := range b.args {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, values); err != nil {
+			return "", fmt.Errorf("unable to expand argument template: %w", err)
+		}
+		if arg := strings.TrimSpace(buf.String()); len(arg) > 0 {
+			args = append(args, arg)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, b.path, args...)
+	cmd.Dir = dir
+
+	b.log.Debug("Running kindle content builder", zap.String("path", cmd.Path), zap.Strings("args", args))
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("unable to redirect %s stdout: %w", b.Name(), err)
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("unable to start %s: %w", b.Name(), err)
+	}
+
+	// keep last lines of output for error reporting
+	var tail []string
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		b.log.Debug(scanner.Text())
+		if tail = append(tail, scanner.Text()); len(tail) > 5 {
+			tail = tail[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("%s output pipe broken: %w", b.Name(), err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%s returned error: %w (%s)", b.Name(), err, strings.Join(tail, "; "))
+	}
+	if _, err := os.Stat(result); err != nil {
+		return "", fmt.Errorf("%s did not return an error, but there is no content %s: %w", b.Name(), result, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+func convertKindle(t *testing.T, format OutputFmt, setup func(cfg *config.Config)) (string, error) {
+
+	t.Helper()
+
+	p, err := newTestProcessor(t, strings.NewReader(fb2Text), false, format, func(cfg *config.Config) {
+		cfg.Doc.Vignettes.Create = false
+		setup(cfg)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+	return p.Save()
+}
+
+func TestKindleCommandBackend(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses shell script")
+	}
+
+	// joint mobi produced by native builder and left untouched plays the role of external program result
+	joint, err := convertKindle(t, OMobi, func(cfg *config.Config) {
+		cfg.Doc.Kindlegen.Engine = EngineNative.String()
+		cfg.Doc.Kindlegen.NoOptimization = true
+	})
+	if err != nil {
+		t.Fatalf("Unable to produce joint mobi: %v", err)
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "builder.sh")
+	record := filepath.Join(dir, "args.txt")
+	if err := os.WriteFile(script, fmt.Appendf(nil, `#!/bin/sh
+echo "$@" > '%s'
+test -f "$1" || { echo "no opf: $1"; exit 3; }
+cp '%s' "$3"
+`, record, joint), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []OutputFmt{OMobi, OAzw3} {
+		t.Run(format.String(), func(t *testing.T) {
+			fname, err := convertKindle(t, format, func(cfg *config.Config) {
+				cfg.Doc.Kindlegen.Engine = EngineCommand.String()
+				cfg.Doc.Kindlegen.Command = config.KindleTool{
+					Path: script,
+					Args: []string{"{{.OPF}}", "{{if .Verbose}}-v{{end}}", "-c{{.Compression}}", "{{.Output}}"},
+				}
+			})
+			if err != nil {
+				t.Fatalf("Unable to convert: %v", err)
+			}
+			data, err := os.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) < 68 || !bytes.Equal(data[60:68], []byte("BOOKMOBI")) {
+				t.Fatalf("Result is not a mobi file: %s", fname)
+			}
+			args, err := os.ReadFile(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fields := strings.Fields(string(args)); len(fields) != 3 || filepath.Base(fields[0]) != "content.opf" || fields[1] != "-c1" || filepath.Base(fields[2]) != "book.mobi" {
+				t.Fatalf("Unexpected program arguments: %s", args)
+			}
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		_, err := convertKindle(t, OAzw3, func(cfg *config.Config) {
+			cfg.Doc.Kindlegen.Engine = EngineCommand.String()
+			cfg.Doc.Kindlegen.Command = config.KindleTool{Path: script, Args: []string{"missing.opf"}}
+		})
+		if err == nil || !strings.Contains(err.Error(), "no opf: missing.opf") {
+			t.Fatalf("Expected error with program output, got %v", err)
+		}
+	})
+
+	t.Run("no command", func(t *testing.T) {
+		_, err := convertKindle(t, OAzw3, func(cfg *config.Config) {
+			cfg.Doc.Kindlegen.Engine = EngineCommand.String()
+		})
+		if err == nil {
+			t.Fatal("Expected error when no command is configured")
+		}
+	})
+}
@@ -0,0 +1,500 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+
+	"fb2converter/etree"
+)
+
+// Severity of the problem found in the book.
+type Severity string
+
+// Severities
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a single problem found in the book.
+type Finding struct {
+	Path     string   `json:"path"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Lint checks FB2 document against FictionBook 2.x schema rules: required elements, allowed nesting, id/href integrity
+// and binaries content. Malformed documents are reported as findings too, only read errors are returned.
+func Lint(r io.Reader, unknownEncoding bool) ([]Finding, error) {
+
+	doc := etree.NewDocument()
+	r, err := prepareReadSettings(doc, r, unknownEncoding, "", zap.NewNop())
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{
+		ids:        make(map[string]bool),
+		binaries:   make(map[string]string),
+		referenced: make(map[string]bool),
+	}
+
+	// document parsing is forgiving, so check that XML is well-formed first
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.CharsetReader = doc.ReadSettings.CharsetReader
+	dec.Entity = doc.ReadSettings.Entity
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			l.findings = append(l.findings, Finding{Path: "/", Severity: SeverityError, Message: fmt.Sprintf("malformed XML: %v", err)})
+			break
+		}
+	}
+
+	if _, err := doc.ReadFrom(bytes.NewReader(data)); err != nil {
+		l.findings = append(l.findings, Finding{Path: "/", Severity: SeverityError, Message: fmt.Sprintf("unable to parse FB2: %v", err)})
+		return l.findings, nil
+	}
+	l.lint(doc)
+	return l.findings, nil
+}
+
+// Allowed content of FictionBook elements, inline elements are allowed in text elements.
+var (
+	fb2Inline  = []string{"strong", "emphasis", "style", "a", "strikethrough", "sub", "sup", "code", "image"}
+	fb2Content = map[string][]string{
+		"body":          {"image", "title", "epigraph", "section"},
+		"section":       {"title", "epigraph", "image", "annotation", "section", "p", "poem", "subtitle", "cite", "empty-line", "table"},
+		"title":         {"p", "empty-line"},
+		"epigraph":      {"p", "poem", "cite", "empty-line", "text-author"},
+		"annotation":    {"p", "poem", "cite", "subtitle", "empty-line", "table"},
+		"cite":          {"p", "poem", "subtitle", "empty-line", "table", "text-author"},
+		"poem":          {"title", "epigraph", "stanza", "text-author", "date"},
+		"stanza":        {"title", "subtitle", "v"},
+		"table":         {"tr"},
+		"tr":            {"th", "td"},
+		"p":             fb2Inline,
+		"v":             fb2Inline,
+		"subtitle":      fb2Inline,
+		"text-author":   fb2Inline,
+		"th":            fb2Inline,
+		"td":            fb2Inline,
+		"date":          nil,
+		"strong":        fb2Inline,
+		"emphasis":      fb2Inline,
+		"style":         fb2Inline,
+		"strikethrough": fb2Inline,
+		"sub":           fb2Inline,
+		"sup":           fb2Inline,
+		"code":          fb2Inline,
+		"a":             {"strong", "emphasis", "style", "strikethrough", "sub", "sup", "code", "image"},
+		"image":         nil,
+		"empty-line":    nil,
+	}
+	// elements converter understands, but schema does not have
+	fb2NonStandard = map[string]string{"b": "strong", "i": "emphasis", "span": "style"}
+	// section content when section has no subsections
+	fb2SectionText = []string{"p", "poem", "subtitle", "cite", "empty-line", "table"}
+	// elements which should not have text of their own
+	fb2Structural = []string{"body", "section", "title", "epigraph", "annotation", "cite", "poem", "stanza", "table", "tr"}
+)
+
+type linkRef struct {
+	path   string
+	target string
+	image  bool
+}
+
+type linter struct {
+	findings   []Finding
+	ids        map[string]bool
+	binaries   map[string]string // binary id -> path
+	links      []linkRef
+	referenced map[string]bool
+}
+
+func (l *linter) report(e *etree.Element, sev Severity, format string, args ...any) {
+	l.findings = append(l.findings, Finding{Path: xpath(e), Severity: sev, Message: fmt.Sprintf(format, args...)})
+}
+
+// xpath returns position of the element in the document.
+func xpath(e *etree.Element) string {
+	if e == nil {
+		return "/"
+	}
+	var parts []string
+	for ; e != nil && len(e.Tag) > 0; e = e.Parent() {
+		p := e.Parent()
+		if p == nil || len(p.Tag) == 0 {
+			parts = append(parts, e.Tag)
+			break
+		}
+		n := 1
+		for _, c := range p.ChildElements() {
+			if c == e {
+				break
+			}
+			if c.Tag == e.Tag {
+				n++
+			}
+		}
+		parts = append(parts, e.Tag+"["+strconv.Itoa(n)+"]")
+	}
+	slices.Reverse(parts)
+	return "/" + strings.Join(parts, "/")
+}
+
+func (l *linter) lint(doc *etree.Document) {
+
+	root := doc.Root()
+	if root == nil || root.Tag != "FictionBook" {
+		l.report(root, SeverityError, "root element must be FictionBook")
+		return
+	}
+	if ns := root.SelectAttrValue("xmlns", ""); ns != "http://www.gribuser.ru/xml/fictionbook/2.0" {
+		l.report(root, SeverityWarning, "unexpected FictionBook namespace %q", ns)
+	}
+
+	var descriptions, bodies []*etree.Element
+	for _, e := range root.ChildElements() {
+		switch e.Tag {
+		case "description":
+			descriptions = append(descriptions, e)
+		case "body":
+			bodies = append(bodies, e)
+		case "binary", "stylesheet":
+		default:
+			l.report(e, SeverityError, "unexpected element <%s> in FictionBook", e.Tag)
+		}
+	}
+
+	// ids first, so links could be checked anywhere
+	l.collect(root)
+
+	switch len(descriptions) {
+	case 0:
+		l.report(root, SeverityError, "description is missing")
+	case 1:
+		l.description(descriptions[0])
+	default:
+		l.report(descriptions[1], SeverityError, "multiple descriptions")
+	}
+
+	if len(bodies) == 0 {
+		l.report(root, SeverityError, "body is missing")
+	}
+	for i, b := range bodies {
+		if i > 0 && len(b.SelectAttrValue("name", "")) == 0 {
+			l.report(b, SeverityWarning, "additional body has no name")
+		}
+		if b.SelectElement("section") == nil {
+			l.report(b, SeverityError, "body has no sections")
+		}
+		l.content(b)
+	}
+
+	for _, e := range root.SelectElements("binary") {
+		l.binary(e)
+	}
+
+	l.resolve(bodies)
+}
+
+// collect walks whole document remembering ids and links.
+func (l *linter) collect(e *etree.Element) {
+
+	if id := e.SelectAttrValue("id", ""); len(id) > 0 {
+		if l.ids[id] {
+			l.report(e, SeverityError, "duplicate id %q", id)
+		}
+		l.ids[id] = true
+	}
+
+	switch e.Tag {
+	case "a":
+		href := getAttrValue(e, "href")
+		switch {
+		case len(href) == 0:
+			l.report(e, SeverityWarning, "link has no href")
+		case strings.HasPrefix(href, "#"):
+			l.links = append(l.links, linkRef{path: xpath(e), target: href[1:]})
+		}
+	case "image":
+		href := getAttrValue(e, "href")
+		switch {
+		case len(href) == 0:
+			l.report(e, SeverityError, "image has no href")
+		case strings.HasPrefix(href, "#"):
+			l.links = append(l.links, linkRef{path: xpath(e), target: href[1:], image: true})
+		default:
+			l.report(e, SeverityWarning, "external image %q will not be included", href)
+		}
+	}
+
+	for _, c := range e.ChildElements() {
+		l.collect(c)
+	}
+}
+
+func (l *linter) description(desc *etree.Element) {
+
+	for _, e := range desc.ChildElements() {
+		switch e.Tag {
+		case "title-info", "src-title-info", "document-info", "publish-info", "custom-info", "output":
+		default:
+			l.report(e, SeverityError, "unexpected element <%s> in description", e.Tag)
+		}
+	}
+
+	switch infos := desc.SelectElements("title-info"); len(infos) {
+	case 0:
+		l.report(desc, SeverityError, "title-info is missing")
+	case 1:
+		l.titleInfo(infos[0])
+	default:
+		l.report(infos[1], SeverityError, "multiple title-info elements")
+	}
+	if info := desc.SelectElement("src-title-info"); info != nil {
+		l.titleInfo(info)
+	}
+
+	info := desc.SelectElement("document-info")
+	if info == nil {
+		l.report(desc, SeverityWarning, "document-info is missing")
+		return
+	}
+	if len(info.SelectElements("author")) == 0 {
+		l.report(info, SeverityWarning, "document-info has no author")
+	}
+	for _, name := range []string{"date", "version"} {
+		if info.SelectElement(name) == nil {
+			l.report(info, SeverityWarning, "document-info has no %s", name)
+		}
+	}
+	if e := info.SelectElement("id"); e == nil || len(strings.TrimSpace(e.Text())) == 0 {
+		l.report(info, SeverityWarning, "document-info has no id, book identifier will be random")
+	}
+}
+
+func (l *linter) titleInfo(info *etree.Element) {
+
+	genres := info.SelectElements("genre")
+	if len(genres) == 0 {
+		l.report(info, SeverityError, "%s has no genre", info.Tag)
+	}
+	for _, e := range genres {
+		if len(strings.TrimSpace(e.Text())) == 0 {
+			l.report(e, SeverityError, "empty genre")
+		}
+	}
+
+	authors := info.SelectElements("author")
+	if len(authors) == 0 {
+		l.report(info, SeverityError, "%s has no author", info.Tag)
+	}
+	for _, e := range authors {
+		first, last, nick := e.SelectElement("first-name"), e.SelectElement("last-name"), e.SelectElement("nickname")
+		if (first == nil || last == nil) && nick == nil {
+			l.report(e, SeverityError, "author must have first and last name or nickname")
+		}
+	}
+
+	if titles := info.SelectElements("book-title"); len(titles) != 1 || len(strings.TrimSpace(titles[0].Text())) == 0 {
+		l.report(info, SeverityError, "%s must have single non empty book-title", info.Tag)
+	}
+
+	if langs := info.SelectElements("lang"); len(langs) != 1 {
+		l.report(info, SeverityError, "%s must have single lang", info.Tag)
+	} else if lang := strings.TrimSpace(langs[0].Text()); len(lang) == 0 {
+		l.report(langs[0], SeverityError, "empty lang")
+	} else if _, err := language.Parse(lang); err != nil {
+		l.report(langs[0], SeverityWarning, "unknown language %q", lang)
+	}
+
+	if cover := info.SelectElement("coverpage"); cover != nil {
+		images := cover.SelectElements("image")
+		switch {
+		case len(images) == 0:
+			l.report(cover, SeverityError, "coverpage has no image")
+		case len(images) > 1:
+			l.report(images[1], SeverityWarning, "multiple cover images, only first will be used")
+		}
+		for _, e := range cover.ChildElements() {
+			if e.Tag != "image" {
+				l.report(e, SeverityError, "unexpected element <%s> in coverpage", e.Tag)
+			}
+		}
+	}
+
+	for _, e := range info.SelectElements("sequence") {
+		if len(strings.TrimSpace(e.SelectAttrValue("name", ""))) == 0 {
+			l.report(e, SeverityError, "sequence has no name")
+		}
+		if num := e.SelectAttrValue("number", ""); len(num) > 0 && !govalidator.IsNumeric(num) {
+			l.report(e, SeverityWarning, "sequence number %q is not an integer", num)
+		}
+	}
+}
+
+// content checks nesting of the body elements.
+func (l *linter) content(e *etree.Element) {
+
+	allowed := fb2Content[e.Tag]
+	if target, ok := fb2NonStandard[e.Tag]; ok {
+		allowed = fb2Content[target]
+	}
+
+	if slices.Contains(fb2Structural, e.Tag) && len(strings.TrimSpace(e.Text())) > 0 {
+		l.report(e, SeverityWarning, "text outside of paragraph in <%s>", e.Tag)
+	}
+
+	var subsections, text bool
+	for _, c := range e.ChildElements() {
+		_, known := fb2Content[c.Tag]
+		target, nonStandard := fb2NonStandard[c.Tag]
+		switch {
+		case known && slices.Contains(allowed, c.Tag):
+		case nonStandard && slices.Contains(allowed, target):
+			l.report(c, SeverityWarning, "non-standard element <%s>, treated as <%s>", c.Tag, target)
+		case known || nonStandard:
+			l.report(c, SeverityError, "element <%s> is not allowed in <%s>", c.Tag, e.Tag)
+		case e.Tag == "body" || e.Tag == "section":
+			l.report(c, SeverityError, "unknown element <%s> will be dropped", c.Tag)
+			continue
+		default:
+			l.report(c, SeverityError, "unknown element <%s>", c.Tag)
+			continue
+		}
+		if c.Tag == "section" {
+			subsections = true
+		} else if slices.Contains(fb2SectionText, c.Tag) {
+			text = true
+		}
+		l.content(c)
+	}
+	if e.Tag == "section" && subsections && text {
+		l.report(e, SeverityError, "section has both subsections and text content")
+	}
+}
+
+func (l *linter) binary(e *etree.Element) {
+
+	id := e.SelectAttrValue("id", "")
+	if len(id) == 0 {
+		l.report(e, SeverityError, "binary has no id")
+		return
+	}
+	l.binaries[id] = xpath(e)
+
+	declared := e.SelectAttrValue("content-type", "")
+	if len(declared) == 0 {
+		l.report(e, SeverityError, "binary %q has no content-type", id)
+	}
+
+	s := strings.Join(strings.Fields(e.Text()), "")
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		l.report(e, SeverityError, "unable to decode binary %q: %v", id, err)
+		return
+	}
+
+	if strings.HasSuffix(strings.ToLower(declared), "svg") {
+		if !bytes.Contains(data, []byte("<svg")) {
+			l.report(e, SeverityError, "binary %q declared as %s is not SVG", id, declared)
+		}
+		return
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		l.report(e, SeverityError, "binary %q is not a recognized image: %v", id, err)
+		return
+	}
+	detected := mime.TypeByExtension("." + format)
+	switch {
+	case len(declared) == 0 || strings.EqualFold(declared, detected):
+	case normalizeContentType(declared) == detected:
+		l.report(e, SeverityWarning, "binary %q has non-standard content-type %s, should be %s", id, declared, detected)
+	default:
+		l.report(e, SeverityError, "binary %q declared as %s is actually %s", id, declared, detected)
+	}
+}
+
+// contentTypeAliases maps commonly used non-standard image types to registered ones.
+var contentTypeAliases = map[string]string{
+	"image/jpg":   "image/jpeg",
+	"image/pjpeg": "image/jpeg",
+	"image/x-png": "image/png",
+}
+
+// normalizeContentType lowercases content type, drops its parameters and replaces known aliases.
+func normalizeContentType(ct string) string {
+	ct, _, _ = strings.Cut(ct, ";")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if alias, ok := contentTypeAliases[ct]; ok {
+		return alias
+	}
+	return ct
+}
+
+// resolve checks that all local links have targets.
+func (l *linter) resolve(bodies []*etree.Element) {
+
+	// ids in additional bodies - notes
+	notes := make(map[string]bool)
+	for i, b := range bodies {
+		if i == 0 {
+			continue
+		}
+		for _, e := range b.FindElements(".//*[@id]") {
+			notes[e.SelectAttrValue("id", "")] = true
+		}
+	}
+
+	for _, ref := range l.links {
+		l.referenced[ref.target] = true
+		switch {
+		case ref.image:
+			if _, ok := l.binaries[ref.target]; !ok {
+				l.findings = append(l.findings, Finding{Path: ref.path, Severity: SeverityError, Message: fmt.Sprintf("image references missing binary %q", ref.target)})
+			}
+		case !l.ids[ref.target]:
+			l.findings = append(l.findings, Finding{Path: ref.path, Severity: SeverityError, Message: fmt.Sprintf("dangling link to %q", ref.target)})
+		}
+	}
+
+	for _, b := range bodies {
+		for _, e := range b.FindElements(".//a[@type='note']") {
+			if href := getAttrValue(e, "href"); strings.HasPrefix(href, "#") && l.ids[href[1:]] && !notes[href[1:]] {
+				l.report(e, SeverityWarning, "note link %q points outside of notes body", href)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(l.binaries))
+	for id := range l.binaries {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if !l.referenced[id] {
+			l.findings = append(l.findings, Finding{Path: l.binaries[id], Severity: SeverityWarning, Message: fmt.Sprintf("binary %q is not referenced", id)})
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+const lintPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+const lintGood = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>John</first-name><last-name>Sample</last-name></author>
+   <book-title>Sample Book</book-title>
+   <coverpage><image l:href="#cover.png"/></coverpage>
+   <lang>en</lang>
+  </title-info>
+  <document-info>
+   <author><nickname>maker</nickname></author>
+   <date>2020</date>
+   <id>5b3a2b14-0b5e-4d2c-9c3e-6f1c2f0a1a11</id>
+   <version>1.0</version>
+  </document-info>
+ </description>
+ <body>
+  <section><title><p>Chapter 1</p></title><p>Text<a l:href="#n1" type="note">1</a>.</p></section>
+ </body>
+ <body name="notes">
+  <section id="n1"><title><p>1</p></title><p>Note.</p></section>
+ </body>
+ <binary id="cover.png" content-type="image/png">` + lintPNG + `</binary>
+</FictionBook>
+`
+
+const lintBad = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <author><first-name>John</first-name></author>
+   <book-title>Sample Book</book-title>
+   <coverpage><image l:href="#cover.png"/><image l:href="#missing.png"/></coverpage>
+   <lang>en</lang>
+  </title-info>
+ </description>
+ <body>
+  <section id="s1">
+   <p>Text<a l:href="#n2" type="note">2</a>.</p>
+   <section id="s1"><p>Nested <b>bold</b></p><table><p>bad</p></table><video/></section>
+  </section>
+ </body>
+ <binary id="cover.png" content-type="image/jpeg">` + lintPNG + `</binary>
+ <binary id="unused.png" content-type="image/png">` + lintPNG + `</binary>
+ <binary id="alias.png" content-type="image/x-png">` + lintPNG + `</binary>
+</FictionBook>
+`
+
+func TestLint(t *testing.T) {
+
+	findings, err := Lint(strings.NewReader(lintGood), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Fatalf("Unexpected findings for valid book: %+v", findings)
+	}
+
+	findings, err = Lint(strings.NewReader(lintBad), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Finding{
+		{"/FictionBook/body[1]/section[1]/section[1]", SeverityError, `duplicate id "s1"`},
+		{"/FictionBook/description[1]/title-info[1]", SeverityError, "title-info has no genre"},
+		{"/FictionBook/description[1]/title-info[1]/author[1]", SeverityError, "author must have first and last name or nickname"},
+		{"/FictionBook/description[1]/title-info[1]/coverpage[1]/image[2]", SeverityWarning, "multiple cover images, only first will be used"},
+		{"/FictionBook/description[1]", SeverityWarning, "document-info is missing"},
+		{"/FictionBook/body[1]/section[1]/section[1]/p[1]/b[1]", SeverityWarning, "non-standard element <b>, treated as <strong>"},
+		{"/FictionBook/body[1]/section[1]/section[1]/table[1]/p[1]", SeverityError, "element <p> is not allowed in <table>"},
+		{"/FictionBook/body[1]/section[1]/section[1]/video[1]", SeverityError, "unknown element <video> will be dropped"},
+		{"/FictionBook/body[1]/section[1]", SeverityError, "section has both subsections and text content"},
+		{"/FictionBook/binary[1]", SeverityError, `binary "cover.png" declared as image/jpeg is actually image/png`},
+		{"/FictionBook/binary[3]", SeverityWarning, `binary "alias.png" has non-standard content-type image/x-png, should be image/png`},
+		{"/FictionBook/description[1]/title-info[1]/coverpage[1]/image[2]", SeverityError, `image references missing binary "missing.png"`},
+		{"/FictionBook/body[1]/section[1]/p[1]/a[1]", SeverityError, `dangling link to "n2"`},
+		{"/FictionBook/binary[3]", SeverityWarning, `binary "alias.png" is not referenced`},
+		{"/FictionBook/binary[2]", SeverityWarning, `binary "unused.png" is not referenced`},
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("Unexpected findings: %+v", findings)
+	}
+	for i := range expected {
+		if findings[i] != expected[i] {
+			t.Fatalf("Finding %d:\nexpected %+v\ngot      %+v", i, expected[i], findings[i])
+		}
+	}
+
+	findings, err = Lint(strings.NewReader("<FictionBook><body></FictionBook>"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) == 0 || findings[0].Severity != SeverityError || !strings.HasPrefix(findings[0].Message, "malformed XML") {
+		t.Fatalf("Broken XML was not reported: %+v", findings)
+	}
+}
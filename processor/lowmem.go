@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"fb2converter/etree"
+)
+
+// Low memory mode. Huge books (omnibus editions with thousands of illustrations) do not fit in memory when parsed
+// document keeps every binary and all decoded images wait for the book to be saved. In this mode source is spooled to
+// disk, binaries are decoded and stored next to it as soon as parser reads them, images are decoded one at a time when
+// they are stored and finished content documents are written out while conversion goes on. Spooled files live in the
+// root of working directory, so they never end up in the resulting book.
+
+// spooledSource is the name of the spooled source in working directory.
+const spooledSource = "source.fb2.spool"
+
+// spooledBinary is content of binary tag stored to disk during parsing.
+type spooledBinary struct {
+	id    string
+	ct    string
+	fname string // empty when content could not be decoded
+}
+
+// streamDocument reads FB2 source in low memory mode.
+func (p *Processor) streamDocument(r io.Reader) error {
+
+	fname := filepath.Join(p.tmpDir, spooledSource)
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to spool FB2: %w", err)
+	}
+	h := sha1.New()
+	h.Write(nameSpaceFB2[:])
+	_, err = io.Copy(f, io.TeeReader(r, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read FB2: %w", err)
+	}
+
+	// uuid.NewSHA1(nameSpaceFB2, data) without data in memory
+	copy(p.contentID[:], h.Sum(nil))
+	p.contentID[6] = (p.contentID[6] & 0x0f) | 0x50
+	p.contentID[8] = (p.contentID[8] & 0x3f) | 0x80
+
+	p.doc.ReadSettings.Done = p.spoolBinary
+	return p.readDocument(func(doc *etree.Document) error {
+		// broken source is read again in recovery mode, start over
+		p.binaries, p.repairs = nil, nil
+		return doc.ReadFromFile(fname)
+	})
+}
+
+// spoolBinary is called by parser for every element it reads. Binaries are decoded and stored to disk right away, so
+// they never stay in parsed document.
+func (p *Processor) spoolBinary(el *etree.Element) (bool, error) {
+
+	// only interested in "./FictionBook/binary"
+	parent := el.Parent()
+	if el.Tag != "binary" || parent == nil || parent.Tag != "FictionBook" || parent.Parent() == nil || parent.Parent().Parent() != nil {
+		return true, nil
+	}
+
+	id := getAttrValue(el, "id")
+	if !p.binaryDecodable(el) {
+		p.repaired(fmt.Sprintf("binary %q cannot be decoded, dropped", id))
+		return false, nil
+	}
+	if len(id) == 0 {
+		// nothing could refer to it
+		return false, nil
+	}
+
+	sb := &spooledBinary{id: id, ct: getAttrValue(el, "content-type")}
+	if data, ok := p.decodeBinary(id, el.Text()); ok {
+		sb.fname = filepath.Join(p.tmpDir, fmt.Sprintf("binary%08d.spool", len(p.binaries)))
+		if err := os.WriteFile(sb.fname, data, 0644); err != nil {
+			return false, fmt.Errorf("unable to spool binary %s: %w", id, err)
+		}
+	}
+	p.binaries = append(p.binaries, sb)
+	return false, nil
+}
+
+// processSpooledBinaries prepares book images from binaries stored during parsing. Content is read one binary at a
+// time and only image type is detected, images are decoded when they are stored.
+func (p *Processor) processSpooledBinaries() error {
+
+	for i, sb := range p.binaries {
+		if err := p.canceled(); err != nil {
+			return err
+		}
+		if len(sb.fname) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(sb.fname)
+		if err != nil {
+			return fmt.Errorf("unable to read spooled binary %s: %w", sb.id, err)
+		}
+		if b := p.newBinImage(i, sb.id, sb.ct, data, true); b != nil {
+			b.data, b.src = nil, sb.fname
+			p.Book.Images = append(p.Book.Images, b)
+		}
+	}
+	return nil
+}
+
+// releaseXHTML writes out finished content documents in low memory mode. It is called after every top level element
+// of the body is transferred: from then on content only goes to the current document and to the one body started
+// with, all others are finished. Text formats produce single document out of everything, nothing is released for them.
+func (p *Processor) releaseXHTML(body *etree.Element) error {
+
+	if !p.env.Cfg.Doc.LowMemory || p.textual() {
+		return nil
+	}
+	for _, f := range p.Book.Files {
+		if f.doc == nil || f.doc == p.ctx().out || f.doc.FindElement("./html/body") == body {
+			continue
+		}
+		if err := f.release(p.tmpDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
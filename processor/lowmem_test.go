@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"fb2converter/config"
+)
+
+func lowMemoryProcessor(t *testing.T, book string, lowMemory bool) *Processor {
+
+	t.Helper()
+
+	p, err := newTestProcessor(t, strings.NewReader(book), false, OEpub, func(cfg *config.Config) {
+		cfg.Doc.LowMemory = lowMemory
+	})
+	if err != nil {
+		t.Fatalf("Unable to prepare book: %v", err)
+	}
+	return p
+}
+
+func corpusBook(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "corpus", name+".fb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLowMemoryImages(t *testing.T) {
+
+	p := lowMemoryProcessor(t, corpusBook(t, "images"), true)
+
+	if n := len(p.doc.FindElements("./FictionBook/binary")); n != 0 {
+		t.Errorf("Expected binaries to be removed from parsed document, %d left", n)
+	}
+	if len(p.binaries) == 0 {
+		t.Fatal("Expected binaries to be spooled")
+	}
+	for _, sb := range p.binaries {
+		if _, err := os.Stat(sb.fname); err != nil {
+			t.Errorf("Binary %s is not spooled: %v", sb.id, err)
+		}
+	}
+
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+	inMemory := func(when string) {
+		for _, b := range p.Book.Images {
+			if len(b.src) == 0 || b.id == p.Book.Cover {
+				continue
+			}
+			if b.data != nil || b.img != nil {
+				t.Errorf("Image %s is kept in memory %s", b.id, when)
+			}
+		}
+	}
+	inMemory("before book is saved")
+	if _, err := p.Save(); err != nil {
+		t.Fatalf("Unable to save book: %v", err)
+	}
+	inMemory("after it was stored")
+}
+
+func TestLowMemoryContent(t *testing.T) {
+
+	p := lowMemoryProcessor(t, corpusBook(t, "structure"), true)
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+
+	var released int
+	for _, f := range p.Book.Files {
+		if !f.released {
+			continue
+		}
+		released++
+		if _, err := os.Stat(filepath.Join(p.tmpDir, f.relpath, f.fname)); err != nil {
+			t.Errorf("Released content %s is not stored: %v", f.fname, err)
+		}
+	}
+	if released == 0 {
+		t.Error("Expected finished content to be released during conversion")
+	}
+}
+
+func TestLowMemoryRecover(t *testing.T) {
+
+	want := lowMemoryProcessor(t, fb2Broken, false)
+	got := lowMemoryProcessor(t, fb2Broken, true)
+
+	// binaries are checked while document is read, so order differs
+	slices.Sort(want.repairs)
+	slices.Sort(got.repairs)
+	if !slices.Equal(want.repairs, got.repairs) {
+		t.Errorf("Unexpected repairs in low memory mode\n\twant: %q\n\t got: %q", want.repairs, got.repairs)
+	}
+	if len(got.binaries) != 0 {
+		t.Errorf("Expected broken binary to be dropped, got %d", len(got.binaries))
+	}
+}
+
+func TestLowMemoryCharset(t *testing.T) {
+
+	book := strings.Replace(corpusBook(t, "images"), `encoding="utf-8"`, `encoding="windows-1251"`, 1)
+	book = strings.Replace(book, "</section>", "<p>"+textRussian+"</p></section>", 1)
+	data, err := charmap.Windows1251.NewEncoder().Bytes([]byte(book))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// source without BOM is decoded while it is spooled
+	p, err := newTestProcessor(t, bytes.NewReader(data), true, OEpub, func(cfg *config.Config) {
+		cfg.Doc.LowMemory = true
+	})
+	if err != nil {
+		t.Fatalf("Unable to prepare book: %v", err)
+	}
+	if len(p.binaries) == 0 {
+		t.Fatal("Expected binaries to be spooled")
+	}
+	var found bool
+	for _, e := range p.doc.FindElements("//p") {
+		found = found || e.Text() == textRussian
+	}
+	if !found {
+		t.Fatal("Text was not decoded")
+	}
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+}
@@ -1,13 +1,10 @@
 package processor
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -124,77 +121,16 @@ func (p *Processor) FinalizeAZW3(fname string) error {
 	return nil
 }
 
-// generateIntermediateContent produces temporary mobi file, presently by running kindlegen and returns its full path.
+// generateIntermediateContent produces temporary mobi file using selected kindle backend and returns its full path.
 func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 
 	workDir := filepath.Join(p.tmpDir, DirContent)
 	workFile := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)) + ".mobi"
 
-	args := make([]string, 0, 10)
-	args = append(args, filepath.Join(workDir, "content.opf"))
-	args = append(args, fmt.Sprintf("-c%d", p.env.Cfg.Doc.Kindlegen.CompressionLevel))
-	args = append(args, "-locale", "en")
-	if p.env.Cfg.Doc.Kindlegen.Verbose {
-		args = append(args, "-verbose")
-	}
-	args = append(args, "-o", workFile)
-
-	cmd := exec.Command(p.kindlegenPath, args...)
-
-	p.env.Log.Debug("kindlegen staring")
+	p.env.Log.Debug("Producing kindle content - start", zap.String("backend", p.kindleBackend.Name()))
 	defer func(start time.Time) {
-		p.env.Log.Debug("kindlegen done",
-			zap.Duration("elapsed", time.Since(start)),
-			zap.String("path", cmd.Path),
-			zap.Strings("args", args),
-		)
+		p.env.Log.Debug("Producing kindle content - done", zap.String("backend", p.kindleBackend.Name()), zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	out, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("unable to redirect kindlegen stdout: %w", err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("unable to start kindlegen: %w", err)
-	}
-
-	// read and print kindlegen stdout
-	scanner := bufio.NewScanner(out)
-	for scanner.Scan() {
-		p.env.Log.Debug(scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("kindlegen stdout pipe broken: %w", err)
-	}
-
-	result := filepath.Join(workDir, workFile)
-	if err := cmd.Wait(); err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			if len(ee.Stderr) > 0 {
-				p.env.Log.Error("kindlegen", zap.String("stderr", string(ee.Stderr)), zap.Error(err))
-			}
-			ws := ee.Sys().(syscall.WaitStatus)
-			switch ws.ExitStatus() {
-			case 1:
-				// warnings
-				p.env.Log.Warn("kindlegen has some warnings, see log for details")
-				fallthrough
-			case 0:
-				// success
-				if _, err := os.Stat(result); err != nil {
-					// kindlegen lied
-					return "", fmt.Errorf("kindlegen did not return an error, but there is no content %s: %w", result, err)
-				}
-			case 2:
-				// error - unable to create mobi
-				fallthrough
-			default:
-				return "", fmt.Errorf("kindlegen returned error: %w", err)
-			}
-		} else {
-			return "", fmt.Errorf("kindlegen returned error: %w", err)
-		}
-	}
-	return result, nil
+	return p.kindleBackend.Build(p.runContext(), workDir, workFile)
 }
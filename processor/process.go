@@ -3,6 +3,7 @@ package processor
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/base64"
 	"fmt"
 	"image"
@@ -11,6 +12,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -21,7 +24,6 @@ import (
 	"github.com/google/uuid"
 	"github.com/gosimple/slug"
 	"go.uber.org/zap"
-	"golang.org/x/net/html/charset"
 	"golang.org/x/text/language"
 	"golang.org/x/text/language/display"
 	gomail "gopkg.in/gomail.v2"
@@ -66,6 +68,8 @@ type Processor struct {
 	stampPlacement StampPlacement
 	coverResize    CoverProcessing
 	version        int
+	metaOnly       bool      // only book description is needed
+	contentID      uuid.UUID // derived from source, for books without id
 	// working directory
 	tmpDir string
 	// input document
@@ -79,7 +83,10 @@ type Processor struct {
 	dashTransform     *config.Transformation
 	dialogueTransform *config.Transformation
 	metaOverwrite     *config.MetaInfo
-	kindlegenPath     string
+	kindleBackend     KindleBackend
+	repairs           []string         // corrections made to broken source
+	binaries          []*spooledBinary // low memory mode - binaries stored to disk during parsing
+	runCtx            gocontext.Context
 }
 
 // NewFB2 creates FB2 book processor and prepares necessary temporary directories.
@@ -97,6 +104,16 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		env.Log.Warn("Unknown notes mode requested, switching to default", zap.String("mode", env.Cfg.Doc.Notes.Mode))
 		notes = NDefault
 	}
+	if format == OEpub3 && (notes == NDefault || notes == NFloat || notes == NFloatOld) {
+		// EPUB3 has proper footnotes semantics, notes become footnote asides unless they are placed in text
+		env.Log.Debug("Using float-new notes mode for EPUB3", zap.String("mode", env.Cfg.Doc.Notes.Mode))
+		notes = NFloatNew
+	}
+	if (format == OTxt || format == OMd) && notes != NDefault {
+		// plain text has no links, notes become endnotes
+		env.Log.Debug("Using default notes mode for text output", zap.String("mode", env.Cfg.Doc.Notes.Mode))
+		notes = NDefault
+	}
 	if notes != NFloat && notes != NFloatOld && notes != NFloatNew && notes != NFloatNewMore && env.Cfg.Doc.Notes.Renumber {
 		env.Log.Warn("Notes can be renumbered in floating modes only, ignoring", zap.String("mode", env.Cfg.Doc.Notes.Mode))
 	}
@@ -111,12 +128,20 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		place = TOCNone
 	}
 	var apnx APNXGeneration
+	var engine KindleEngine
 	if kindle {
 		apnx = ParseAPNXGenerationSring(env.Cfg.Doc.Kindlegen.PageMap)
 		if apnx == UnsupportedAPNXGeneration {
 			env.Log.Warn("Unknown APNX generation option requested, turning off", zap.String("apnx", env.Cfg.Doc.Kindlegen.PageMap))
 			apnx = APNXNone
 		}
+		if len(env.Cfg.Doc.Kindlegen.Engine) > 0 {
+			engine = ParseKindleEngineString(env.Cfg.Doc.Kindlegen.Engine)
+			if engine == UnsupportedKindleEngine {
+				env.Log.Warn("Unknown kindle engine requested, switching to auto", zap.String("engine", env.Cfg.Doc.Kindlegen.Engine))
+				engine = EngineAuto
+			}
+		}
 	}
 	if env.Cfg.Doc.NoPageMap && apnx != APNXNone {
 		env.Log.Warn("APNX generation option requested but no page map is generated, turning off")
@@ -165,8 +190,7 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	p.doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
 
 	if kindle {
-		// Fail early
-		if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
+		if p.kindleBackend, err = NewKindleBackend(engine, p.timestamp, env); err != nil {
 			return nil, err
 		}
 	}
@@ -195,24 +219,28 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	}
 	env.Rpt.Store(fmt.Sprintf("fb2c-%s", u.String()), p.tmpDir)
 
-	if unknownEncoding {
-		// input file had no BOM mark - most likely was not Unicode
-		// in this mode we will try and respect as many HTML named character references as possible, since creator of the
-		// document did not have any choice
-		entities, err := prepareHTMLNamedEntities()
-		if err != nil {
-			return nil, fmt.Errorf("unable to write prepare HTML named entities: %w", err)
-		}
-		p.doc.ReadSettings = etree.ReadSettings{
-			CharsetReader: charset.NewReaderLabel,
-			Entity:        entities,
-		}
+	if r, err = prepareReadSettings(p.doc, r, unknownEncoding, env.Cfg.Doc.SourceCharset, env.Log); err != nil {
+		return nil, err
 	}
 
 	// Read and parse fb2
-	if _, err := p.doc.ReadFrom(r); err != nil {
-		return nil, fmt.Errorf("unable to parse FB2: %w", err)
+	if env.Cfg.Doc.LowMemory {
+		if err := p.streamDocument(r); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read FB2: %w", err)
+		}
+		if err := p.readDocument(func(doc *etree.Document) error { return doc.ReadFromBytes(data) }); err != nil {
+			return nil, err
+		}
+		p.contentID = uuid.NewSHA1(nameSpaceFB2, data)
 	}
+	// book without id gets the same one every time it is converted, so it matches what catalog and meta report
+	p.Book.ID = p.contentID
+	p.repairDocument()
 
 	// Save parsed document back to file for debugging
 	if p.env.Rpt != nil {
@@ -226,6 +254,117 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	return p, nil
 }
 
+// reproducibleTime is used in reproducible mode when source document has no date.
+var reproducibleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// timestamp returns time to be stored in generated content. In reproducible mode it does not depend on the moment of
+// conversion: document-info date of the source is used, when it is absent or cannot be parsed SOURCE_DATE_EPOCH
+// environment variable or fixed date.
+func (p *Processor) timestamp() time.Time {
+
+	if !p.env.Cfg.Doc.Reproducible {
+		return time.Now()
+	}
+	if e := p.doc.FindElement("./FictionBook/description/document-info/date"); e != nil {
+		for _, v := range []string{e.SelectAttrValue("value", ""), strings.TrimSpace(e.Text())} {
+			for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil && t.After(reproducibleTime) {
+					return t
+				}
+			}
+		}
+	}
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil && epoch > reproducibleTime.Unix() {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return reproducibleTime
+}
+
+// descriptionEnd matches closing tag of the book description, possibly with namespace prefix.
+var descriptionEnd = regexp.MustCompile(`</(?:[\w.-]+:)?description\s*>`)
+
+// ReadDescription reads FB2 only up to the end of description and parses it the same way conversion does. Resulting
+// book has metadata only, book without id gets nil UUID. Used for quick scanning of large collections.
+func ReadDescription(r io.Reader, unknownEncoding bool, src string, env *state.LocalEnv) (*Book, error) {
+
+	head, err := readDescriptionHead(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read FB2: %w", err)
+	}
+
+	p := &Processor{
+		src:           src,
+		metaOnly:      true,
+		doc:           etree.NewDocument(),
+		Book:          NewBook(uuid.Nil, filepath.Base(src)),
+		env:           env,
+		metaOverwrite: env.Cfg.GetOverwrite(src),
+	}
+	hr, err := prepareReadSettings(p.doc, bytes.NewReader(head), unknownEncoding, env.Cfg.Doc.SourceCharset, env.Log)
+	if err != nil {
+		return nil, err
+	}
+	if head, err = io.ReadAll(hr); err != nil {
+		return nil, err
+	}
+	// document is cut short, but parsing is forgiving enough
+	if err := p.readDocument(func(doc *etree.Document) error { return doc.ReadFromBytes(head) }); err != nil {
+		return nil, err
+	}
+	if err := p.processDescription(); err != nil {
+		return nil, err
+	}
+	return p.Book, nil
+}
+
+// readDescriptionHead reads input until description is over.
+func readDescriptionHead(r io.Reader) ([]byte, error) {
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			// closing tag could be split between reads
+			from := max(0, buf.Len()-64)
+			buf.Write(chunk[:n])
+			if loc := descriptionEnd.FindIndex(buf.Bytes()[from:]); loc != nil {
+				return buf.Bytes()[:from+loc[1]], nil
+			}
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// prepareReadSettings sets up XML parsing of FB2 document and returns reader to parse it from. Sources without BOM
+// are converted to UTF-8 using forced encoding or the one detected.
+func prepareReadSettings(doc *etree.Document, r io.Reader, unknownEncoding bool, forced string, log *zap.Logger) (io.Reader, error) {
+	if !unknownEncoding {
+		return r, nil
+	}
+	// input file had no BOM mark - most likely was not Unicode
+	// in this mode we will try and respect as many HTML named character references as possible, since creator of the
+	// document did not have any choice
+	entities, err := prepareHTMLNamedEntities()
+	if err != nil {
+		return nil, fmt.Errorf("unable to write prepare HTML named entities: %w", err)
+	}
+	if r, err = decodeSource(r, forced, log); err != nil {
+		return nil, err
+	}
+	doc.ReadSettings = etree.ReadSettings{
+		// source is UTF-8 already, whatever XML declaration says
+		CharsetReader: func(_ string, input io.Reader) (io.Reader, error) { return input, nil },
+		Entity:        entities,
+	}
+	return r, nil
+}
+
 // Process does all the work.
 func (p *Processor) Process() error {
 
@@ -251,6 +390,16 @@ func (p *Processor) Process() error {
 	if err := p.processImages(); err != nil {
 		return err
 	}
+	if p.textual() {
+		// single document does not need cover page, navigation and packaging
+		if p.format != OHtml {
+			return nil
+		}
+		if err := p.generateTOCPage(); err != nil {
+			return err
+		}
+		return p.prepareStylesheet()
+	}
 	if err := p.generateTOCPage(); err != nil {
 		return err
 	}
@@ -266,6 +415,9 @@ func (p *Processor) Process() error {
 	if err := p.generatePagemap(); err != nil {
 		return err
 	}
+	if err := p.generateNav(); err != nil {
+		return err
+	}
 	if err := p.generateOPF(); err != nil {
 		return err
 	}
@@ -275,6 +427,46 @@ func (p *Processor) Process() error {
 	return p.KepubifyXHTML()
 }
 
+// Describe only parses book description, so book metadata is available without full conversion. Returns cover image
+// data if book has one.
+func (p *Processor) Describe() ([]byte, error) {
+
+	p.metaOnly = true
+	// book without id should be described the same way every time
+	p.Book.ID = p.contentID
+	if err := p.processDescription(); err != nil {
+		return nil, err
+	}
+	if len(p.Book.Cover) == 0 {
+		return nil, nil
+	}
+	// in low memory mode binaries are not in the document
+	for _, sb := range p.binaries {
+		if sb.id == p.Book.Cover && len(sb.fname) > 0 {
+			data, err := os.ReadFile(sb.fname)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read cover image: %w", err)
+			}
+			return data, nil
+		}
+	}
+	for _, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+		if getAttrValue(el, "id") != p.Book.Cover {
+			continue
+		}
+		// some files are badly formatted
+		s := strings.Replace(el.Text(), " ", "", -1)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+		n, err := base64.StdEncoding.Decode(data, []byte(s))
+		if err != nil && n == 0 {
+			return nil, fmt.Errorf("unable to decode cover image: %w", err)
+		}
+		return data[:n], nil
+	}
+	p.env.Log.Warn("Unable to find cover image", zap.String("id", p.Book.Cover))
+	return nil, nil
+}
+
 // Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts.
 func (p *Processor) Save() (string, error) {
 
@@ -289,10 +481,15 @@ func (p *Processor) Save() (string, error) {
 	if err := p.Book.flushVignettes(p.tmpDir); err != nil {
 		return "", err
 	}
-	if err := p.Book.flushImages(p.tmpDir); err != nil {
+	jobs := runtime.NumCPU()
+	if p.env.Cfg.Doc.LowMemory {
+		// one image in memory at a time
+		jobs = 1
+	}
+	if err := p.Book.flushImages(p.tmpDir, jobs, p.canceled); err != nil {
 		return "", err
 	}
-	if err := p.Book.flushXHTML(p.tmpDir); err != nil {
+	if err := p.Book.flushXHTML(p.tmpDir, p.canceled); err != nil {
 		return "", err
 	}
 	if err := p.Book.flushMeta(p.tmpDir); err != nil {
@@ -301,9 +498,12 @@ func (p *Processor) Save() (string, error) {
 
 	fname := p.prepareOutputName()
 
+	if err := p.canceled(); err != nil {
+		return "", err
+	}
 	var err error
 	switch p.format {
-	case OEpub:
+	case OEpub, OEpub3:
 		err = p.FinalizeEPUB(fname)
 	case OKepub:
 		err = p.FinalizeKEPUB(fname)
@@ -311,10 +511,56 @@ func (p *Processor) Save() (string, error) {
 		err = p.FinalizeMOBI(fname)
 	case OAzw3:
 		err = p.FinalizeAZW3(fname)
+	case OTxt:
+		err = p.FinalizeTXT(fname)
+	case OMd:
+		err = p.FinalizeMD(fname)
+	case OHtml:
+		err = p.FinalizeHTML(fname)
 	}
 	return fname, err
 }
 
+// outputExt returns extension of the resulting file.
+func (p *Processor) outputExt() string {
+	switch p.format {
+	case OKepub:
+		return "." + OKepub.String() + "." + OEpub.String()
+	case OEpub3:
+		return "." + OEpub.String()
+	}
+	return "." + p.format.String()
+}
+
+// OutputName returns name of the file Save will produce. It is only meaningful after book was processed.
+func (p *Processor) OutputName() string {
+	return p.prepareOutputName()
+}
+
+// SetContext makes Process and Save stop with context error when ctx is canceled. Cancellation is noticed for every
+// section, image and output file, and external kindle programs are killed.
+func (p *Processor) SetContext(ctx gocontext.Context) {
+	p.runCtx = ctx
+}
+
+// runContext returns context conversion runs in.
+func (p *Processor) runContext() gocontext.Context {
+	if p.runCtx == nil {
+		return gocontext.Background()
+	}
+	return p.runCtx
+}
+
+// canceled returns context error when conversion was abandoned.
+func (p *Processor) canceled() error {
+	return p.runContext().Err()
+}
+
+// AllowOverwrite lets Save replace existing output file. It is for callers which decide that only knowing OutputName.
+func (p *Processor) AllowOverwrite() {
+	p.overwrite = true
+}
+
 // SendToKindle will mail converted file to specified address and remove file if requested.
 func (p *Processor) SendToKindle(fname string) error {
 
@@ -423,10 +669,7 @@ func (p *Processor) prepareOutputName() string {
 	if p.env.Cfg.Doc.FileNameTransliterate {
 		name = slug.Make(name)
 	}
-	outFile := config.CleanFileName(name) + "." + p.format.String()
-	if p.format == OKepub {
-		outFile += "." + OEpub.String()
-	}
+	outFile := config.CleanFileName(name) + p.outputExt()
 
 	if len(p.env.Cfg.Doc.FileNameFormat) == 0 {
 		return filepath.Join(outDir, outFile)
@@ -458,10 +701,7 @@ func (p *Processor) prepareOutputName() string {
 			if p.env.Cfg.Doc.FileNameTransliterate {
 				tail = slug.Make(tail)
 			}
-			outFile = config.CleanFileName(tail) + "." + p.format.String()
-			if p.format == OKepub {
-				outFile += "." + OEpub.String()
-			}
+			outFile = config.CleanFileName(tail) + p.outputExt()
 			first = false
 		} else {
 			if p.env.Cfg.Doc.FileNameTransliterate {
@@ -495,6 +735,14 @@ func (p *Processor) processDescription() error {
 			zap.String("sequence", p.Book.SeqName),
 			zap.Int("sequence number", p.Book.SeqNum),
 			zap.String("date", p.Book.Date),
+			zap.Any("translators", p.Book.Translators),
+			zap.String("publisher", p.Book.Publisher),
+			zap.String("city", p.Book.PublishCity),
+			zap.String("year", p.Book.PublishYear),
+			zap.String("isbn", p.Book.ISBN),
+			zap.String("source title", p.Book.SrcTitle),
+			zap.String("source lang", p.Book.SrcLang),
+			zap.Any("source authors", p.Book.SrcAuthors),
 		)
 	}(time.Now())
 
@@ -534,10 +782,10 @@ func (p *Processor) processDescription() error {
 						}
 					}
 					p.Book.Lang = t
-					if p.env.Cfg.Doc.Hyphenate {
+					if p.env.Cfg.Doc.Hyphenate && !p.metaOnly {
 						p.Book.hyph = newHyph(t, p.env.Log)
 					}
-					if p.format == OKepub {
+					if p.format == OKepub && !p.metaOnly {
 						p.Book.tokenizer = newTokenizer(t, p.env.Log)
 					}
 				}
@@ -559,33 +807,8 @@ func (p *Processor) processDescription() error {
 					p.Book.Genres = append(p.Book.Genres, g)
 				}
 			}
-			for _, e := range info.SelectElements("author") {
-				var (
-					an       = new(config.AuthorName)
-					notEmpty bool
-				)
-				if n := e.SelectElement("first-name"); n != nil {
-					if f := strings.TrimSpace(n.Text()); len(f) > 0 {
-						an.First = f
-						notEmpty = true
-					}
-				}
-				if n := e.SelectElement("middle-name"); n != nil {
-					if m := strings.TrimSpace(n.Text()); len(m) > 0 {
-						an.Middle = m
-						notEmpty = true
-					}
-				}
-				if n := e.SelectElement("last-name"); n != nil {
-					if l := strings.TrimSpace(n.Text()); len(l) > 0 {
-						an.Last = l
-						notEmpty = true
-					}
-				}
-				if notEmpty {
-					p.Book.Authors = append(p.Book.Authors, an)
-				}
-			}
+			p.Book.Authors = append(p.Book.Authors, parseAuthors(info, "author")...)
+			p.Book.Translators = append(p.Book.Translators, parseAuthors(info, "translator")...)
 			if e := info.SelectElement("sequence"); e != nil {
 				var err error
 				p.Book.SeqName = getAttrValue(e, "name")
@@ -603,7 +826,7 @@ func (p *Processor) processDescription() error {
 			}
 			if e := info.SelectElement("annotation"); e != nil {
 				p.Book.Annotation = getTextFragment(e)
-				if p.env.Cfg.Doc.Annotation.Create {
+				if p.env.Cfg.Doc.Annotation.Create && !p.metaOnly {
 					to, f := p.ctx().createXHTML("annotation", attr("xmlns", `http://www.w3.org/1999/xhtml`))
 					inner := to.AddNext("div", attr("class", "annotation"))
 					inner.AddNext("div", attr("class", "h1")).SetText(p.env.Cfg.Doc.Annotation.Title)
@@ -629,6 +852,29 @@ func (p *Processor) processDescription() error {
 				p.Book.Date = getTextFragment(e)
 			}
 		}
+		if info := desc.SelectElement("publish-info"); info != nil {
+			if e := info.SelectElement("publisher"); e != nil {
+				p.Book.Publisher = strings.TrimSpace(e.Text())
+			}
+			if e := info.SelectElement("city"); e != nil {
+				p.Book.PublishCity = strings.TrimSpace(e.Text())
+			}
+			if e := info.SelectElement("year"); e != nil {
+				p.Book.PublishYear = strings.TrimSpace(e.Text())
+			}
+			if e := info.SelectElement("isbn"); e != nil {
+				p.Book.ISBN = strings.TrimSpace(e.Text())
+			}
+		}
+		if info := desc.SelectElement("src-title-info"); info != nil {
+			if e := info.SelectElement("book-title"); e != nil {
+				p.Book.SrcTitle = strings.TrimSpace(e.Text())
+			}
+			if e := info.SelectElement("lang"); e != nil {
+				p.Book.SrcLang = strings.TrimSpace(e.Text())
+			}
+			p.Book.SrcAuthors = append(p.Book.SrcAuthors, parseAuthors(info, "author")...)
+		}
 	}
 
 	// Let's see if we need to correct any meta information - always comes last
@@ -656,7 +902,7 @@ func (p *Processor) processDescription() error {
 			if t, err := language.Parse(l); err == nil {
 				p.Book.Lang = t
 				p.env.Log.Info("Meta overwrite", zap.Stringer("lang", p.Book.Lang))
-				if p.env.Cfg.Doc.Hyphenate {
+				if p.env.Cfg.Doc.Hyphenate && !p.metaOnly {
 					p.Book.hyph = newHyph(t, p.env.Log)
 				}
 			}
@@ -690,9 +936,75 @@ func (p *Processor) processDescription() error {
 		p.Book.Date = date
 		p.env.Log.Info("Meta overwrite", zap.String("date", p.Book.Date))
 	}
+	if len(p.metaOverwrite.Translators) > 0 {
+		p.Book.Translators = append([]*config.AuthorName{}, p.metaOverwrite.Translators...)
+		p.env.Log.Info("Meta overwrite", zap.Any("translators", p.Book.Translators))
+	}
+	if publisher := strings.TrimSpace(p.metaOverwrite.Publisher); len(publisher) > 0 {
+		p.Book.Publisher = publisher
+		p.env.Log.Info("Meta overwrite", zap.String("publisher", p.Book.Publisher))
+	}
+	if city := strings.TrimSpace(p.metaOverwrite.PublishCity); len(city) > 0 {
+		p.Book.PublishCity = city
+		p.env.Log.Info("Meta overwrite", zap.String("city", p.Book.PublishCity))
+	}
+	if year := strings.TrimSpace(p.metaOverwrite.PublishYear); len(year) > 0 {
+		p.Book.PublishYear = year
+		p.env.Log.Info("Meta overwrite", zap.String("year", p.Book.PublishYear))
+	}
+	if isbn := strings.TrimSpace(p.metaOverwrite.ISBN); len(isbn) > 0 {
+		p.Book.ISBN = isbn
+		p.env.Log.Info("Meta overwrite", zap.String("isbn", p.Book.ISBN))
+	}
+	if title := strings.TrimSpace(p.metaOverwrite.SrcTitle); len(title) > 0 {
+		p.Book.SrcTitle = title
+		p.env.Log.Info("Meta overwrite", zap.String("source title", p.Book.SrcTitle))
+	}
+	if lang := strings.TrimSpace(p.metaOverwrite.SrcLang); len(lang) > 0 {
+		p.Book.SrcLang = lang
+		p.env.Log.Info("Meta overwrite", zap.String("source lang", p.Book.SrcLang))
+	}
+	if len(p.metaOverwrite.SrcAuthors) > 0 {
+		p.Book.SrcAuthors = append([]*config.AuthorName{}, p.metaOverwrite.SrcAuthors...)
+		p.env.Log.Info("Meta overwrite", zap.Any("source authors", p.Book.SrcAuthors))
+	}
 	return nil
 }
 
+// parseAuthors returns non empty person names from all child elements of info with requested tag.
+func parseAuthors(info *etree.Element, tag string) []*config.AuthorName {
+
+	var res []*config.AuthorName
+	for _, e := range info.SelectElements(tag) {
+		var (
+			an       = new(config.AuthorName)
+			notEmpty bool
+		)
+		if n := e.SelectElement("first-name"); n != nil {
+			if f := strings.TrimSpace(n.Text()); len(f) > 0 {
+				an.First = f
+				notEmpty = true
+			}
+		}
+		if n := e.SelectElement("middle-name"); n != nil {
+			if m := strings.TrimSpace(n.Text()); len(m) > 0 {
+				an.Middle = m
+				notEmpty = true
+			}
+		}
+		if n := e.SelectElement("last-name"); n != nil {
+			if l := strings.TrimSpace(n.Text()); len(l) > 0 {
+				an.Last = l
+				notEmpty = true
+			}
+		}
+		if notEmpty {
+			res = append(res, an)
+		}
+	}
+	return res
+}
+
 // processBodies processes book bodies, including main one.
 func (p *Processor) processBodies() error {
 
@@ -819,119 +1131,147 @@ func (p *Processor) processBinaries() error {
 		)
 	}(time.Now())
 
-	for i, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
-
-		id := getAttrValue(el, "id")
-		declaredCT := getAttrValue(el, "content-type")
-
-		// some files are badly formatted
-		s := strings.Replace(el.Text(), " ", "", -1)
-		dst, src := make([]byte, base64.StdEncoding.DecodedLen(len(s))), []byte(s)
+	if p.env.Cfg.Doc.LowMemory {
+		return p.processSpooledBinaries()
+	}
 
-		n, err := base64.StdEncoding.Decode(dst, src)
-		if err != nil {
-			if n == 0 {
-				p.env.Log.Warn("Unable to decode binary, ignoring", zap.String("id", id), zap.Error(err))
-				continue
-			}
-			// And some may have several images staffed together or wrong padding
-			p.env.Log.Warn("Unable to fully decode binary, recovering", zap.String("id", id), zap.Error(err))
+	for i, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+		if err := p.canceled(); err != nil {
+			return err
 		}
-
-		if strings.HasSuffix(strings.ToLower(declaredCT), "svg") {
-			// Special case - do not touch SVG
-			p.Book.Images = append(p.Book.Images, &binImage{
-				log:         p.env.Log,
-				id:          id,
-				ct:          "image/svg+xml",
-				fname:       fmt.Sprintf("bin%08d.svg", i),
-				relpath:     filepath.Join(DirContent, DirImages),
-				imgType:     "svg",
-				jpegQuality: p.env.Cfg.Doc.JPEGQuality,
-				data:        dst,
-			})
+		id := getAttrValue(el, "id")
+		data, ok := p.decodeBinary(id, el.Text())
+		if !ok {
 			continue
 		}
+		if b := p.newBinImage(i, id, getAttrValue(el, "content-type"), data, false); b != nil {
+			p.Book.Images = append(p.Book.Images, b)
+		}
+	}
+	return nil
+}
 
-		var (
-			detectedCT string
-			doNotTouch bool
-		)
-
-		img, imgType, err := image.Decode(bytes.NewReader(dst))
-		if err != nil {
-			p.env.Log.Warn("Unable to decode image",
-				zap.String("id", id),
-				zap.String("declared", declaredCT),
-				zap.Error(err))
+// decodeBinary returns content of binary tag, false is returned when nothing could be decoded.
+func (p *Processor) decodeBinary(id, text string) ([]byte, bool) {
 
-			if !p.env.Cfg.Doc.UseBrokenImages {
-				continue
-			}
+	// some files are badly formatted
+	s := strings.Replace(text, " ", "", -1)
+	dst, src := make([]byte, base64.StdEncoding.DecodedLen(len(s))), []byte(s)
 
-			detectedCT = declaredCT
-			doNotTouch = true
-		} else {
-			detectedCT = mime.TypeByExtension("." + imgType)
+	n, err := base64.StdEncoding.Decode(dst, src)
+	if err != nil {
+		if n == 0 {
+			p.env.Log.Warn("Unable to decode binary, ignoring", zap.String("id", id), zap.Error(err))
+			return nil, false
 		}
+		// And some may have several images staffed together or wrong padding
+		p.env.Log.Warn("Unable to fully decode binary, recovering", zap.String("id", id), zap.Error(err))
+	}
+	return dst, true
+}
 
-		if !strings.EqualFold(declaredCT, detectedCT) {
-			p.env.Log.Warn("Declared and detected image types do not match, using detected type",
-				zap.String("id", id),
-				zap.String("declared", declaredCT),
-				zap.String("detected", detectedCT))
-		}
+// newBinImage prepares i-th book image for processing, nil is returned when image cannot be used. Lazy image is not
+// decoded, only its type is detected - it will be decoded when stored.
+func (p *Processor) newBinImage(i int, id, declaredCT string, data []byte, lazy bool) *binImage {
 
-		// fill in image info
-		b := &binImage{
+	if strings.HasSuffix(strings.ToLower(declaredCT), "svg") {
+		// Special case - do not touch SVG
+		return &binImage{
 			log:         p.env.Log,
 			id:          id,
-			ct:          detectedCT,
-			fname:       fmt.Sprintf("bin%08d.%s", i, imgType),
+			ct:          "image/svg+xml",
+			fname:       fmt.Sprintf("bin%08d.svg", i),
 			relpath:     filepath.Join(DirContent, DirImages),
+			imgType:     "svg",
 			jpegQuality: p.env.Cfg.Doc.JPEGQuality,
-			img:         img,
-			imgType:     imgType,
-			data:        dst,
+			data:        data,
 		}
+	}
 
-		if !doNotTouch {
-			// see if any additional processing is requested
-			if !isImageSupported(b.imgType) && (p.format == OMobi || p.format == OAzw3) {
-				b.flags |= imageKindle
-			}
-			if p.env.Cfg.Doc.RemovePNGTransparency && imgType == "png" {
-				b.flags |= imageOpaquePNG
-			}
-			if p.env.Cfg.Doc.ImagesScaleFactor > 0 && (imgType == "png" || imgType == "jpeg") {
-				b.flags |= imageScale
-				b.scaleFactor = p.env.Cfg.Doc.ImagesScaleFactor
-			}
-			if p.env.Cfg.Doc.OptimizeImages && imgType == "png" {
-				// forcefully reencode image
+	var (
+		detectedCT string
+		doNotTouch bool
+		img        image.Image
+		imgType    string
+		err        error
+	)
+
+	if lazy {
+		imgType, err = decodeImageType(data)
+	} else {
+		img, imgType, err = decodeImage(data)
+	}
+	if err != nil {
+		p.env.Log.Warn("Unable to decode image",
+			zap.String("id", id),
+			zap.String("declared", declaredCT),
+			zap.Error(err))
+
+		if !p.env.Cfg.Doc.UseBrokenImages {
+			return nil
+		}
+
+		detectedCT = declaredCT
+		doNotTouch = true
+	} else {
+		detectedCT = mime.TypeByExtension("." + imgType)
+	}
+
+	if !strings.EqualFold(declaredCT, detectedCT) {
+		p.env.Log.Warn("Declared and detected image types do not match, using detected type",
+			zap.String("id", id),
+			zap.String("declared", declaredCT),
+			zap.String("detected", detectedCT))
+	}
+
+	// fill in image info
+	b := &binImage{
+		log:         p.env.Log,
+		id:          id,
+		ct:          detectedCT,
+		fname:       fmt.Sprintf("bin%08d.%s", i, imgType),
+		relpath:     filepath.Join(DirContent, DirImages),
+		jpegQuality: p.env.Cfg.Doc.JPEGQuality,
+		img:         img,
+		imgType:     imgType,
+		data:        data,
+	}
+
+	if !doNotTouch {
+		// see if any additional processing is requested
+		if !isImageSupported(b.imgType) && (p.format == OMobi || p.format == OAzw3) {
+			b.flags |= imageKindle
+		}
+		if p.env.Cfg.Doc.RemovePNGTransparency && imgType == "png" {
+			b.flags |= imageOpaquePNG
+		}
+		if p.env.Cfg.Doc.ImagesScaleFactor > 0 && (imgType == "png" || imgType == "jpeg") {
+			b.flags |= imageScale
+			b.scaleFactor = p.env.Cfg.Doc.ImagesScaleFactor
+		}
+		if p.env.Cfg.Doc.OptimizeImages && imgType == "png" {
+			// forcefully reencode image
+			b.flags |= imageChanged
+		}
+		if p.env.Cfg.Doc.OptimizeImages && imgType == "jpeg" {
+			if jr, err := jpegq.NewWithBytes(data); err != nil {
+				p.env.Log.Warn("Unable to detect JPEG quality level, skipping...", zap.String("id", id), zap.Error(err))
+			} else if q := jr.Quality(); q > p.env.Cfg.Doc.JPEGQuality {
+				p.env.Log.Debug("JPEG quality level higher than requested, reencoding...",
+					zap.String("id", id),
+					zap.Int("detected", q),
+					zap.Int("requested", p.env.Cfg.Doc.JPEGQuality))
+				// forcefully reencode with requested quality level
 				b.flags |= imageChanged
-			}
-			if p.env.Cfg.Doc.OptimizeImages && imgType == "jpeg" {
-				if jr, err := jpegq.NewWithBytes(dst); err != nil {
-					p.env.Log.Warn("Unable to detect JPEG quality level, skipping...", zap.String("id", id), zap.Error(err))
-				} else if q := jr.Quality(); q > p.env.Cfg.Doc.JPEGQuality {
-					p.env.Log.Debug("JPEG quality level higher than requested, reencoding...",
-						zap.String("id", id),
-						zap.Int("detected", q),
-						zap.Int("requested", p.env.Cfg.Doc.JPEGQuality))
-					// forcefully reencode with requested quality level
-					b.flags |= imageChanged
-				} else {
-					p.env.Log.Debug("JPEG quality level already lower than requested, skipping...",
-						zap.String("id", id),
-						zap.Int("detected", q),
-						zap.Int("requested", p.env.Cfg.Doc.JPEGQuality))
-				}
+			} else {
+				p.env.Log.Debug("JPEG quality level already lower than requested, skipping...",
+					zap.String("id", id),
+					zap.Int("detected", q),
+					zap.Int("requested", p.env.Cfg.Doc.JPEGQuality))
 			}
 		}
-		p.Book.Images = append(p.Book.Images, b)
 	}
-	return nil
+	return b
 }
 
 // processLinks goes over generated documents and makes sure hanging anchors are properly anchored.
@@ -943,17 +1283,19 @@ func (p *Processor) processLinks() error {
 	}(time.Now())
 
 	for _, f := range p.Book.Files {
-		if f.doc == nil {
-			continue
-		}
-		for _, a := range f.doc.FindElements("//a[@href]") {
-			href := getAttrValue(a, "href")
-			if !strings.HasPrefix(href, "#") {
-				continue
-			}
-			if fname, ok := p.Book.LinksLocations[href[1:]]; ok {
-				a.CreateAttr("href", fname+href)
+		if err := f.update(p.tmpDir, func(doc *etree.Document) error {
+			for _, a := range doc.FindElements("//a[@href]") {
+				href := getAttrValue(a, "href")
+				if !strings.HasPrefix(href, "#") {
+					continue
+				}
+				if fname, ok := p.Book.LinksLocations[href[1:]]; ok {
+					a.CreateAttr("href", fname+href)
+				}
 			}
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -994,6 +1336,10 @@ func (p *Processor) processImages() error {
 							}
 						}
 					}
+					// in low memory mode cover content has to be brought in, it is processed when cover page is generated
+					if err := p.Book.Images[i].load(true); err != nil {
+						p.env.Log.Warn("Unable to load cover image", zap.String("id", b.id), zap.Error(err))
+					}
 					// NOTE: We will process cover separately
 					b.flags &= ^imageScale
 					b.scaleFactor = 0
@@ -0,0 +1,55 @@
+package processor
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+// testEnv returns environment with default configuration adjusted by "setup", which may be nil.
+func testEnv(tb testing.TB, setup func(cfg *config.Config)) *state.LocalEnv {
+
+	tb.Helper()
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if setup != nil {
+		setup(cfg)
+	}
+	return &state.LocalEnv{Log: zap.NewNop(), Cfg: cfg}
+}
+
+// newTestProcessor prepares "book.fb2" for conversion into temporary directory. Processor is cleaned when test ends.
+func newTestProcessor(t *testing.T, r io.Reader, unknownEncoding bool, format OutputFmt, setup func(cfg *config.Config)) (*Processor, error) {
+
+	t.Helper()
+
+	p, err := NewFB2(r, unknownEncoding, "book.fb2", t.TempDir(), false, false, false, format, testEnv(t, setup))
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { p.Clean() })
+	return p, nil
+}
+
+// processBook converts book text, any failure ends the test.
+func processBook(t *testing.T, book string, format OutputFmt, setup func(cfg *config.Config)) *Processor {
+
+	t.Helper()
+
+	p, err := newTestProcessor(t, strings.NewReader(book), false, format, setup)
+	if err != nil {
+		t.Fatalf("Unable to parse book: %v", err)
+	}
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process book: %v", err)
+	}
+	return p
+}
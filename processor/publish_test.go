@@ -0,0 +1,168 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/processor/internal/mobi"
+)
+
+const fb2Publish = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>Иван</first-name><last-name>Иванов</last-name></author>
+   <book-title>Переведённая книга</book-title>
+   <lang>ru</lang>
+   <src-lang>en</src-lang>
+   <translator><first-name>Пётр</first-name><last-name>Петров</last-name></translator>
+  </title-info>
+  <src-title-info>
+   <genre>sf</genre>
+   <author><first-name>John</first-name><last-name>Smith</last-name></author>
+   <book-title>Translated Book</book-title>
+   <lang>en</lang>
+  </src-title-info>
+  <document-info>
+   <id>6c1b7c1e-33a5-4b8e-9b0c-6a5b1f3e2d11</id>
+  </document-info>
+  <publish-info>
+   <book-name>Переведённая книга</book-name>
+   <publisher>Издательство</publisher>
+   <city>Москва</city>
+   <year>2002</year>
+   <isbn>978-3-16-148410-0</isbn>
+  </publish-info>
+ </description>
+ <body>
+  <section>
+   <title><p>Глава</p></title>
+   <p>Текст.</p>
+  </section>
+ </body>
+</FictionBook>
+`
+
+func newPublishProcessor(t *testing.T, format OutputFmt, overwrite *config.MetaInfo) *Processor {
+
+	t.Helper()
+
+	return processBook(t, fb2Publish, format, func(cfg *config.Config) {
+		cfg.Doc.Vignettes.Create = false
+		cfg.Doc.Kindlegen.Engine = EngineNative.String()
+		if overwrite != nil {
+			cfg.Overwrites["*"] = *overwrite
+		}
+	})
+}
+
+func packageMetadata(t *testing.T, p *Processor) string {
+
+	t.Helper()
+
+	for _, f := range p.Book.Files {
+		if f.id == "content" {
+			meta := f.doc.FindElement("./package/metadata")
+			if meta == nil {
+				t.Fatal("No package metadata")
+			}
+			return getXMLFragmentFromElement(meta, false)
+		}
+	}
+	t.Fatal("No package document")
+	return ""
+}
+
+func TestPublishInfo(t *testing.T) {
+
+	t.Run("description", func(t *testing.T) {
+		b := newPublishProcessor(t, OEpub, nil).Book
+		if b.Publisher != "Издательство" || b.PublishCity != "Москва" || b.PublishYear != "2002" || b.ISBN != "978-3-16-148410-0" {
+			t.Fatalf("Unexpected publish info: %q %q %q %q", b.Publisher, b.PublishCity, b.PublishYear, b.ISBN)
+		}
+		if len(b.Translators) != 1 || b.Translators[0].Last != "Петров" {
+			t.Fatalf("Unexpected translators: %v", b.Translators)
+		}
+		if b.SrcTitle != "Translated Book" || b.SrcLang != "en" || len(b.SrcAuthors) != 1 || b.SrcAuthors[0].Last != "Smith" {
+			t.Fatalf("Unexpected source info: %q %q %v", b.SrcTitle, b.SrcLang, b.SrcAuthors)
+		}
+		if len(b.Authors) != 1 || b.Authors[0].Last != "Иванов" {
+			t.Fatalf("Source authors mixed with book authors: %v", b.Authors)
+		}
+	})
+
+	t.Run("epub", func(t *testing.T) {
+		meta := packageMetadata(t, newPublishProcessor(t, OEpub, nil))
+		for _, s := range []string{
+			`<dc:contributor opf:role="trl">Петров Пётр</dc:contributor>`,
+			`<dc:identifier opf:scheme="ISBN">978-3-16-148410-0</dc:identifier>`,
+			`<dc:publisher>Издательство</dc:publisher>`,
+			`<dc:date>2002</dc:date>`,
+			`<dc:source>Translated Book</dc:source>`,
+		} {
+			if !strings.Contains(meta, s) {
+				t.Fatalf("%s is missing from metadata:\n%s", s, meta)
+			}
+		}
+	})
+
+	t.Run("epub3", func(t *testing.T) {
+		meta := packageMetadata(t, newPublishProcessor(t, OEpub3, nil))
+		for _, s := range []string{
+			`<dc:contributor id="contributor1">Петров Пётр</dc:contributor>`,
+			`<meta refines="#contributor1" property="role" scheme="marc:relators">trl</meta>`,
+			`<dc:identifier id="isbn">urn:isbn:978-3-16-148410-0</dc:identifier>`,
+			`<dc:publisher>Издательство</dc:publisher>`,
+		} {
+			if !strings.Contains(meta, s) {
+				t.Fatalf("%s is missing from metadata:\n%s", s, meta)
+			}
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		p := newPublishProcessor(t, OEpub, &config.MetaInfo{
+			Publisher:  "Other House",
+			ISBN:       "978-0-00-000000-2",
+			SrcTitle:   "Original",
+			SrcAuthors: []*config.AuthorName{{First: "Jane", Last: "Doe"}},
+		})
+		if p.Book.Publisher != "Other House" || p.Book.ISBN != "978-0-00-000000-2" || p.Book.PublishCity != "Москва" {
+			t.Fatalf("Unexpected publish info: %q %q %q", p.Book.Publisher, p.Book.ISBN, p.Book.PublishCity)
+		}
+		res, err := p.expandTemplate("test", `{{.Publisher}}|{{.PublishCity}}|{{.PublishYear}}|{{.ISBN}}|{{(index .Translators 0).LastName}}|{{.Source.Title}}|{{.Source.Language}}|{{(index .Source.Authors 0).LastName}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != "Other House|Москва|2002|978-0-00-000000-2|Петров|Original|en|Doe" {
+			t.Fatalf("Unexpected template expansion: %s", res)
+		}
+	})
+
+	t.Run("azw3", func(t *testing.T) {
+		p := newPublishProcessor(t, OAzw3, nil)
+		fname, err := p.Save()
+		if err != nil {
+			t.Fatalf("Unable to save book: %v", err)
+		}
+		u, err := mobi.NewUnpacker(fname, zap.NewNop())
+		if err != nil {
+			t.Fatalf("Unable to read result: %v", err)
+		}
+		exth := make(map[int]string)
+		for _, r := range u.Exth() {
+			if s, ok := r.Value.(string); ok {
+				exth[int(r.ID)] = s
+			}
+		}
+		for id, v := range map[int]string{101: "Издательство", 104: "978-3-16-148410-0", 106: "2002", 108: "Петров Пётр", 112: "Translated Book"} {
+			if exth[id] != v {
+				t.Fatalf("EXTH %d: expected %q, got %q", id, v, exth[id])
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// Repairs of broken FB2 documents. Every correction is logged and remembered, so it could be put in debug report.
+
+// readDocument parses FB2 source using read. Source which is not well formed XML is read again in recovery mode.
+func (p *Processor) readDocument(read func(doc *etree.Document) error) error {
+
+	err := read(p.doc)
+	if err == nil {
+		return nil
+	}
+	p.env.Log.Warn("Unable to parse FB2, trying to recover", zap.String("file", p.src), zap.Error(err))
+
+	doc := etree.NewDocument()
+	doc.ReadSettings = p.doc.ReadSettings
+	doc.WriteSettings = p.doc.WriteSettings
+	if doc.ReadSettings.Entity == nil {
+		// broken documents often use HTML named character references
+		if doc.ReadSettings.Entity, err = prepareHTMLNamedEntities(); err != nil {
+			return fmt.Errorf("unable to prepare HTML named entities: %w", err)
+		}
+	}
+	doc.ReadSettings.Recover = func(line int, msg string) {
+		p.repaired(fmt.Sprintf("line %d: %s", line, msg))
+	}
+	if err := read(doc); err != nil {
+		return fmt.Errorf("unable to parse FB2: %w", err)
+	}
+	if doc.SelectElement("FictionBook") == nil {
+		return fmt.Errorf("unable to parse FB2: no FictionBook element found")
+	}
+	p.doc = doc
+	return nil
+}
+
+// repaired records single correction.
+func (p *Processor) repaired(msg string) {
+	p.repairs = append(p.repairs, msg)
+	if p.metaOnly {
+		p.env.Log.Debug("FB2 repaired", zap.String("file", p.src), zap.String("fix", msg))
+		return
+	}
+	p.env.Log.Warn("FB2 repaired", zap.String("file", p.src), zap.String("fix", msg))
+}
+
+// repairDocument fixes problems which do not prevent parsing, but break conversion: binaries which could not be
+// decoded are dropped and duplicate ids are renamed, so links and images point to a single target.
+func (p *Processor) repairDocument() {
+
+	for _, el := range p.doc.FindElements("./FictionBook/binary") {
+		if id := getAttrValue(el, "id"); !p.binaryDecodable(el) {
+			p.repaired(fmt.Sprintf("binary %q cannot be decoded, dropped", id))
+			el.Parent().RemoveChild(el)
+		}
+	}
+
+	elements := p.doc.FindElements("//*[@id]")
+	ids := make(map[string]bool, len(elements)+len(p.binaries))
+	for _, el := range elements {
+		ids[getAttrValue(el, "id")] = true
+	}
+	for _, sb := range p.binaries {
+		ids[sb.id] = true
+	}
+	seen := make(map[string]bool, len(ids))
+	unique := func(id, tag string) string {
+		if !seen[id] {
+			seen[id] = true
+			return id
+		}
+		newID := id
+		for i := 2; ids[newID]; i++ {
+			newID = fmt.Sprintf("%s_%d", id, i)
+		}
+		ids[newID] = true
+		p.repaired(fmt.Sprintf("duplicate id %q of <%s> renamed to %q", id, tag, newID))
+		return newID
+	}
+	for _, el := range elements {
+		id := getAttrValue(el, "id")
+		if newID := unique(id, el.Tag); newID != id {
+			el.CreateAttr("id", newID)
+		}
+	}
+	// in low memory mode binaries are not in the document, they always come last
+	for _, sb := range p.binaries {
+		sb.id = unique(sb.id, "binary")
+	}
+
+	if p.env.Rpt != nil && len(p.repairs) > 0 {
+		if err := os.WriteFile(filepath.Join(p.tmpDir, "repairs.txt"), []byte(strings.Join(p.repairs, "\n")+"\n"), 0644); err != nil {
+			p.env.Log.Warn("Unable to save list of repairs", zap.Error(err))
+		}
+	}
+}
+
+// binaryDecodable checks if binary content is usable. Partially decoded images are kept when they could be decoded
+// or when broken images are requested.
+func (p *Processor) binaryDecodable(el *etree.Element) bool {
+
+	s := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, el.Text())
+	dst := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+	n, err := base64.StdEncoding.Decode(dst, []byte(s))
+	switch {
+	case err == nil:
+		return true
+	case n == 0:
+		return false
+	case p.env.Cfg.Doc.UseBrokenImages || strings.HasSuffix(strings.ToLower(getAttrValue(el, "content-type")), "svg"):
+		return true
+	}
+	_, _, err = decodeImage(dst[:n])
+	return err == nil
+}
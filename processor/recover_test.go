@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+const fb2Broken = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author><first-name>Иван</first-name><last-name>Иванов</last-name></author>
+   <book-title>Ромео & Джульетта</book-title>
+   <lang>ru</lang>
+  </title-info>
+ </description>
+ <body>
+  <section id="ch1">
+   <title><p>Глава 1</p></title>
+   <p>Текст с <emphasis>незакрытым тегом</p>
+   <p>Ссылка на <a l:href="#ch1">главу</a>&nbsp;и &#1;символ.</p>
+  </section>
+  <section id="ch1">
+   <title><p>Глава 2</p></title>
+   <p>Текст</p>
+  </section>
+ </body>
+ <binary id="broken.png" content-type="image/png">!!!!****</binary>
+`
+
+func TestRecoverBroken(t *testing.T) {
+
+	p, err := newTestProcessor(t, strings.NewReader(fb2Broken), false, OEpub, func(cfg *config.Config) {
+		cfg.Doc.Vignettes.Create = false
+	})
+	if err != nil {
+		t.Fatalf("Unable to recover book: %v", err)
+	}
+
+	for _, fix := range []string{
+		"line 7: stray '&' escaped",
+		"line 14: unclosed <emphasis> closed by </p>",
+		"line 15: reference to invalid character &#1; dropped",
+		"unclosed <FictionBook> closed at the end of document",
+		`binary "broken.png" cannot be decoded, dropped`,
+		`duplicate id "ch1" of <section> renamed to "ch1_2"`,
+	} {
+		found := false
+		for _, r := range p.repairs {
+			found = found || strings.HasSuffix(r, fix)
+		}
+		if !found {
+			t.Errorf("Repair %q not recorded:\n%s", fix, strings.Join(p.repairs, "\n"))
+		}
+	}
+
+	if len(p.doc.FindElements("./FictionBook/binary")) != 0 {
+		t.Fatal("Broken binary was not dropped")
+	}
+	if err := p.Process(); err != nil {
+		t.Fatalf("Unable to process recovered book: %v", err)
+	}
+	if p.Book.Title != "Ромео & Джульетта" {
+		t.Fatalf("Unexpected title: %q", p.Book.Title)
+	}
+	if _, err := p.Save(); err != nil {
+		t.Fatalf("Unable to save recovered book: %v", err)
+	}
+}
+
+func TestRecoverWellFormed(t *testing.T) {
+
+	p, err := newTestProcessor(t, strings.NewReader(fb2Text), false, OEpub, nil)
+	if err != nil {
+		t.Fatalf("Unable to parse book: %v", err)
+	}
+	if len(p.repairs) != 0 {
+		t.Fatalf("Unexpected repairs of well formed book:\n%s", strings.Join(p.repairs, "\n"))
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"text/template"
 
 	sprig "github.com/go-task/slim-sprig/v3"
+
+	"fb2converter/config"
 )
 
 type SequenceDefinition struct {
@@ -20,6 +22,12 @@ type AuthorDefinition struct {
 	FirstName, MiddleName, LastName string
 }
 
+type SourceDefinition struct {
+	Title    string
+	Language string
+	Authors  []AuthorDefinition
+}
+
 type NoteDefinition struct {
 	Name               string
 	Number, NoteNumber int
@@ -38,6 +46,14 @@ type Values struct {
 	BookID     string
 	ASIN       string
 	Genres     []string
+	// publish-info
+	Publisher   string
+	PublishCity string
+	PublishYear string
+	ISBN        string
+	Translators []AuthorDefinition
+	// src-title-info
+	Source SourceDefinition
 	// context dependent
 	Author any
 	Body   any
@@ -59,22 +75,25 @@ func (p *Processor) expandTemplate(name, field string, args ...any) (string, err
 			Name:   p.Book.SeqName,
 			Number: p.Book.SeqNum,
 		},
-		Language:   p.Book.Lang.String(),
-		Date:       p.Book.Date,
-		Format:     p.format.String(),
-		SourceFile: strings.TrimSuffix(filepath.Base(p.src), filepath.Ext(p.src)),
-		BookID:     p.Book.ID.String(),
-		ASIN:       p.Book.ASIN,
-		Genres:     slices.Clone(p.Book.Genres),
-	}
-
-	for _, a := range p.Book.Authors {
-		values.Authors = append(values.Authors, AuthorDefinition{
-			FirstName:  a.First,
-			MiddleName: a.Middle,
-			LastName:   a.Last,
-		})
+		Language:    p.Book.Lang.String(),
+		Date:        p.Book.Date,
+		Format:      p.format.String(),
+		SourceFile:  strings.TrimSuffix(filepath.Base(p.src), filepath.Ext(p.src)),
+		BookID:      p.Book.ID.String(),
+		ASIN:        p.Book.ASIN,
+		Genres:      slices.Clone(p.Book.Genres),
+		Publisher:   p.Book.Publisher,
+		PublishCity: p.Book.PublishCity,
+		PublishYear: p.Book.PublishYear,
+		ISBN:        p.Book.ISBN,
+		Translators: authorDefinitions(p.Book.Translators),
+		Source: SourceDefinition{
+			Title:    p.Book.SrcTitle,
+			Language: p.Book.SrcLang,
+			Authors:  authorDefinitions(p.Book.SrcAuthors),
+		},
 	}
+	values.Authors = authorDefinitions(p.Book.Authors)
 
 	// context dependent
 
@@ -108,3 +127,15 @@ func (p *Processor) expandTemplate(name, field string, args ...any) (string, err
 	}
 	return buf.String(), nil
 }
+
+func authorDefinitions(names []*config.AuthorName) []AuthorDefinition {
+	var res []AuthorDefinition
+	for _, a := range names {
+		res = append(res, AuthorDefinition{
+			FirstName:  a.First,
+			MiddleName: a.Middle,
+			LastName:   a.Last,
+		})
+	}
+	return res
+}
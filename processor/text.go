@@ -0,0 +1,790 @@
+package processor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	tc "golang.org/x/text/cases"
+
+	"fb2converter/etree"
+)
+
+// Plain text, markdown and single page html are rendered from XHTML content produced by transfer, so all FB2 processing
+// (titles, notes, text transformations) is shared with other formats.
+
+// textual checks if requested output is a single document rendered from generated content rather than packaged book.
+func (p *Processor) textual() bool {
+	return p.format == OTxt || p.format == OMd || p.format == OHtml
+}
+
+// FinalizeTXT produces plain text file out of generated content.
+func (p *Processor) FinalizeTXT(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+	w := newTextWriter(p, false)
+	return os.WriteFile(fname, []byte(w.render()), 0644)
+}
+
+// FinalizeMD produces markdown file out of generated content. Images are stored in directory next to it.
+func (p *Processor) FinalizeMD(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+
+	w := newTextWriter(p, true)
+	w.media = strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)) + "_files"
+	text := w.render()
+
+	if len(w.images) > 0 {
+		dir := filepath.Join(filepath.Dir(fname), w.media)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("unable to create images directory: %w", err)
+		}
+		for _, name := range w.images {
+			data, err := os.ReadFile(filepath.Join(p.tmpDir, DirContent, DirImages, name))
+			if err != nil {
+				return fmt.Errorf("unable to read image: %w", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				return fmt.Errorf("unable to save image: %w", err)
+			}
+		}
+	}
+	return os.WriteFile(fname, []byte(text), 0644)
+}
+
+// FinalizeHTML produces self-contained html page out of generated content: stylesheet is inlined and all images are
+// turned into data URIs.
+func (p *Processor) FinalizeHTML(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+
+	// stylesheet goes in as is, XML escaping would break it
+	const stylePlaceholder = "fb2c-stylesheet"
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateDirective("DOCTYPE html")
+	root := doc.AddNext("html", attr("lang", p.Book.Lang.String()))
+	head := root.AddNext("head").
+		AddSame("meta", attr("charset", "utf-8")).
+		AddSame("meta", attr("name", "viewport"), attr("content", "width=device-width, initial-scale=1"))
+	head.AddNext("title").SetText(p.Book.Title)
+	head.AddNext("style").SetText(stylePlaceholder)
+	body := root.AddNext("body")
+
+	if img := p.coverImage(); img != nil {
+		body.AddNext("div", attr("class", "image")).AddNext("img", attr("src", path.Join(DirImages, img.fname)), attr("alt", "cover"))
+	}
+
+	ids := make(map[string]string, len(p.Book.Files))
+	for _, f := range p.Book.Files {
+		if f != nil {
+			ids[f.fname] = "doc-" + f.id
+		}
+	}
+	for _, f := range p.Book.Files {
+		if f == nil || f.doc == nil {
+			continue
+		}
+		from := f.doc.FindElement("./html/body")
+		if from == nil {
+			continue
+		}
+		to := body.AddNext("div", attr("id", ids[f.fname]))
+		for from = from.Copy(); len(from.Child) > 0; {
+			to.AddChild(from.Child[0])
+		}
+	}
+
+	uris := make(map[string]string)
+	dataURI := func(src string) string {
+		if uri, ok := uris[src]; ok {
+			return uri
+		}
+		data, err := os.ReadFile(filepath.Join(p.tmpDir, DirContent, filepath.FromSlash(src)))
+		if err != nil {
+			p.env.Log.Warn("Unable to inline resource", zap.String("src", src), zap.Error(err))
+			return src
+		}
+		ct := mime.TypeByExtension(path.Ext(src))
+		if len(ct) == 0 {
+			ct = http.DetectContentType(data)
+		}
+		uri := "data:" + ct + ";base64," + base64.StdEncoding.EncodeToString(data)
+		uris[src] = uri
+		return uri
+	}
+
+	for _, e := range body.FindElements(".//*") {
+		e.Attr = slices.DeleteFunc(e.Attr, func(a etree.Attr) bool {
+			return a.Space == "epub" || a.Space == "xmlns" || a.Key == "xmlns"
+		})
+		switch e.Tag {
+		case "img":
+			if src := getAttrValue(e, "src"); len(src) > 0 && !isExternalLink(src) {
+				e.CreateAttr("src", dataURI(src))
+			}
+		case "image":
+			// svg
+			if src := e.SelectAttrValue("xlink:href", ""); len(src) > 0 && !isExternalLink(src) {
+				e.CreateAttr("xlink:href", dataURI(src))
+			}
+		case "a":
+			if href := getAttrValue(e, "href"); len(href) > 0 && !isExternalLink(href) {
+				file, frag, _ := strings.Cut(href, "#")
+				if id, ok := ids[file]; ok {
+					if len(frag) == 0 {
+						frag = id
+					}
+					e.CreateAttr("href", "#"+frag)
+				}
+			}
+		}
+		if len(e.Child) == 0 && !isVoidElement(e.Tag) {
+			// html parsers do not understand self-closing tags
+			e.CreateCharData("")
+		}
+	}
+
+	var css string
+	for _, d := range p.Book.Data {
+		if d.ct == "text/css" {
+			css = reCSSURL.ReplaceAllStringFunc(string(d.data), func(s string) string {
+				m := reCSSURL.FindStringSubmatch(s)
+				if isExternalLink(m[1]) || strings.HasPrefix(m[1], "data:") {
+					return s
+				}
+				return `url("` + dataURI(m[1]) + `")`
+			})
+			break
+		}
+	}
+
+	out, err := doc.WriteToString()
+	if err != nil {
+		return fmt.Errorf("unable to produce html: %w", err)
+	}
+	out = strings.Replace(out, stylePlaceholder, "\n"+css+"\n", 1)
+	return os.WriteFile(fname, []byte(out), 0644)
+}
+
+var reCSSURL = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+
+// prepareOutputFile checks if output file could be written.
+func (p *Processor) prepareOutputFile(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+	return nil
+}
+
+// coverImage returns book cover if book has one.
+func (p *Processor) coverImage() *binImage {
+	if len(p.Book.Cover) == 0 {
+		return nil
+	}
+	for _, b := range p.Book.Images {
+		if b.id == p.Book.Cover {
+			return b
+		}
+	}
+	return nil
+}
+
+func isExternalLink(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && len(u.Scheme) > 0
+}
+
+func isVoidElement(tag string) bool {
+	switch tag {
+	case "area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "source", "track", "wbr":
+		return true
+	}
+	return false
+}
+
+// textWriter renders generated XHTML as plain text or markdown.
+type textWriter struct {
+	p        *Processor
+	markdown bool
+	width    int
+	media    string            // markdown: directory images are stored in, relative to output file
+	images   map[string]string // markdown: image src in content -> stored file name
+
+	buf     strings.Builder
+	started bool
+	tight   bool   // last block was a verse line
+	quote   int    // quotation level of the last block
+	lead    string // prefix of the first line of the next block (endnote number)
+	hang    string // prefix of all other lines while endnote is rendered
+
+	notes   []string       // note ids in order of first reference
+	numbers map[string]int // note id -> endnote number
+}
+
+func newTextWriter(p *Processor, markdown bool) *textWriter {
+	w := &textWriter{
+		p:        p,
+		markdown: markdown,
+		images:   make(map[string]string),
+		numbers:  make(map[string]int),
+	}
+	if !markdown {
+		w.width = p.env.Cfg.Doc.Text.Width
+	}
+	return w
+}
+
+// render produces resulting text: main content in order followed by endnotes.
+func (w *textWriter) render() string {
+
+	// notes bodies are rendered as endnotes
+	notes := make(map[string]bool)
+	for _, n := range w.p.Book.Notes {
+		notes[GenSafeName(n.bodyName)+".xhtml"] = true
+	}
+
+	if img := w.p.coverImage(); img != nil && w.markdown {
+		w.emit([]string{w.imageRef(path.Join(DirImages, img.fname), "cover")}, 0, false, 0)
+	}
+	for _, f := range w.p.Book.Files {
+		if f == nil || f.doc == nil || notes[f.fname] {
+			continue
+		}
+		if body := f.doc.FindElement("./html/body"); body != nil {
+			w.blocks(body, 0, false)
+		}
+	}
+	w.endnotes()
+	return w.buf.String()
+}
+
+// endnotes renders all notes, referenced ones first and in order of reference.
+func (w *textWriter) endnotes() {
+
+	if len(w.p.Book.NotesOrder) == 0 {
+		return
+	}
+
+	if !w.markdown {
+		// markdown renderers collect footnotes themselves
+		var titles []string
+		for _, nl := range w.p.Book.NotesOrder {
+			t := tc.Title(w.p.Book.Lang).String(nl.bodyName)
+			if nt, ok := w.p.Book.NoteBodyTitles[nl.bodyName]; ok {
+				t = nt.title
+			}
+			if !slices.Contains(titles, t) {
+				titles = append(titles, t)
+			}
+		}
+		w.heading(strings.Split(AllLines(strings.Join(titles, " / ")), "\n"), 1, 0)
+	}
+
+	for i := 0; ; i++ {
+		if i == len(w.notes) {
+			// notes nobody references are still part of the book
+			for _, nl := range w.p.Book.NotesOrder {
+				w.noteNumber(nl.id)
+			}
+			if i == len(w.notes) {
+				break
+			}
+		}
+		n, ok := w.p.Book.Notes[w.notes[i]]
+		if !ok || n.parsed == nil {
+			continue
+		}
+		if w.markdown {
+			w.lead, w.hang = fmt.Sprintf("[^%d]: ", i+1), "    "
+		} else {
+			w.lead = fmt.Sprintf("[%d] ", i+1)
+			w.hang = strings.Repeat(" ", utf8.RuneCountInString(w.lead))
+		}
+		w.blocks(n.parsed, 0, false)
+		w.lead, w.hang = "", ""
+	}
+}
+
+// noteNumber returns endnote number, assigning new one on first reference.
+func (w *textWriter) noteNumber(id string) int {
+	if n, ok := w.numbers[id]; ok {
+		return n
+	}
+	w.notes = append(w.notes, id)
+	w.numbers[id] = len(w.notes)
+	return len(w.notes)
+}
+
+// blocks renders block level content of the element, loose inline content is treated as paragraph.
+func (w *textWriter) blocks(e *etree.Element, quote int, verse bool) {
+
+	var pending []etree.Token
+	flush := func() {
+		if len(pending) > 0 {
+			w.paragraph(w.inlineTokens(pending), quote, verse)
+			pending = pending[:0]
+		}
+	}
+	for _, t := range e.Child {
+		if c, ok := t.(*etree.Element); ok && !isInlineElement(c.Tag) {
+			flush()
+			w.block(c, quote, verse)
+			if len(c.TailData) > 0 {
+				pending = append(pending, etree.NewCharData(c.TailData))
+			}
+			continue
+		}
+		pending = append(pending, t)
+	}
+	flush()
+}
+
+func (w *textWriter) block(e *etree.Element, quote int, verse bool) {
+
+	cls := getAttrValue(e, "class")
+	switch e.Tag {
+	case "p":
+		switch {
+		case strings.HasPrefix(cls, "vignette"):
+		case cls == "subtitle":
+			text := normalizeText(w.inline(e))
+			if w.markdown && len(text) > 0 {
+				text = emphasize(text, "**")
+			}
+			w.paragraph(text, quote, false)
+		default:
+			w.paragraph(w.inline(e), quote, verse)
+		}
+	case "div":
+		switch {
+		case strings.HasPrefix(cls, "titleblock"):
+			w.title(e, quote)
+		case strings.HasPrefix(cls, "vignette"), cls == "chapter_end", cls == "section":
+		case cls == "image":
+			if img := e.SelectElement("img"); img != nil && w.markdown {
+				w.emit([]string{w.imageRef(getAttrValue(img, "src"), getAttrValue(img, "alt"))}, quote, false, 0)
+			}
+		case cls == "emptyline":
+			if w.started && !w.markdown {
+				w.buf.WriteString("\n")
+			}
+			w.tight = false
+		case cls == "stanza":
+			w.blocks(e, quote, true)
+			w.tight = false
+		case cls == "poem", cls == "epigraph", cls == "cite", cls == "annotation":
+			w.blocks(e, quote+1, false)
+		case cls == "text-author":
+			text := normalizeText(w.inline(e))
+			if w.markdown && len(text) > 0 {
+				text = emphasize(text, "*")
+			}
+			w.paragraph(text, quote, false)
+		case headerLevel(cls) >= 0:
+			w.title(e, quote)
+		default:
+			w.blocks(e, quote, verse)
+		}
+	case "table":
+		w.table(e, quote)
+	default:
+		w.blocks(e, quote, verse)
+	}
+}
+
+// title renders title block.
+func (w *textWriter) title(e *etree.Element, quote int) {
+
+	level := headerLevel(getAttrValue(e, "class"))
+	for _, d := range e.FindElements(".//div[@class]") {
+		if level >= 0 {
+			break
+		}
+		level = headerLevel(getAttrValue(d, "class"))
+	}
+
+	var lines []string
+	for _, el := range e.FindElements(".//p") {
+		if strings.HasPrefix(getAttrValue(el, "class"), "vignette") {
+			continue
+		}
+		if t := normalizeText(w.inline(el)); len(t) > 0 {
+			lines = append(lines, t)
+		}
+	}
+	if len(lines) == 0 {
+		if t := normalizeText(w.inline(e)); len(t) > 0 {
+			lines = append(lines, t)
+		}
+	}
+	w.heading(lines, max(level, 0), quote)
+}
+
+func (w *textWriter) heading(lines []string, level, quote int) {
+
+	if len(lines) == 0 {
+		return
+	}
+	if w.markdown {
+		text := lines[0]
+		for _, l := range lines[1:] {
+			if strings.ContainsAny(text[len(text)-1:], ".!?:;…") {
+				text += " " + l
+			} else {
+				text += ". " + l
+			}
+		}
+		w.emit([]string{strings.Repeat("#", min(level+1, 6)) + " " + text}, quote, false, 0)
+		return
+	}
+
+	if w.started && level <= 1 {
+		// chapters are easier to see with more space around them
+		w.buf.WriteString("\n")
+	}
+	var underline int
+	for _, l := range lines {
+		underline = max(underline, utf8.RuneCountInString(l))
+	}
+	if w.width > 0 {
+		underline = min(underline, w.width)
+	}
+	switch level {
+	case 0:
+		lines = append(lines, strings.Repeat("=", underline))
+	case 1:
+		lines = append(lines, strings.Repeat("-", underline))
+	}
+	w.emit(lines, quote, false, 0)
+}
+
+// paragraph renders single paragraph or verse line.
+func (w *textWriter) paragraph(text string, quote int, verse bool) {
+
+	var lines []string
+	for l := range strings.SplitSeq(text, "\n") {
+		if l = normalizeText(l); len(l) > 0 {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if w.markdown {
+		for i := range lines {
+			lines[i] = escapeLineStart(lines[i])
+			if i < len(lines)-1 || verse {
+				// hard line break
+				lines[i] += "  "
+			}
+		}
+	}
+	indent := 0
+	if verse {
+		indent = 2
+	}
+	w.emit(lines, quote, verse, indent)
+}
+
+func (w *textWriter) table(e *etree.Element, quote int) {
+
+	var rows [][]string
+	var columns int
+	for _, tr := range e.FindElements(".//tr") {
+		var row []string
+		for _, td := range tr.ChildElements() {
+			if td.Tag != "td" && td.Tag != "th" {
+				continue
+			}
+			text := normalizeText(strings.ReplaceAll(w.inline(td), "\n", " "))
+			if w.markdown {
+				text = strings.ReplaceAll(text, "|", `\|`)
+			}
+			row = append(row, text)
+		}
+		columns = max(columns, len(row))
+		rows = append(rows, row)
+	}
+	if columns == 0 {
+		return
+	}
+
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		if !w.markdown {
+			lines = append(lines, strings.Join(row, " | "))
+			continue
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, strings.TrimSpace(strings.Repeat("| --- ", columns))+" |")
+		}
+	}
+	w.emit(lines, quote, false, -1)
+}
+
+// emit writes block lines separating it from the previous block with empty line. Lines are wrapped to configured width
+// unless indent is negative, continuation lines are indented.
+func (w *textWriter) emit(lines []string, quote int, tight bool, indent int) {
+
+	prefix := strings.Repeat("    ", quote)
+	if w.markdown {
+		prefix = strings.Repeat("> ", quote)
+	}
+	if w.started && !(tight && w.tight) {
+		sep := strings.Repeat("    ", min(quote, w.quote))
+		if w.markdown {
+			sep = strings.Repeat("> ", min(quote, w.quote))
+		}
+		w.buf.WriteString(strings.TrimRight(w.hang+sep, " ") + "\n")
+	}
+
+	for _, line := range lines {
+		lead := w.hang
+		if len(w.lead) > 0 {
+			lead, w.lead = w.lead, ""
+		}
+		parts := []string{line}
+		if !w.markdown && w.width > 0 && indent >= 0 {
+			parts = wrapText(line, max(w.width-utf8.RuneCountInString(lead+prefix), 20), indent)
+		}
+		for i, part := range parts {
+			if i > 0 {
+				lead = w.hang
+			}
+			if len(part) == 0 {
+				w.buf.WriteString(strings.TrimRight(lead+prefix, " ") + "\n")
+				continue
+			}
+			w.buf.WriteString(lead + prefix + part + "\n")
+		}
+	}
+	w.started, w.tight, w.quote = true, tight, quote
+}
+
+// inline renders element content as a single piece of text.
+func (w *textWriter) inline(e *etree.Element) string {
+	return w.inlineTokens(e.Child)
+}
+
+func (w *textWriter) inlineTokens(tokens []etree.Token) string {
+
+	var b strings.Builder
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.WriteString(w.escape(t.Data))
+		case *etree.Element:
+			b.WriteString(w.inlineElement(t))
+			b.WriteString(w.escape(t.TailData))
+		}
+	}
+	return b.String()
+}
+
+func (w *textWriter) inlineElement(e *etree.Element) string {
+
+	switch e.Tag {
+	case "br":
+		return "\n"
+	case "img":
+		if !w.markdown || !strings.HasPrefix(getAttrValue(e, "src"), DirImages+"/") {
+			return ""
+		}
+		return w.imageRef(getAttrValue(e, "src"), getAttrValue(e, "alt"))
+	case "code":
+		if w.markdown {
+			if text := normalizeText(strings.ReplaceAll(textOf(e), "`", "'")); len(text) > 0 {
+				return "`" + text + "`"
+			}
+		}
+	case "a":
+		href := getAttrValue(e, "href")
+		if len(href) == 0 {
+			break
+		}
+		if _, id, ok := strings.Cut(href, "#"); ok {
+			if _, ok := w.p.Book.Notes[id]; ok {
+				if w.markdown {
+					return "[^" + strconv.Itoa(w.noteNumber(id)) + "]"
+				}
+				return "[" + strconv.Itoa(w.noteNumber(id)) + "]"
+			}
+		}
+		if !isExternalLink(href) {
+			break
+		}
+		text := w.inline(e)
+		if w.markdown {
+			return "[" + text + "](" + strings.ReplaceAll(href, ")", "%29") + ")"
+		}
+		if strings.TrimSpace(text) == href {
+			return text
+		}
+		return text + " (" + href + ")"
+	case "span":
+		if !w.markdown {
+			break
+		}
+		switch getAttrValue(e, "class") {
+		case "strong":
+			return emphasize(w.inline(e), "**")
+		case "emphasis":
+			return emphasize(w.inline(e), "*")
+		case "strike":
+			return emphasize(w.inline(e), "~~")
+		}
+	}
+	return w.inline(e)
+}
+
+// imageRef returns markdown image reference remembering image to be stored with the result.
+func (w *textWriter) imageRef(src, alt string) string {
+	name := path.Base(src)
+	w.images[src] = name
+	return "![" + w.escape(alt) + "](" + w.media + "/" + url.PathEscape(name) + ")"
+}
+
+var mdEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "~", `\~`, "&", `\&`, "|", `\|`,
+)
+
+// escape prepares text: drops soft hyphens and markdown special characters are escaped.
+func (w *textWriter) escape(text string) string {
+	text = strings.ReplaceAll(text, strSOFTHYPHEN, "")
+	if w.markdown {
+		text = mdEscaper.Replace(text)
+	}
+	return text
+}
+
+var reMDLineStart = regexp.MustCompile(`^(#|[-+=]\s|[-+=]$|\d+[.)](\s|$))`)
+
+// escapeLineStart makes sure markdown line does not start list or heading.
+func escapeLineStart(line string) string {
+	if loc := reMDLineStart.FindStringIndex(line); loc != nil {
+		if line[0] >= '0' && line[0] <= '9' {
+			i := strings.IndexAny(line, ".)")
+			return line[:i] + `\` + line[i:]
+		}
+		return `\` + line
+	}
+	return line
+}
+
+// emphasize wraps text into markdown emphasis keeping surrounding spaces outside.
+func emphasize(text, mark string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+	i := strings.Index(text, trimmed)
+	return text[:i] + mark + trimmed + mark + text[i+len(trimmed):]
+}
+
+var reXMLSpaces = regexp.MustCompile(`[ \t\r\n]+`)
+
+// normalizeText collapses XML white space, leaving non-breaking spaces alone.
+func normalizeText(text string) string {
+	return strings.Trim(reXMLSpaces.ReplaceAllString(text, " "), " ")
+}
+
+// wrapText breaks line on spaces to fit width.
+func wrapText(line string, width, indent int) []string {
+
+	if utf8.RuneCountInString(line) <= width {
+		return []string{line}
+	}
+
+	var (
+		res   []string
+		cur   strings.Builder
+		size  int
+		empty = true // no words on current line yet
+	)
+	for word := range strings.SplitSeq(line, " ") {
+		if len(word) == 0 {
+			continue
+		}
+		wl := utf8.RuneCountInString(word)
+		if !empty && size+1+wl > width {
+			res = append(res, cur.String())
+			cur.Reset()
+			cur.WriteString(strings.Repeat(" ", indent))
+			size, empty = indent, true
+		}
+		if !empty {
+			cur.WriteByte(' ')
+			size++
+		}
+		cur.WriteString(word)
+		size, empty = size+wl, false
+	}
+	if !empty {
+		res = append(res, cur.String())
+	}
+	return res
+}
+
+// textOf returns all text of the element.
+func textOf(e *etree.Element) string {
+	var b strings.Builder
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.WriteString(t.Data)
+		case *etree.Element:
+			b.WriteString(textOf(t))
+			b.WriteString(t.TailData)
+		}
+	}
+	return b.String()
+}
+
+func isInlineElement(tag string) bool {
+	switch tag {
+	case "span", "a", "img", "code", "time", "sup", "sub", "br", "b", "i", "em", "strong", "small", "u", "s":
+		return true
+	}
+	return false
+}
+
+// headerLevel returns level of "hN" class, -1 for anything else.
+func headerLevel(cls string) int {
+	if len(cls) == 2 && cls[0] == 'h' && cls[1] >= '0' && cls[1] <= '9' {
+		return int(cls[1] - '0')
+	}
+	return -1
+}
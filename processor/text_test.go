@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fb2converter/config"
+)
+
+const fb2Text = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+ <description>
+  <title-info>
+   <genre>sf</genre>
+   <author>
+    <first-name>John</first-name>
+    <last-name>Smith</last-name>
+   </author>
+   <book-title>Text Book</book-title>
+   <lang>en</lang>
+  </title-info>
+  <document-info>
+   <id>0c1d6d3c-79f2-4bc5-a4b9-25e1a1b4f8d2</id>
+  </document-info>
+ </description>
+ <body>
+  <title>
+   <p>John Smith</p>
+   <p>Text Book</p>
+  </title>
+  <section>
+   <title>
+    <p>Chapter 1</p>
+   </title>
+   <epigraph>
+    <p>Short epigraph.</p>
+    <text-author>Somebody</text-author>
+   </epigraph>
+   <p>First paragraph is long enough to be wrapped, it has <emphasis>emphasis</emphasis>, <strong>strong</strong> text and a note<a l:href="#n_1" type="note">[1]</a>.</p>
+   <p>Second paragraph points to <a l:href="https://example.com/">site</a> and to the second note<a l:href="#n_2" type="note">[2]</a>.</p>
+   <empty-line/>
+   <poem>
+    <stanza>
+     <v>First line of the poem,</v>
+     <v>second line of the poem.</v>
+    </stanza>
+    <stanza>
+     <v>Another stanza.</v>
+    </stanza>
+   </poem>
+   <subtitle>* * *</subtitle>
+   <cite>
+    <p>Citation.</p>
+   </cite>
+   <image l:href="#pic.png"/>
+   <table>
+    <tr><th>Name</th><th>Value</th></tr>
+    <tr><td>one</td><td>1</td></tr>
+   </table>
+  </section>
+ </body>
+ <body name="notes">
+  <title>
+   <p>Notes</p>
+  </title>
+  <section id="n_1">
+   <title>
+    <p>1</p>
+   </title>
+   <p>First note.</p>
+  </section>
+  <section id="n_2">
+   <title>
+    <p>2</p>
+   </title>
+   <p>Second note.</p>
+   <p>More of the second note.</p>
+  </section>
+ </body>
+ <binary id="pic.png" content-type="image/png">iVBORw0KGgoAAAANSUhEUgAAAAQAAAAECAIAAAAmkwkpAAAAEElEQVR4nGP4z8AARwzEcQCukw/x0F8jngAAAABJRU5ErkJggg==</binary>
+</FictionBook>
+`
+
+func convertText(t *testing.T, format OutputFmt, width int) (string, string) {
+
+	t.Helper()
+
+	p := processBook(t, fb2Text, format, func(cfg *config.Config) {
+		cfg.Doc.Text.Width = width
+		cfg.Doc.Vignettes.Create = false
+	})
+	fname, err := p.Save()
+	if err != nil {
+		t.Fatalf("Unable to save book: %v", err)
+	}
+	if filepath.Ext(fname) != "."+format.String() {
+		t.Fatalf("Unexpected output name: %s", fname)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), fname
+}
+
+func TestTextFormats(t *testing.T) {
+
+	t.Run("txt", func(t *testing.T) {
+		out, _ := convertText(t, OTxt, 40)
+		for _, s := range []string{
+			"Chapter 1\n---------\n",
+			"    Short epigraph.\n",
+			"First paragraph is long enough to be\nwrapped, it has emphasis, strong text\nand a note[1].\n",
+			"site\n(https://example.com/) and to the second\nnote[2].",
+			"    First line of the poem,\n    second line of the poem.\n\n    Another stanza.\n",
+			"Name | Value\none | 1\n",
+			"Notes\n-----\n\n[1] First note.\n\n[2] Second note.\n\n    More of the second note.\n",
+		} {
+			if !strings.Contains(out, s) {
+				t.Fatalf("%q is missing from result:\n%s", s, out)
+			}
+		}
+		for line := range strings.SplitSeq(out, "\n") {
+			if len([]rune(line)) > 40 {
+				t.Fatalf("Line is too long: %q", line)
+			}
+		}
+		if strings.Count(out, "First note.") != 1 {
+			t.Fatal("Notes body must only be rendered as endnotes")
+		}
+	})
+
+	t.Run("md", func(t *testing.T) {
+		out, fname := convertText(t, OMd, 0)
+		for _, s := range []string{
+			"# John Smith. Text Book\n",
+			"## Chapter 1\n",
+			"> Short epigraph.\n>\n> *Somebody*\n",
+			"it has *emphasis*, **strong** text and a note[^1].\n",
+			"[site](https://example.com/) and to the second note[^2].\n",
+			"> First line of the poem,  \n> second line of the poem.  \n",
+			"**\\* \\* \\***\n",
+			"![bin00000000.png](book_files/bin00000000.png)\n",
+			"| Name | Value |\n| --- | --- |\n| one | 1 |\n",
+			"[^1]: First note.\n",
+			"[^2]: Second note.\n\n    More of the second note.\n",
+		} {
+			if !strings.Contains(out, s) {
+				t.Fatalf("%q is missing from result:\n%s", s, out)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(fname), "book_files", "bin00000000.png")); err != nil {
+			t.Fatalf("Image was not stored: %v", err)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		out, _ := convertText(t, OHtml, 0)
+		if !strings.HasPrefix(out, "<!DOCTYPE html><html lang=\"en\">") {
+			t.Fatalf("Unexpected start of result: %.100s", out)
+		}
+		for _, s := range []string{
+			"<style>\n@page",
+			`<img src="data:image/png;base64,`,
+			`<a class="anchor" href="#n_1">[1]</a>`,
+			`<a href="#tocref2">Chapter 1</a>`,
+			`<div class="emptyline"></div>`,
+			`<div class="poem">`,
+		} {
+			if !strings.Contains(out, s) {
+				t.Fatalf("%q is missing from result", s)
+			}
+		}
+		for _, s := range []string{"images/", ".xhtml", "/>\n<div", "epub:type"} {
+			if strings.Contains(out, s) {
+				t.Fatalf("%q should not be in result", s)
+			}
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package processor
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor/internal/mobi"
+)
+
+// UnpackKF8 extracts KF8 content of Kindle book (azw3 or combo mobi) as EPUB and stores it along with EXTH
+// metadata in JSON format.
+func UnpackKF8(fname, epub, meta string, log *zap.Logger) error {
+
+	u, err := newUnpacker(fname, log)
+	if err != nil {
+		return err
+	}
+	if err := u.SaveResult(epub); err != nil {
+		return err
+	}
+	return u.SaveExth(meta)
+}
+
+// ReadKF8 returns KF8 content of Kindle book (azw3 or combo mobi) as EPUB.
+func ReadKF8(fname string, log *zap.Logger) ([]byte, error) {
+
+	u, err := newUnpacker(fname, log)
+	if err != nil {
+		return nil, err
+	}
+	return u.Result(), nil
+}
+
+func newUnpacker(fname string, log *zap.Logger) (u *mobi.Unpacker, err error) {
+
+	defer func() {
+		// damaged books could have offsets pointing anywhere
+		if r := recover(); r != nil {
+			log.Debug("Unpacking ended with panic", zap.String("file", fname), zap.ByteString("stack", debug.Stack()))
+			u, err = nil, fmt.Errorf("unable to parse book: %v", r)
+		}
+	}()
+	return mobi.NewUnpacker(fname, log)
+}
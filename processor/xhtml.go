@@ -21,6 +21,27 @@ import (
 	"fb2converter/etree"
 )
 
+// epubTypes checks if generated XHTML carries epub:type semantic attributes - EPUB3 always does, others only for new
+// floating notes.
+func (p *Processor) epubTypes() bool {
+	return p.format == OEpub3 || p.notesMode == NFloatNew || p.notesMode == NFloatNewMore
+}
+
+// asideNotes checks if notes are generated as footnote asides, only then note references are marked for reading systems
+// to show notes in popups.
+func (p *Processor) asideNotes() bool {
+	return p.notesMode == NFloatNew || p.notesMode == NFloatNewMore
+}
+
+// xhtmlNamespaces returns namespace declarations for content documents.
+func (p *Processor) xhtmlNamespaces() []*etree.Attr {
+	ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
+	if p.epubTypes() {
+		ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
+	}
+	return ns
+}
+
 // processBody parses fb2 document body and produces formatted output.
 func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 
@@ -44,11 +65,7 @@ func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 
 	if p.notesMode == NDefault || !IsOneOf(p.ctx().bodyName, p.env.Cfg.Doc.Notes.BodyNames) {
 		// initialize first XHTML buffer
-		ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-		if p.notesMode == NFloatNew || p.notesMode == NFloatNewMore {
-			ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-		}
-		to, f := p.ctx().createXHTML("", ns...)
+		to, f := p.ctx().createXHTML("", p.xhtmlNamespaces()...)
 		p.Book.Files = append(p.Book.Files, f)
 		p.Book.Pages[f.fname] = 0
 		return p.transfer(from, to)
@@ -60,11 +77,7 @@ func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 	}
 
 	// initialize XHTML buffer for notes
-	ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-	if p.notesMode == NFloatNew || p.notesMode == NFloatNewMore {
-		ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-	}
-	to, f := p.ctx().createXHTML("", ns...)
+	to, f := p.ctx().createXHTML("", p.xhtmlNamespaces()...)
 	p.Book.Files = append(p.Book.Files, f)
 
 	// To satisfy Amazon's requirements for floating notes we have to create notes body on the fly here, removing most if not
@@ -525,7 +538,7 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 			attrs[0] = attr("id", newid)
 			attrs[1] = attr("class", css)
 			attrs[2] = attr("href", href)
-			if (p.notesMode == NFloatNew || p.notesMode == NFloatNewMore) && tag == "a" && css == "anchor" {
+			if p.asideNotes() && tag == "a" && css == "anchor" {
 				attrs = append(attrs, attr("epub:type", "noteref"))
 			}
 			inner = to.AddNext(tag, attrs...)
@@ -555,6 +568,9 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 						to, inner = body, body
 					}
 				}
+				if err == nil && from.Tag == "body" {
+					err = p.releaseXHTML(inner)
+				}
 			} else {
 				// unexpected tag to transfer
 				if from.Tag == "body" || from.Tag == "section" {
@@ -691,12 +707,8 @@ func transferSubtitle(p *Processor, from, to *etree.Element) error {
 			for _, dv := range p.env.Cfg.Doc.ChapterDividers {
 				if t == dv && !p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
 					// open next XHTML
-					ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-					if p.notesMode == NFloatNew || p.notesMode == NFloatNewMore {
-						ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-					}
 					var f *dataFile
-					to, f = p.ctx().createXHTML("", ns...)
+					to, f = p.ctx().createXHTML("", p.xhtmlNamespaces()...)
 					// store it for future flushing
 					p.Book.Files = append(p.Book.Files, f)
 					p.Book.Pages[f.fname] = 0
@@ -717,12 +729,8 @@ func transferParagraph(p *Processor, from, to *etree.Element) error {
 		if pages, ok := p.Book.Pages[p.ctx().fname]; ok && pages >= p.env.Cfg.Doc.PagesPerFile &&
 			!p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
 			// open next XHTML
-			ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-			if p.notesMode == NFloatNew || p.notesMode == NFloatNewMore {
-				ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-			}
 			var f *dataFile
-			to, f = p.ctx().createXHTML("", ns...)
+			to, f = p.ctx().createXHTML("", p.xhtmlNamespaces()...)
 			// store it for future flushing
 			p.Book.Files = append(p.Book.Files, f)
 			p.Book.Pages[f.fname] = 0
@@ -816,6 +824,10 @@ func transferTitle(p *Processor, from, to *etree.Element) error {
 
 func transferSection(p *Processor, from, to *etree.Element) error {
 
+	if err := p.canceled(); err != nil {
+		return err
+	}
+
 	if len(p.ctx().bodyName) == 0 && p.ctx().header.Int() == 0 && p.ctx().firstBodyTitle {
 
 		// processing section in main body, but there was no (body) title - we have to fake it to
@@ -888,12 +900,8 @@ func transferSection(p *Processor, from, to *etree.Element) error {
 	if p.env.Cfg.Doc.ChapterPerFile {
 		if len(p.ctx().bodyName) == 0 && p.ctx().header.Int() < p.env.Cfg.Doc.ChapterLevel {
 			// open next XHTML
-			ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-			if p.notesMode == NFloatNew || p.notesMode == NFloatNewMore {
-				ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
-			}
 			var f *dataFile
-			to, f = p.ctx().createXHTML("", ns...)
+			to, f = p.ctx().createXHTML("", p.xhtmlNamespaces()...)
 			// store it for future flushing
 			p.Book.Files = append(p.Book.Files, f)
 			p.Book.Pages[f.fname] = 0
@@ -8,12 +8,14 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 )
 
 // Reporter accumulates information necessary to prepare debug report.
 type Report struct {
-	// NOTE: not to be used concurrently!
+	// NOTE: Store could be called concurrently, paths are protected by mutex
+	mu    sync.Mutex
 	paths map[string]string
 	file  *os.File
 }
@@ -63,6 +65,10 @@ func (r *Report) Store(name, path string) {
 		// Ignore uninitialized cases to avoid checking n many places. This means no report has been requested.
 		return
 	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if old, exists := r.paths[name]; exists && old != path {
 		// Somewhere I do not know what I am doing.
 		panic(fmt.Sprintf("Attempt to overwrite file in the report for [%s]: was %s, now %s", name, old, path))
@@ -77,6 +83,9 @@ func (r *Report) Store(name, path string) {
 
 func (r *Report) finalize() error {
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	arc := zip.NewWriter(r.file)
 	defer arc.Close()
 